@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"distributepki/keystore"
+	"distributepki/shard"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net"
+	"pbft"
 	"strings"
 
 	"github.com/coreos/pkg/capnslog"
@@ -20,6 +23,11 @@ var (
 const OP_CREATE = 0x01
 const OP_UPDATE = 0x02
 const OP_LOOKUP = 0x03
+const OP_ADD_KEY = 0x04
+const OP_REMOVE_KEY = 0x05
+const OP_REVOKE = 0x06
+const OP_SHARD_MAP = 0x07
+const OP_IMPORT_SHARD = 0x08
 
 type KeyOperation struct {
 	OpCode int
@@ -67,6 +75,23 @@ type Create struct {
 	Signature keystore.Signature // Signature of authority
 }
 
+// Checked again when it's applied, since anybody can send the cluster
+// a request.
+func (c Create) ApplyTo(ks *keystore.Keystore) error {
+	if !c.SignatureValid(ks.Authorities()) {
+		return errors.New("Not signed by the authority")
+	}
+	return ks.CreateKey(c.Alias, c.Key)
+}
+
+func (c Create) Sender() (string, int64) {
+	return keystore.AliasClient(c.Alias), c.Timestamp
+}
+
+func (c Create) Attribution(ks *keystore.Keystore) keystore.Attribution {
+	return keystore.Attribution{Operation: keystore.OPERATION_CREATE, Timestamp: c.Timestamp, Signer: keystore.SIGNER_AUTHORITY}
+}
+
 type keyMapping struct {
 	Alias     string
 	Key       string
@@ -142,9 +167,327 @@ func (u Update) SignatureValid(previousKey keystore.Key) bool {
 	return true
 }
 
+func (u Update) ApplyTo(ks *keystore.Keystore) error {
+	ok, previous := ks.LookupKey(u.Alias)
+	if !ok {
+		return keystore.AliasNotFoundError(u.Alias)
+	}
+	if !u.SignatureValid(previous) {
+		return errors.New("Not signed by the key it replaces")
+	}
+	return ks.UpdateKey(u.Alias, u.Key)
+}
+
+func (u Update) Sender() (string, int64) {
+	return keystore.AliasClient(u.Alias), u.Timestamp
+}
+
+// Signed by the primary key it replaces.
+func (u Update) Attribution(ks *keystore.Keystore) keystore.Attribution {
+	var signer string
+	if set, ok := ks.LookupKeySet(u.Alias); ok {
+		primary, _ := set.Primary()
+		signer = primary.Label
+	}
+	return keystore.Attribution{Operation: keystore.OPERATION_UPDATE, Timestamp: u.Timestamp, Signer: signer}
+}
+
+// ** KEYSETS ** //
+
+// Adds a key to an alias' set (see keystore/keyset.go). Signed by a key
+// that's already in it (the one labelled Signer).
+type AddKey struct {
+	Alias     keystore.Alias
+	Label     string
+	Key       keystore.Key
+	Flags     keystore.KeyFlags
+	Timestamp int64
+	Signer    string
+	Signature keystore.Signature
+}
+
+// Takes a key out of an alias' set. Signed by any key in it, including
+// the one going.
+type RemoveKey struct {
+	Alias     keystore.Alias
+	Label     string
+	Timestamp int64
+	Signer    string
+	Signature keystore.Signature
+}
+
+// Marks a key in an alias' set as revoked (see keystore/revocation.go).
+// Signed by the key being revoked, or any other key in the set that
+// hasn't been.
+type Revoke struct {
+	Alias     keystore.Alias
+	Label     string
+	Reason    string
+	Timestamp int64
+	Signer    string
+	Signature keystore.Signature
+}
+
+// What gets signed for a keyset change. OpCode is in there so a
+// signature for one kind of change can't be passed off as another.
+type keySetChange struct {
+	OpCode    int
+	Alias     string
+	Label     string
+	Key       string `json:",omitempty"`
+	Flags     keystore.KeyFlags
+	Reason    string `json:",omitempty"`
+	Timestamp int64
+}
+
+func (a AddKey) signed() keySetChange {
+	return keySetChange{
+		OpCode:    OP_ADD_KEY,
+		Alias:     string(a.Alias),
+		Label:     a.Label,
+		Key:       string(a.Key),
+		Flags:     a.Flags,
+		Timestamp: a.Timestamp,
+	}
+}
+
+func (r RemoveKey) signed() keySetChange {
+	return keySetChange{
+		OpCode:    OP_REMOVE_KEY,
+		Alias:     string(r.Alias),
+		Label:     r.Label,
+		Timestamp: r.Timestamp,
+	}
+}
+
+func (r Revoke) signed() keySetChange {
+	return keySetChange{
+		OpCode:    OP_REVOKE,
+		Alias:     string(r.Alias),
+		Label:     r.Label,
+		Reason:    r.Reason,
+		Timestamp: r.Timestamp,
+	}
+}
+
+// Whether signature is by signer (an armored public key) over change.
+func signedBy(signer keystore.Key, change keySetChange, signature keystore.Signature) bool {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(string(signer)))
+	if err != nil {
+		plog.Error("Couldn't read signing key!")
+		return false
+	}
+	enc, err := json.Marshal(&change)
+	if err != nil {
+		plog.Error("Couldn't encode as json!")
+		return false
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(enc), strings.NewReader(string(signature))); err != nil {
+		plog.Error("Not signed by the signing key")
+		return false
+	}
+	return true
+}
+
+// Finds the signing key in the alias' current set, and checks it signed
+// change. Runs both when we're asked and when it's applied, since the
+// set could change in between.
+func checkSigner(ks *keystore.Keystore, alias keystore.Alias, signer string, change keySetChange, signature keystore.Signature) error {
+	set, ok := ks.LookupKeySet(alias)
+	if !ok {
+		return keystore.AliasNotFoundError(alias)
+	}
+	key, ok := set.Get(signer)
+	if !ok {
+		return keystore.LabelNotFoundError(signer)
+	}
+	if key.Revoked() {
+		return keystore.KeyRevoked(signer)
+	}
+	if !signedBy(key.Key, change, signature) {
+		return errors.New("Not signed by " + signer)
+	}
+	return nil
+}
+
+// Signs the add with key (which has to be in the alias' set already,
+// labelled signer).
+func (a *AddKey) Sign(signer string, key *openpgp.Entity) error {
+	signature, err := signChange(key, a.signed())
+	if err != nil {
+		return err
+	}
+	a.Signer, a.Signature = signer, signature
+	return nil
+}
+
+func (r *RemoveKey) Sign(signer string, key *openpgp.Entity) error {
+	signature, err := signChange(key, r.signed())
+	if err != nil {
+		return err
+	}
+	r.Signer, r.Signature = signer, signature
+	return nil
+}
+
+func (r *Revoke) Sign(signer string, key *openpgp.Entity) error {
+	signature, err := signChange(key, r.signed())
+	if err != nil {
+		return err
+	}
+	r.Signer, r.Signature = signer, signature
+	return nil
+}
+
+func signChange(key *openpgp.Entity, change keySetChange) (keystore.Signature, error) {
+	enc, err := json.Marshal(&change)
+	if err != nil {
+		return "", err
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, key, bytes.NewReader(enc), nil); err != nil {
+		return "", err
+	}
+	return keystore.Signature(sig.String()), nil
+}
+
+func (a AddKey) Check(ks *keystore.Keystore) error {
+	if a.Label == "" {
+		return errors.New("Keys need a label")
+	}
+	return checkSigner(ks, a.Alias, a.Signer, a.signed(), a.Signature)
+}
+
+func (a AddKey) ApplyTo(ks *keystore.Keystore) error {
+	if err := a.Check(ks); err != nil {
+		return err
+	}
+	return ks.AddKey(a.Alias, keystore.LabelledKey{Label: a.Label, Key: a.Key, Flags: a.Flags})
+}
+
+func (a AddKey) Sender() (string, int64) {
+	return keystore.AliasClient(a.Alias), a.Timestamp
+}
+
+func (a AddKey) Attribution(ks *keystore.Keystore) keystore.Attribution {
+	return keystore.Attribution{Operation: keystore.OPERATION_ADD, Timestamp: a.Timestamp, Signer: a.Signer}
+}
+
+func (r RemoveKey) Check(ks *keystore.Keystore) error {
+	return checkSigner(ks, r.Alias, r.Signer, r.signed(), r.Signature)
+}
+
+func (r RemoveKey) ApplyTo(ks *keystore.Keystore) error {
+	if err := r.Check(ks); err != nil {
+		return err
+	}
+	return ks.RemoveKey(r.Alias, r.Label)
+}
+
+func (r RemoveKey) Sender() (string, int64) {
+	return keystore.AliasClient(r.Alias), r.Timestamp
+}
+
+func (r RemoveKey) Attribution(ks *keystore.Keystore) keystore.Attribution {
+	return keystore.Attribution{Operation: keystore.OPERATION_REMOVE, Timestamp: r.Timestamp, Signer: r.Signer}
+}
+
+func (r Revoke) Check(ks *keystore.Keystore) error {
+	return checkSigner(ks, r.Alias, r.Signer, r.signed(), r.Signature)
+}
+
+func (r Revoke) ApplyTo(ks *keystore.Keystore) error {
+	if err := r.Check(ks); err != nil {
+		return err
+	}
+	return ks.RevokeKey(r.Alias, r.Label, keystore.Revocation{
+		Reason:    r.Reason,
+		Timestamp: r.Timestamp,
+		Signer:    r.Signer,
+	})
+}
+
+// Revocations are ordered on their own (see keystore.RevocationClient).
+func (r Revoke) Sender() (string, int64) {
+	return keystore.RevocationClient(r.Alias), r.Timestamp
+}
+
+func (r Revoke) Attribution(ks *keystore.Keystore) keystore.Attribution {
+	return keystore.Attribution{Operation: keystore.OPERATION_REVOKE, Timestamp: r.Timestamp, Signer: r.Signer}
+}
+
+// ** SHARDING ** //
+
+// The next version of the shard map, signed by the authority (see
+// keystore/sharding.go).
+type ChangeShardMap struct {
+	Map shard.SignedShardMap
+}
+
+func (c ChangeShardMap) ApplyTo(ks *keystore.Keystore) error {
+	return ks.ChangeShardMap(c.Map)
+}
+
+func (c ChangeShardMap) Sender() (string, int64) {
+	return keystore.SHARD_MAP_CLIENT, int64(c.Map.Map.Version)
+}
+
+// Another shard's aliases that the current map gives us, signed by the
+// authority.
+type ImportShard struct {
+	Export keystore.SignedShardExport
+}
+
+func (i ImportShard) ApplyTo(ks *keystore.Keystore) error {
+	return ks.ImportShard(i.Export)
+}
+
+func (i ImportShard) Sender() (string, int64) {
+	return keystore.ImportClient(i.Export.Export.From), int64(i.Export.Export.Version)
+}
+
 type Lookup struct {
 	Alias  keystore.Alias
 	Client net.Addr
+	Label  string // which key in the set; the primary one if empty
+}
+
+// What GET /?name=<alias> (and /keyset) returns from an engine whose
+// replicas sign Merkle roots, unless the client passes merkle=false: the
+// alias' keyset as of the last stable checkpoint (nil if it didn't have
+// one), the key asked for from it (not for /keyset), and the proof of it
+// against a root a quorum signed (see keystore/merkle.go). Clients
+// should check Alias is what they asked about, then Verify.
+type ProvenKey struct {
+	Alias  keystore.Alias
+	Key    *keystore.LabelledKey `json:",omitempty"`
+	KeySet *keystore.KeySet      `json:",omitempty"`
+	Proof  keystore.MerkleProof
+	Root   pbft.StateRootProof
+}
+
+// Checks the root's signatures, the proof against it, and that Key is in
+// the keyset. v has to know every node in the cluster (see
+// pbft.NewVerifier). The root has to be from minSeq on (see
+// pbft.StateRootProof.Verify).
+func (p *ProvenKey) Verify(v pbft.Verifier, minSeq int) error {
+	if err := p.Root.Verify(v, minSeq); err != nil {
+		return err
+	}
+	if err := p.Proof.Verify(p.Root.StateRoot, p.Alias, p.KeySet); err != nil {
+		return err
+	}
+	if p.Key == nil {
+		return nil
+	}
+	if p.KeySet == nil {
+		return errors.New("Key without a keyset")
+	}
+	key, ok := p.KeySet.Get(p.Key.Label)
+	if !ok || key.Key != p.Key.Key || key.Flags != p.Key.Flags || key.Revoked() != p.Key.Revoked() {
+		return errors.New("Key isn't in the keyset")
+	}
+	return nil
 }
 
 type Ack struct {
@@ -183,3 +526,63 @@ func (updateJSON *UpdateJSON) ToUpdate() (Update, error) {
 		Signature: keystore.Signature(updateJSON.Signature),
 	}, nil
 }
+
+type AddKeyJSON struct {
+	Alias     string
+	Label     string
+	Key       string
+	Flags     keystore.KeyFlags
+	Timestamp int64
+	Signer    string
+	Signature string
+}
+
+func (addJSON *AddKeyJSON) ToAddKey() AddKey {
+	return AddKey{
+		Alias:     keystore.Alias(addJSON.Alias),
+		Label:     addJSON.Label,
+		Key:       keystore.Key(addJSON.Key),
+		Flags:     addJSON.Flags,
+		Timestamp: addJSON.Timestamp,
+		Signer:    addJSON.Signer,
+		Signature: keystore.Signature(addJSON.Signature),
+	}
+}
+
+type RemoveKeyJSON struct {
+	Alias     string
+	Label     string
+	Timestamp int64
+	Signer    string
+	Signature string
+}
+
+func (removeJSON *RemoveKeyJSON) ToRemoveKey() RemoveKey {
+	return RemoveKey{
+		Alias:     keystore.Alias(removeJSON.Alias),
+		Label:     removeJSON.Label,
+		Timestamp: removeJSON.Timestamp,
+		Signer:    removeJSON.Signer,
+		Signature: keystore.Signature(removeJSON.Signature),
+	}
+}
+
+type RevokeJSON struct {
+	Alias     string
+	Label     string
+	Reason    string
+	Timestamp int64
+	Signer    string
+	Signature string
+}
+
+func (revokeJSON *RevokeJSON) ToRevoke() Revoke {
+	return Revoke{
+		Alias:     keystore.Alias(revokeJSON.Alias),
+		Label:     revokeJSON.Label,
+		Reason:    revokeJSON.Reason,
+		Timestamp: revokeJSON.Timestamp,
+		Signer:    revokeJSON.Signer,
+		Signature: keystore.Signature(revokeJSON.Signature),
+	}
+}
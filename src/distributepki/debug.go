@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"distributepki/util"
 	"encoding/json"
 	"errors"
@@ -11,26 +12,125 @@ import (
 	"net/http"
 	"os"
 	"pbft"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
+// If the cluster uses TLS, the REPL (which runs alongside the nodes
+// it launched) connects as the first node.
+var debugTLS map[pbft.NodeId]*tls.Config
+
+// Admin commands are signed with this operator's key (see
+// pbft/admin.go). nil if we weren't given one.
+var operator *pbft.Signer
+
 func sendDebugMessage(cluster *pbft.ClusterConfig, node *pbft.NodeConfig, msg pbft.DebugMessage) {
-	err := util.SendRpc(
-		util.GetHostname(node.Host, node.Port),
-		cluster.Endpoint, // TODO: listen on a different endpoint for debugging
-		"PBFTNode.Debug",
-		&msg,
+	if operator == nil {
+		fmt.Println("Admin commands need an operator key (-operatorkey)")
+		return
+	} else if node.AdminPort == 0 {
+		fmt.Printf("Node %d doesn't take admin commands (no adminport)\n", node.Id)
+		return
+	}
+	command, err := pbft.NewAdminCommand(*operator, node.Id, msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = util.SendRpc(
+		util.GetHostname(node.Host, node.AdminPort),
+		pbft.ADMIN_ENDPOINT,
+		"Admin.Command",
+		command,
 		nil,
-		10,
-		0,
+		1,
+		time.Second,
 	)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf("Node %d: %v\n", node.Id, err)
 	}
 }
 
+func getStatus(cluster *pbft.ClusterConfig, node *pbft.NodeConfig) (*pbft.NodeStatus, error) {
+	var status pbft.NodeStatus
+	err := util.SendRpcTLS(
+		util.GetHostname(node.Host, node.Port),
+		cluster.Endpoint,
+		"PBFTNode.Status",
+		&pbft.Ack{},
+		&status,
+		1,
+		time.Second,
+		debugTLS[node.Id],
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Renders a node => number map as "1:5,2:7"
+func formatNodeMap(m map[pbft.NodeId]int) string {
+	if len(m) == 0 {
+		return "-"
+	}
+	ids := make([]int, 0, len(m))
+	for id, _ := range m {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("%d:%d", id, m[pbft.NodeId(id)]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Asks every node in the cluster for its status and prints them as a table.
+func printStatus(cluster *pbft.ClusterConfig) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVIEW\tPRIMARY\tDOWN\tVIEW CHANGE\tVOTES\tISSUED\tCOMMITTED\tEXECUTED\tWATERMARKS\tCHECKPOINTS\tCAUGHT UP\tOUTSTANDING")
+	for i := range cluster.Nodes {
+		node := &cluster.Nodes[i]
+		status, err := getStatus(cluster, node)
+		if err != nil {
+			fmt.Fprintf(w, "%d\tunreachable: %v\n", node.Id, err)
+			continue
+		}
+		viewChange := "-"
+		if status.ViewChangeInProgress {
+			viewChange = fmt.Sprintf("-> %d", status.ViewChangeViewNumber)
+		}
+		checkpoints := "-"
+		if len(status.PendingCheckpoints) > 0 {
+			seqs := make([]string, 0, len(status.PendingCheckpoints))
+			for _, c := range status.PendingCheckpoints {
+				seqs = append(seqs, strconv.Itoa(c.SeqNumber))
+			}
+			checkpoints = strings.Join(seqs, ",")
+		}
+		fmt.Fprintf(w, "%d\t%d\t%t\t%t\t%s\t%s\t%d\t%d\t%d\t(%d, %d]\t%s\t%s\t%d\n",
+			status.Id,
+			status.ViewNumber,
+			status.Primary,
+			status.Down,
+			viewChange,
+			formatNodeMap(status.ViewChangeVotes),
+			status.IssuedSequenceNumber,
+			status.CommittedSequenceNumber,
+			status.ExecutedSequenceNumber,
+			status.LowWatermark,
+			status.HighWatermark,
+			checkpoints,
+			formatNodeMap(status.CaughtUp),
+			len(status.OutstandingRequests),
+		)
+	}
+	w.Flush()
+}
+
 func extractNode(cluster *pbft.ClusterConfig, arg string) (*pbft.NodeConfig, error) {
 	if i, err := strconv.Atoi(arg); err == nil {
 		for _, n := range cluster.Nodes {
@@ -130,6 +230,7 @@ func doGet(cluster *pbft.ClusterConfig, node *pbft.NodeConfig, alias string) (st
 	}
 	q := req.URL.Query()
 	q.Add("name", alias)
+	q.Add("merkle", "false") // just the key, as of now
 	req.URL.RawQuery = q.Encode()
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -178,7 +279,19 @@ func extractGetParams(cluster *pbft.ClusterConfig, args []string,
 }
 
 // TODO (sydli): the below needs a massive cleanup
-func StartDebugRepl(cluster *pbft.ClusterConfig) {
+func StartDebugRepl(cluster *pbft.ClusterConfig, operatorKeyFile string, operatorPassPhraseFile string) {
+	configs, err := pbft.DialTLSConfigs(cluster.Nodes[0], *cluster)
+	if err != nil {
+		log.Fatal(err)
+	}
+	debugTLS = configs
+	if operatorKeyFile != "" {
+		signer, err := pbft.OperatorSigner(operatorKeyFile, operatorPassPhraseFile, *cluster)
+		if err != nil {
+			log.Fatal(err)
+		}
+		operator = &signer
+	}
 	for {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print(">> ")
@@ -190,6 +303,8 @@ func StartDebugRepl(cluster *pbft.ClusterConfig) {
 		switch cmd := cmdList[0]; cmd {
 		case "exit":
 			return
+		case "status":
+			printStatus(cluster)
 		case "get":
 			extractGetParams(cluster, cmdList[1:], doGet)
 		case "update":
@@ -217,6 +332,8 @@ func StartDebugRepl(cluster *pbft.ClusterConfig) {
 			sendPbft(cluster, cmdList[1:], pbft.DebugMessage{Op: pbft.UP})
 		case "down":
 			sendPbft(cluster, cmdList[1:], pbft.DebugMessage{Op: pbft.DOWN})
+		case "recover":
+			sendPbft(cluster, cmdList[1:], pbft.DebugMessage{Op: pbft.RECOVER})
 		}
 	}
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pbft"
+	"sync"
+	"time"
+)
+
+// ** CONSENSUS ENGINES ** //
+
+// KeyNode doesn't care how operations get ordered, just that every
+// replica applies the same ones in the same order. Whatever orders them
+// is a ConsensusEngine. Engines are started with the application (a
+// pbft.StateMachine): committed operations are fed to its Apply in
+// order, and Snapshot/Restore are how the engine checkpoints it and
+// catches it up. Apart from PBFT (which has its own), engines go
+// through a committer for all of that, so they all treat the
+// application the same way.
+type ConsensusEngine interface {
+	Id() pbft.NodeId
+
+	// Orders a request and applies it, without blocking. Engines fail
+	// proposals with pbft.ErrOverloaded or pbft.ErrViewChange when
+	// the client should just try again later, and with
+	// pbft.ErrStaleRequest when the client has already moved on.
+	Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal
+	RetryAfter(err error) time.Duration
+
+	// Every operation applied from now on, in order (see
+	// pbft.CommitStream)
+	Committed(ctx context.Context) <-chan pbft.CommittedEntry
+	// Called with every snapshot of the application the engine takes
+	OnSnapshot(hook pbft.SnapshotHook)
+
+	// Who's in the cluster
+	Members() []pbft.NodeId
+	// Something JSON-able, for /status
+	Status() interface{}
+
+	// Whether the engine's been taken down for debugging
+	Down() bool
+	// Signalled if the engine dies
+	Failure() <-chan error
+	Stop(ctx context.Context) error
+}
+
+// Engines can offer more than that; KeyNode checks for these.
+type evidenceEngine interface {
+	Evidence() []pbft.MisbehaviourEvidence
+}
+
+type certificateEngine interface {
+	CertificateBySeq(seq int) (pbft.CertifiedRequest, bool)
+	CertificateByDigest(digest [sha256.Size]byte) (pbft.CertifiedRequest, bool)
+}
+
+const (
+	ENGINE_PBFT = "pbft" // byzantine fault tolerant (the default)
+	ENGINE_RAFT = "raft" // crash fault tolerant, see raft_engine.go
+	ENGINE_SCP  = "scp"  // federated (nodes pick who they trust), see scp.go
+	ENGINE_DEV  = "dev"  // one node, no fault tolerance at all
+
+	// Not an engine you pick: nodes listed under the cluster's
+	// "observers" follow the pbft replicas (see observer.go)
+	ENGINE_OBSERVER = "observer"
+)
+
+func StartEngine(engine string, config pbft.NodeConfig, cluster pbft.ClusterConfig, app pbft.StateMachine) (ConsensusEngine, error) {
+	switch engine {
+	case ENGINE_PBFT, "":
+		node := pbft.StartNode(config, cluster, app)
+		if node == nil {
+			return nil, errors.New("PBFT node failed to start")
+		}
+		return &pbftEngine{node, cluster}, nil
+	case ENGINE_RAFT:
+		return startRaftEngine(config, cluster, app)
+	case ENGINE_SCP:
+		return startSCPEngine(config, cluster, app)
+	case ENGINE_DEV:
+		return newDevEngine(config.Id, app), nil
+	case ENGINE_OBSERVER:
+		return startObserverEngine(config.Id, cluster, app)
+	}
+	return nil, fmt.Errorf("Unknown consensus engine %q (expected %s, %s, %s or %s)", engine, ENGINE_PBFT, ENGINE_RAFT, ENGINE_SCP, ENGINE_DEV)
+}
+
+// ** PBFT ** //
+
+// Evidence and certificates come straight from the node.
+type pbftEngine struct {
+	*pbft.PBFTNode
+	cluster pbft.ClusterConfig
+}
+
+func (e *pbftEngine) Members() []pbft.NodeId {
+	return clusterMembers(e.cluster)
+}
+
+func (e *pbftEngine) Status() interface{} {
+	return e.GetStatus()
+}
+
+func (e *pbftEngine) Failure() <-chan error {
+	return e.PBFTNode.Failure()
+}
+
+func clusterMembers(cluster pbft.ClusterConfig) []pbft.NodeId {
+	members := make([]pbft.NodeId, 0, len(cluster.Nodes))
+	for _, node := range cluster.Nodes {
+		members = append(members, node.Id)
+	}
+	return members
+}
+
+// ** COMMITTING ** //
+
+// Applies what the raft, SCP and dev engines commit: the application's
+// checks, the reply cache, the commit stream and snapshots all happen
+// here, so the engines only have to get requests into order. Resolves
+// proposals as it goes.
+type committer struct {
+	app       pbft.StateMachine
+	proposals *proposalTracker
+	stream    *pbft.CommitStream
+
+	mux     sync.Mutex
+	seq     int // of the last request applied
+	replies replyCache
+}
+
+// What engines snapshot: the application's snapshot plus the reply
+// cache (same as PBFT's checkpoints).
+type engineSnapshot struct {
+	Seq     int
+	App     []byte
+	Replies replyCache
+}
+
+func newCommitter(app pbft.StateMachine, maxPending int) *committer {
+	return &committer{
+		app:       app,
+		proposals: newProposalTracker(maxPending),
+		stream:    pbft.NewCommitStream(),
+		replies:   make(replyCache),
+	}
+}
+
+// Whether to take on a request at all (see pbft.AdmitRequest).
+func (c *committer) admit(request *pbft.Request) error {
+	return pbft.AdmitRequest(c.app, *request)
+}
+
+// Whether the request's already been dealt with, and if so, how.
+func (c *committer) replied(request *pbft.Request, digest [sha256.Size]byte) (pbft.ProposalResult, error, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.replies.check(request, digest)
+}
+
+// Applies a committed request as seq, unless the application refuses
+// it or the client's already moved on. Whoever proposed it gets the
+// result either way. Seqs have to go up, but engines can skip some
+// (e.g. raft's own entries). False if it wasn't applied.
+func (c *committer) commit(seq int, request pbft.Request) bool {
+	digest, err := request.Digest()
+	if err != nil {
+		log.Errorf("Digesting committed request: %v", err)
+		return false
+	}
+	if err := pbft.CheckRequest(c.app, request); err != nil {
+		c.proposals.resolve(digest, pbft.ProposalResult{}, err)
+		return false
+	}
+	c.mux.Lock()
+	if result, err, done := c.replies.check(&request, digest); done {
+		c.mux.Unlock()
+		c.proposals.resolve(digest, result, err)
+		return false
+	}
+	result := pbft.ProposalResult{
+		Result:    c.app.Apply(seq, request.Operation),
+		SeqNumber: seq,
+	}
+	c.seq = seq
+	c.replies.add(&request, digest, result)
+	c.mux.Unlock()
+	c.stream.Publish(pbft.CommittedEntry{SeqNumber: seq, Operation: request.Operation, Result: result.Result})
+	c.proposals.resolve(digest, result, nil)
+	return true
+}
+
+// For engines that number requests as they apply them.
+func (c *committer) commitNext(request pbft.Request) bool {
+	return c.commit(c.applied()+1, request)
+}
+
+func (c *committer) applied() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.seq
+}
+
+// Snapshots the application and reply cache (see engineSnapshot), and
+// runs the snapshot hooks.
+func (c *committer) snapshot() ([]byte, error) {
+	c.mux.Lock()
+	app, err := c.app.Snapshot()
+	if err != nil {
+		c.mux.Unlock()
+		return nil, err
+	}
+	seq := c.seq
+	data, err := json.Marshal(engineSnapshot{Seq: seq, App: app, Replies: c.replies})
+	c.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c.stream.Snapshotted(seq, app)
+	return data, nil
+}
+
+// Replaces everything with a snapshot from snapshot (ours or a peer's).
+func (c *committer) restore(snapshot []byte) error {
+	var state engineSnapshot
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return err
+	}
+	if err := c.app.Restore(state.App); err != nil {
+		return err
+	}
+	if state.Replies == nil {
+		state.Replies = make(replyCache)
+	}
+	c.mux.Lock()
+	c.seq = state.Seq
+	c.replies = state.Replies
+	c.mux.Unlock()
+	// anybody waiting on a request we skipped over gets its result
+	for _, reply := range state.Replies {
+		c.proposals.resolve(reply.Digest, reply.Result, nil)
+	}
+	return nil
+}
+
+func (c *committer) Committed(ctx context.Context) <-chan pbft.CommittedEntry {
+	return c.stream.Committed(ctx)
+}
+
+func (c *committer) OnSnapshot(hook pbft.SnapshotHook) {
+	c.stream.OnSnapshot(hook)
+}
+
+// ** REPLY CACHE ** //
+
+// The same rules as PBFT's reply cache, for the other engines: a
+// client's retry gets the original result, and anything older than its
+// last request fails with pbft.ErrStaleRequest.
+type replyCache map[string]cachedReply
+
+type cachedReply struct {
+	Timestamp int64
+	Digest    [sha256.Size]byte
+	Result    pbft.ProposalResult
+}
+
+// Whether the request's already been dealt with, and if so, how. The
+// application should have checked the request's Client and Timestamp
+// first (see pbft.CheckRequest).
+func (c replyCache) check(request *pbft.Request, digest [sha256.Size]byte) (pbft.ProposalResult, error, bool) {
+	last, ok := c[request.Client]
+	if !ok || request.Timestamp > last.Timestamp {
+		return pbft.ProposalResult{}, nil, false
+	}
+	if last.Digest == digest {
+		return last.Result, nil, true
+	}
+	return pbft.ProposalResult{}, pbft.ErrStaleRequest, true
+}
+
+func (c replyCache) add(request *pbft.Request, digest [sha256.Size]byte, result pbft.ProposalResult) {
+	c[request.Client] = cachedReply{Timestamp: request.Timestamp, Digest: digest, Result: result}
+}
+
+// ** PROPOSALS ** //
+
+// Who's waiting on which requests, for the engines that don't have
+// their own way of keeping track. Proposals for the same request all
+// get its result.
+type proposalTracker struct {
+	mux       sync.Mutex
+	proposals map[[sha256.Size]byte][]*pbft.Proposal
+	pending   int
+	max       int
+}
+
+func newProposalTracker(max int) *proposalTracker {
+	if max <= 0 {
+		max = pbft.MAX_PENDING_REQUESTS
+	}
+	return &proposalTracker{
+		proposals: make(map[[sha256.Size]byte][]*pbft.Proposal),
+		max:       max,
+	}
+}
+
+// False if there are too many waiting already.
+func (t *proposalTracker) add(digest [sha256.Size]byte, p *pbft.Proposal) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.pending >= t.max {
+		return false
+	}
+	t.proposals[digest] = append(t.proposals[digest], p)
+	t.pending++
+	return true
+}
+
+// Gives up on just this proposal.
+func (t *proposalTracker) fail(digest [sha256.Size]byte, p *pbft.Proposal, err error) {
+	t.mux.Lock()
+	pending := t.proposals[digest]
+	for i, other := range pending {
+		if other == p {
+			pending = append(pending[:i], pending[i+1:]...)
+			t.pending--
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(t.proposals, digest)
+	} else {
+		t.proposals[digest] = pending
+	}
+	t.mux.Unlock()
+	p.Resolve(pbft.ProposalResult{}, err)
+}
+
+func (t *proposalTracker) resolve(digest [sha256.Size]byte, result pbft.ProposalResult, err error) {
+	t.mux.Lock()
+	pending := t.proposals[digest]
+	delete(t.proposals, digest)
+	t.pending -= len(pending)
+	t.mux.Unlock()
+	for _, p := range pending {
+		p.Resolve(result, err)
+	}
+}
+
+func (t *proposalTracker) failAll(err error) {
+	t.mux.Lock()
+	proposals := t.proposals
+	t.proposals = make(map[[sha256.Size]byte][]*pbft.Proposal)
+	t.pending = 0
+	t.mux.Unlock()
+	for _, pending := range proposals {
+		for _, p := range pending {
+			p.Resolve(pbft.ProposalResult{}, err)
+		}
+	}
+}
+
+func (t *proposalTracker) count() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.pending
+}
+
+// ** DEVELOPMENT ** //
+
+// Commits everything straight away, on its own. Only good for trying
+// things out on one machine.
+type devEngine struct {
+	*committer
+	id      pbft.NodeId
+	failure chan error
+	mux     sync.Mutex // one operation at a time
+}
+
+type devStatus struct {
+	Engine    string
+	Id        pbft.NodeId
+	SeqNumber int
+}
+
+func newDevEngine(id pbft.NodeId, app pbft.StateMachine) *devEngine {
+	return &devEngine{
+		committer: newCommitter(app, 0),
+		id:        id,
+		failure:   make(chan error),
+	}
+}
+
+func (e *devEngine) Id() pbft.NodeId {
+	return e.id
+}
+
+func (e *devEngine) Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal {
+	digest, err := request.Digest()
+	p := pbft.NewProposal(digest)
+	if err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	if err := ctx.Err(); err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	if err := e.admit(request); err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	if !e.proposals.add(digest, p) {
+		p.Resolve(pbft.ProposalResult{}, pbft.ErrOverloaded)
+		return p
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.commitNext(*request)
+	return p
+}
+
+func (e *devEngine) RetryAfter(err error) time.Duration {
+	return 0
+}
+
+func (e *devEngine) Members() []pbft.NodeId {
+	return []pbft.NodeId{e.id}
+}
+
+func (e *devEngine) Status() interface{} {
+	return devStatus{Engine: ENGINE_DEV, Id: e.id, SeqNumber: e.applied()}
+}
+
+func (e *devEngine) Down() bool {
+	return false
+}
+
+func (e *devEngine) Failure() <-chan error {
+	return e.failure
+}
+
+func (e *devEngine) Stop(ctx context.Context) error {
+	e.stream.Close()
+	return nil
+}
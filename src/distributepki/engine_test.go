@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"pbft"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ** ENGINE TESTS ** //
+// (These don't need the cluster TestMain starts.)
+
+// Remembers what got applied, in order.
+type testApp struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (a *testApp) Apply(seq int, op string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied = append(a.applied, op)
+	return strings.ToUpper(op)
+}
+
+func (a *testApp) Snapshot() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return []byte(strings.Join(a.applied, "\n")), nil
+}
+
+func (a *testApp) Restore(snapshot []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied = nil
+	if len(snapshot) > 0 {
+		a.applied = strings.Split(string(snapshot), "\n")
+	}
+	return nil
+}
+
+func (a *testApp) StateDigest() [sha256.Size]byte {
+	snapshot, _ := a.Snapshot()
+	return sha256.Sum256(snapshot)
+}
+
+func (a *testApp) ops() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.applied...)
+}
+
+func testFreePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Keeps proposing until the engine takes it (e.g. once there's a
+// leader).
+func proposeUntilDone(t *testing.T, engine ConsensusEngine, request *pbft.Request) pbft.ProposalResult {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		result, err := engine.Propose(ctx, request).Result()
+		cancel()
+		if err == nil {
+			return result
+		} else if time.Now().After(deadline) {
+			t.Fatalf("proposing %q: %v", request.Operation, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestDevEngine(t *testing.T) {
+	app := &testApp{}
+	engine, err := StartEngine(ENGINE_DEV, pbft.NodeConfig{Id: 1}, pbft.ClusterConfig{}, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop(context.Background())
+	committed := engine.Committed(context.Background())
+
+	first := &pbft.Request{Client: "client", Timestamp: 1, Operation: "first"}
+	result, err := engine.Propose(context.Background(), first).Result()
+	if err != nil || result.Result != "FIRST" || result.SeqNumber != 1 {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	// retries get the same answer, without being applied again
+	if again, err := engine.Propose(context.Background(), first).Result(); err != nil || again.Result != result.Result || again.SeqNumber != result.SeqNumber {
+		t.Fatalf("expected retry to get %+v, got %+v, %v", result, again, err)
+	}
+	stale := &pbft.Request{Client: "client", Timestamp: 1, Operation: "other"}
+	if _, err := engine.Propose(context.Background(), stale).Result(); err != pbft.ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %v", err)
+	}
+	if ops := app.ops(); len(ops) != 1 {
+		t.Fatalf("expected one operation applied, got %v", ops)
+	}
+	// followers see it once too
+	if entry := <-committed; entry.SeqNumber != 1 || entry.Operation != "first" || entry.Result != "FIRST" {
+		t.Fatalf("unexpected committed entry %+v", entry)
+	}
+	select {
+	case entry := <-committed:
+		t.Fatalf("expected one committed entry, got another %+v", entry)
+	default:
+	}
+}
+
+func TestRaftEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cluster := pbft.ClusterConfig{CheckpointInterval: 4}
+	for i := 1; i <= 3; i++ {
+		cluster.Nodes = append(cluster.Nodes, pbft.NodeConfig{
+			Id:         pbft.NodeId(i),
+			Host:       "localhost",
+			Port:       testFreePort(t),
+			EngineFile: filepath.Join(dir, fmt.Sprintf("raft%d.db", i)),
+		})
+	}
+	engines := make(map[pbft.NodeId]ConsensusEngine)
+	apps := make(map[pbft.NodeId]*testApp)
+	for _, node := range cluster.Nodes {
+		apps[node.Id] = &testApp{}
+		engine, err := StartEngine(ENGINE_RAFT, node, cluster, apps[node.Id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines[node.Id] = engine
+	}
+	defer func() {
+		for _, engine := range engines {
+			engine.Stop(context.Background())
+		}
+	}()
+	snapshots := make(chan int, 100)
+	engines[1].OnSnapshot(func(seq int, snapshot []byte) {
+		snapshots <- seq
+	})
+
+	// followers forward to the leader; enough to snapshot a few times
+	var expected []string
+	for i := 0; i < 10; i++ {
+		op := fmt.Sprintf("op%d", i)
+		at := pbft.NodeId(i%3 + 1)
+		result := proposeUntilDone(t, engines[at], &pbft.Request{Client: "client", Timestamp: int64(i + 1), Operation: op})
+		if result.Result != strings.ToUpper(op) {
+			t.Fatalf("expected %q, got %q", strings.ToUpper(op), result.Result)
+		}
+		expected = append(expected, op)
+	}
+
+	// still works with one node down
+	term := engines[3].Status().(raftStatus).Term
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := engines[3].Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	delete(engines, 3)
+	proposeUntilDone(t, engines[1], &pbft.Request{Client: "client", Timestamp: 11, Operation: "missed"})
+	expected = append(expected, "missed")
+	select {
+	case <-snapshots:
+	default:
+		t.Fatal("expected node 1 to have snapshotted")
+	}
+
+	// node 3 comes back with nothing but its engine file, and picks up
+	// where it left off
+	apps[3] = &testApp{}
+	restarted, err := StartEngine(ENGINE_RAFT, cluster.Nodes[2], cluster, apps[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines[3] = restarted
+	if status := restarted.Status().(raftStatus); status.Term < term {
+		t.Fatalf("expected node 3 to remember term %d, got %d", term, status.Term)
+	}
+	if len(apps[3].ops()) == 0 {
+		t.Fatal("expected node 3 to restore its own snapshot")
+	}
+	proposeUntilDone(t, engines[3], &pbft.Request{Client: "client", Timestamp: 12, Operation: "last"})
+	expected = append(expected, "last")
+
+	for id, _ := range engines {
+		deadline := time.Now().Add(5 * time.Second)
+		for strings.Join(apps[id].ops(), ",") != strings.Join(expected, ",") {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d applied %v, expected %v", id, apps[id].ops(), expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"distributepki/clientapi"
 	"distributepki/keystore"
+	"distributepki/shard"
 	"distributepki/util"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"pbft"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/coreos/pkg/capnslog"
@@ -26,59 +30,96 @@ type KeyRequest struct {
 }
 
 type KeyNode struct {
-	consensusNode   *pbft.PBFTNode
-	store           *keystore.Keystore
-	pendingRequests *sync.Map
-	logger          *capnslog.PackageLogger
+	engine       ConsensusEngine
+	store        *keystore.Keystore
+	logger       *capnslog.PackageLogger
+	clientServer *http.Server
+	router       *ShardRouter // nil unless the namespace is sharded (see router.go)
 }
 
 var keyring openpgp.EntityList
 
-func SpawnKeyNode(config pbft.NodeConfig, cluster *pbft.ClusterConfig, store *keystore.Keystore) *KeyNode {
+const KEYSET_ENDPOINT string = "/keyset"
+const REVOKE_ENDPOINT string = "/revoke"
+const FINGERPRINT_ENDPOINT string = "/fingerprint"
+const HISTORY_ENDPOINT string = "/history"
+
+func SpawnKeyNode(config pbft.NodeConfig, cluster *pbft.ClusterConfig, store *keystore.Keystore, engine string) *KeyNode {
 	// Hook in mock authority~
 	var err error
 	keyring, err = util.ReadPgpKeyFile(cluster.AuthorityKeyFile)
 	if err != nil {
 		return nil
 	}
-	node := pbft.StartNode(config, *cluster)
-	if node == nil {
+	store.SetAuthorities(keyring)
+	consensus, err := StartEngine(engine, config, *cluster, store.StateMachine())
+	if err != nil {
+		log.Errorf("Starting %s engine: %v", engine, err)
 		return nil
 	}
 
 	keyNode := KeyNode{
-		consensusNode:   node,
-		store:           store,
-		pendingRequests: &sync.Map{},
-		logger:          capnslog.NewPackageLogger("github.com/sydli/distributePKI", fmt.Sprintf("Keynode [Node %v]", node.Id())),
+		engine: consensus,
+		store:  store,
+		logger: capnslog.NewPackageLogger("github.com/sydli/distributePKI", fmt.Sprintf("Keynode [Node %v]", consensus.Id())),
 	}
-
-	go keyNode.handleUpdates()
 	return &keyNode
 }
 
 // is there a better way to bind this variable to the inner fn...?
 func handlerWithContext(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if kn.consensusNode.Down() {
+		if kn.engine.Down() {
 			kn.logger.Info("I'm down")
 			return
 		}
 
+		if _, ok := kn.engine.(*observerEngine); ok && r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+
 		switch r.Method {
 
 		// TODO: have client send signed KeyOperations directly, rather than generating them here
 		case "GET":
 			var response keystore.Key
 			alias := keystore.Alias(r.URL.Query().Get("name"))
+			if kn.wantsProof(r) {
+				kn.provenLookup(w, alias, r.URL.Query().Get("label"), false)
+				return
+			}
 			op := clientapi.KeyOperation{
 				OpCode: clientapi.OP_LOOKUP,
-				Op:     clientapi.Lookup{alias, nil},
+				Op:     clientapi.Lookup{Alias: alias, Label: r.URL.Query().Get("label")},
 			}
 			op.SetDigest()
 
-			if found, key := kn.LookupKey(&op, nil); found {
+			var found bool
+			var key keystore.Key
+			if observer, ok := kn.engine.(observedEngine); ok {
+				// say what the answer's current as of
+				proof := observer.Read(func() { found, key = kn.LookupKey(&op, nil) })
+				w.Header().Set("X-Sequence-Number", strconv.Itoa(proof.SeqNumber))
+				if found && r.URL.Query().Get("proof") != "" {
+					jsonBody, err := json.Marshal(ObservedKey{Key: string(key), Proof: proof})
+					if err != nil {
+						http.Error(w, "Error converting results to json",
+							http.StatusInternalServerError)
+						return
+					}
+					w.Write(jsonBody)
+					return
+				}
+			} else {
+				found, key = kn.LookupKey(&op, nil)
+			}
+			if found {
 				response = key
+			} else if revoked, ok := kn.store.LookupLabelled(alias, r.URL.Query().Get("label")); ok && revoked.Revoked() {
+				writeRevoked(w, revoked)
+				return
 			} else {
 				http.Error(w, "Key not found", http.StatusNotFound)
 				return
@@ -116,8 +157,8 @@ func handlerWithContext(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
 				Op:     create,
 			}
 			op.SetDigest()
-			if error := kn.CreateKey(&op, nil); error == nil {
-				kn.waitForCommit(&op, &w)
+			if proposal, error := kn.CreateKey(r.Context(), &op); error == nil {
+				kn.waitForCommit(proposal, &w)
 			} else {
 				http.Error(w, error.Error(), http.StatusBadRequest)
 				return
@@ -148,8 +189,8 @@ func handlerWithContext(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
 				Op:     update,
 			}
 			op.SetDigest()
-			if error := kn.UpdateKey(&op, nil); error == nil {
-				kn.waitForCommit(&op, &w)
+			if proposal, error := kn.UpdateKey(r.Context(), &op); error == nil {
+				kn.waitForCommit(proposal, &w)
 			} else {
 				http.Error(w, error.Error(), http.StatusBadRequest)
 				return
@@ -158,24 +199,35 @@ func handlerWithContext(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (kn *KeyNode) waitForCommit(op *clientapi.KeyOperation, w *http.ResponseWriter) {
-	responseChan := make(chan string, 100)
-	kn.pendingRequests.Store(op.Digest, responseChan)
-	kn.logger.Infof("Store pending request with digest: %v", op.Digest)
-
-	var error string
-	select {
-	case error = <-responseChan:
-	case <-time.After(time.Second * 10):
-		error = "Timeout on wait for Commit"
+// Blocks until the proposed operation executes (or fails) and writes
+// the outcome to the client.
+func (kn *KeyNode) waitForCommit(proposal *pbft.Proposal, w *http.ResponseWriter) {
+	result, err := proposal.Result()
+	switch err {
+	case nil:
+	case pbft.ErrOverloaded, pbft.ErrViewChange:
+		// whole seconds, rounded up
+		retryAfter := (kn.engine.RetryAfter(err) + time.Second - 1) / time.Second
+		(*w).Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+		http.Error(*w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case pbft.ErrStaleRequest:
+		http.Error(*w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(*w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if error == "" {
+	// where to look up the commit certificate
+	(*w).Header().Set("X-Sequence-Number", strconv.Itoa(result.SeqNumber))
+	digest := proposal.Digest()
+	(*w).Header().Set("X-Request-Digest", hex.EncodeToString(digest[:]))
+	if result.Result == "" {
 		writeJSON("", w)
 	} else {
-		http.Error(*w, error, http.StatusInternalServerError)
+		http.Error(*w, result.Result, http.StatusInternalServerError)
 	}
-	kn.pendingRequests.Delete(op.Digest)
 }
 
 func writeJSON(msg string, w *http.ResponseWriter) {
@@ -187,147 +239,185 @@ func writeJSON(msg string, w *http.ResponseWriter) {
 	}
 }
 
-func (kn *KeyNode) respondPendingRequest(digest [sha256.Size]byte, response string) {
-	if request, ok := kn.pendingRequests.Load(digest); !ok {
-		kn.logger.Debugf("No corresponding http request for operation digest %v", digest)
-		return
-	} else {
-		request.(chan string) <- response
+// Read-only view of the underlying consensus node's state, for debugging.
+func statusHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jsonBody, err := json.Marshal(kn.engine.Status())
+		if err != nil {
+			http.Error(w, "Error converting status to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
 	}
 }
 
-func (kn *KeyNode) StartClientServer(httpPort int) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handlerWithContext(kn))
-	log.Fatal(http.ListenAndServe(util.GetHostname("", httpPort), mux))
+// Proof of misbehaviour the consensus node has collected against its
+// peers (pairs of conflicting signed messages).
+func evidenceHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		engine, ok := kn.engine.(evidenceEngine)
+		if !ok {
+			http.Error(w, "Not supported by this consensus engine", http.StatusNotFound)
+			return
+		}
+		jsonBody, err := json.Marshal(engine.Evidence())
+		if err != nil {
+			http.Error(w, "Error converting evidence to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	}
 }
 
-func (kn *KeyNode) handleUpdates() {
-	for {
-		select {
-		case commit := <-kn.consensusNode.Committed():
-			kn.handleCommit(commit)
-		case request := <-kn.consensusNode.SnapshotRequested():
-			kn.handleSnapshotRequest(request)
-		case snapshot := <-kn.consensusNode.Snapshotted():
-			kn.handleSnapshot(snapshot)
+// Proof that the cluster agreed to an operation: the request and its
+// commit certificate, looked up by ?seq=<sequence number> or
+// ?digest=<hex request digest> (see pbft.VerifyCertificate).
+func certificateHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		engine, ok := kn.engine.(certificateEngine)
+		if !ok {
+			http.Error(w, "Not supported by this consensus engine", http.StatusNotFound)
+			return
+		}
+		var certified pbft.CertifiedRequest
+		var found bool
+		query := r.URL.Query()
+		if seq := query.Get("seq"); seq != "" {
+			number, err := strconv.Atoi(seq)
+			if err != nil {
+				http.Error(w, "Bad sequence number", http.StatusBadRequest)
+				return
+			}
+			certified, found = engine.CertificateBySeq(number)
+		} else if digest := query.Get("digest"); digest != "" {
+			decoded, err := hex.DecodeString(digest)
+			if err != nil || len(decoded) != sha256.Size {
+				http.Error(w, "Bad request digest", http.StatusBadRequest)
+				return
+			}
+			var requestDigest [sha256.Size]byte
+			copy(requestDigest[:], decoded)
+			certified, found = engine.CertificateByDigest(requestDigest)
+		} else {
+			http.Error(w, "Expected seq or digest", http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "Certificate not found", http.StatusNotFound)
+			return
 		}
+		jsonBody, err := json.Marshal(certified)
+		if err != nil {
+			http.Error(w, "Error converting certificate to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
 	}
 }
 
-func (kn *KeyNode) handleSnapshotRequest(slot pbft.SlotId) {
-	snapshot, err := kn.store.GetSnapshot()
+// Starts serving the client HTTP API in the background.
+func (kn *KeyNode) StartClientServer(httpPort int) error {
+	listener, err := net.Listen("tcp", util.GetHostname("", httpPort))
 	if err != nil {
-		kn.logger.Errorf("oh no, couldnt snapshot")
+		return err
 	}
-	kn.consensusNode.SnapshotReply(slot, snapshot)
+	kn.clientServer = &http.Server{Handler: kn.clientMux()}
+	go func() {
+		if err := kn.clientServer.Serve(listener); err != http.ErrServerClosed {
+			kn.logger.Errorf("Serving client API: %v", err)
+		}
+	}()
+	return nil
 }
 
-func (kn *KeyNode) handleSnapshot(snapshot *[]byte) {
-	kn.store.ApplySnapshot(snapshot)
-	// var keyOp clientapi.KeyOperation
-	// err := gob.NewDecoder(bytes.NewReader([]byte(*operation))).Decode(&keyOp)
-	// if err != nil {
-	// 	kn.logger.Error(err)
-	// 	return
-	// }
-
-	// kn.logger.Infof("Commit operation: %+v", keyOp)
-
-	// // XXX: do we need to check the signature of the operation again here?
-	// // Or do we assume that since it's committed and we're a non-faulty
-	// // node, we can apply it.
-	// switch keyOp.OpCode {
-	// case clientapi.OP_CREATE:
-	// 	create, ok := keyOp.Op.(clientapi.Create)
-	// 	if !ok {
-	// 		kn.logger.Error("Operation not a Create (handleCommit)")
-	// 		return
-	// 	}
-	// 	kn.logger.Infof("Commit create to keystore: %v", create)
-	// 	kn.store.CreateKey(create.Alias, create.Key)
-	// case clientapi.OP_UPDATE:
-	// 	update, ok := keyOp.Op.(clientapi.Update)
-	// 	if !ok {
-	// 		kn.logger.Error("Operation not a Update (handleCommit)")
-	// 		return
-	// 	}
-	// 	kn.logger.Infof("Commit update to keystore: %v", update)
-	// 	// TODO: Update keystore
-	// }
+func (kn *KeyNode) clientMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	if kn.router != nil {
+		mux.HandleFunc("/", kn.router.wrap(handlerWithContext(kn)))
+		mux.HandleFunc(KEYSET_ENDPOINT, kn.router.wrap(keySetHandler(kn)))
+		mux.HandleFunc(REVOKE_ENDPOINT, kn.router.wrap(revokeHandler(kn)))
+		mux.HandleFunc(HISTORY_ENDPOINT, kn.router.wrap(historyHandler(kn)))
+		mux.HandleFunc(shard.MAP_ENDPOINT, shardMapHandler(kn))
+		mux.HandleFunc(EXPORT_ENDPOINT, shardExportHandler(kn))
+		mux.HandleFunc(IMPORT_ENDPOINT, shardImportHandler(kn))
+	} else {
+		mux.HandleFunc("/", handlerWithContext(kn))
+		mux.HandleFunc(KEYSET_ENDPOINT, keySetHandler(kn))
+		mux.HandleFunc(REVOKE_ENDPOINT, revokeHandler(kn))
+		mux.HandleFunc(HISTORY_ENDPOINT, historyHandler(kn))
+	}
+	mux.HandleFunc(FINGERPRINT_ENDPOINT, fingerprintHandler(kn))
+	mux.HandleFunc("/status", statusHandler(kn))
+	mux.HandleFunc("/evidence", evidenceHandler(kn))
+	mux.HandleFunc("/certificates", certificateHandler(kn))
+	return mux
 }
 
-func (kn *KeyNode) handleCommit(operation *string) {
-	if operation == nil {
-		return
+// Shuts down the whole stack, outside in: stop taking client requests
+// (letting in-flight ones finish until ctx expires), then stop the
+// consensus node.
+func (kn *KeyNode) Stop(ctx context.Context) error {
+	var clientErr error
+	if kn.clientServer != nil {
+		clientErr = kn.clientServer.Shutdown(ctx)
 	}
-
-	var keyOp clientapi.KeyOperation
-	err := gob.NewDecoder(bytes.NewReader([]byte(*operation))).Decode(&keyOp)
+	err := kn.engine.Stop(ctx)
 	if err != nil {
-		kn.logger.Error(err)
-		kn.respondPendingRequest(keyOp.Digest, err.Error())
-		return
-	}
-
-	switch keyOp.OpCode {
-	case clientapi.OP_CREATE:
-		create, ok := keyOp.Op.(clientapi.Create)
-		if !ok {
-			error := "Operation not a Create (handleCommit)"
-			kn.logger.Error(error)
-			kn.respondPendingRequest(keyOp.Digest, error)
-			return
-		}
-		kn.logger.Info("Commiting create to keystore")
-		kn.store.CreateKey(create.Alias, create.Key)
-
-	case clientapi.OP_UPDATE:
-		update, ok := keyOp.Op.(clientapi.Update)
-		if !ok {
-			error := "Operation not a Update (handleCommit)"
-			kn.logger.Error(error)
-			kn.respondPendingRequest(keyOp.Digest, error)
-			return
-		}
-		kn.logger.Info("Commiting update to keystore")
-		kn.store.UpdateKey(update.Alias, update.Key)
+		return err
 	}
-
-	kn.respondPendingRequest(keyOp.Digest, "")
+	return clientErr
 }
 
-func (kn *KeyNode) CreateKey(args *clientapi.KeyOperation, reply *clientapi.Ack) error {
+// Validates the create and proposes it to the cluster.
+func (kn *KeyNode) CreateKey(ctx context.Context, args *clientapi.KeyOperation) (*pbft.Proposal, error) {
 
 	if !args.DigestValid() {
 		errMsg := "Operation digest is invalid (CreateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	if args.OpCode != clientapi.OP_CREATE {
 		errMsg := "Incorrect opcode value (CreateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	create, ok := args.Op.(clientapi.Create)
 	if !ok {
 		errMsg := "Operation not a Create (CreateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	if !create.SignatureValid(keyring) {
 		errMsg := "Signature is invalid (CreateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	if ok, _ := kn.store.LookupKey((args.Op.(clientapi.Create)).Alias); ok {
 		errMsg := "Key already exists for user (CreateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	kn.logger.Infof("Create Key: %+v", create)
@@ -335,49 +425,46 @@ func (kn *KeyNode) CreateKey(args *clientapi.KeyOperation, reply *clientapi.Ack)
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
 		kn.logger.Error(err)
-		return err
+		return nil, err
 	}
 
-	str := buf.String()
-	kn.consensusNode.Propose(&str)
-
-	if reply != nil {
-		reply.Success = true
-	}
-	return nil
+	// the timestamp's signed by the authority, so retries carry the
+	// same one
+	return kn.propose(ctx, buf.String(), create), nil
 }
 
-func (kn *KeyNode) UpdateKey(args *clientapi.KeyOperation, reply *clientapi.Ack) error {
+// Validates the update and proposes it to the cluster.
+func (kn *KeyNode) UpdateKey(ctx context.Context, args *clientapi.KeyOperation) (*pbft.Proposal, error) {
 
 	if !args.DigestValid() {
 		errMsg := "Operation digest is invalid (UpdateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	if args.OpCode != clientapi.OP_UPDATE {
 		errMsg := "Incorrect opcode value (UpdateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	update, ok := args.Op.(clientapi.Update)
 	if !ok {
 		errMsg := "Operation not an Update (UpdateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	ok, key := kn.store.LookupKey((args.Op.(clientapi.Update)).Alias)
 	if !ok {
 		errMsg := "Key does not exist for user (UpdateKey)"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 	if !update.SignatureValid(key) {
 		errMsg := "Update message not signed by client!"
 		kn.logger.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	kn.logger.Infof("Update Key: %+v", update)
@@ -385,16 +472,10 @@ func (kn *KeyNode) UpdateKey(args *clientapi.KeyOperation, reply *clientapi.Ack)
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
 		kn.logger.Error(err)
-		return err
+		return nil, err
 	}
 
-	str := buf.String()
-	kn.consensusNode.Propose(&str)
-
-	if reply != nil {
-		reply.Success = true
-	}
-	return nil
+	return kn.propose(ctx, buf.String(), update), nil
 }
 
 func (kn *KeyNode) LookupKey(args *clientapi.KeyOperation, reply *clientapi.Ack) (bool, keystore.Key) {
@@ -415,5 +496,363 @@ func (kn *KeyNode) LookupKey(args *clientapi.KeyOperation, reply *clientapi.Ack)
 		return false, keystore.Key("")
 	}
 	kn.logger.Infof("Lookup Key: %+v", lookup)
+	if lookup.Label != "" {
+		set, ok := kn.store.LookupKeySet(lookup.Alias)
+		if !ok {
+			return false, keystore.Key("")
+		}
+		key, ok := set.Get(lookup.Label)
+		return ok && !key.Revoked(), key.Key
+	}
 	return kn.store.LookupKey(lookup.Alias)
 }
+
+// Validates the add (it has to be signed by a key already in the set)
+// and proposes it to the cluster.
+func (kn *KeyNode) AddKey(ctx context.Context, args *clientapi.KeyOperation) (*pbft.Proposal, error) {
+	if !args.DigestValid() {
+		errMsg := "Operation digest is invalid (AddKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	add, ok := args.Op.(clientapi.AddKey)
+	if args.OpCode != clientapi.OP_ADD_KEY || !ok {
+		errMsg := "Operation not an AddKey (AddKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	if err := add.Check(kn.store); err != nil {
+		kn.logger.Error(err)
+		return nil, err
+	}
+	kn.logger.Infof("Add Key: %+v", add)
+	return kn.proposeOperation(ctx, args, add)
+}
+
+// Validates the removal (signed by any key in the set) and proposes it
+// to the cluster.
+func (kn *KeyNode) RemoveKey(ctx context.Context, args *clientapi.KeyOperation) (*pbft.Proposal, error) {
+	if !args.DigestValid() {
+		errMsg := "Operation digest is invalid (RemoveKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	remove, ok := args.Op.(clientapi.RemoveKey)
+	if args.OpCode != clientapi.OP_REMOVE_KEY || !ok {
+		errMsg := "Operation not a RemoveKey (RemoveKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	if err := remove.Check(kn.store); err != nil {
+		kn.logger.Error(err)
+		return nil, err
+	}
+	kn.logger.Infof("Remove Key: %+v", remove)
+	return kn.proposeOperation(ctx, args, remove)
+}
+
+// Validates the revocation (signed by the key being revoked, or another
+// one in the set) and proposes it to the cluster.
+func (kn *KeyNode) RevokeKey(ctx context.Context, args *clientapi.KeyOperation) (*pbft.Proposal, error) {
+	if !args.DigestValid() {
+		errMsg := "Operation digest is invalid (RevokeKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	revoke, ok := args.Op.(clientapi.Revoke)
+	if args.OpCode != clientapi.OP_REVOKE || !ok {
+		errMsg := "Operation not a Revoke (RevokeKey)"
+		kn.logger.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	if err := revoke.Check(kn.store); err != nil {
+		kn.logger.Error(err)
+		return nil, err
+	}
+	kn.logger.Infof("Revoke Key: %+v", revoke)
+	return kn.proposeOperation(ctx, args, revoke)
+}
+
+func (kn *KeyNode) proposeOperation(ctx context.Context, args *clientapi.KeyOperation, op keystore.SignedOperation) (*pbft.Proposal, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		kn.logger.Error(err)
+		return nil, err
+	}
+	return kn.propose(ctx, buf.String(), op), nil
+}
+
+// The request goes under whoever the operation says sent it, which is
+// what every replica checks (see keystore.CheckRequest).
+func (kn *KeyNode) propose(ctx context.Context, operation string, op keystore.SignedOperation) *pbft.Proposal {
+	client, timestamp := op.Sender()
+	return kn.engine.Propose(ctx, &pbft.Request{
+		Client:    client,
+		Timestamp: timestamp,
+		Operation: operation,
+	})
+}
+
+// GET /keyset?name=<alias> returns every key the alias has; POST adds
+// one and DELETE removes one (see clientapi.AddKeyJSON and
+// RemoveKeyJSON).
+func keySetHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := kn.engine.(*observerEngine); ok && r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if kn.wantsProof(r) {
+				kn.provenLookup(w, keystore.Alias(r.URL.Query().Get("name")), "", true)
+				return
+			}
+			set, ok := kn.store.LookupKeySet(keystore.Alias(r.URL.Query().Get("name")))
+			if !ok {
+				http.Error(w, "Key not found", http.StatusNotFound)
+				return
+			}
+			jsonBody, err := json.Marshal(set)
+			if err != nil {
+				http.Error(w, "Error converting results to json",
+					http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonBody)
+		case "POST":
+			var addJSON clientapi.AddKeyJSON
+			if err := json.NewDecoder(r.Body).Decode(&addJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			op := clientapi.KeyOperation{
+				OpCode: clientapi.OP_ADD_KEY,
+				Op:     addJSON.ToAddKey(),
+			}
+			op.SetDigest()
+			if proposal, err := kn.AddKey(r.Context(), &op); err == nil {
+				kn.waitForCommit(proposal, &w)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		case "DELETE":
+			var removeJSON clientapi.RemoveKeyJSON
+			if err := json.NewDecoder(r.Body).Decode(&removeJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			op := clientapi.KeyOperation{
+				OpCode: clientapi.OP_REMOVE_KEY,
+				Op:     removeJSON.ToRemoveKey(),
+			}
+			op.SetDigest()
+			if proposal, err := kn.RemoveKey(r.Context(), &op); err == nil {
+				kn.waitForCommit(proposal, &w)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Lookups of a revoked key get 410 Gone, with the key and why it was
+// revoked, rather than just a 404.
+func writeRevoked(w http.ResponseWriter, key keystore.LabelledKey) {
+	jsonBody, err := json.Marshal(key)
+	if err != nil {
+		http.Error(w, "Error converting results to json",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	w.Write(jsonBody)
+}
+
+// POST /revoke revokes a key (see clientapi.RevokeJSON).
+func revokeHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := kn.engine.(*observerEngine); ok {
+			http.Error(w, ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		var revokeJSON clientapi.RevokeJSON
+		if err := json.NewDecoder(r.Body).Decode(&revokeJSON); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		op := clientapi.KeyOperation{
+			OpCode: clientapi.OP_REVOKE,
+			Op:     revokeJSON.ToRevoke(),
+		}
+		op.SetDigest()
+		if proposal, err := kn.RevokeKey(r.Context(), &op); err == nil {
+			kn.waitForCommit(proposal, &w)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// GET /fingerprint?fp=<hex> returns every key with that fingerprint:
+// which alias and label it's under, and whether (and why) it's been
+// revoked. Only this shard's keys, if the namespace is sharded.
+func fingerprintHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fingerprint := r.URL.Query().Get("fp")
+		if fingerprint == "" {
+			http.Error(w, "Missing fingerprint", http.StatusBadRequest)
+			return
+		}
+		matches := kn.store.LookupFingerprint(fingerprint)
+		if len(matches) == 0 {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		jsonBody, err := json.Marshal(matches)
+		if err != nil {
+			http.Error(w, "Error converting results to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	}
+}
+
+// GET /history?name=<alias> lists every version of the alias' keyset,
+// oldest first. With &seq=<sequence number> or &time=<timestamp>, just
+// the version that was current then (see keystore/history.go).
+func historyHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		alias := keystore.Alias(query.Get("name"))
+		var response interface{}
+		var found bool
+		switch {
+		case query.Get("seq") != "":
+			seq, err := strconv.Atoi(query.Get("seq"))
+			if err != nil {
+				http.Error(w, "Invalid sequence number", http.StatusBadRequest)
+				return
+			}
+			response, found = kn.store.VersionAt(alias, seq)
+		case query.Get("time") != "":
+			timestamp, err := strconv.ParseInt(query.Get("time"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+				return
+			}
+			response, found = kn.store.VersionAtTime(alias, timestamp)
+		default:
+			response, found = kn.store.History(alias)
+		}
+		if !found {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		jsonBody, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, "Error converting results to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	}
+}
+
+// Engines whose replicas sign the keystore's Merkle root at every
+// checkpoint (pbft replicas and observers).
+type rootedEngine interface {
+	StateRootProof() (pbft.StateRootProof, error)
+}
+
+// Lookups come with a proof whenever the engine can give one, unless the
+// client opts out with merkle=false (for the current answer, which no
+// quorum's signed yet), or asks an observer for its own kind of proof
+// (proof=true). Asking for one (merkle=true) from an engine that can't
+// gets 501.
+func (kn *KeyNode) wantsProof(r *http.Request) bool {
+	merkle := r.URL.Query().Get("merkle")
+	if merkle == "false" || (merkle == "" && r.URL.Query().Get("proof") != "") {
+		return false
+	}
+	_, rooted := kn.engine.(rootedEngine)
+	return rooted || merkle != ""
+}
+
+// Answers a lookup as of the last stable checkpoint, with a proof the
+// client can check (see clientapi.ProvenKey). Missing aliases and
+// labels get 404 and revoked keys 410, as for other lookups, but with
+// the proof either way. For the whole keyset, the key's left out.
+func (kn *KeyNode) provenLookup(w http.ResponseWriter, alias keystore.Alias, label string, keyset bool) {
+	rooted, ok := kn.engine.(rootedEngine)
+	if !ok {
+		http.Error(w, "This engine doesn't sign Merkle roots", http.StatusNotImplemented)
+		return
+	}
+	root, err := rooted.StateRootProof()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if root.Number.SeqNumber == 0 {
+		http.Error(w, "No stable checkpoint yet", http.StatusServiceUnavailable)
+		return
+	}
+	set, proof, err := kn.store.Prove(alias, root.Number.SeqNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := clientapi.ProvenKey{Alias: alias, KeySet: set, Proof: proof, Root: root}
+	status := http.StatusNotFound
+	if set != nil && keyset {
+		status = http.StatusOK
+	} else if set != nil {
+		var key keystore.LabelledKey
+		if label == "" {
+			key, ok = set.LastPrimary()
+		} else {
+			key, ok = set.Get(label)
+		}
+		if ok {
+			response.Key = &key
+			status = http.StatusOK
+			if key.Revoked() {
+				status = http.StatusGone
+			}
+		}
+	}
+	jsonBody, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Error converting results to json",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Sequence-Number", strconv.Itoa(root.Number.SeqNumber))
+	w.WriteHeader(status)
+	w.Write(jsonBody)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"distributepki/clientapi"
+	"distributepki/keystore"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"pbft"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// ** KEYSET TESTS ** //
+// (These don't need the cluster TestMain starts.)
+
+func armoredPublicKey(t *testing.T, entity *openpgp.Entity) keystore.Key {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return keystore.Key(buf.String())
+}
+
+// A KeyNode on the dev engine, with its keyset endpoint.
+func testKeyNode(t *testing.T, initial map[string]string) (*KeyNode, *httptest.Server) {
+	gob.Register(clientapi.AddKey{})
+	gob.Register(clientapi.RemoveKey{})
+	gob.Register(clientapi.Revoke{})
+	store := keystore.NewKeystore(&initial)
+	kn := &KeyNode{
+		engine: newDevEngine(1, store.StateMachine()),
+		store:  store,
+		logger: capnslog.NewPackageLogger("github.com/sydli/distributePKI", "Keynode [test]"),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handlerWithContext(kn))
+	mux.HandleFunc(KEYSET_ENDPOINT, keySetHandler(kn))
+	mux.HandleFunc(REVOKE_ENDPOINT, revokeHandler(kn))
+	mux.HandleFunc(FINGERPRINT_ENDPOINT, fingerprintHandler(kn))
+	mux.HandleFunc(HISTORY_ENDPOINT, historyHandler(kn))
+	return kn, httptest.NewServer(mux)
+}
+
+func sendJSON(t *testing.T, server *httptest.Server, method string, path string, body interface{}) (int, string) {
+	encoded, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(encoded))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(reply)
+}
+
+func getPath(t *testing.T, server *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(reply)
+}
+
+func TestKeySets(t *testing.T) {
+	laptop := testEntity(t)
+	phone := testEntity(t)
+	backup := testEntity(t)
+	_, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+
+	send := func(method string, body interface{}) (int, string) {
+		return sendJSON(t, server, method, KEYSET_ENDPOINT, body)
+	}
+	add := func(label string, key keystore.Key, flags keystore.KeyFlags, timestamp int64, signer string, by *openpgp.Entity) (int, string) {
+		op := clientapi.AddKey{Alias: "alice@example.com", Label: label, Key: key, Flags: flags, Timestamp: timestamp}
+		if err := op.Sign(signer, by); err != nil {
+			t.Fatal(err)
+		}
+		return send("POST", clientapi.AddKeyJSON{
+			Alias: string(op.Alias), Label: op.Label, Key: string(op.Key), Flags: op.Flags,
+			Timestamp: op.Timestamp, Signer: op.Signer, Signature: string(op.Signature),
+		})
+	}
+	get := func(path string) (int, string) {
+		return getPath(t, server, path)
+	}
+
+	// the laptop key (from the create) vouches for the others
+	if status, reply := add("phone", armoredPublicKey(t, phone), keystore.FLAG_PRIMARY, 1, keystore.DEFAULT_LABEL, laptop); status != http.StatusOK {
+		t.Fatalf("adding the phone key: %d %s", status, reply)
+	}
+	if status, reply := add("backup", armoredPublicKey(t, backup), keystore.FLAG_BACKUP, 2, "phone", phone); status != http.StatusOK {
+		t.Fatalf("adding the backup key: %d %s", status, reply)
+	}
+	// but nobody else can
+	if status, _ := add("evil", armoredPublicKey(t, testEntity(t)), keystore.FLAG_PRIMARY, 3, "phone", testEntity(t)); status == http.StatusOK {
+		t.Fatal("added a key signed by someone outside the set")
+	}
+
+	_, reply := get(KEYSET_ENDPOINT + "?name=alice@example.com")
+	var set keystore.KeySet
+	if err := json.Unmarshal([]byte(reply), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 3 {
+		t.Fatalf("expected 3 keys, got %+v", set)
+	}
+	if primary, _ := set.Primary(); primary.Label != "phone" {
+		t.Errorf("primary key is %q, not the phone", primary.Label)
+	}
+
+	// a plain lookup gets the primary key, or ask for one by label
+	var key keystore.Key
+	_, reply = get("/?name=alice@example.com")
+	json.Unmarshal([]byte(reply), &key)
+	if key != armoredPublicKey(t, phone) {
+		t.Error("lookup didn't return the primary key")
+	}
+	_, reply = get("/?name=alice@example.com&label=backup")
+	json.Unmarshal([]byte(reply), &key)
+	if key != armoredPublicKey(t, backup) {
+		t.Error("lookup by label didn't return the backup key")
+	}
+	if status, _ := get("/?name=alice@example.com&label=tablet"); status != http.StatusNotFound {
+		t.Errorf("lookup of a missing label got %d", status)
+	}
+
+	// the backup key can get rid of a lost laptop
+	remove := clientapi.RemoveKey{Alias: "alice@example.com", Label: keystore.DEFAULT_LABEL, Timestamp: 4}
+	if err := remove.Sign("backup", backup); err != nil {
+		t.Fatal(err)
+	}
+	status, reply := send("DELETE", clientapi.RemoveKeyJSON{
+		Alias: string(remove.Alias), Label: remove.Label, Timestamp: remove.Timestamp,
+		Signer: remove.Signer, Signature: string(remove.Signature),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("removing the laptop key: %d %s", status, reply)
+	}
+	if status, _ := get("/?name=alice@example.com&label=" + keystore.DEFAULT_LABEL); status != http.StatusNotFound {
+		t.Error("laptop key still there")
+	}
+}
+
+func TestKeySetChangeReplay(t *testing.T) {
+	laptop := testEntity(t)
+	kn, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+
+	// a removal and an empty add sign the same fields otherwise
+	remove := clientapi.RemoveKey{Alias: "alice@example.com", Label: "phone", Timestamp: 1}
+	if err := remove.Sign(keystore.DEFAULT_LABEL, laptop); err != nil {
+		t.Fatal(err)
+	}
+	if err := remove.Check(kn.store); err != nil {
+		t.Fatalf("removal doesn't check out: %v", err)
+	}
+	add := clientapi.AddKey{
+		Alias: remove.Alias, Label: remove.Label, Timestamp: remove.Timestamp,
+		Signer: remove.Signer, Signature: remove.Signature,
+	}
+	if err := add.Check(kn.store); err == nil {
+		t.Error("a removal's signature passed for an add")
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	laptop := testEntity(t)
+	phone := testEntity(t)
+	_, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+
+	add := clientapi.AddKey{Alias: "alice@example.com", Label: "phone", Key: armoredPublicKey(t, phone), Timestamp: 1}
+	if err := add.Sign(keystore.DEFAULT_LABEL, laptop); err != nil {
+		t.Fatal(err)
+	}
+	if status, reply := sendJSON(t, server, "POST", KEYSET_ENDPOINT, clientapi.AddKeyJSON{
+		Alias: string(add.Alias), Label: add.Label, Key: string(add.Key),
+		Timestamp: add.Timestamp, Signer: add.Signer, Signature: string(add.Signature),
+	}); status != http.StatusOK {
+		t.Fatalf("adding the phone key: %d %s", status, reply)
+	}
+	revoke := func(label string, timestamp int64, signer string, by *openpgp.Entity) (int, string) {
+		op := clientapi.Revoke{Alias: "alice@example.com", Label: label, Reason: "stolen", Timestamp: timestamp}
+		if err := op.Sign(signer, by); err != nil {
+			t.Fatal(err)
+		}
+		return sendJSON(t, server, "POST", REVOKE_ENDPOINT, clientapi.RevokeJSON{
+			Alias: string(op.Alias), Label: op.Label, Reason: op.Reason,
+			Timestamp: op.Timestamp, Signer: op.Signer, Signature: string(op.Signature),
+		})
+	}
+
+	// a removal signature can't be replayed as a revocation
+	remove := clientapi.RemoveKey{Alias: "alice@example.com", Label: keystore.DEFAULT_LABEL, Timestamp: 2}
+	remove.Sign("phone", phone)
+	if status, _ := sendJSON(t, server, "POST", REVOKE_ENDPOINT, clientapi.RevokeJSON{
+		Alias: string(remove.Alias), Label: remove.Label, Timestamp: remove.Timestamp,
+		Signer: remove.Signer, Signature: string(remove.Signature),
+	}); status == http.StatusOK {
+		t.Fatal("revoked with a removal's signature")
+	}
+
+	// the phone revokes the stolen laptop, which then can't sign anything
+	if status, reply := revoke(keystore.DEFAULT_LABEL, 3, "phone", phone); status != http.StatusOK {
+		t.Fatalf("revoking the laptop key: %d %s", status, reply)
+	}
+	if status, _ := revoke("phone", 4, keystore.DEFAULT_LABEL, laptop); status == http.StatusOK {
+		t.Fatal("a revoked key revoked another")
+	}
+
+	// lookups of it say so
+	status, reply := getPath(t, server, "/?name=alice@example.com&label="+keystore.DEFAULT_LABEL)
+	var revoked keystore.LabelledKey
+	json.Unmarshal([]byte(reply), &revoked)
+	if status != http.StatusGone || revoked.Revocation == nil || revoked.Revocation.Reason != "stolen" || revoked.Revocation.Signer != "phone" {
+		t.Errorf("lookup of the revoked key: %d %s", status, reply)
+	}
+	var key keystore.Key
+	_, reply = getPath(t, server, "/?name=alice@example.com")
+	json.Unmarshal([]byte(reply), &key)
+	if key != armoredPublicKey(t, phone) {
+		t.Error("plain lookup didn't skip the revoked key")
+	}
+
+	// and so does looking it up by fingerprint
+	fingerprint := hex.EncodeToString(laptop.PrimaryKey.Fingerprint[:])
+	status, reply = getPath(t, server, FINGERPRINT_ENDPOINT+"?fp="+strings.ToUpper(fingerprint))
+	var matches []keystore.FingerprintMatch
+	if err := json.Unmarshal([]byte(reply), &matches); err != nil {
+		t.Fatalf("%d %s", status, reply)
+	}
+	if len(matches) != 1 || matches[0].Alias != "alice@example.com" || matches[0].Label != keystore.DEFAULT_LABEL || !matches[0].Revoked() {
+		t.Errorf("fingerprint lookup: %+v", matches)
+	}
+	if status, _ := getPath(t, server, FINGERPRINT_ENDPOINT+"?fp=00"); status != http.StatusNotFound {
+		t.Errorf("lookup of an unknown fingerprint got %d", status)
+	}
+
+	// once the phone goes too, a plain lookup is gone as well
+	if status, reply := revoke("phone", 5, "phone", phone); status != http.StatusOK {
+		t.Fatalf("revoking the phone key: %d %s", status, reply)
+	}
+	if status, _ := getPath(t, server, "/?name=alice@example.com"); status != http.StatusGone {
+		t.Errorf("plain lookup with every key revoked got %d", status)
+	}
+}
+
+func TestKeyHistory(t *testing.T) {
+	laptop := testEntity(t)
+	phone := testEntity(t)
+	_, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+
+	add := clientapi.AddKey{Alias: "alice@example.com", Label: "phone", Key: armoredPublicKey(t, phone), Timestamp: 10}
+	add.Sign(keystore.DEFAULT_LABEL, laptop)
+	if status, reply := sendJSON(t, server, "POST", KEYSET_ENDPOINT, clientapi.AddKeyJSON{
+		Alias: string(add.Alias), Label: add.Label, Key: string(add.Key),
+		Timestamp: add.Timestamp, Signer: add.Signer, Signature: string(add.Signature),
+	}); status != http.StatusOK {
+		t.Fatalf("adding the phone key: %d %s", status, reply)
+	}
+	revoke := clientapi.Revoke{Alias: "alice@example.com", Label: keystore.DEFAULT_LABEL, Reason: "lost", Timestamp: 20}
+	revoke.Sign("phone", phone)
+	if status, reply := sendJSON(t, server, "POST", REVOKE_ENDPOINT, clientapi.RevokeJSON{
+		Alias: string(revoke.Alias), Label: revoke.Label, Reason: revoke.Reason,
+		Timestamp: revoke.Timestamp, Signer: revoke.Signer, Signature: string(revoke.Signature),
+	}); status != http.StatusOK {
+		t.Fatalf("revoking the laptop key: %d %s", status, reply)
+	}
+
+	_, reply := getPath(t, server, HISTORY_ENDPOINT+"?name=alice@example.com")
+	var history []keystore.Version
+	if err := json.Unmarshal([]byte(reply), &history); err != nil {
+		t.Fatal(reply)
+	}
+	operations := make([]string, len(history))
+	for i, version := range history {
+		operations[i] = version.Operation
+	}
+	if len(history) != 3 || operations[0] != keystore.OPERATION_INITIAL || operations[1] != keystore.OPERATION_ADD || operations[2] != keystore.OPERATION_REVOKE {
+		t.Fatalf("history: %v", operations)
+	}
+	if history[2].Seq != 2 || history[2].Timestamp != 20 || history[2].Signer != "phone" {
+		t.Errorf("revocation version: %+v", history[2])
+	}
+
+	// the laptop key was good until the revocation
+	at := func(query string) keystore.Version {
+		status, reply := getPath(t, server, HISTORY_ENDPOINT+"?name=alice@example.com&"+query)
+		var version keystore.Version
+		if err := json.Unmarshal([]byte(reply), &version); err != nil {
+			t.Fatalf("%s: %d %s", query, status, reply)
+		}
+		return version
+	}
+	for _, query := range []string{"seq=1", "time=15"} {
+		version := at(query)
+		if laptopKey, _ := version.Keys.Get(keystore.DEFAULT_LABEL); version.Operation != keystore.OPERATION_ADD || laptopKey.Revoked() {
+			t.Errorf("%s: %+v", query, version)
+		}
+	}
+	if version := at("time=25"); version.Operation != keystore.OPERATION_REVOKE {
+		t.Errorf("time=25: %+v", version)
+	}
+	if status, _ := getPath(t, server, HISTORY_ENDPOINT+"?name=bob@example.com"); status != http.StatusNotFound {
+		t.Errorf("history of a missing alias got %d", status)
+	}
+	if status, _ := getPath(t, server, HISTORY_ENDPOINT+"?name=alice@example.com&seq=x"); status != http.StatusBadRequest {
+		t.Errorf("bad sequence number got %d", status)
+	}
+}
+
+func TestRequestSenders(t *testing.T) {
+	laptop := testEntity(t)
+	phone := testEntity(t)
+	kn, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+	add := func(label string, key *openpgp.Entity, timestamp int64) (int, string) {
+		op := clientapi.AddKey{Alias: "alice@example.com", Label: label, Key: armoredPublicKey(t, key), Timestamp: timestamp}
+		op.Sign(keystore.DEFAULT_LABEL, laptop)
+		return sendJSON(t, server, "POST", KEYSET_ENDPOINT, clientapi.AddKeyJSON{
+			Alias: string(op.Alias), Label: op.Label, Key: string(op.Key),
+			Timestamp: op.Timestamp, Signer: op.Signer, Signature: string(op.Signature),
+		})
+	}
+
+	// a timestamp from the far future doesn't lock the alias out
+	if status, _ := add("tablet", phone, math.MaxInt64); status == http.StatusOK {
+		t.Fatal("took an add from the far future")
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if status, reply := add("phone", phone, now); status != http.StatusOK {
+		t.Fatalf("adding the phone key: %d %s", status, reply)
+	}
+
+	// nor can a request go under a client (or timestamp) other than the
+	// one its operation was signed with
+	remove := clientapi.RemoveKey{Alias: "alice@example.com", Label: "phone", Timestamp: now + 1}
+	remove.Sign(keystore.DEFAULT_LABEL, laptop)
+	args := clientapi.KeyOperation{OpCode: clientapi.OP_REMOVE_KEY, Op: remove}
+	args.SetDigest()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&args); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []pbft.Request{
+		{Client: "bob@example.com", Timestamp: remove.Timestamp, Operation: buf.String()},
+		{Client: keystore.AliasClient(remove.Alias), Timestamp: remove.Timestamp + 1, Operation: buf.String()},
+	} {
+		if _, err := kn.engine.Propose(context.Background(), &request).Result(); err != keystore.ErrWrongSender {
+			t.Errorf("%+v: expected ErrWrongSender, got %v", request, err)
+		}
+	}
+
+	// revocations are ordered on their own, so an older one still goes in
+	revoke := clientapi.Revoke{Alias: "alice@example.com", Label: keystore.DEFAULT_LABEL, Reason: "stolen", Timestamp: 1}
+	revoke.Sign("phone", phone)
+	if status, reply := sendJSON(t, server, "POST", REVOKE_ENDPOINT, clientapi.RevokeJSON{
+		Alias: string(revoke.Alias), Label: revoke.Label, Reason: revoke.Reason,
+		Timestamp: revoke.Timestamp, Signer: revoke.Signer, Signature: string(revoke.Signature),
+	}); status != http.StatusOK {
+		t.Fatalf("revoking the laptop key: %d %s", status, reply)
+	}
+}
+
+// The dev engine, with every sequence number it's executed "stable" (but
+// nobody's signatures).
+type rootedDevEngine struct {
+	*devEngine
+	store *keystore.Keystore
+}
+
+func (e rootedDevEngine) StateRootProof() (pbft.StateRootProof, error) {
+	seq := e.Status().(devStatus).SeqNumber
+	return pbft.StateRootProof{Number: pbft.SlotId{SeqNumber: seq}, StateRoot: e.store.StateRoot(seq)}, nil
+}
+
+func TestProvenLookup(t *testing.T) {
+	laptop := testEntity(t)
+	kn, server := testKeyNode(t, map[string]string{"alice@example.com": string(armoredPublicKey(t, laptop))})
+	defer server.Close()
+
+	// only engines that sign roots can do this
+	if status, _ := getPath(t, server, "/?name=alice@example.com&merkle=true"); status != http.StatusNotImplemented {
+		t.Errorf("dev engine got %d", status)
+	}
+	kn.engine = rootedDevEngine{kn.engine.(*devEngine), kn.store}
+	if status, _ := getPath(t, server, "/?name=alice@example.com&merkle=true"); status != http.StatusServiceUnavailable {
+		t.Errorf("before any checkpoint got %d", status)
+	}
+
+	phone := testEntity(t)
+	add := clientapi.AddKey{Alias: "alice@example.com", Label: "phone", Key: armoredPublicKey(t, phone), Timestamp: 1}
+	add.Sign(keystore.DEFAULT_LABEL, laptop)
+	if status, reply := sendJSON(t, server, "POST", KEYSET_ENDPOINT, clientapi.AddKeyJSON{
+		Alias: string(add.Alias), Label: add.Label, Key: string(add.Key),
+		Timestamp: add.Timestamp, Signer: add.Signer, Signature: string(add.Signature),
+	}); status != http.StatusOK {
+		t.Fatalf("adding the phone key: %d %s", status, reply)
+	}
+
+	lookup := func(query string) (int, clientapi.ProvenKey) {
+		status, reply := getPath(t, server, "/?merkle=true&"+query)
+		var proven clientapi.ProvenKey
+		if err := json.Unmarshal([]byte(reply), &proven); err != nil {
+			t.Fatalf("%s: %d %s", query, status, reply)
+		}
+		// (no signatures to check, so just the proof)
+		if err := proven.Proof.Verify(proven.Root.StateRoot, proven.Alias, proven.KeySet); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+		return status, proven
+	}
+	status, proven := lookup("name=alice@example.com&label=phone")
+	if status != http.StatusOK || proven.Key == nil || proven.Key.Key != armoredPublicKey(t, phone) || len(proven.KeySet.Keys) != 2 {
+		t.Errorf("lookup of the phone key: %d %+v", status, proven)
+	}
+	if status, proven := lookup("name=bob@example.com"); status != http.StatusNotFound || proven.KeySet != nil {
+		t.Errorf("lookup of a missing alias: %d %+v", status, proven)
+	}
+	if status, proven := lookup("name=alice@example.com&label=tablet"); status != http.StatusNotFound || proven.Key != nil || proven.KeySet == nil {
+		t.Errorf("lookup of a missing label: %d %+v", status, proven)
+	}
+
+	// plain lookups come with the proof too, unless the client opts out
+	status, reply := getPath(t, server, "/?name=alice@example.com")
+	var plain clientapi.ProvenKey
+	if err := json.Unmarshal([]byte(reply), &plain); status != http.StatusOK || err != nil || plain.Key == nil || plain.Root.Number != proven.Root.Number {
+		t.Errorf("lookup without asking for a proof: %d %s", status, reply)
+	}
+	status, reply = getPath(t, server, KEYSET_ENDPOINT+"?name=alice@example.com")
+	var whole clientapi.ProvenKey
+	if err := json.Unmarshal([]byte(reply), &whole); status != http.StatusOK || err != nil || whole.Key != nil || len(whole.KeySet.Keys) != 2 {
+		t.Errorf("keyset lookup: %d %s", status, reply)
+	} else if err := whole.Proof.Verify(whole.Root.StateRoot, whole.Alias, whole.KeySet); err != nil {
+		t.Errorf("keyset lookup: %v", err)
+	}
+	var key keystore.Key
+	if status, reply := getPath(t, server, "/?name=alice@example.com&merkle=false"); status != http.StatusOK || json.Unmarshal([]byte(reply), &key) != nil || key != armoredPublicKey(t, laptop) {
+		t.Errorf("lookup opting out of the proof: %d %s", status, reply)
+	}
+
+	// nor does a keyset the node made up
+	forged := *proven.KeySet
+	forged.Keys = append([]keystore.LabelledKey{{Label: "evil", Key: "evil"}}, forged.Keys...)
+	if err := proven.Proof.Verify(proven.Root.StateRoot, proven.Alias, &forged); err == nil {
+		t.Error("verified a forged keyset")
+	}
+}
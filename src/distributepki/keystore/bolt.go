@@ -0,0 +1,257 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// ** BOLT STORAGE ** //
+
+// Keeps keysets (as JSON) in a bolt database (one file), so a restarted node starts
+// from what it had. Every write is a single bolt transaction, so the
+// keys and how far they're current as of never get out of step. Each
+// alias' versions go in a bucket of their own under history, numbered
+// in order, next to its current keyset under keys.
+
+// How long to wait for another process to let go of the file
+const BOLT_TIMEOUT time.Duration = time.Duration(time.Second)
+
+var (
+	keysBucket     = []byte("keys")
+	historyBucket  = []byte("history")
+	metaBucket     = []byte("meta")
+	seqField       = []byte("seq")
+	replicaField   = []byte("replica")
+	placementField = []byte("placement")
+)
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(file string) (KeyStorage, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: BOLT_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(keysBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Lookup(alias Alias) (KeySet, bool, error) {
+	var keys KeySet
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(keysBucket).Get([]byte(alias)); v != nil {
+			found = true
+			return json.Unmarshal(v, &keys)
+		}
+		return nil
+	})
+	return keys, found, err
+}
+
+func (s *boltStorage) History(alias Alias) ([]Version, error) {
+	var history []Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		history, err = readHistory(tx.Bucket(historyBucket).Bucket([]byte(alias)))
+		return err
+	})
+	return history, err
+}
+
+func readHistory(bucket *bolt.Bucket) ([]Version, error) {
+	if bucket == nil {
+		return nil, nil
+	}
+	var history []Version
+	err := bucket.ForEach(func(k, v []byte) error {
+		var version Version
+		if err := json.Unmarshal(v, &version); err != nil {
+			return err
+		}
+		history = append(history, version)
+		return nil
+	})
+	return history, err
+}
+
+// Appends the version to the alias' history, and makes its keys current.
+func putVersion(tx *bolt.Tx, alias Alias, version Version) error {
+	encoded, err := json.Marshal(version.Keys)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(keysBucket).Put([]byte(alias), encoded); err != nil {
+		return err
+	}
+	history, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(alias))
+	if err != nil {
+		return err
+	}
+	n, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	if encoded, err = json.Marshal(version); err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return history.Put(key, encoded)
+}
+
+func (s *boltStorage) Write(batch Batch, seq int, replica []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for alias, versions := range batch.Histories {
+			if err := deleteHistory(tx, alias); err != nil {
+				return err
+			}
+			for _, version := range versions {
+				if err := putVersion(tx, alias, version); err != nil {
+					return err
+				}
+			}
+		}
+		for alias, version := range batch.Versions {
+			if err := putVersion(tx, alias, version); err != nil {
+				return err
+			}
+		}
+		if batch.Placement != nil {
+			if err := putPlacement(tx, batch.Placement); err != nil {
+				return err
+			}
+		}
+		return putSaved(tx, seq, replica)
+	})
+}
+
+func deleteHistory(tx *bolt.Tx, alias Alias) error {
+	if err := tx.Bucket(keysBucket).Delete([]byte(alias)); err != nil {
+		return err
+	}
+	histories := tx.Bucket(historyBucket)
+	if histories.Bucket([]byte(alias)) == nil {
+		return nil
+	}
+	return histories.DeleteBucket([]byte(alias))
+}
+
+func (s *boltStorage) Save(seq int, replica []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putSaved(tx, seq, replica)
+	})
+}
+
+func putSaved(tx *bolt.Tx, seq int, replica []byte) error {
+	meta := tx.Bucket(metaBucket)
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, uint64(seq))
+	if err := meta.Put(seqField, encoded); err != nil {
+		return err
+	}
+	if replica == nil {
+		return meta.Delete(replicaField)
+	}
+	return meta.Put(replicaField, replica)
+}
+
+func (s *boltStorage) Saved() (int, []byte, error) {
+	var seq int
+	var replica []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if v := meta.Get(seqField); len(v) == 8 {
+			seq = int(binary.BigEndian.Uint64(v))
+		}
+		// only good for the life of the transaction, so copy it
+		if v := meta.Get(replicaField); v != nil {
+			replica = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return seq, replica, err
+}
+
+func (s *boltStorage) All() (map[Alias][]Version, error) {
+	all := make(map[Alias][]Version)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		histories := tx.Bucket(historyBucket)
+		return histories.ForEach(func(k, _ []byte) error {
+			history, err := readHistory(histories.Bucket(k))
+			all[Alias(k)] = history
+			return err
+		})
+	})
+	return all, err
+}
+
+func (s *boltStorage) Placement() ([]byte, error) {
+	var placement []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(placementField); v != nil {
+			placement = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return placement, err
+}
+
+func (s *boltStorage) Place(placement []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putPlacement(tx, placement)
+	})
+}
+
+func putPlacement(tx *bolt.Tx, placement []byte) error {
+	if placement == nil {
+		return tx.Bucket(metaBucket).Delete(placementField)
+	}
+	return tx.Bucket(metaBucket).Put(placementField, placement)
+}
+
+func (s *boltStorage) Replace(history map[Alias][]Version, placement []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, historyBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for alias, versions := range history {
+			for _, version := range versions {
+				if err := putVersion(tx, alias, version); err != nil {
+					return err
+				}
+			}
+		}
+		if err := putPlacement(tx, placement); err != nil {
+			return err
+		}
+		return putSaved(tx, 0, nil)
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,122 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// ** STATE DIGEST ** //
+
+// Replicas digest the whole store, history and all, at every checkpoint.
+// Encoding all of it each time gets slower as the history grows, so we
+// keep a hash of each alias' history instead, chained through its
+// versions as they're written, and digest those. We keep the hash of
+// each alias' current keyset too, which is all the Merkle tree needs.
+type historyDigests struct {
+	mu     sync.Mutex
+	chains map[Alias][sha256.Size]byte
+	keys   map[Alias][sha256.Size]byte // see KeySetHash
+	seq    int                         // of the latest version
+}
+
+func chainVersion(previous [sha256.Size]byte, version Version) [sha256.Size]byte {
+	encoded, err := json.Marshal(version)
+	if err != nil {
+		plog.Fatal("Encoding version: " + err.Error())
+	}
+	return sha256.Sum256(append(previous[:], encoded...))
+}
+
+// Starts over from the whole history (when the store's opened or
+// restored).
+func (d *historyDigests) reset(history map[Alias][]Version) {
+	chains := make(map[Alias][sha256.Size]byte, len(history))
+	seq := 0
+	for alias, versions := range history {
+		var chain [sha256.Size]byte
+		for _, version := range versions {
+			chain = chainVersion(chain, version)
+			if version.Seq > seq {
+				seq = version.Seq
+			}
+		}
+		chains[alias] = chain
+	}
+	keys := make(map[Alias][sha256.Size]byte, len(history))
+	for alias, set := range currentKeys(history) {
+		keys[alias] = KeySetHash(set)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.chains, d.keys, d.seq = chains, keys, seq
+}
+
+// Adds versions that were just written.
+func (d *historyDigests) update(versions map[Alias]Version) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for alias, version := range versions {
+		d.chains[alias] = chainVersion(d.chains[alias], version)
+		d.keys[alias] = KeySetHash(version.Keys)
+		if version.Seq > d.seq {
+			d.seq = version.Seq
+		}
+	}
+}
+
+// Starts the aliases over from their whole (new) history, when they've
+// moved here from another shard.
+func (d *historyDigests) replace(history map[Alias][]Version) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for alias, versions := range history {
+		var chain [sha256.Size]byte
+		for _, version := range versions {
+			chain = chainVersion(chain, version)
+			if version.Seq > d.seq {
+				d.seq = version.Seq
+			}
+		}
+		d.chains[alias] = chain
+		if len(versions) > 0 {
+			d.keys[alias] = KeySetHash(versions[len(versions)-1].Keys)
+		}
+	}
+}
+
+// Sorted by alias, so it's the same on every replica.
+func (d *historyDigests) digest() [sha256.Size]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	aliases := make([]Alias, 0, len(d.chains))
+	for alias, _ := range d.chains {
+		aliases = append(aliases, alias)
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i] < aliases[j] })
+	h := sha256.New()
+	for _, alias := range aliases {
+		index, chain := MerkleIndex(alias), d.chains[alias]
+		h.Write(index[:])
+		h.Write(chain[:])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// The Merkle tree over every alias' current keyset, if nothing's been
+// written since seq.
+func (d *historyDigests) tree(seq int) (*merkleTree, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seq < d.seq {
+		return nil, false
+	}
+	leaves := make([]MerkleLeaf, 0, len(d.keys))
+	for alias, hash := range d.keys {
+		leaves = append(leaves, MerkleLeaf{Index: MerkleIndex(alias), Value: hash})
+	}
+	return newMerkleTreeOf(leaves), true
+}
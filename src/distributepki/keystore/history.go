@@ -0,0 +1,85 @@
+package keystore
+
+// ** HISTORY ** //
+
+// Every change to an alias' keyset is kept as a version, so we can say
+// what key it had at some point in the past, not just now.
+
+// What the operations that change keysets are called in the history
+const (
+	OPERATION_INITIAL = "initial" // from the initial keys file
+	OPERATION_CREATE  = "create"
+	OPERATION_UPDATE  = "update"
+	OPERATION_ADD     = "add"
+	OPERATION_REMOVE  = "remove"
+	OPERATION_REVOKE  = "revoke"
+)
+
+// Who signed for a create
+const SIGNER_AUTHORITY string = "authority"
+
+// What an operation says about itself: what it was, when (by the
+// client's clock) and the label of the key that signed for it.
+type Attribution struct {
+	Operation string
+	Timestamp int64
+	Signer    string `json:",omitempty"`
+}
+
+// Operations that go in the history say who made them. Asked before the
+// operation's applied, so it can look at the set as it was.
+type Attributed interface {
+	Attribution(ks *Keystore) Attribution
+}
+
+// An alias' keyset as of one change. Seq is the sequence number the
+// operation committed at (0 for the initial keys).
+type Version struct {
+	Seq int
+	Attribution
+	Keys KeySet
+}
+
+// The alias' versions, oldest first.
+func (ks *Keystore) History(alias Alias) ([]Version, bool) {
+	history, err := ks.storage.History(alias)
+	if err != nil {
+		plog.Errorf("Looking up history of %v: %v", alias, err)
+		return nil, false
+	}
+	return history, len(history) > 0
+}
+
+// The version that was current once sequence number seq had executed.
+func (ks *Keystore) VersionAt(alias Alias, seq int) (Version, bool) {
+	history, _ := ks.History(alias)
+	return latest(history, func(v Version) bool { return v.Seq <= seq })
+}
+
+// The version that was current at timestamp: the last one made before
+// it. Timestamps are the clients', so they needn't be in order; we go
+// by commit order and skip any that are later.
+func (ks *Keystore) VersionAtTime(alias Alias, timestamp int64) (Version, bool) {
+	history, _ := ks.History(alias)
+	return latest(history, func(v Version) bool { return v.Timestamp <= timestamp })
+}
+
+func latest(history []Version, valid func(Version) bool) (Version, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if valid(history[i]) {
+			return history[i], true
+		}
+	}
+	return Version{}, false
+}
+
+// The keysets as of the last version of each alias.
+func currentKeys(history map[Alias][]Version) map[Alias]KeySet {
+	keys := make(map[Alias]KeySet, len(history))
+	for alias, versions := range history {
+		if len(versions) > 0 {
+			keys[alias] = versions[len(versions)-1].Keys
+		}
+	}
+	return keys
+}
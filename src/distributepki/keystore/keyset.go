@@ -0,0 +1,172 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ** KEYSETS ** //
+
+// An alias holds a set of keys (a laptop key, a phone key, an offline
+// backup...), each under its own label. Creates and updates only touch
+// the primary key, so clients that only know about one key per alias
+// don't notice.
+
+type KeyFlags int
+
+const (
+	FLAG_PRIMARY      KeyFlags = 1 << iota // what a plain lookup returns
+	FLAG_BACKUP                            // kept offline, for when the others are lost
+	FLAG_SIGNING_ONLY                      // don't encrypt to it
+)
+
+// Where the key from a create goes
+const DEFAULT_LABEL string = "default"
+
+var (
+	ErrLastKey    = errors.New("Can't remove an alias' last key")
+	ErrAllRevoked = errors.New("Every key for this alias has been revoked")
+)
+
+type KeyRevoked string
+
+func (e KeyRevoked) Error() string {
+	return fmt.Sprintf("Key '%v' has been revoked.", string(e))
+}
+
+type LabelNotFoundError string
+
+func (e LabelNotFoundError) Error() string {
+	return fmt.Sprintf("No key labelled '%v'.", string(e))
+}
+
+type LabelAlreadyExists string
+
+func (e LabelAlreadyExists) Error() string {
+	return fmt.Sprintf("There's already a key labelled '%v'.", string(e))
+}
+
+func (f KeyFlags) String() string {
+	var names []string
+	if f&FLAG_PRIMARY != 0 {
+		names = append(names, "primary")
+	}
+	if f&FLAG_BACKUP != 0 {
+		names = append(names, "backup")
+	}
+	if f&FLAG_SIGNING_ONLY != 0 {
+		names = append(names, "signing-only")
+	}
+	return strings.Join(names, ",")
+}
+
+type LabelledKey struct {
+	Label      string
+	Key        Key
+	Flags      KeyFlags
+	Revocation *Revocation `json:",omitempty"` // nil unless it's been revoked
+}
+
+// Why a key was revoked, when (by the revoker's clock) and which key in
+// the set said so.
+type Revocation struct {
+	Reason    string
+	Timestamp int64
+	Signer    string
+}
+
+func (k LabelledKey) Revoked() bool {
+	return k.Revocation != nil
+}
+
+// Every key an alias has, in label order (so it encodes the same way on
+// every replica).
+type KeySet struct {
+	Keys []LabelledKey
+}
+
+// A new keyset with just this key, as its primary.
+func NewKeySet(key Key) KeySet {
+	return KeySet{Keys: []LabelledKey{{Label: DEFAULT_LABEL, Key: key, Flags: FLAG_PRIMARY}}}
+}
+
+func (s KeySet) Get(label string) (LabelledKey, bool) {
+	for _, key := range s.Keys {
+		if key.Label == label {
+			return key, true
+		}
+	}
+	return LabelledKey{}, false
+}
+
+// The key flagged primary. If none is (it was removed or revoked), the
+// first one that isn't a backup, or failing that the first one. Revoked
+// keys never are, so there's no primary once they all have been.
+func (s KeySet) Primary() (LabelledKey, bool) {
+	return s.unrevoked().primary()
+}
+
+// What the primary key was, revoked or not.
+func (s KeySet) LastPrimary() (LabelledKey, bool) {
+	if primary, ok := s.Primary(); ok {
+		return primary, true
+	}
+	return s.primary()
+}
+
+func (s KeySet) primary() (LabelledKey, bool) {
+	if len(s.Keys) == 0 {
+		return LabelledKey{}, false
+	}
+	for _, key := range s.Keys {
+		if key.Flags&FLAG_PRIMARY != 0 {
+			return key, true
+		}
+	}
+	for _, key := range s.Keys {
+		if key.Flags&FLAG_BACKUP == 0 {
+			return key, true
+		}
+	}
+	return s.Keys[0], true
+}
+
+func (s KeySet) unrevoked() KeySet {
+	keys := make([]LabelledKey, 0, len(s.Keys))
+	for _, key := range s.Keys {
+		if !key.Revoked() {
+			keys = append(keys, key)
+		}
+	}
+	return KeySet{Keys: keys}
+}
+
+// Adds key, or replaces the one with the same label. Only one key can
+// be primary, so if key is, the old one isn't any more.
+func (s KeySet) with(key LabelledKey) KeySet {
+	keys := make([]LabelledKey, 0, len(s.Keys)+1)
+	for _, k := range s.Keys {
+		if k.Label == key.Label {
+			continue
+		}
+		if key.Flags&FLAG_PRIMARY != 0 {
+			k.Flags &^= FLAG_PRIMARY
+		}
+		keys = append(keys, k)
+	}
+	keys = append(keys, key)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Label < keys[j].Label })
+	return KeySet{Keys: keys}
+}
+
+func (s KeySet) without(label string) KeySet {
+	keys := make([]LabelledKey, 0, len(s.Keys))
+	for _, k := range s.Keys {
+		if k.Label != label {
+			keys = append(keys, k)
+		}
+	}
+	return KeySet{Keys: keys}
+}
@@ -0,0 +1,91 @@
+package keystore
+
+import (
+	"testing"
+)
+
+func TestKeySet(t *testing.T) {
+	set := NewKeySet("laptop")
+	set = set.with(LabelledKey{Label: "phone", Key: "phone", Flags: FLAG_PRIMARY})
+	set = set.with(LabelledKey{Label: "backup", Key: "backup", Flags: FLAG_BACKUP})
+	if labels := []string{set.Keys[0].Label, set.Keys[1].Label, set.Keys[2].Label}; labels[0] != "backup" || labels[1] != DEFAULT_LABEL || labels[2] != "phone" {
+		t.Errorf("keys out of order: %v", labels)
+	}
+	// only one key is primary
+	if primary, _ := set.Primary(); primary.Label != "phone" {
+		t.Errorf("primary is %q", primary.Label)
+	}
+	if laptop, _ := set.Get(DEFAULT_LABEL); laptop.Flags&FLAG_PRIMARY != 0 {
+		t.Error("old primary still flagged")
+	}
+	// without one, a plain lookup skips backups
+	set = set.without("phone")
+	if primary, _ := set.Primary(); primary.Label != DEFAULT_LABEL {
+		t.Errorf("primary is %q after removing the phone", primary.Label)
+	}
+}
+
+func TestKeystoreKeySets(t *testing.T) {
+	ks := NewKeystore(&map[string]string{"a@example.com": "laptop"})
+	if err := ks.AddKey("a@example.com", LabelledKey{Label: "backup", Key: "backup", Flags: FLAG_BACKUP}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.AddKey("a@example.com", LabelledKey{Label: "backup", Key: "other"}); err != LabelAlreadyExists("backup") {
+		t.Errorf("adding a duplicate label: %v", err)
+	}
+	if err := ks.AddKey("b@example.com", LabelledKey{Label: "backup", Key: "backup"}); err != AliasNotFoundError("b@example.com") {
+		t.Errorf("adding to a missing alias: %v", err)
+	}
+	// updates only replace the primary key
+	if err := ks.UpdateKey("a@example.com", "new laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, key := ks.LookupKey("a@example.com"); !ok || key != "new laptop" {
+		t.Errorf("lookup after update: %q, %v", key, ok)
+	}
+	set, _ := ks.LookupKeySet("a@example.com")
+	if backup, ok := set.Get("backup"); !ok || backup.Key != "backup" {
+		t.Error("update lost the backup key")
+	}
+	if err := ks.RemoveKey("a@example.com", DEFAULT_LABEL); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.RemoveKey("a@example.com", "backup"); err != ErrLastKey {
+		t.Errorf("removing the last key: %v", err)
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	ks := NewKeystore(&map[string]string{"a@example.com": "laptop"})
+	if err := ks.AddKey("a@example.com", LabelledKey{Label: "phone", Key: "phone"}); err != nil {
+		t.Fatal(err)
+	}
+	revocation := Revocation{Reason: "stolen", Timestamp: 1, Signer: "phone"}
+	if err := ks.RevokeKey("a@example.com", DEFAULT_LABEL, revocation); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.RevokeKey("a@example.com", DEFAULT_LABEL, revocation); err != KeyRevoked(DEFAULT_LABEL) {
+		t.Errorf("revoking twice: %v", err)
+	}
+	// the revoked key's still there, marked, but isn't the primary
+	if laptop, ok := ks.LookupLabelled("a@example.com", DEFAULT_LABEL); !ok || laptop.Revocation == nil || laptop.Revocation.Reason != "stolen" {
+		t.Errorf("revoked key: %+v, %v", laptop, ok)
+	}
+	if ok, key := ks.LookupKey("a@example.com"); !ok || key != "phone" {
+		t.Errorf("lookup after revoking the primary: %q, %v", key, ok)
+	}
+
+	// with nothing left, there's no primary to look up or update
+	if err := ks.RevokeKey("a@example.com", "phone", revocation); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := ks.LookupKey("a@example.com"); ok {
+		t.Error("looked up a revoked key")
+	}
+	if last, ok := ks.LookupLabelled("a@example.com", ""); !ok || last.Label != DEFAULT_LABEL {
+		t.Errorf("last primary: %+v, %v", last, ok)
+	}
+	if err := ks.UpdateKey("a@example.com", "new laptop"); err != ErrAllRevoked {
+		t.Errorf("updating a revoked alias: %v", err)
+	}
+}
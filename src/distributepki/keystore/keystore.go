@@ -1,12 +1,18 @@
 package keystore
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"pbft"
 	"sync"
 	"time"
 
 	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/crypto/openpgp"
 )
 
 var (
@@ -35,6 +41,17 @@ func (e AliasAlreadyExists) Error() string {
 	return fmt.Sprintf("Alias '%v' already exists.", string(e))
 }
 
+var (
+	ErrUnsigned        = errors.New("Operation doesn't say who sent it")
+	ErrWrongSender     = errors.New("Request's client or timestamp isn't the operation's")
+	ErrFutureTimestamp = errors.New("Operation's timestamp is too far ahead of our clock")
+)
+
+// How far ahead of a replica's clock an operation's timestamp can be.
+// Each alias' operations have to have increasing timestamps, so one
+// from far in the future would lock it out until then.
+const MAX_CLOCK_SKEW time.Duration = time.Minute
+
 type SignatureMismatch struct {
 	update KeyUpdate
 	oldKey Key
@@ -45,45 +62,243 @@ func (e SignatureMismatch) Error() string {
 }
 
 type Keystore struct {
-	keys *map[Alias]Key
-	mux  sync.RWMutex
+	storage KeyStorage
+	// what the operation being applied has written, so it all goes to
+	// storage in one write (nil unless we're applying one)
+	pending map[Alias]KeySet
+	// and how it goes in the history
+	applying Version
+	// histories it's brought in from another shard, and where that
+	// leaves the shard (see sharding.go)
+	importing map[Alias][]Version
+	placing   *Placement
+	placement *Placement // nil unless the namespace is sharded
+	mux       sync.Mutex
+	durable   bool // storage outlives us
+
+	fingerprints fingerprintIndex
+	trees        merkleTrees
+	digests      historyDigests
+
+	authorities openpgp.EntityList // who signs creates
+}
+
+// A keystore that saves how far it's current as of along with every
+// write (see pbft.DurableStateMachine).
+type DurableKeystore struct {
+	*Keystore
+}
+
+// Committed operations that modify the store know how to apply
+// themselves (the operation types live in clientapi, which depends
+// on us).
+type Operation interface {
+	ApplyTo(ks *Keystore) error
+}
+
+// Operations that clients sign say who sent them and when, so the
+// request they're ordered in can be checked against it (see
+// CheckRequest).
+type SignedOperation interface {
+	Operation
+	// The client (see AliasClient) and the timestamp (milliseconds)
+	// it was signed with
+	Sender() (client string, timestamp int64)
+}
+
+// Who the cluster thinks an alias' operations come from, so they're
+// ordered (and retried) per alias. Revocations get a client of their
+// own: whatever else gets sent in the alias' name can't hold one up.
+func AliasClient(alias Alias) string {
+	return "alias:" + string(alias)
+}
+
+func RevocationClient(alias Alias) string {
+	return "revoke:" + string(alias)
+}
+
+// Same shape as clientapi.KeyOperation, so gob can decode one into it.
+type operationEnvelope struct {
+	OpCode int
+	Op     interface{}
+	Digest [sha256.Size]byte
 }
 
 func NewKeystore(initial *map[string]string) *Keystore {
-	syncMap := make(map[Alias]Key)
-	for k, v := range *initial {
-		// TODO: figure out a better way to do this
-		syncMap[Alias(k)] = Key(v)
+	ks, err := openKeystore(NewMemoryStorage(), initial)
+	if err != nil {
+		plog.Fatal(err)
+	}
+	return ks
+}
+
+// A keystore kept in a bolt database, that a replica can restart from
+// (see DurableKeystore).
+func OpenKeystore(file string, initial *map[string]string) (*Keystore, error) {
+	storage, err := NewBoltStorage(file)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := openKeystore(storage, initial)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	ks.durable = true
+	return ks, nil
+}
+
+// If storage doesn't know how far it's current as of (it's new, or we
+// were in the middle of restoring a checkpoint), we start over from the
+// initial keys.
+func openKeystore(storage KeyStorage, initial *map[string]string) (*Keystore, error) {
+	seq, _, err := storage.Saved()
+	if err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		history := make(map[Alias][]Version)
+		for k, v := range *initial {
+			history[Alias(k)] = []Version{{
+				Attribution: Attribution{Operation: OPERATION_INITIAL},
+				Keys:        NewKeySet(Key(v)),
+			}}
+		}
+		if err := storage.Replace(history, nil); err != nil {
+			return nil, err
+		}
 	}
-	return &Keystore{keys: &syncMap}
+	history, err := storage.All()
+	if err != nil {
+		return nil, err
+	}
+	placement, err := decodePlacement(storage)
+	if err != nil {
+		return nil, err
+	}
+	ks := &Keystore{storage: storage, placement: placement}
+	ks.fingerprints.reset(currentKeys(history))
+	ks.digests.reset(history)
+	return ks, nil
+}
+
+// What to hand the consensus engine: a DurableKeystore if we're on
+// disk, so a replica only has to catch up on what it missed.
+func (ks *Keystore) StateMachine() pbft.StateMachine {
+	if ks.durable {
+		return DurableKeystore{ks}
+	}
+	return ks
+}
+
+// The authority keys that have to sign creates. Every replica (and
+// observer) needs the same ones, before it starts applying operations.
+func (ks *Keystore) SetAuthorities(authorities openpgp.EntityList) {
+	ks.authorities = authorities
+}
+
+func (ks *Keystore) Authorities() openpgp.EntityList {
+	return ks.authorities
+}
+
+func (ks *Keystore) Close() error {
+	return ks.storage.Close()
 }
 
 func (ks *Keystore) CreateKey(alias Alias, key Key) error {
 	plog.Infof("Storing key for alias %v", alias)
-	ks.mux.Lock()
-	defer ks.mux.Unlock()
-	(*ks.keys)[alias] = key
-	return nil
+	return ks.write(alias, NewKeySet(key))
 }
 
+// Replaces the primary key, and leaves the rest of the set alone.
 func (ks *Keystore) UpdateKey(alias Alias, key Key) error {
 	plog.Infof("Updating key for alias %v", alias)
+	set, ok := ks.current(alias)
+	if !ok {
+		return ks.write(alias, NewKeySet(key))
+	}
+	primary, ok := set.Primary()
+	if !ok {
+		return ErrAllRevoked
+	}
+	primary.Key = key
+	primary.Flags |= FLAG_PRIMARY
+	return ks.write(alias, set.with(primary))
+}
+
+func (ks *Keystore) AddKey(alias Alias, key LabelledKey) error {
+	plog.Infof("Adding key %v (%v) for alias %v", key.Label, key.Flags, alias)
+	set, ok := ks.current(alias)
+	if !ok {
+		return AliasNotFoundError(alias)
+	}
+	if _, ok := set.Get(key.Label); ok {
+		return LabelAlreadyExists(key.Label)
+	}
+	return ks.write(alias, set.with(key))
+}
+
+func (ks *Keystore) RemoveKey(alias Alias, label string) error {
+	plog.Infof("Removing key %v for alias %v", label, alias)
+	set, ok := ks.current(alias)
+	if !ok {
+		return AliasNotFoundError(alias)
+	}
+	if _, ok := set.Get(label); !ok {
+		return LabelNotFoundError(label)
+	}
+	if len(set.Keys) == 1 {
+		return ErrLastKey
+	}
+	return ks.write(alias, set.without(label))
+}
+
+// The alias' keyset, including anything the operation being applied
+// has changed.
+func (ks *Keystore) current(alias Alias) (KeySet, bool) {
+	ks.mux.Lock()
+	set, ok := ks.pending[alias]
+	ks.mux.Unlock()
+	if ok {
+		return set, true
+	}
+	return ks.LookupKeySet(alias)
+}
+
+// Adds to the operation being applied, or writes straight through if
+// there isn't one (and then there's nothing to say in the history about
+// where it came from).
+func (ks *Keystore) write(alias Alias, set KeySet) error {
 	ks.mux.Lock()
 	defer ks.mux.Unlock()
-	(*ks.keys)[alias] = key
+	if err := ks.owns(alias); err != nil {
+		return err
+	}
+	if ks.pending != nil {
+		ks.pending[alias] = set
+		return nil
+	}
+	version := map[Alias]Version{alias: {Keys: set}}
+	if err := ks.storage.Write(Batch{Versions: version}, 0, nil); err != nil {
+		return err
+	}
+	ks.fingerprints.update(map[Alias]KeySet{alias: set})
+	ks.digests.update(version)
 	return nil
 }
 
+// The alias' primary key (see KeySet.Primary), if it has one that
+// hasn't been revoked.
 func (ks *Keystore) LookupKey(alias Alias) (bool, Key) {
 	/*
 		plog.Infof("Keystore Query for Alias: %v", alias)
 		ks.store.Propose("Lookup", clientMessage)
 	*/
 	plog.Info("Load ", alias)
-	ks.mux.RLock()
-	defer ks.mux.RUnlock()
-	if key, ok := (*ks.keys)[alias]; ok {
-		return true, key
+	if set, ok := ks.LookupKeySet(alias); ok {
+		if primary, ok := set.Primary(); ok {
+			return true, primary.Key
+		}
 	}
 	return false, Key("")
 
@@ -99,21 +314,200 @@ func (ks *Keystore) LookupKey(alias Alias) (bool, Key) {
 	*/
 }
 
-func (s *Keystore) GetSnapshot() ([]byte, error) {
-	// s.mu.Lock()
-	// defer s.mu.Unlock()
-	return json.Marshal(*s.keys)
+func (ks *Keystore) LookupKeySet(alias Alias) (KeySet, bool) {
+	set, ok, err := ks.storage.Lookup(alias)
+	if err != nil {
+		plog.Errorf("Looking up %v: %v", alias, err)
+		return KeySet{}, false
+	}
+	return set, ok
+}
+
+// ** pbft.StateMachine ** //
+
+// Applies a committed (gob-encoded) key operation. The result is
+// empty on success, or the error message otherwise.
+func (ks *Keystore) Apply(seq int, request string) string {
+	return ks.applyDurably(seq, request, nil)
 }
 
-func (ks *Keystore) ApplySnapshot(snapshot *[]byte) error {
-	// s.mu.Lock()
-	// defer s.mu.Unlock()
+// Writes everything the operation changed in one go, along with seq
+// and the replica's state if there is one. Without it, storage no
+// longer knows how far it's current as of.
+func (ks *Keystore) applyDurably(seq int, request string, replica func(result string) []byte) string {
 	ks.mux.Lock()
-	defer ks.mux.Unlock()
-	var keys map[Alias]Key
-	if err := json.Unmarshal(*snapshot, &keys); err != nil {
+	ks.pending = make(map[Alias]KeySet)
+	ks.importing = make(map[Alias][]Version)
+	ks.mux.Unlock()
+	result := ks.apply(seq, request)
+	ks.mux.Lock()
+	writes, imported, placed := ks.pending, ks.importing, ks.placing
+	versions := make(map[Alias]Version, len(writes))
+	for alias, set := range writes {
+		version := ks.applying
+		version.Keys = set
+		versions[alias] = version
+	}
+	ks.pending, ks.importing, ks.placing, ks.applying = nil, nil, nil, Version{}
+	ks.mux.Unlock()
+	batch := Batch{Versions: versions, Histories: imported}
+	if placed != nil {
+		var err error
+		if batch.Placement, err = json.Marshal(placed); err != nil {
+			plog.Fatalf("Encoding shard placement at sequence number %d: %v", seq, err)
+		}
+	}
+	saveSeq, saved := 0, []byte(nil)
+	if replica != nil {
+		saveSeq, saved = seq, replica(result)
+	}
+	if err := ks.storage.Write(batch, saveSeq, saved); err != nil {
+		plog.Fatalf("Writing keys at sequence number %d: %v", seq, err)
+	}
+	if placed != nil {
+		ks.mux.Lock()
+		ks.placement = placed
+		ks.mux.Unlock()
+	}
+	ks.fingerprints.update(currentKeys(imported))
+	ks.fingerprints.update(writes)
+	ks.digests.replace(imported)
+	ks.digests.update(versions)
+	return result
+}
+
+func decodeOperation(request string) (int, Operation, error) {
+	var envelope operationEnvelope
+	if err := gob.NewDecoder(bytes.NewReader([]byte(request))).Decode(&envelope); err != nil {
+		return 0, nil, err
+	}
+	op, ok := envelope.Op.(Operation)
+	if !ok {
+		return envelope.OpCode, nil, fmt.Errorf("Operation %d doesn't modify the keystore", envelope.OpCode)
+	}
+	return envelope.OpCode, op, nil
+}
+
+func (ks *Keystore) apply(seq int, request string) string {
+	opCode, op, err := decodeOperation(request)
+	if err != nil {
+		plog.Error(err)
+		return err.Error()
+	}
+	plog.Infof("Applying operation %d at sequence number %d", opCode, seq)
+	applying := Version{Seq: seq}
+	if attributed, ok := op.(Attributed); ok {
+		applying.Attribution = attributed.Attribution(ks)
+	}
+	ks.mux.Lock()
+	ks.applying = applying
+	ks.mux.Unlock()
+	if err := op.ApplyTo(ks); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// ** pbft.RequestChecker ** //
+
+// The request has to be filed under the client and timestamp its
+// operation was signed with. (Whether the signature's any good depends
+// on the store, so that's up to ApplyTo; a retry has to get through
+// here to get its cached reply.)
+func (ks *Keystore) CheckRequest(request pbft.Request) error {
+	_, op, err := decodeOperation(request.Operation)
+	if err != nil {
+		return err
+	}
+	signed, ok := op.(SignedOperation)
+	if !ok {
+		return ErrUnsigned
+	}
+	if client, timestamp := signed.Sender(); request.Client != client || request.Timestamp != timestamp {
+		return ErrWrongSender
+	}
+	return nil
+}
+
+// As well as that, we don't take on anything from too far in the future.
+func (ks *Keystore) AdmitRequest(request pbft.Request, now time.Time) error {
+	if err := ks.CheckRequest(request); err != nil {
 		return err
 	}
-	ks.keys = &keys
+	if request.Timestamp > (now.UnixNano()+int64(MAX_CLOCK_SKEW))/int64(time.Millisecond) {
+		return ErrFutureTimestamp
+	}
 	return nil
 }
+
+// ** pbft.DurableStateMachine ** //
+
+func (ks DurableKeystore) ApplyDurably(seq int, request string, replica func(result string) []byte) string {
+	return ks.applyDurably(seq, request, replica)
+}
+
+func (ks DurableKeystore) Save(seq int, replica []byte) error {
+	return ks.storage.Save(seq, replica)
+}
+
+func (ks DurableKeystore) Saved() (int, []byte, error) {
+	return ks.storage.Saved()
+}
+
+// Every alias' whole history, not just its current keys, and the
+// shard placement if there is one.
+type keystoreSnapshot struct {
+	History   map[Alias][]Version
+	Placement *Placement `json:",omitempty"`
+}
+
+func (ks *Keystore) Snapshot() ([]byte, error) {
+	history, err := ks.storage.All()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := keystoreSnapshot{History: history}
+	if placement, ok := ks.Placement(); ok {
+		snapshot.Placement = &placement
+	}
+	return json.Marshal(snapshot)
+}
+
+func (ks *Keystore) Restore(data []byte) error {
+	var snapshot keystoreSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	var placement []byte
+	if snapshot.Placement != nil {
+		var err error
+		if placement, err = json.Marshal(snapshot.Placement); err != nil {
+			return err
+		}
+	}
+	if err := ks.storage.Replace(snapshot.History, placement); err != nil {
+		return err
+	}
+	ks.mux.Lock()
+	ks.placement = snapshot.Placement
+	ks.mux.Unlock()
+	ks.fingerprints.reset(currentKeys(snapshot.History))
+	ks.trees.reset()
+	ks.digests.reset(snapshot.History)
+	return nil
+}
+
+// Kept up to date as versions are written (see digest.go). The shard
+// placement's in it too, so replicas agree on who owns what.
+func (ks *Keystore) StateDigest() [sha256.Size]byte {
+	digest := ks.digests.digest()
+	placement, ok := ks.Placement()
+	if !ok {
+		return digest
+	}
+	encoded, err := json.Marshal(placement)
+	if err != nil {
+		plog.Fatal("Encoding shard placement: " + err.Error())
+	}
+	return sha256.Sum256(append(digest[:], encoded...))
+}
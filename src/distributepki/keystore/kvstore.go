@@ -1,30 +1,33 @@
-// Copyright 2015 The etcd Authors
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-//     http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
 package keystore
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"pbft"
 	"sync"
+	"time"
 )
 
-// a key-value store backed by raft
+// Whatever orders the store's writes: a *pbft.PBFTNode, or any of
+// distributepki's consensus engines.
+type Proposer interface {
+	Id() pbft.NodeId
+	Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal
+}
+
+// a key-value store replicated by a cluster
 type Kvstore struct {
 	mu            sync.RWMutex
 	kvStore       map[string]string // current committed key-value pairs
-	consensusNode *pbft.PBFTNode
+	consensusNode Proposer
+
+	// we're the client as far as the cluster is concerned
+	clientId      string
+	lastTimestamp int64
 }
 
 type kv struct {
@@ -32,18 +35,30 @@ type kv struct {
 	Val string
 }
 
-func NewKVStore(node *pbft.PBFTNode, initialStore map[string]string) *Kvstore {
+// The store has to exist before the node that replicates it, so
+// hook the two up with SetConsensusNode once the node has started.
+func NewKVStore(initialStore map[string]string) *Kvstore {
 	if initialStore == nil {
 		initialStore = make(map[string]string)
 	}
-	s := &Kvstore{kvStore: initialStore, consensusNode: node}
+	return &Kvstore{kvStore: initialStore}
+}
 
-	// XXX: this is necessary for Raft, but not PBFT right now, fix it to work with both
-	// replay log into key-value map
-	// s.readCommits(node)
-	// read commits from cluster into kvStore map until error
-	go s.readCommits(node)
-	return s
+func (s *Kvstore) SetConsensusNode(node Proposer) {
+	s.consensusNode = node
+	s.clientId = fmt.Sprintf("kvstore-%d", node.Id())
+}
+
+// Request timestamps have to keep going up, even if the clock doesn't.
+func (s *Kvstore) nextTimestamp() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timestamp := time.Now().UnixNano()
+	if timestamp <= s.lastTimestamp {
+		timestamp = s.lastTimestamp + 1
+	}
+	s.lastTimestamp = timestamp
+	return timestamp
 }
 
 func (s *Kvstore) Get(key string) (string, bool) {
@@ -53,59 +68,41 @@ func (s *Kvstore) Get(key string) (string, bool) {
 	return v, ok
 }
 
-func (s *Kvstore) Put(k, v string) {
-	// var buf bytes.Buffer
-	// if err := gob.NewEncoder(&buf).Encode(kv{k, v}); err != nil {
-	// 	plog.Fatal(err)
-	// }
-	// s.consensusNode.Propose(0, buf.String())
+// Proposes the write; it shows up in Get once the proposal resolves.
+func (s *Kvstore) Put(ctx context.Context, k, v string) *pbft.Proposal {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(kv{k, v}); err != nil {
+		plog.Fatal(err)
+	}
+	return s.consensusNode.Propose(ctx, &pbft.Request{
+		Client:    s.clientId,
+		Timestamp: s.nextTimestamp(),
+		Operation: buf.String(),
+	})
 }
 
-func (s *Kvstore) readCommits(node *pbft.PBFTNode) {
-	// for data := range node.Committed() {
-	// 	if data == nil {
-	// 		// done replaying log; new data incoming
-	// 		// OR signaled to load snapshot
-	// 		// snapshot, err := s.snapshotter.Load()
-	// 		snapshot, err := node.GetCheckpoint()
-	// 		if err == snap.ErrNoSnapshot {
-	// 			return
-	// 		}
-	// 		if err != nil && err != snap.ErrNoSnapshot {
-	// 			plog.Panic(err)
-	// 		}
-	// 		r_snapshot, ok := snapshot.(*raftpb.Snapshot)
-	// 		if !ok {
-	// 			plog.Panic("Incorrectly-typed snapshot")
-	// 		}
-	// 		plog.Printf("loading snapshot at term %d and index %d", r_snapshot.Metadata.Term, r_snapshot.Metadata.Index)
-	// 		if err := s.recoverFromSnapshot(r_snapshot.Data); err != nil {
-	// 			plog.Panic(err)
-	// 		}
-	// 		continue
-	// 	}
+// ** pbft.StateMachine ** //
 
-	// 	var dataKv kv
-	// 	dec := gob.NewDecoder(bytes.NewBufferString(*data))
-	// 	if err := dec.Decode(&dataKv); err != nil {
-	// 		plog.Fatalf("raftexample: could not decode message (%v)", err)
-	// 	}
-	// 	s.mu.Lock()
-	// 	s.kvStore[dataKv.Key] = dataKv.Val
-	// 	s.mu.Unlock()
-	// }
-	// if err, ok := <-node.Failure(); ok {
-	// 	plog.Fatal(err)
-	// }
+func (s *Kvstore) Apply(seq int, request string) string {
+	var dataKv kv
+	dec := gob.NewDecoder(bytes.NewBufferString(request))
+	if err := dec.Decode(&dataKv); err != nil {
+		plog.Errorf("kvstore: could not decode message (%v)", err)
+		return err.Error()
+	}
+	s.mu.Lock()
+	s.kvStore[dataKv.Key] = dataKv.Val
+	s.mu.Unlock()
+	return ""
 }
 
-func (s *Kvstore) GetSnapshot() ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Kvstore) Snapshot() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return json.Marshal(s.kvStore)
 }
 
-func (s *Kvstore) ApplySnapshot(snapshot []byte) error {
+func (s *Kvstore) Restore(snapshot []byte) error {
 	var store map[string]string
 	if err := json.Unmarshal(snapshot, &store); err != nil {
 		return err
@@ -115,3 +112,11 @@ func (s *Kvstore) ApplySnapshot(snapshot []byte) error {
 	s.mu.Unlock()
 	return nil
 }
+
+func (s *Kvstore) StateDigest() [sha256.Size]byte {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		plog.Fatal(err)
+	}
+	return sha256.Sum256(snapshot)
+}
@@ -0,0 +1,327 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ** MERKLE PREFIX TREE ** //
+
+// A CONIKS-style binary prefix tree over aliases. Each alias sits at the
+// path given by the bits of its index (the hash of the alias), as high
+// up as it can go: a leaf is the only alias under its prefix, and
+// everything else is interior nodes and empty subtrees. A leaf commits
+// to the alias' whole keyset. Replicas sign the root at every
+// checkpoint (see pbft.AuthenticatedStateMachine), so a lookup can come
+// with a proof that the keyset is (or isn't) what the cluster agreed
+// on.
+//
+// Unlike CONIKS, the index is a plain hash rather than a VRF, so a proof
+// doesn't hide which aliases exist.
+
+// How many checkpoints' trees we keep around for proofs. Older ones can
+// still be rebuilt from the history.
+const MERKLE_TREES_KEPT int = 3
+
+const MERKLE_DEPTH int = sha256.Size * 8
+
+// Domain separation, so nodes of one kind can't pass for another
+const (
+	merkleEmpty    byte = 0x00
+	merkleLeaf     byte = 0x01
+	merkleInterior byte = 0x02
+)
+
+var (
+	ErrProofMismatch  = errors.New("Merkle proof doesn't match the root")
+	ErrProofMalformed = errors.New("Malformed Merkle proof")
+)
+
+// Where the path ends: a leaf, and the keyset it commits to (by hash).
+type MerkleLeaf struct {
+	Index [sha256.Size]byte
+	Value [sha256.Size]byte
+}
+
+// The hashes of the siblings along an alias' path, from the root down,
+// and the leaf the path ends at (nil if it ends at an empty subtree).
+// Proves an alias' keyset is in the tree if the leaf is the alias', or
+// that it isn't if the leaf belongs to some other alias or there's no
+// leaf at all.
+type MerkleProof struct {
+	Siblings [][sha256.Size]byte
+	Leaf     *MerkleLeaf `json:",omitempty"`
+}
+
+func MerkleIndex(alias Alias) [sha256.Size]byte {
+	return sha256.Sum256([]byte(alias))
+}
+
+// What a leaf commits to. The keys in a set are sorted, so this is the
+// same on every replica.
+func KeySetHash(set KeySet) [sha256.Size]byte {
+	encoded, err := json.Marshal(set)
+	if err != nil {
+		plog.Fatal("Encoding keyset: " + err.Error())
+	}
+	return sha256.Sum256(encoded)
+}
+
+func bit(index [sha256.Size]byte, depth int) byte {
+	return (index[depth/8] >> uint(7-depth%8)) & 1
+}
+
+// The first depth bits of index, and zeroes after.
+func prefix(index [sha256.Size]byte, depth int) [sha256.Size]byte {
+	var masked [sha256.Size]byte
+	copy(masked[:depth/8], index[:depth/8])
+	if depth%8 != 0 {
+		masked[depth/8] = index[depth/8] & ^byte(0xff>>uint(depth%8))
+	}
+	return masked
+}
+
+func depthBytes(depth int) []byte {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, uint32(depth))
+	return encoded
+}
+
+func emptyHash(index [sha256.Size]byte, depth int) [sha256.Size]byte {
+	masked := prefix(index, depth)
+	return hashOf(merkleEmpty, depthBytes(depth), masked[:])
+}
+
+func leafHash(leaf MerkleLeaf, depth int) [sha256.Size]byte {
+	return hashOf(merkleLeaf, depthBytes(depth), leaf.Index[:], leaf.Value[:])
+}
+
+func interiorHash(left, right [sha256.Size]byte) [sha256.Size]byte {
+	return hashOf(merkleInterior, left[:], right[:])
+}
+
+func hashOf(kind byte, parts ...[]byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{kind})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Checks the proof against root, for alias: that set is its keyset, or
+// if set is nil, that it isn't in the tree at all.
+func (p MerkleProof) Verify(root [sha256.Size]byte, alias Alias, set *KeySet) error {
+	index := MerkleIndex(alias)
+	depth := len(p.Siblings)
+	if depth > MERKLE_DEPTH {
+		return ErrProofMalformed
+	}
+	var hash [sha256.Size]byte
+	switch {
+	case set != nil:
+		if p.Leaf == nil || p.Leaf.Index != index || p.Leaf.Value != KeySetHash(*set) {
+			return ErrProofMismatch
+		}
+		hash = leafHash(*p.Leaf, depth)
+	case p.Leaf == nil:
+		hash = emptyHash(index, depth)
+	default:
+		// somebody else's leaf, where ours would have been
+		if p.Leaf.Index == index || prefix(p.Leaf.Index, depth) != prefix(index, depth) {
+			return ErrProofMismatch
+		}
+		hash = leafHash(*p.Leaf, depth)
+	}
+	for d := depth - 1; d >= 0; d-- {
+		if bit(index, d) == 0 {
+			hash = interiorHash(hash, p.Siblings[d])
+		} else {
+			hash = interiorHash(p.Siblings[d], hash)
+		}
+	}
+	if hash != root {
+		return ErrProofMismatch
+	}
+	return nil
+}
+
+// ** BUILDING THE TREE ** //
+
+// nil is an empty subtree.
+type merkleNode struct {
+	hash        [sha256.Size]byte
+	left, right *merkleNode
+	leaf        *MerkleLeaf
+}
+
+type merkleTree struct {
+	root *merkleNode
+}
+
+func newMerkleTree(keys map[Alias]KeySet) *merkleTree {
+	leaves := make([]MerkleLeaf, 0, len(keys))
+	for alias, set := range keys {
+		leaves = append(leaves, MerkleLeaf{Index: MerkleIndex(alias), Value: KeySetHash(set)})
+	}
+	return newMerkleTreeOf(leaves)
+}
+
+func newMerkleTreeOf(leaves []MerkleLeaf) *merkleTree {
+	sort.Slice(leaves, func(i, j int) bool {
+		return string(leaves[i].Index[:]) < string(leaves[j].Index[:])
+	})
+	return &merkleTree{root: buildMerkle(leaves, 0)}
+}
+
+// leaves are sorted, and share their first depth bits.
+func buildMerkle(leaves []MerkleLeaf, depth int) *merkleNode {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return &merkleNode{hash: leafHash(leaves[0], depth), leaf: &leaves[0]}
+	}
+	split := sort.Search(len(leaves), func(i int) bool { return bit(leaves[i].Index, depth) == 1 })
+	node := &merkleNode{
+		left:  buildMerkle(leaves[:split], depth+1),
+		right: buildMerkle(leaves[split:], depth+1),
+	}
+	left := prefix(leaves[0].Index, depth)
+	right := flip(left, depth)
+	node.hash = interiorHash(node.left.hashAt(left, depth+1), node.right.hashAt(right, depth+1))
+	return node
+}
+
+// index is anywhere under the node, for empty subtrees.
+func (n *merkleNode) hashAt(index [sha256.Size]byte, depth int) [sha256.Size]byte {
+	if n == nil {
+		return emptyHash(index, depth)
+	}
+	return n.hash
+}
+
+func (t *merkleTree) rootHash() [sha256.Size]byte {
+	return t.root.hashAt([sha256.Size]byte{}, 0)
+}
+
+func (t *merkleTree) prove(alias Alias) MerkleProof {
+	index := MerkleIndex(alias)
+	var proof MerkleProof
+	node := t.root
+	for depth := 0; node != nil && node.leaf == nil; depth++ {
+		var sibling [sha256.Size]byte
+		if bit(index, depth) == 0 {
+			sibling = node.right.hashAt(flip(index, depth), depth+1)
+			node = node.left
+		} else {
+			sibling = node.left.hashAt(flip(index, depth), depth+1)
+			node = node.right
+		}
+		proof.Siblings = append(proof.Siblings, sibling)
+	}
+	if node != nil {
+		leaf := *node.leaf
+		proof.Leaf = &leaf
+	}
+	return proof
+}
+
+func flip(index [sha256.Size]byte, depth int) [sha256.Size]byte {
+	index[depth/8] ^= 0x80 >> uint(depth%8)
+	return index
+}
+
+// ** KEYSTORE ** //
+
+// The last few checkpoints' trees, by sequence number.
+type merkleTrees struct {
+	mu    sync.Mutex
+	trees map[int]*merkleTree
+}
+
+// They're no good once the history's been replaced.
+func (t *merkleTrees) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.trees = nil
+}
+
+// The tree over every alias' keyset as of seq, built from the history
+// if we don't have it.
+func (ks *Keystore) treeAt(seq int) (*merkleTree, error) {
+	ks.trees.mu.Lock()
+	tree, ok := ks.trees.trees[seq]
+	ks.trees.mu.Unlock()
+	if ok {
+		return tree, nil
+	}
+	history, err := ks.storage.All()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[Alias]KeySet, len(history))
+	for alias, versions := range history {
+		if version, ok := latest(versions, func(v Version) bool { return v.Seq <= seq }); ok {
+			keys[alias] = version.Keys
+		}
+	}
+	tree = newMerkleTree(keys)
+	ks.trees.add(seq, tree)
+	return tree, nil
+}
+
+func (t *merkleTrees) add(seq int, tree *merkleTree) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trees == nil {
+		t.trees = make(map[int]*merkleTree)
+	}
+	t.trees[seq] = tree
+	for len(t.trees) > MERKLE_TREES_KEPT {
+		oldest := seq
+		for s, _ := range t.trees {
+			if s < oldest {
+				oldest = s
+			}
+		}
+		delete(t.trees, oldest)
+	}
+}
+
+// The alias' keyset as of sequence number seq (nil if it didn't have
+// one), and the proof of it against the root as of seq.
+func (ks *Keystore) Prove(alias Alias, seq int) (*KeySet, MerkleProof, error) {
+	tree, err := ks.treeAt(seq)
+	if err != nil {
+		return nil, MerkleProof{}, err
+	}
+	var set *KeySet
+	if version, ok := ks.VersionAt(alias, seq); ok {
+		set = &version.Keys
+	}
+	return set, tree.prove(alias), nil
+}
+
+// ** pbft.AuthenticatedStateMachine ** //
+
+// At checkpoints the store's as of seq, so the tree's built from the
+// keyset hashes we keep up to date (see digest.go), not the history.
+func (ks *Keystore) StateRoot(seq int) [sha256.Size]byte {
+	tree, ok := ks.digests.tree(seq)
+	if ok {
+		ks.trees.add(seq, tree)
+		return tree.rootHash()
+	}
+	tree, err := ks.treeAt(seq)
+	if err != nil {
+		plog.Fatalf("Building Merkle tree at sequence number %d: %v", seq, err)
+	}
+	return tree.rootHash()
+}
@@ -0,0 +1,103 @@
+package keystore
+
+import (
+	"fmt"
+	"pbft"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	initial := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		initial[fmt.Sprintf("user%d@example.com", i)] = fmt.Sprintf("key %d", i)
+	}
+	ks := NewKeystore(&initial)
+	authenticated, ok := ks.StateMachine().(pbft.AuthenticatedStateMachine)
+	if !ok {
+		t.Fatal("keystore doesn't have a state root")
+	}
+	root := authenticated.StateRoot(0)
+	if other := NewKeystore(&initial).StateRoot(0); other != root {
+		t.Fatal("same keys, different roots")
+	}
+
+	for alias, _ := range initial {
+		set, proof, err := ks.Prove(Alias(alias), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set == nil {
+			t.Fatalf("%s: no keyset", alias)
+		}
+		if err := proof.Verify(root, Alias(alias), set); err != nil {
+			t.Errorf("%s: %v", alias, err)
+		}
+		// the proof's no good for a different keyset, or alias
+		forged := set.with(LabelledKey{Label: "evil", Key: "evil"})
+		if err := proof.Verify(root, Alias(alias), &forged); err != ErrProofMismatch {
+			t.Errorf("%s: forged keyset: %v", alias, err)
+		}
+		if err := proof.Verify(root, "mallory@example.com", set); err != ErrProofMismatch {
+			t.Errorf("%s: proved for another alias: %v", alias, err)
+		}
+		// nor to say it isn't there
+		if err := proof.Verify(root, Alias(alias), nil); err != ErrProofMismatch {
+			t.Errorf("%s: proved missing: %v", alias, err)
+		}
+	}
+
+	// missing aliases end at an empty subtree or somebody else's leaf
+	var empty, other int
+	for i := 0; i < 50; i++ {
+		alias := Alias(fmt.Sprintf("nobody%d@example.com", i))
+		set, proof, err := ks.Prove(alias, 0)
+		if err != nil || set != nil {
+			t.Fatalf("%s: %v, %v", alias, set, err)
+		}
+		if err := proof.Verify(root, alias, nil); err != nil {
+			t.Errorf("%s: %v", alias, err)
+		}
+		if proof.Leaf == nil {
+			empty++
+		} else {
+			other++
+		}
+	}
+	if empty == 0 || other == 0 {
+		t.Errorf("only tried %d empty subtrees and %d other leaves", empty, other)
+	}
+
+	// restoring a snapshot gets the same root
+	restored := NewKeystore(&map[string]string{})
+	snapshot, _ := ks.Snapshot()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if restored.StateRoot(0) != root {
+		t.Error("restored keystore has a different root")
+	}
+
+	// a later change gets a new root, and the old one still checks out
+	if result := restored.Apply(4, testOperationAt(t, "user0@example.com", "new key", 1)); result != "" {
+		t.Fatal(result)
+	}
+	newRoot := restored.StateRoot(4)
+	if newRoot == root || restored.StateRoot(3) != root {
+		t.Error("roots don't follow the history")
+	}
+	set, proof, _ := restored.Prove("user0@example.com", 3)
+	if err := proof.Verify(root, "user0@example.com", set); err != nil {
+		t.Errorf("proof as of an old checkpoint: %v", err)
+	}
+}
+
+func TestEmptyMerkleTree(t *testing.T) {
+	ks := NewKeystore(&map[string]string{})
+	set, proof, err := ks.Prove("a@example.com", 0)
+	if err != nil || set != nil {
+		t.Fatal(set, err)
+	}
+	if err := proof.Verify(ks.StateRoot(0), "a@example.com", nil); err != nil {
+		t.Error(err)
+	}
+}
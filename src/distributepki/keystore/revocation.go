@@ -0,0 +1,145 @@
+package keystore
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** REVOCATION ** //
+
+// A revoked key stays in its alias' set, so anyone who looks it up can
+// see that (and why), but it's never the primary key and can't sign for
+// the set any more. Revoking is for good: a new key needs a new label.
+
+func (ks *Keystore) RevokeKey(alias Alias, label string, revocation Revocation) error {
+	plog.Infof("Revoking key %v for alias %v (%v)", label, alias, revocation.Reason)
+	set, ok := ks.current(alias)
+	if !ok {
+		return AliasNotFoundError(alias)
+	}
+	key, ok := set.Get(label)
+	if !ok {
+		return LabelNotFoundError(label)
+	}
+	if key.Revoked() {
+		return KeyRevoked(label)
+	}
+	key.Revocation = &revocation
+	return ks.write(alias, set.with(key))
+}
+
+// The key labelled label, or the alias' primary key if label is empty,
+// whether or not it's been revoked. If every key has been, that's the
+// one that was primary.
+func (ks *Keystore) LookupLabelled(alias Alias, label string) (LabelledKey, bool) {
+	set, ok := ks.LookupKeySet(alias)
+	if !ok {
+		return LabelledKey{}, false
+	}
+	if label == "" {
+		return set.LastPrimary()
+	}
+	return set.Get(label)
+}
+
+// ** FINGERPRINTS ** //
+
+// The hex fingerprint of an armored public key's primary key.
+func Fingerprint(key Key) (string, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(string(key)))
+	if err != nil {
+		return "", err
+	}
+	if len(keyring) == 0 {
+		return "", errors.New("No keys in keyring")
+	}
+	return hex.EncodeToString(keyring[0].PrimaryKey.Fingerprint[:]), nil
+}
+
+// Lower case, without the spaces gpg puts in.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, " ", "", -1))
+}
+
+// Where a key with some fingerprint is
+type FingerprintMatch struct {
+	Alias Alias
+	LabelledKey
+}
+
+// Every key with this fingerprint (the same key can be in more than one
+// set), as it is now.
+func (ks *Keystore) LookupFingerprint(fingerprint string) []FingerprintMatch {
+	refs := ks.fingerprints.lookup(NormalizeFingerprint(fingerprint))
+	matches := make([]FingerprintMatch, 0, len(refs))
+	for _, ref := range refs {
+		if key, ok := ks.LookupLabelled(ref.alias, ref.label); ok {
+			matches = append(matches, FingerprintMatch{Alias: ref.alias, LabelledKey: key})
+		}
+	}
+	return matches
+}
+
+type keyRef struct {
+	alias Alias
+	label string
+}
+
+// Fingerprint -> keys, kept in memory and rebuilt when we open or
+// restore. Keys that aren't armored public keys aren't in it.
+type fingerprintIndex struct {
+	mu      sync.RWMutex
+	keys    map[string][]keyRef
+	aliases map[Alias][]string // what to take out when the alias changes
+}
+
+func (idx *fingerprintIndex) lookup(fingerprint string) []keyRef {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return append([]keyRef(nil), idx.keys[fingerprint]...)
+}
+
+func (idx *fingerprintIndex) reset(keys map[Alias]KeySet) {
+	idx.mu.Lock()
+	idx.keys = make(map[string][]keyRef)
+	idx.aliases = make(map[Alias][]string)
+	idx.mu.Unlock()
+	idx.update(keys)
+}
+
+func (idx *fingerprintIndex) update(keys map[Alias]KeySet) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.keys == nil {
+		idx.keys = make(map[string][]keyRef)
+		idx.aliases = make(map[Alias][]string)
+	}
+	for alias, set := range keys {
+		for _, fingerprint := range idx.aliases[alias] {
+			refs := idx.keys[fingerprint][:0]
+			for _, ref := range idx.keys[fingerprint] {
+				if ref.alias != alias {
+					refs = append(refs, ref)
+				}
+			}
+			if len(refs) == 0 {
+				delete(idx.keys, fingerprint)
+			} else {
+				idx.keys[fingerprint] = refs
+			}
+		}
+		delete(idx.aliases, alias)
+		for _, key := range set.Keys {
+			fingerprint, err := Fingerprint(key.Key)
+			if err != nil {
+				continue
+			}
+			idx.keys[fingerprint] = append(idx.keys[fingerprint], keyRef{alias, key.Label})
+			idx.aliases[alias] = append(idx.aliases[alias], fingerprint)
+		}
+	}
+}
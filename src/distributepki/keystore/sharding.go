@@ -0,0 +1,278 @@
+package keystore
+
+import (
+	"distributepki/shard"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** SHARDING ** //
+
+// In a sharded namespace (see the shard package) a store only takes
+// writes for the aliases its shard owns, under the map it's applied.
+// A newer map is an operation like any other (see ChangeShardMap), so
+// every replica switches at the same point in the log, and the shards
+// giving aliases up stop taking writes for them right there. The
+// aliases coming our way stay frozen until their history arrives: the
+// old owner exports it (once it's switched, so it can't change any
+// more), the authority signs that, and we apply it (ImportShard).
+//
+// Versions go up one at a time, and a shard has to have everything
+// it's waiting on before it takes the next map, so nothing's ever
+// moving two ways at once.
+
+var (
+	ErrNotSharded      = errors.New("Store isn't sharded")
+	ErrNotApplying     = errors.New("Shard changes have to go through the log")
+	ErrWrongShard      = errors.New("Alias belongs to another shard")
+	ErrMoving          = errors.New("Alias is moving here from another shard, and hasn't arrived yet")
+	ErrStillMoving     = errors.New("Aliases from the last shard map change haven't all arrived yet")
+	ErrShardMapVersion = errors.New("Shard map isn't the next version")
+	ErrBadExport       = errors.New("Export isn't one we're waiting for")
+	ErrExportSignature = errors.New("Export isn't signed by the authority")
+)
+
+// Map changes are ordered on their own, by version (see CheckRequest),
+// and so are each shard's exports.
+const SHARD_MAP_CLIENT string = "shardmap"
+
+func ImportClient(from shard.ShardId) string {
+	return "import:" + strconv.Itoa(int(from))
+}
+
+// Which shard the store is, and where it's up to.
+type Placement struct {
+	Shard    shard.ShardId
+	Map      shard.SignedShardMap
+	Previous *shard.ShardMap `json:",omitempty"` // the map before Map (nil if we started on it)
+	Waiting  []shard.ShardId `json:",omitempty"` // shards whose aliases haven't arrived yet, in order
+}
+
+func (p Placement) waitingOn(id shard.ShardId) bool {
+	for _, waiting := range p.Waiting {
+		if waiting == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The aliases one shard gives another with a map version (all of the
+// ones it has, that is), every version of each.
+type ShardExport struct {
+	Version int
+	From    shard.ShardId
+	To      shard.ShardId
+	History map[Alias][]Version
+}
+
+type SignedShardExport struct {
+	Export    ShardExport
+	Signature []byte
+}
+
+func (e ShardExport) Sign(authority *openpgp.Entity) (*SignedShardExport, error) {
+	signature, err := shard.SignJSON(e, authority)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedShardExport{Export: e, Signature: signature}, nil
+}
+
+func (s *SignedShardExport) Verify(authorities openpgp.EntityList) error {
+	if err := shard.VerifyJSON(s.Export, s.Signature, authorities); err != nil {
+		return ErrExportSignature
+	}
+	return nil
+}
+
+func decodePlacement(storage KeyStorage) (*Placement, error) {
+	data, err := storage.Placement()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	placement := new(Placement)
+	if err := json.Unmarshal(data, placement); err != nil {
+		return nil, err
+	}
+	return placement, nil
+}
+
+// Starts a sharded store off on signed (which the caller's checked),
+// unless it's kept a placement from before. Every replica has to start
+// on the same one, before it applies anything.
+func (ks *Keystore) Place(id shard.ShardId, signed shard.SignedShardMap) error {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	if ks.placement != nil {
+		if ks.placement.Shard != id {
+			return ErrWrongShard
+		}
+		return nil
+	}
+	placement := &Placement{Shard: id, Map: signed}
+	data, err := json.Marshal(placement)
+	if err != nil {
+		return err
+	}
+	if err := ks.storage.Place(data); err != nil {
+		return err
+	}
+	ks.placement = placement
+	return nil
+}
+
+// As of the last operation applied.
+func (ks *Keystore) Placement() (Placement, bool) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	if ks.placement == nil {
+		return Placement{}, false
+	}
+	return *ks.placement, true
+}
+
+// Including whatever the operation being applied has changed. (The
+// caller holds mux.)
+func (ks *Keystore) currentPlacement() *Placement {
+	if ks.placing != nil {
+		return ks.placing
+	}
+	return ks.placement
+}
+
+// Whether the store can write to alias. (The caller holds mux.)
+func (ks *Keystore) owns(alias Alias) error {
+	placement := ks.currentPlacement()
+	if placement == nil {
+		return nil
+	}
+	if placement.Map.Map.ShardFor(string(alias)) != placement.Shard {
+		return ErrWrongShard
+	}
+	if placement.Previous == nil {
+		return nil
+	}
+	if from := placement.Previous.ShardFor(string(alias)); from != placement.Shard && placement.waitingOn(from) {
+		return ErrMoving
+	}
+	return nil
+}
+
+// Whether alias is on its way here, and from where.
+func (ks *Keystore) Moving(alias Alias) (shard.ShardId, bool) {
+	placement, ok := ks.Placement()
+	if !ok || placement.Previous == nil || placement.Map.Map.ShardFor(string(alias)) != placement.Shard {
+		return 0, false
+	}
+	from := placement.Previous.ShardFor(string(alias))
+	return from, from != placement.Shard && placement.waitingOn(from)
+}
+
+// Moves to the next version of the map (signed by the authority). From
+// here on we only take writes for what it gives us, and not for what's
+// coming from elsewhere until it's arrived.
+func (ks *Keystore) ChangeShardMap(signed shard.SignedShardMap) error {
+	if err := signed.Verify(ks.authorities); err != nil {
+		return err
+	}
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	if ks.pending == nil {
+		return ErrNotApplying
+	}
+	current := ks.currentPlacement()
+	if current == nil {
+		return ErrNotSharded
+	}
+	if signed.Map.Version != current.Map.Map.Version+1 {
+		return ErrShardMapVersion
+	}
+	if len(current.Waiting) > 0 {
+		return ErrStillMoving
+	}
+	previous := current.Map.Map
+	ks.placing = &Placement{
+		Shard:    current.Shard,
+		Map:      signed,
+		Previous: &previous,
+		Waiting:  shard.Sources(previous, signed.Map, current.Shard),
+	}
+	return nil
+}
+
+// What we're giving shard to with the current map. Only the aliases
+// we owned before are in it; they've been frozen since we switched.
+func (ks *Keystore) Export(to shard.ShardId) (ShardExport, error) {
+	placement, ok := ks.Placement()
+	if !ok {
+		return ShardExport{}, ErrNotSharded
+	}
+	export := ShardExport{
+		Version: placement.Map.Map.Version,
+		From:    placement.Shard,
+		To:      to,
+		History: make(map[Alias][]Version),
+	}
+	if placement.Previous == nil || to == placement.Shard {
+		return export, nil
+	}
+	history, err := ks.storage.All()
+	if err != nil {
+		return ShardExport{}, err
+	}
+	for alias, versions := range history {
+		if placement.Previous.ShardFor(string(alias)) == placement.Shard && placement.Map.Map.ShardFor(string(alias)) == to {
+			export.History[alias] = versions
+		}
+	}
+	return export, nil
+}
+
+// Takes in the aliases another shard's given us (signed by the
+// authority), and unfreezes them. Their versions from before all go in
+// our history at the import's sequence number, since the old owner's
+// numbers mean nothing in our log.
+func (ks *Keystore) ImportShard(signed SignedShardExport) error {
+	if err := signed.Verify(ks.authorities); err != nil {
+		return err
+	}
+	export := signed.Export
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	if ks.pending == nil {
+		return ErrNotApplying
+	}
+	current := ks.currentPlacement()
+	if current == nil {
+		return ErrNotSharded
+	}
+	if export.To != current.Shard || export.Version != current.Map.Map.Version || !current.waitingOn(export.From) {
+		return ErrBadExport
+	}
+	for alias, _ := range export.History {
+		if current.Previous.ShardFor(string(alias)) != export.From || current.Map.Map.ShardFor(string(alias)) != current.Shard {
+			return ErrBadExport
+		}
+	}
+	for alias, versions := range export.History {
+		imported := make([]Version, len(versions))
+		for i, version := range versions {
+			version.Seq = ks.applying.Seq
+			imported[i] = version
+		}
+		ks.importing[alias] = imported
+	}
+	next := *current
+	next.Waiting = nil
+	for _, waiting := range current.Waiting {
+		if waiting != export.From {
+			next.Waiting = append(next.Waiting, waiting)
+		}
+	}
+	ks.placing = &next
+	return nil
+}
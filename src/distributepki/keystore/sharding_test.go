@@ -0,0 +1,165 @@
+package keystore
+
+import (
+	"bytes"
+	"distributepki/shard"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Stand in for clientapi.ChangeShardMap and ImportShard.
+type testShardMap struct {
+	Map shard.SignedShardMap
+}
+
+func (c testShardMap) ApplyTo(ks *Keystore) error {
+	return ks.ChangeShardMap(c.Map)
+}
+
+type testImport struct {
+	Export SignedShardExport
+}
+
+func (i testImport) ApplyTo(ks *Keystore) error {
+	return ks.ImportShard(i.Export)
+}
+
+func init() {
+	gob.Register(testShardMap{})
+	gob.Register(testImport{})
+}
+
+func testEnvelope(t *testing.T, op Operation) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(operationEnvelope{OpCode: 7, Op: op}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func testShardMapVersion(t *testing.T, authority *openpgp.Entity, version int, domains map[string]shard.ShardId) shard.SignedShardMap {
+	m := shard.ShardMap{
+		Version: version,
+		Shards: []shard.Shard{
+			{Id: 1, Endpoints: []string{"http://localhost:8001"}},
+			{Id: 2, Endpoints: []string{"http://localhost:9001"}},
+		},
+		Domains: domains,
+	}
+	signed, err := m.Sign(authority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *signed
+}
+
+func TestShardMove(t *testing.T) {
+	authority, err := openpgp.NewEntity("authority", "", "authority@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.db")
+	var ks *Keystore
+	apply := func(seq int, request string) string {
+		return DurableKeystore{ks}.ApplyDurably(seq, request, func(string) []byte { return nil })
+	}
+
+	// Shard 1, about to be given two.com
+	if ks, err = OpenKeystore(file, &map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	ks.SetAuthorities(openpgp.EntityList{authority})
+	v1 := testShardMapVersion(t, authority, 1, map[string]shard.ShardId{"one.com": 1, "two.com": 2})
+	if err := ks.Place(1, v1); err != nil {
+		t.Fatal(err)
+	}
+	if result := apply(1, testOperation(t, "a@two.com", "a")); result != ErrWrongShard.Error() {
+		t.Errorf("Creating another shard's alias: %q", result)
+	}
+	before := ks.StateDigest()
+
+	// Maps only come through the log, one version at a time
+	v2 := testShardMapVersion(t, authority, 2, map[string]shard.ShardId{"one.com": 1, "two.com": 1})
+	if err := ks.ChangeShardMap(v2); err != ErrNotApplying {
+		t.Errorf("Changing the map outside the log: %v", err)
+	}
+	v3 := testShardMapVersion(t, authority, 3, map[string]shard.ShardId{"one.com": 2, "two.com": 1})
+	if result := apply(2, testEnvelope(t, testShardMap{v3})); result != ErrShardMapVersion.Error() {
+		t.Errorf("Skipping a version: %q", result)
+	}
+	if result := apply(3, testEnvelope(t, testShardMap{v2})); result != "" {
+		t.Fatal(result)
+	}
+	if ks.StateDigest() == before {
+		t.Error("Changing the map didn't change the digest")
+	}
+
+	// two.com's frozen until shard 2's export arrives, and so is the map
+	if result := apply(4, testOperation(t, "a@two.com", "a")); result != ErrMoving.Error() {
+		t.Errorf("Creating an alias that's moving: %q", result)
+	}
+	if result := apply(5, testEnvelope(t, testShardMap{v3})); result != ErrStillMoving.Error() {
+		t.Errorf("Changing the map mid move: %q", result)
+	}
+
+	// which still comes back after a restart
+	ks.Close()
+	if ks, err = OpenKeystore(file, &map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	ks.SetAuthorities(openpgp.EntityList{authority})
+	if err := ks.Place(1, v1); err != nil {
+		t.Fatal(err)
+	}
+	if from, moving := ks.Moving("a@two.com"); !moving || from != 2 {
+		t.Fatalf("After restarting, a@two.com moving from %d: %v", from, moving)
+	}
+
+	history := []Version{{Seq: 40, Attribution: Attribution{Operation: OPERATION_CREATE, Timestamp: 7}, Keys: NewKeySet("old")}}
+	export := ShardExport{Version: 2, From: 2, To: 1, History: map[Alias][]Version{"a@two.com": history}}
+	wrong := export
+	wrong.History = map[Alias][]Version{"a@one.com": history}
+	for _, e := range []ShardExport{wrong, {Version: 1, From: 2, To: 1}} {
+		signed, _ := e.Sign(authority)
+		if result := apply(6, testEnvelope(t, testImport{*signed})); result != ErrBadExport.Error() {
+			t.Errorf("Importing %+v: %q", e, result)
+		}
+	}
+	signed, _ := export.Sign(authority)
+	if result := apply(7, testEnvelope(t, testImport{*signed})); result != "" {
+		t.Fatal(result)
+	}
+	if versions, _ := ks.History("a@two.com"); len(versions) != 1 || versions[0].Seq != 7 || versions[0].Timestamp != 7 {
+		t.Errorf("Imported history: %+v", versions)
+	}
+	if result := apply(8, testOperation(t, "b@two.com", "b")); result != "" {
+		t.Errorf("Creating an alias once it's arrived: %q", result)
+	}
+
+	// The placement goes with snapshots too
+	snapshot, err := ks.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewKeystore(&map[string]string{})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if placement, ok := restored.Placement(); !ok || placement.Map.Map.Version != 2 || len(placement.Waiting) != 0 {
+		t.Errorf("Restored placement %+v, %v", placement, ok)
+	}
+	if restored.StateDigest() != ks.StateDigest() {
+		t.Error("Restored store has a different digest")
+	}
+}
@@ -0,0 +1,139 @@
+package keystore
+
+import (
+	"sync"
+)
+
+// ** STORAGE ** //
+
+// Where a Keystore keeps its keysets, and every version of them (see
+// history.go). Every write also records how far the keys are current
+// as of (the sequence number, and whatever the replica wants saved with
+// it; see pbft.DurableStateMachine), all or nothing, so a node that
+// restarts can tell exactly where it left off.
+type KeyStorage interface {
+	// The alias' current keyset
+	Lookup(alias Alias) (KeySet, bool, error)
+	// Every version of the alias' keyset, oldest first
+	History(alias Alias) ([]Version, error)
+	// Writes the batch, and records seq and replica, atomically. A seq
+	// of 0 means we no longer know how far the keys are current as of.
+	Write(batch Batch, seq int, replica []byte) error
+	// Records seq and replica, without changing any keys.
+	Save(seq int, replica []byte) error
+	Saved() (int, []byte, error)
+	// Every alias' history
+	All() (map[Alias][]Version, error)
+	// The shard placement (see sharding.go), nil if there isn't one
+	Placement() ([]byte, error)
+	// Replaces the placement, and nothing else.
+	Place(placement []byte) error
+	// Replaces every alias' history and the placement, and forgets what
+	// was saved.
+	Replace(history map[Alias][]Version, placement []byte) error
+	Close() error
+}
+
+// Everything one operation changes.
+type Batch struct {
+	Versions  map[Alias]Version   // added to each alias' history (making its keys current)
+	Histories map[Alias][]Version // replace each alias' history (it's moved here from another shard)
+	Placement []byte              // replaces the placement, if it isn't nil
+}
+
+// Keeps everything in a map, so a restarted node starts over.
+type memoryStorage struct {
+	mu        sync.RWMutex
+	history   map[Alias][]Version
+	placement []byte
+	seq       int
+	replica   []byte
+}
+
+func NewMemoryStorage() KeyStorage {
+	return &memoryStorage{history: make(map[Alias][]Version)}
+}
+
+func (s *memoryStorage) Lookup(alias Alias) (KeySet, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.history[alias]
+	if len(versions) == 0 {
+		return KeySet{}, false, nil
+	}
+	return versions[len(versions)-1].Keys, true, nil
+}
+
+func (s *memoryStorage) History(alias Alias) ([]Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Version(nil), s.history[alias]...), nil
+}
+
+func (s *memoryStorage) Write(batch Batch, seq int, replica []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for alias, versions := range batch.Histories {
+		s.history[alias] = append([]Version(nil), versions...)
+	}
+	for alias, version := range batch.Versions {
+		s.history[alias] = append(s.history[alias], version)
+	}
+	if batch.Placement != nil {
+		s.placement = batch.Placement
+	}
+	s.seq, s.replica = seq, replica
+	return nil
+}
+
+func (s *memoryStorage) Save(seq int, replica []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq, s.replica = seq, replica
+	return nil
+}
+
+func (s *memoryStorage) Saved() (int, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq, s.replica, nil
+}
+
+func (s *memoryStorage) All() (map[Alias][]Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := make(map[Alias][]Version, len(s.history))
+	for alias, versions := range s.history {
+		history[alias] = append([]Version(nil), versions...)
+	}
+	return history, nil
+}
+
+func (s *memoryStorage) Placement() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.placement, nil
+}
+
+func (s *memoryStorage) Place(placement []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.placement = placement
+	return nil
+}
+
+func (s *memoryStorage) Replace(history map[Alias][]Version, placement []byte) error {
+	replaced := make(map[Alias][]Version, len(history))
+	for alias, versions := range history {
+		replaced[alias] = append([]Version(nil), versions...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history, s.placement = replaced, placement
+	s.seq, s.replica = 0, nil
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,237 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pbft"
+	"testing"
+)
+
+// Stands in for clientapi.Create, which we can't import from here.
+type testCreate struct {
+	Alias     Alias
+	Key       Key
+	Timestamp int64
+}
+
+func (c testCreate) ApplyTo(ks *Keystore) error {
+	return ks.CreateKey(c.Alias, c.Key)
+}
+
+func (c testCreate) Attribution(ks *Keystore) Attribution {
+	return Attribution{Operation: OPERATION_CREATE, Timestamp: c.Timestamp, Signer: SIGNER_AUTHORITY}
+}
+
+func init() {
+	gob.Register(testCreate{})
+}
+
+func testOperation(t *testing.T, alias Alias, key Key) string {
+	return testOperationAt(t, alias, key, 0)
+}
+
+func testOperationAt(t *testing.T, alias Alias, key Key, timestamp int64) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(operationEnvelope{OpCode: 1, Op: testCreate{alias, key, timestamp}}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestMemoryKeystore(t *testing.T) {
+	ks := NewKeystore(&map[string]string{"a@example.com": "a"})
+	if _, ok := ks.StateMachine().(pbft.DurableStateMachine); ok {
+		t.Error("an in-memory keystore shouldn't claim to be durable")
+	}
+	if result := ks.Apply(2, testOperation(t, "b@example.com", "b")); result != "" {
+		t.Fatal(result)
+	}
+	for alias, want := range map[Alias]Key{"a@example.com": "a", "b@example.com": "b"} {
+		if ok, key := ks.LookupKey(alias); !ok || key != want {
+			t.Errorf("%s: got %q, %v", alias, key, ok)
+		}
+	}
+}
+
+func TestDurableKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.db")
+	initial := map[string]string{"a@example.com": "a"}
+
+	ks, err := OpenKeystore(file, &initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	durable, ok := ks.StateMachine().(pbft.DurableStateMachine)
+	if !ok {
+		t.Fatal("a keystore on disk should be durable")
+	}
+	result := durable.ApplyDurably(5, testOperation(t, "b@example.com", "b"), func(result string) []byte {
+		return []byte("replica:" + result)
+	})
+	if result != "" {
+		t.Fatal(result)
+	}
+	ks.Close()
+
+	// the keys and how far they're current as of come back together
+	if ks, err = OpenKeystore(file, &initial); err != nil {
+		t.Fatal(err)
+	}
+	if ok, key := ks.LookupKey("b@example.com"); !ok || key != "b" {
+		t.Errorf("b@example.com: got %q, %v", key, ok)
+	}
+	durable = ks.StateMachine().(pbft.DurableStateMachine)
+	if seq, replica, err := durable.Saved(); err != nil || seq != 5 || string(replica) != "replica:" {
+		t.Errorf("saved %d, %q, %v", seq, replica, err)
+	}
+
+	// restoring forgets where we were, until the replica says
+	snapshot, err := ks.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _, _ := durable.Saved(); seq != 0 {
+		t.Errorf("still saved as of %d after restoring", seq)
+	}
+	ks.Close()
+
+	// so if we'd stopped there, we start over
+	if ks, err = OpenKeystore(file, &initial); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	if ok, _ := ks.LookupKey("b@example.com"); ok {
+		t.Error("started from a half restored store")
+	}
+	if ok, key := ks.LookupKey("a@example.com"); !ok || key != "a" {
+		t.Errorf("a@example.com: got %q, %v", key, ok)
+	}
+}
+
+func TestStateDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.db")
+	initial := map[string]string{"a@example.com": "a"}
+
+	ks, err := OpenKeystore(file, &initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	durable := ks.StateMachine().(pbft.DurableStateMachine)
+	before := ks.StateDigest()
+	for seq, key := range []Key{"a2", "a3"} {
+		if result := durable.ApplyDurably(seq+1, testOperationAt(t, "a@example.com", key, int64(seq)), func(string) []byte { return nil }); result != "" {
+			t.Fatal(result)
+		}
+	}
+	digest := ks.StateDigest()
+	if digest == before {
+		t.Error("digest didn't change with the history")
+	}
+	snapshot, err := ks.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Close()
+
+	// it's the same however we got the history: reopening it, or
+	// restoring it on another replica
+	if ks, err = OpenKeystore(file, &initial); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	if ks.StateDigest() != digest {
+		t.Error("reopened keystore has a different digest")
+	}
+	restored := NewKeystore(&map[string]string{})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if restored.StateDigest() != digest {
+		t.Error("restored keystore has a different digest")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.db")
+	initial := map[string]string{"a@example.com": "a"}
+
+	ks, err := OpenKeystore(file, &initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	durable := ks.StateMachine().(pbft.DurableStateMachine)
+	// in order, like the log would
+	for _, change := range []struct {
+		seq int
+		key Key
+	}{{3, "a2"}, {7, "a3"}} {
+		if result := durable.ApplyDurably(change.seq, testOperationAt(t, "a@example.com", change.key, int64(change.seq*10)), func(string) []byte { return nil }); result != "" {
+			t.Fatal(result)
+		}
+	}
+	ks.Close()
+
+	// it's all still there after a restart
+	if ks, err = OpenKeystore(file, &initial); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	history, _ := ks.History("a@example.com")
+	if len(history) != 3 || history[0].Operation != OPERATION_INITIAL || history[2].Seq != 7 || history[2].Signer != SIGNER_AUTHORITY {
+		t.Fatalf("history: %+v", history)
+	}
+	primary := func(v Version) Key {
+		key, _ := v.Keys.Primary()
+		return key.Key
+	}
+	for seq, want := range map[int]Key{0: "a", 2: "a", 3: "a2", 6: "a2", 100: "a3"} {
+		if v, ok := ks.VersionAt("a@example.com", seq); !ok || primary(v) != want {
+			t.Errorf("at sequence number %d: %q, %v", seq, primary(v), ok)
+		}
+	}
+	for timestamp, want := range map[int64]Key{0: "a", 45: "a2", 70: "a3"} {
+		if v, ok := ks.VersionAtTime("a@example.com", timestamp); !ok || primary(v) != want {
+			t.Errorf("at time %d: %q, %v", timestamp, primary(v), ok)
+		}
+	}
+	if _, ok := ks.VersionAt("b@example.com", 100); ok {
+		t.Error("found a version of a missing alias")
+	}
+
+	// and it goes along with snapshots
+	snapshot, err := ks.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewKeystore(&map[string]string{})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := restored.VersionAt("a@example.com", 5); !ok || primary(v) != "a2" || v.Timestamp != 30 {
+		t.Errorf("restored version: %+v, %v", v, ok)
+	}
+	if restored.StateDigest() != ks.StateDigest() {
+		t.Error("restored keystore has a different digest")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"distributepki/clientapi"
 	"distributepki/keystore"
+	"distributepki/shard"
 	"distributepki/util"
 	"encoding/gob"
 	"encoding/json"
@@ -13,6 +15,8 @@ import (
 	"os/exec"
 	"os/signal"
 	"pbft"
+	"syscall"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 )
@@ -21,6 +25,9 @@ var (
 	log = capnslog.NewPackageLogger("github.com/sydli/distributePKI", "main")
 )
 
+// How long we give a node to drain in-flight requests on shutdown.
+const SHUTDOWN_TIMEOUT time.Duration = time.Duration(5 * time.Second)
+
 func logFatal(e error) {
 	if e != nil {
 		log.Fatal(e)
@@ -40,11 +47,7 @@ func LoadConfig(filename string) pbft.ClusterConfig {
 func LoadConfigSubset(filename string, num int) pbft.ClusterConfig {
 	config := LoadConfig(filename)
 	config.Nodes = config.Nodes[0:num]
-	return pbft.ClusterConfig{
-		Nodes:            config.Nodes[0:num],
-		AuthorityKeyFile: config.AuthorityKeyFile,
-		Endpoint:         config.Endpoint,
-	}
+	return config
 }
 
 func LoadInitialKeys(filename string, config *pbft.ClusterConfig) map[string]string {
@@ -80,12 +83,35 @@ func main() {
 	debug := flag.Bool("debug", false, "with cluster flag, enables debugging. without cluster flag, starts debugging repl")
 	id := flag.Int("id", 1, "Node ID to start")
 	keystoreFile := flag.String("keys", "keys.json", "Initial keys in store")
+	operatorKey := flag.String("operatorkey", "", "with debug flag, PGP private key to sign admin commands with")
+	operatorPassPhrase := flag.String("operatorpassphrase", "", "passphrase file for operatorkey")
+	engine := flag.String("engine", ENGINE_PBFT, "Consensus engine: pbft, raft, scp, or dev (single node, for development)")
+	shardMapFile := flag.String("shardmap", "", "Signed shard map, if the namespace is sharded")
+	shardId := flag.Int("shard", 0, "with shardmap flag, which shard this cluster is")
+	signShardMap := flag.String("signshardmap", "", "Sign this (unsigned) shard map with the authority key, and print it")
+	authorityKey := flag.String("authoritykey", "", "with signshardmap flag, the authority's PGP private key")
+	authorityPassPhrase := flag.String("authoritypassphrase", "", "passphrase file for authoritykey")
+	signExport := flag.String("signexport", "", "Sign this shard export (from GET /shardmap/export) with the authority key, and print it")
 	flag.Parse()
 
+	if *signShardMap != "" {
+		SignShardMap(*signShardMap, *authorityKey, *authorityPassPhrase)
+		return
+	}
+	if *signExport != "" {
+		SignShardExport(*signExport, *authorityKey, *authorityPassPhrase)
+		return
+	}
+
 	// Register Gob types
 	gob.Register(clientapi.Create{})
 	gob.Register(clientapi.Update{})
 	gob.Register(clientapi.Lookup{})
+	gob.Register(clientapi.AddKey{})
+	gob.Register(clientapi.RemoveKey{})
+	gob.Register(clientapi.Revoke{})
+	gob.Register(clientapi.ChangeShardMap{})
+	gob.Register(clientapi.ImportShard{})
 	var config pbft.ClusterConfig
 	if *num == 0 {
 		config = LoadConfig(*configFile)
@@ -95,23 +121,26 @@ func main() {
 	initialKeyTable := LoadInitialKeys(*keystoreFile, &config)
 
 	if *cluster {
-		StartCluster(&initialKeyTable, &config, make(chan struct{}), *debug)
+		StartCluster(&initialKeyTable, &config, make(chan struct{}), *debug, *engine, *shardMapFile, *shardId)
 	} else if *debug {
-		StartDebugRepl(&config)
+		StartDebugRepl(&config, *operatorKey, *operatorPassPhrase)
 	} else {
-		StartNode(pbft.NodeId(*id), &initialKeyTable, &config)
+		StartNode(pbft.NodeId(*id), &initialKeyTable, &config, *engine, *shardMapFile, shard.ShardId(*shardId))
 	}
 }
 
-func StartCluster(initialKeyTable *map[string]string, cluster *pbft.ClusterConfig, shutdown chan struct{}, debug bool) {
+func StartCluster(initialKeyTable *map[string]string, cluster *pbft.ClusterConfig, shutdown chan struct{}, debug bool, engine string, shardMapFile string, shardId int) {
 	var nodeProcesses []*exec.Cmd
-	for _, n := range cluster.Nodes {
+	for _, n := range append(append([]pbft.NodeConfig(nil), cluster.Nodes...), cluster.Observers...) {
 		id := n.Id
 		if debug {
 			// TODO (sydli): Take debug flag into account
 		}
 		cmd := exec.Command("./distributepki", "-id", fmt.Sprintf("%d", id), "-num",
-			fmt.Sprintf("%d", len(cluster.Nodes)))
+			fmt.Sprintf("%d", len(cluster.Nodes)), "-engine", engine)
+		if shardMapFile != "" {
+			cmd.Args = append(cmd.Args, "-shardmap", shardMapFile, "-shard", fmt.Sprintf("%d", shardId))
+		}
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		cmd.Dir = "."
@@ -122,38 +151,138 @@ func StartCluster(initialKeyTable *map[string]string, cluster *pbft.ClusterConfi
 		}
 		nodeProcesses = append(nodeProcesses, cmd)
 	}
-	// If we get Ctrl+C, kill all subprocesses
+	// If we get Ctrl+C, shut down all subprocesses
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	select {
 	case <-c:
 	case <-shutdown:
 	}
 	for i, cmd := range nodeProcesses {
-		log.Infof("Kill process %d", i)
-		cmd.Process.Kill()
+		log.Infof("Stop process %d", i)
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	// Give them a chance to shut down cleanly before killing them.
+	for i, cmd := range nodeProcesses {
+		exited := make(chan struct{})
+		go func(cmd *exec.Cmd) {
+			cmd.Wait()
+			close(exited)
+		}(cmd)
+		select {
+		case <-exited:
+		case <-time.After(SHUTDOWN_TIMEOUT):
+			log.Infof("Kill process %d", i)
+			cmd.Process.Kill()
+		}
 	}
 }
 
-func StartNode(id pbft.NodeId, initialKeyTable *map[string]string, cluster *pbft.ClusterConfig) {
+// Reads an unsigned shard map, and prints it signed by the authority.
+func SignShardMap(filename string, authorityKey string, passPhraseFile string) {
+	data, err := ioutil.ReadFile(filename)
+	logFatal(err)
+	var m shard.ShardMap
+	logFatal(json.Unmarshal(data, &m))
+	logFatal(m.Validate())
+	authority, err := pbft.ReadPrivateKey(authorityKey, passPhraseFile)
+	logFatal(err)
+	signed, err := m.Sign(authority)
+	logFatal(err)
+	out, err := json.MarshalIndent(signed, "", "  ")
+	logFatal(err)
+	fmt.Println(string(out))
+}
+
+// Reads what one shard's giving another, and prints it signed by the
+// authority. (Check it against what the shard's other nodes say first.)
+func SignShardExport(filename string, authorityKey string, passPhraseFile string) {
+	data, err := ioutil.ReadFile(filename)
+	logFatal(err)
+	var export keystore.ShardExport
+	logFatal(json.Unmarshal(data, &export))
+	authority, err := pbft.ReadPrivateKey(authorityKey, passPhraseFile)
+	logFatal(err)
+	signed, err := export.Sign(authority)
+	logFatal(err)
+	out, err := json.MarshalIndent(signed, "", "  ")
+	logFatal(err)
+	fmt.Println(string(out))
+}
+
+func StartNode(id pbft.NodeId, initialKeyTable *map[string]string, cluster *pbft.ClusterConfig, engine string, shardMapFile string, shardId shard.ShardId) {
 	var thisNode pbft.NodeConfig
 	for _, n := range cluster.Nodes {
 		if n.Id == id {
 			thisNode = n
 		}
 	}
+	for _, n := range cluster.Observers {
+		if n.Id == id {
+			thisNode = n
+			engine = ENGINE_OBSERVER
+		}
+	}
+
+	var store *keystore.Keystore
+	if thisNode.StoreFile != "" {
+		var err error
+		if store, err = keystore.OpenKeystore(thisNode.StoreFile, initialKeyTable); err != nil {
+			log.Fatalf("Node %d couldn't open %s: %v", id, thisNode.StoreFile, err)
+		}
+		defer store.Close()
+	} else {
+		store = keystore.NewKeystore(initialKeyTable)
+	}
 
-	store := keystore.NewKeystore(initialKeyTable)
+	if shardMapFile != "" {
+		// (unless the store's moved on from it already)
+		authorities, err := util.ReadPgpKeyFile(cluster.AuthorityKeyFile)
+		if err != nil {
+			log.Fatalf("Node %d couldn't read the authority keys: %v", id, err)
+		}
+		signed, err := shard.LoadSignedShardMap(shardMapFile, authorities)
+		if err != nil {
+			log.Fatalf("Node %d couldn't load shard map %s: %v", id, shardMapFile, err)
+		}
+		if err := store.Place(shardId, *signed); err != nil {
+			log.Fatalf("Node %d couldn't start on shard %d: %v", id, shardId, err)
+		}
+	}
 
-	log.Infof("Starting node %d (%s)...", id, util.GetHostname(thisNode.Host, thisNode.Port))
-	node := SpawnKeyNode(thisNode, cluster, store)
+	log.Infof("Starting node %d (%s) with the %s engine...", id, util.GetHostname(thisNode.Host, thisNode.Port), engine)
+	node := SpawnKeyNode(thisNode, cluster, store, engine)
 	if node == nil {
 		log.Fatalf("Node %d failed to start.", id)
 		return
 	}
 	log.Infof("Node %d started successfully!", id)
 
-	node.StartClientServer(thisNode.ClientPort)
+	if shardMapFile != "" {
+		router, err := NewShardRouter(store)
+		if err != nil {
+			log.Fatalf("Node %d couldn't route for shard %d: %v", id, shardId, err)
+		}
+		node.router = router
+		log.Infof("Node %d serving shard %d", id, shardId)
+	}
+
+	if err := node.StartClientServer(thisNode.ClientPort); err != nil {
+		log.Fatalf("Node %d couldn't start client server: %v", id, err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-c:
+		log.Infof("Node %d received %v, shutting down...", id, sig)
+	case err := <-node.engine.Failure():
+		log.Errorf("Node %d failed: %v", id, err)
+	}
 
-	<-node.consensusNode.Failure()
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := node.Stop(ctx); err != nil {
+		log.Errorf("Node %d didn't shut down cleanly: %v", id, err)
+	}
 }
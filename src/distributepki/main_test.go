@@ -28,7 +28,7 @@ func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
 
 func startCluster(cluster *pbft.ClusterConfig, shutdown chan struct{}) {
 	initialKeyTable := LoadInitialKeys("keys.json", cluster)
-	StartCluster(&initialKeyTable, cluster, shutdown, true)
+	StartCluster(&initialKeyTable, cluster, shutdown, true, ENGINE_PBFT, "", 0)
 }
 
 func getNode(node int) *pbft.NodeConfig {
@@ -208,6 +208,32 @@ func TestConcurrentWrites(t *testing.T) {
 	concurrentPutHelper(t, 5)
 }
 
+func TestStatus(t *testing.T) {
+	primaries := 0
+	view := -1
+	for i := range cluster.Nodes {
+		status, err := getStatus(&cluster, &cluster.Nodes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, status.Id, cluster.Nodes[i].Id, "")
+		if status.Down || status.ViewChangeInProgress {
+			continue
+		}
+		if view == -1 {
+			view = status.ViewNumber
+		}
+		assertEqual(t, status.ViewNumber, view, "nodes disagree on view")
+		if status.Primary {
+			primaries++
+		}
+		if status.LowWatermark >= status.HighWatermark {
+			t.Fatalf("node %d has bad watermarks (%d, %d]", status.Id, status.LowWatermark, status.HighWatermark)
+		}
+	}
+	assertEqual(t, primaries, 1, "expected exactly one primary")
+}
+
 // ** BENCHMARKING ** //
 
 // cluster config for cluster of any size~
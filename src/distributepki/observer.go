@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"pbft"
+	"time"
+)
+
+// ** OBSERVERS ** //
+
+// An observer (see pbft/observer.go) as far as KeyNode's concerned: an
+// engine that can't order anything, but keeps the store up to date and
+// can say what it's current as of.
+type observerEngine struct {
+	*pbft.Observer
+	cluster pbft.ClusterConfig
+	failure chan error
+}
+
+// Observers that can prove what their store is current as of
+type observedEngine interface {
+	Read(read func()) pbft.ObserverProof
+}
+
+// What GET /?name=<alias>&proof=true returns on an observer.
+type ObservedKey struct {
+	Key   string
+	Proof pbft.ObserverProof
+}
+
+var ErrReadOnly = errors.New("Observers don't take writes; send it to a replica")
+
+func startObserverEngine(id pbft.NodeId, cluster pbft.ClusterConfig, app pbft.StateMachine) (*observerEngine, error) {
+	observer, err := pbft.StartObserver(id, cluster, app)
+	if err != nil {
+		return nil, err
+	}
+	return &observerEngine{observer, cluster, make(chan error)}, nil
+}
+
+func (e *observerEngine) Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal {
+	digest, _ := request.Digest()
+	p := pbft.NewProposal(digest)
+	p.Resolve(pbft.ProposalResult{}, ErrReadOnly)
+	return p
+}
+
+func (e *observerEngine) RetryAfter(err error) time.Duration {
+	return 0
+}
+
+func (e *observerEngine) Members() []pbft.NodeId {
+	return clusterMembers(e.cluster)
+}
+
+func (e *observerEngine) Status() interface{} {
+	return e.Observer.Status()
+}
+
+func (e *observerEngine) Down() bool {
+	return false
+}
+
+func (e *observerEngine) Failure() <-chan error {
+	return e.failure
+}
+
+func (e *observerEngine) Stop(ctx context.Context) error {
+	e.Observer.Stop()
+	return nil
+}
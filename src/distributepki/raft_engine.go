@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"distributepki/util"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"pbft"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/pkg/capnslog"
+)
+
+// ** RAFT ** //
+
+// Crash fault tolerant ordering with etcd's raft library: a cluster of
+// 2f+1 survives f nodes crashing, but (unlike PBFT) trusts every node
+// to follow the protocol. Nodes talk raft over HTTP on their consensus
+// port. The log is compacted into a snapshot of the application every
+// checkpoint interval, and kept on disk if the node has an EngineFile
+// (see raft_storage.go).
+
+const RAFT_ENDPOINT string = "/raft"
+
+// Raft counts time in ticks: a heartbeat every tick, and an election
+// if the leader's been quiet for RAFT_ELECTION_TICKS.
+const RAFT_TICK time.Duration = 100 * time.Millisecond
+const RAFT_ELECTION_TICKS int = 10
+
+// How long we give a peer to take a message
+const RAFT_SEND_TIMEOUT time.Duration = time.Second
+
+type raftEngine struct {
+	*committer
+	id      pbft.NodeId
+	members []pbft.NodeId
+	node    raft.Node
+	storage *raftStorage
+	logger  *capnslog.PackageLogger
+
+	peers    map[pbft.NodeId]string // id => URL
+	clients  map[pbft.NodeId]*http.Client
+	server   *http.Server
+	failure  chan error
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	snapshotInterval uint64
+
+	// Only touched by run()
+	confState     raftpb.ConfState
+	applied       uint64
+	snapshotIndex uint64
+	leader        uint64
+}
+
+type raftStatus struct {
+	Engine    string
+	Id        pbft.NodeId
+	State     string
+	Leader    pbft.NodeId
+	Term      uint64
+	Commit    uint64
+	Applied   uint64
+	Members   []pbft.NodeId
+	Proposals int // waiting to be applied
+}
+
+func startRaftEngine(config pbft.NodeConfig, cluster pbft.ClusterConfig, app pbft.StateMachine) (*raftEngine, error) {
+	serverTLS, err := pbft.ServerTLSConfig(config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	dialTLS, err := pbft.DialTLSConfigs(config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := openRaftStorage(config.EngineFile)
+	if err != nil {
+		return nil, err
+	}
+	e := &raftEngine{
+		committer:        newCommitter(app, cluster.MaxPendingRequests),
+		id:               config.Id,
+		members:          clusterMembers(cluster),
+		storage:          storage,
+		logger:           capnslog.NewPackageLogger("github.com/sydli/distributePKI", fmt.Sprintf("Raft [Node %v]", config.Id)),
+		peers:            make(map[pbft.NodeId]string),
+		clients:          make(map[pbft.NodeId]*http.Client),
+		failure:          make(chan error, 1),
+		quit:             make(chan struct{}),
+		done:             make(chan struct{}),
+		snapshotInterval: uint64(cluster.CheckpointInterval),
+	}
+	if cluster.CheckpointInterval <= 0 {
+		e.snapshotInterval = uint64(pbft.CHECKPOINT)
+	}
+	scheme := "http"
+	if serverTLS != nil {
+		scheme = "https"
+	}
+	var peers []raft.Peer
+	for _, node := range cluster.Nodes {
+		peers = append(peers, raft.Peer{ID: uint64(node.Id)})
+		if node.Id == config.Id {
+			continue
+		}
+		e.peers[node.Id] = scheme + "://" + util.GetHostname(node.Host, node.Port) + RAFT_ENDPOINT
+		transport := &http.Transport{}
+		if dialTLS != nil {
+			transport.TLSClientConfig = dialTLS[node.Id]
+		}
+		e.clients[node.Id] = &http.Client{Transport: transport, Timeout: RAFT_SEND_TIMEOUT}
+	}
+
+	saved, err := e.storage.load()
+	if err != nil {
+		e.storage.close()
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", util.GetHostname("", config.Port))
+	if err != nil {
+		e.storage.close()
+		return nil, err
+	}
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RAFT_ENDPOINT, e.handleMessage)
+	e.server = &http.Server{Handler: mux}
+
+	raftConfig := &raft.Config{
+		ID:              uint64(config.Id),
+		ElectionTick:    RAFT_ELECTION_TICKS,
+		HeartbeatTick:   1,
+		Storage:         e.storage,
+		MaxSizePerMsg:   1024 * 1024,
+		MaxInflightMsgs: 256,
+		Logger:          e.logger,
+	}
+	if !saved.restarted() {
+		// first time: remember what the application started from
+		base, err := e.snapshot()
+		if err == nil {
+			err = e.storage.saveBase(base)
+		}
+		if err != nil {
+			listener.Close()
+			e.storage.close()
+			return nil, err
+		}
+		e.node = raft.StartNode(raftConfig, peers)
+	} else {
+		// start from our snapshot, or where we started the log from,
+		// and raft hands us the rest of the log again
+		if raft.IsEmptySnap(saved.snapshot) {
+			err = e.committer.restore(saved.base)
+		} else {
+			err = e.restore(saved.snapshot)
+		}
+		if err != nil {
+			listener.Close()
+			e.storage.close()
+			return nil, err
+		}
+		raftConfig.Applied = e.applied
+		e.node = raft.RestartNode(raftConfig)
+	}
+	go e.serve(listener)
+	go e.run()
+	e.logger.Infof("Listening on %v", RAFT_ENDPOINT)
+	return e, nil
+}
+
+func (e *raftEngine) serve(listener net.Listener) {
+	if err := e.server.Serve(listener); err != http.ErrServerClosed {
+		e.logger.Errorf("Serving raft: %v", err)
+		select {
+		case e.failure <- err:
+		default:
+		}
+	}
+}
+
+func (e *raftEngine) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(RAFT_TICK)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.node.Tick()
+		case rd := <-e.node.Ready():
+			// persist, then send, then apply
+			if err := e.storage.save(rd.HardState, rd.Entries, rd.Snapshot); err != nil {
+				// we can't promise anything we can't keep
+				e.logger.Errorf("Saving raft state: %v", err)
+				select {
+				case e.failure <- err:
+				default:
+				}
+				e.shutdown(pbft.ErrStopped)
+				return
+			}
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				if err := e.restore(rd.Snapshot); err != nil {
+					e.logger.Errorf("Restoring snapshot: %v", err)
+				}
+			}
+			if rd.SoftState != nil && rd.SoftState.Lead != e.leader {
+				e.leader = rd.SoftState.Lead
+				// we don't know whether outstanding requests will make
+				// it, so let the clients retry
+				e.proposals.failAll(pbft.ErrViewChange)
+			}
+			e.send(rd.Messages)
+			e.apply(rd.CommittedEntries)
+			e.maybeSnapshot()
+			e.node.Advance()
+		case <-e.quit:
+			e.shutdown(pbft.ErrStopped)
+			return
+		}
+	}
+}
+
+func (e *raftEngine) shutdown(err error) {
+	e.node.Stop()
+	e.proposals.failAll(err)
+	e.stream.Close()
+	if err := e.storage.close(); err != nil {
+		e.logger.Errorf("Closing raft storage: %v", err)
+	}
+}
+
+func (e *raftEngine) apply(entries []raftpb.Entry) {
+	for _, entry := range entries {
+		if entry.Index <= e.applied {
+			continue
+		}
+		e.applied = entry.Index
+		switch entry.Type {
+		case raftpb.EntryNormal:
+			// new leaders commit an empty entry
+			if len(entry.Data) == 0 {
+				continue
+			}
+			var request pbft.Request
+			if err := json.Unmarshal(entry.Data, &request); err != nil {
+				e.logger.Errorf("Decoding committed request: %v", err)
+				continue
+			}
+			e.commit(int(entry.Index), request)
+		case raftpb.EntryConfChange:
+			var change raftpb.ConfChange
+			if err := change.Unmarshal(entry.Data); err != nil {
+				e.logger.Errorf("Decoding configuration change: %v", err)
+				continue
+			}
+			e.confState = *e.node.ApplyConfChange(change)
+		}
+	}
+}
+
+// Every snapshot interval, snapshot the application and let raft
+// throw away the log before it (keeping an interval's worth, so
+// followers that are only a little behind don't need the snapshot).
+func (e *raftEngine) maybeSnapshot() {
+	if e.applied-e.snapshotIndex < e.snapshotInterval {
+		return
+	}
+	data, err := e.snapshot()
+	if err != nil {
+		e.logger.Errorf("Snapshotting application: %v", err)
+		return
+	}
+	var compactIndex uint64
+	if e.applied > e.snapshotInterval {
+		compactIndex = e.applied - e.snapshotInterval
+	}
+	if err := e.storage.snapshot(e.applied, &e.confState, data, compactIndex); err != nil {
+		e.logger.Errorf("Creating snapshot: %v", err)
+		return
+	}
+	e.snapshotIndex = e.applied
+}
+
+// We fell too far behind, and the leader sent us a snapshot instead
+// (or we're starting from our own).
+func (e *raftEngine) restore(snapshot raftpb.Snapshot) error {
+	if err := e.committer.restore(snapshot.Data); err != nil {
+		return err
+	}
+	e.confState = snapshot.Metadata.ConfState
+	e.applied = snapshot.Metadata.Index
+	e.snapshotIndex = snapshot.Metadata.Index
+	return nil
+}
+
+// ** TRANSPORT ** //
+
+func (e *raftEngine) send(messages []raftpb.Message) {
+	for _, message := range messages {
+		go func(message raftpb.Message) {
+			err := e.post(message)
+			if err != nil {
+				e.node.ReportUnreachable(message.To)
+			}
+			if message.Type == raftpb.MsgSnap {
+				status := raft.SnapshotFinish
+				if err != nil {
+					status = raft.SnapshotFailure
+				}
+				e.node.ReportSnapshot(message.To, status)
+			}
+		}(message)
+	}
+}
+
+func (e *raftEngine) post(message raftpb.Message) error {
+	to := pbft.NodeId(message.To)
+	client, ok := e.clients[to]
+	if !ok {
+		return fmt.Errorf("No node %d", to)
+	}
+	data, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(e.peers[to], "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Node %d answered %s", to, resp.Status)
+	}
+	return nil
+}
+
+func (e *raftEngine) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading message", http.StatusBadRequest)
+		return
+	}
+	var message raftpb.Message
+	if err := message.Unmarshal(data); err != nil {
+		http.Error(w, "Error decoding message", http.StatusBadRequest)
+		return
+	}
+	if err := e.node.Step(r.Context(), message); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ** PROPOSALS ** //
+
+func (e *raftEngine) Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal {
+	digest, err := request.Digest()
+	p := pbft.NewProposal(digest)
+	if err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	if err := e.admit(request); err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	if !e.proposals.add(digest, p) {
+		p.Resolve(pbft.ProposalResult{}, pbft.ErrOverloaded)
+		return p
+	}
+	go func() {
+		// followers forward proposals to the leader; if there isn't
+		// one, raft drops them without telling us
+		if e.node.Status().Lead == raft.None {
+			e.proposals.fail(digest, p, pbft.ErrViewChange)
+		} else if err := e.node.Propose(ctx, data); err != nil {
+			e.proposals.fail(digest, p, err)
+		}
+		select {
+		case <-ctx.Done():
+			e.proposals.fail(digest, p, ctx.Err())
+		case <-p.Done():
+		}
+	}()
+	return p
+}
+
+// An election takes a couple of election timeouts, at worst
+func (e *raftEngine) RetryAfter(err error) time.Duration {
+	if err == pbft.ErrViewChange {
+		return 2 * time.Duration(RAFT_ELECTION_TICKS) * RAFT_TICK
+	}
+	return RAFT_TICK
+}
+
+// ** ConsensusEngine ** //
+
+func (e *raftEngine) Id() pbft.NodeId {
+	return e.id
+}
+
+func (e *raftEngine) Members() []pbft.NodeId {
+	return e.members
+}
+
+func (e *raftEngine) Status() interface{} {
+	status := e.node.Status()
+	return raftStatus{
+		Engine:    ENGINE_RAFT,
+		Id:        e.id,
+		State:     status.RaftState.String(),
+		Leader:    pbft.NodeId(status.Lead),
+		Term:      status.Term,
+		Commit:    status.Commit,
+		Applied:   status.Applied,
+		Members:   e.members,
+		Proposals: e.proposals.count(),
+	}
+}
+
+func (e *raftEngine) Down() bool {
+	return false
+}
+
+func (e *raftEngine) Failure() <-chan error {
+	return e.failure
+}
+
+func (e *raftEngine) Stop(ctx context.Context) error {
+	e.stopOnce.Do(func() {
+		e.logger.Info("STOPPING")
+		close(e.quit)
+	})
+	err := e.server.Shutdown(ctx)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
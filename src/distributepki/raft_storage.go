@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// ** RAFT STORAGE ** //
+
+// What raft needs to survive a restart: its hard state (term, vote and
+// commit index), the log since the last snapshot, and the snapshot
+// itself. Raft reads them from a MemoryStorage; if the node has an
+// EngineFile we also keep them in a bolt database there, and write
+// (and sync) everything in a Ready before its messages go out. Without
+// that a node that restarts could vote twice in a term, or forget
+// entries it told the leader it had.
+//
+// We also keep a snapshot of the application from when the node first
+// started (the base), so a node that restarts before its first snapshot
+// can start the log over from the same state.
+
+// How long to wait for another process to let go of the file
+const RAFT_BOLT_TIMEOUT time.Duration = time.Second
+
+var (
+	raftStateBucket   = []byte("state")
+	raftEntriesBucket = []byte("entries")
+	hardStateField    = []byte("hardstate")
+	snapshotField     = []byte("snapshot")
+	baseField         = []byte("base")
+)
+
+type raftStorage struct {
+	*raft.MemoryStorage
+	db *bolt.DB // nil if we're not keeping anything
+}
+
+// What was on disk when we started.
+type raftSaved struct {
+	base      []byte // nil if we've never started before
+	snapshot  raftpb.Snapshot
+	hardState raftpb.HardState
+	entries   []raftpb.Entry
+}
+
+// Whether raft got anywhere last time. (If it didn't, we might as well
+// start over.)
+func (saved raftSaved) restarted() bool {
+	return saved.base != nil && (!raft.IsEmptySnap(saved.snapshot) || !raft.IsEmptyHardState(saved.hardState) || len(saved.entries) > 0)
+}
+
+// An empty file name keeps everything in memory.
+func openRaftStorage(file string) (*raftStorage, error) {
+	s := &raftStorage{MemoryStorage: raft.NewMemoryStorage()}
+	if file == "" {
+		return s, nil
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: RAFT_BOLT_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(raftStateBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(raftEntriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+func raftIndexKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+// Reads back what we saved, and loads it into the MemoryStorage.
+func (s *raftStorage) load() (raftSaved, error) {
+	var saved raftSaved
+	if s.db == nil {
+		return saved, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket(raftStateBucket)
+		if base := state.Get(baseField); base != nil {
+			saved.base = append([]byte(nil), base...)
+		}
+		if data := state.Get(snapshotField); data != nil {
+			if err := saved.snapshot.Unmarshal(data); err != nil {
+				return err
+			}
+		}
+		if data := state.Get(hardStateField); data != nil {
+			if err := saved.hardState.Unmarshal(data); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(raftEntriesBucket).ForEach(func(_, data []byte) error {
+			var entry raftpb.Entry
+			if err := entry.Unmarshal(data); err != nil {
+				return err
+			}
+			saved.entries = append(saved.entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return saved, err
+	}
+	if !raft.IsEmptySnap(saved.snapshot) {
+		if err := s.ApplySnapshot(saved.snapshot); err != nil {
+			return saved, err
+		}
+	}
+	if !raft.IsEmptyHardState(saved.hardState) {
+		if err := s.SetHardState(saved.hardState); err != nil {
+			return saved, err
+		}
+	}
+	return saved, s.Append(saved.entries)
+}
+
+// Only the first time we start.
+func (s *raftStorage) saveBase(base []byte) error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(raftStateBucket).Put(baseField, base)
+	})
+}
+
+// Everything a Ready wants kept, in one transaction. New entries
+// replace any we had from the same index on (they're from a newer
+// leader).
+func (s *raftStorage) save(hardState raftpb.HardState, entries []raftpb.Entry, snapshot raftpb.Snapshot) error {
+	if s.db != nil {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			state, logBucket := tx.Bucket(raftStateBucket), tx.Bucket(raftEntriesBucket)
+			if !raft.IsEmptySnap(snapshot) {
+				// the leader's snapshot replaces our whole log
+				if err := putSnapshot(state, logBucket, snapshot, snapshot.Metadata.Index); err != nil {
+					return err
+				}
+				if err := truncateFrom(logBucket, snapshot.Metadata.Index+1); err != nil {
+					return err
+				}
+			}
+			if len(entries) > 0 {
+				if err := truncateFrom(logBucket, entries[0].Index); err != nil {
+					return err
+				}
+			}
+			for _, entry := range entries {
+				data, err := entry.Marshal()
+				if err != nil {
+					return err
+				}
+				if err := logBucket.Put(raftIndexKey(entry.Index), data); err != nil {
+					return err
+				}
+			}
+			if raft.IsEmptyHardState(hardState) {
+				return nil
+			}
+			data, err := hardState.Marshal()
+			if err != nil {
+				return err
+			}
+			return state.Put(hardStateField, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !raft.IsEmptySnap(snapshot) {
+		if err := s.ApplySnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+	if err := s.Append(entries); err != nil {
+		return err
+	}
+	if !raft.IsEmptyHardState(hardState) {
+		return s.SetHardState(hardState)
+	}
+	return nil
+}
+
+// Takes a snapshot as of index, and throws away the log up to
+// compactIndex.
+func (s *raftStorage) snapshot(index uint64, confState *raftpb.ConfState, data []byte, compactIndex uint64) error {
+	snapshot, err := s.CreateSnapshot(index, confState, data)
+	if err != nil {
+		return err
+	}
+	if s.db != nil {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return putSnapshot(tx.Bucket(raftStateBucket), tx.Bucket(raftEntriesBucket), snapshot, compactIndex)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if compactIndex == 0 {
+		return nil
+	}
+	if err := s.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+		return err
+	}
+	return nil
+}
+
+func (s *raftStorage) close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func putSnapshot(state *bolt.Bucket, logBucket *bolt.Bucket, snapshot raftpb.Snapshot, compactIndex uint64) error {
+	data, err := snapshot.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := state.Put(snapshotField, data); err != nil {
+		return err
+	}
+	var compacted [][]byte
+	c := logBucket.Cursor()
+	for key, _ := c.First(); key != nil && binary.BigEndian.Uint64(key) <= compactIndex; key, _ = c.Next() {
+		compacted = append(compacted, key)
+	}
+	return deleteKeys(logBucket, compacted)
+}
+
+func truncateFrom(logBucket *bolt.Bucket, index uint64) error {
+	var replaced [][]byte
+	c := logBucket.Cursor()
+	for key, _ := c.Seek(raftIndexKey(index)); key != nil; key, _ = c.Next() {
+		replaced = append(replaced, key)
+	}
+	return deleteKeys(logBucket, replaced)
+}
+
+// (Deleting while iterating with a cursor skips keys.)
+func deleteKeys(bucket *bolt.Bucket, keys [][]byte) error {
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
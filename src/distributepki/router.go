@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"distributepki/clientapi"
+	"distributepki/keystore"
+	"distributepki/shard"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ** SHARD ROUTING ** //
+
+// When the namespace is sharded (see shard/shard.go), a node only
+// stores its own shard's aliases. Anything else gets forwarded to the
+// owning shard's nodes, marked so they don't forward it again. We route
+// by the map the store has applied (see keystore/sharding.go), so the
+// whole cluster switches at the same point in the log, and an alias
+// that's still on its way here is looked up at its old owner (whose
+// copy is frozen) and can't be written to until it arrives.
+const FORWARDED_HEADER string = "X-Forwarded-Shard"
+
+const FORWARD_TIMEOUT time.Duration = 10 * time.Second
+
+// How long to tell clients to wait before writing to an alias that's
+// moving
+const MOVING_RETRY_AFTER time.Duration = 5 * time.Second
+
+// What we're giving another shard with the current map, and where to
+// send the other shards' (once the authority's signed them)
+const EXPORT_ENDPOINT string = "/shardmap/export"
+const IMPORT_ENDPOINT string = "/shardmap/import"
+
+var (
+	ErrOlderMap = errors.New("Shard map isn't newer than the one we have")
+)
+
+type ShardRouter struct {
+	shard  shard.ShardId
+	store  *keystore.Keystore
+	client *http.Client
+}
+
+// The store has to have been placed already (see keystore.Place).
+func NewShardRouter(store *keystore.Keystore) (*ShardRouter, error) {
+	placement, ok := store.Placement()
+	if !ok {
+		return nil, keystore.ErrNotSharded
+	}
+	return &ShardRouter{
+		shard:  placement.Shard,
+		store:  store,
+		client: &http.Client{Timeout: FORWARD_TIMEOUT},
+	}, nil
+}
+
+func (r *ShardRouter) placement() keystore.Placement {
+	placement, _ := r.store.Placement()
+	return placement
+}
+
+func (r *ShardRouter) signedMap() shard.SignedShardMap {
+	return r.placement().Map
+}
+
+// The alias a client request is about. Also hands back the body we had
+// to read to find out, since the request's is used up.
+func requestAlias(req *http.Request) (string, []byte, error) {
+	switch req.Method {
+	case "GET":
+		return req.URL.Query().Get("name"), nil, nil
+	case "POST", "PUT", "DELETE":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var op struct{ Alias string }
+		if err := json.Unmarshal(body, &op); err != nil {
+			return "", nil, err
+		}
+		return op.Alias, body, nil
+	}
+	return "", nil, nil
+}
+
+// Runs next for our own shard's aliases, and forwards the rest.
+func (r *ShardRouter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		placement := r.placement()
+		m := placement.Map.Map
+		w.Header().Set(shard.VERSION_HEADER, strconv.Itoa(m.Version))
+		alias, body, err := requestAlias(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Method != "GET" && req.Method != "POST" && req.Method != "PUT" && req.Method != "DELETE" {
+			next(w, req)
+			return
+		}
+		owner, from := m.ShardFor(alias), req.Header.Get(FORWARDED_HEADER)
+		if owner == r.shard {
+			previous, moving := r.store.Moving(keystore.Alias(alias))
+			if !moving {
+				next(w, req)
+				return
+			}
+			if req.Method != "GET" {
+				w.Header().Set("Retry-After", strconv.Itoa(int(MOVING_RETRY_AFTER/time.Second)))
+				http.Error(w, keystore.ErrMoving.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			// (It answers lookups we forward, even if it sent them.)
+			previousShard, _ := placement.Previous.Shard(previous)
+			r.forward(w, req, previousShard, body)
+			return
+		}
+		if from != "" {
+			if req.Method == "GET" && from == strconv.Itoa(int(owner)) && placement.Previous != nil && placement.Previous.ShardFor(alias) == r.shard {
+				// The new owner's still waiting for it, and we stopped
+				// taking writes for it when we switched.
+				next(w, req)
+				return
+			}
+			// Whoever sent it has a different idea of the map than we do.
+			http.Error(w, fmt.Sprintf("%s belongs to shard %d", alias, owner), http.StatusMisdirectedRequest)
+			return
+		}
+		ownerShard, _ := m.Shard(owner)
+		r.forward(w, req, ownerShard, body)
+	}
+}
+
+// Tries each of the shard's nodes until one answers, and passes its
+// answer back.
+func (r *ShardRouter) forward(w http.ResponseWriter, req *http.Request, to shard.Shard, body []byte) {
+	for _, endpoint := range to.Endpoints {
+		forwarded, err := http.NewRequest(req.Method, strings.TrimSuffix(endpoint, "/")+req.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		forwarded = forwarded.WithContext(req.Context())
+		if contentType := req.Header.Get("Content-Type"); contentType != "" {
+			forwarded.Header.Set("Content-Type", contentType)
+		}
+		forwarded.Header.Set(FORWARDED_HEADER, strconv.Itoa(int(r.shard)))
+		resp, err := r.client.Do(forwarded)
+		if err != nil {
+			log.Warningf("Forwarding to shard %d at %s: %v", to.Id, endpoint, err)
+			continue
+		}
+		for k, values := range resp.Header {
+			if k == shard.VERSION_HEADER {
+				continue
+			}
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		return
+	}
+	http.Error(w, fmt.Sprintf("No node in shard %d answered", to.Id), http.StatusBadGateway)
+}
+
+// GET for the signed map we're using, PUT (a signed map) to move to the
+// next version, through the log.
+func shardMapHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			jsonBody, err := json.Marshal(kn.router.signedMap())
+			if err != nil {
+				http.Error(w, "Error converting results to json",
+					http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonBody)
+		case "PUT":
+			if _, ok := kn.engine.(*observerEngine); ok {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+				return
+			}
+			var signed shard.SignedShardMap
+			if err := json.NewDecoder(req.Body).Decode(&signed); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := signed.Verify(kn.store.Authorities()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if signed.Map.Version <= kn.router.signedMap().Map.Version {
+				http.Error(w, ErrOlderMap.Error(), http.StatusConflict)
+				return
+			}
+			change := clientapi.ChangeShardMap{Map: signed}
+			op := clientapi.KeyOperation{OpCode: clientapi.OP_SHARD_MAP, Op: change}
+			op.SetDigest()
+			proposal, err := kn.proposeOperation(req.Context(), &op, change)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			kn.waitForCommit(proposal, &w)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// GET ?to=<shard> for the aliases we're giving it, for the authority to
+// sign (see keystore.ShardExport).
+func shardExportHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		to, err := strconv.Atoi(req.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "Bad shard id", http.StatusBadRequest)
+			return
+		}
+		export, err := kn.store.Export(shard.ShardId(to))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonBody, err := json.Marshal(export)
+		if err != nil {
+			http.Error(w, "Error converting results to json",
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	}
+}
+
+// PUT another shard's export, signed by the authority, to take it in
+// (through the log).
+func shardImportHandler(kn *KeyNode) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := kn.engine.(*observerEngine); ok {
+			http.Error(w, ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		var signed keystore.SignedShardExport
+		if err := json.NewDecoder(req.Body).Decode(&signed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := signed.Verify(kn.store.Authorities()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		imported := clientapi.ImportShard{Export: signed}
+		op := clientapi.KeyOperation{OpCode: clientapi.OP_IMPORT_SHARD, Op: imported}
+		op.SetDigest()
+		proposal, err := kn.proposeOperation(req.Context(), &op, imported)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		kn.waitForCommit(proposal, &w)
+	}
+}
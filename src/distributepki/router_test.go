@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"distributepki/clientapi"
+	"distributepki/keystore"
+	"distributepki/shard"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** ROUTER TESTS ** //
+// (These don't need the cluster TestMain starts.)
+
+// Two shards of one dev engine node each, moving a domain from one to
+// the other.
+func TestShardRouter(t *testing.T) {
+	gob.Register(clientapi.ChangeShardMap{})
+	gob.Register(clientapi.ImportShard{})
+	authority := testEntity(t)
+	authorities := openpgp.EntityList{authority}
+
+	nodes := make(map[shard.ShardId]*KeyNode)
+	servers := make(map[shard.ShardId]*httptest.Server)
+	for _, id := range []shard.ShardId{1, 2} {
+		id := id
+		servers[id] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[id].clientMux().ServeHTTP(w, r)
+		}))
+		defer servers[id].Close()
+	}
+	m := shard.ShardMap{
+		Version: 1,
+		Shards: []shard.Shard{
+			{Id: 1, Endpoints: []string{servers[1].URL}},
+			{Id: 2, Endpoints: []string{servers[2].URL}},
+		},
+		Domains: map[string]shard.ShardId{"one.com": 1, "two.com": 2},
+	}
+	signed, err := m.Sign(authority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, _ := range servers {
+		store := keystore.NewKeystore(&map[string]string{})
+		store.SetAuthorities(authorities)
+		if err := store.Place(id, *signed); err != nil {
+			t.Fatal(err)
+		}
+		router, err := NewShardRouter(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[id] = &KeyNode{
+			engine: newDevEngine(1, store.StateMachine()),
+			store:  store,
+			logger: capnslog.NewPackageLogger("github.com/sydli/distributePKI", "Keynode [test]"),
+			router: router,
+		}
+	}
+	if err := nodes[1].store.CreateKey("a@one.com", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[2].store.CreateKey("a@two.com", "k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(id shard.ShardId, alias string) (int, string) {
+		resp, err := http.Get(servers[id].URL + "/?name=" + alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var key string
+		json.NewDecoder(resp.Body).Decode(&key)
+		return resp.StatusCode, key
+	}
+	put := func(id shard.ShardId, endpoint string, v interface{}) int {
+		data, _ := json.Marshal(v)
+		req, _ := http.NewRequest("PUT", servers[id].URL+endpoint, bytes.NewReader(data))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Lookups end up at the owner, whoever gets them
+	if status, key := lookup(1, "a@two.com"); status != http.StatusOK || key != "k2" {
+		t.Errorf("Lookup for two.com through shard 1: %d %q", status, key)
+	}
+	if status, key := lookup(2, "a@one.com"); status != http.StatusOK || key != "k1" {
+		t.Errorf("Lookup for one.com through shard 2: %d %q", status, key)
+	}
+
+	// A forwarded request for the wrong shard isn't forwarded again
+	req, _ := http.NewRequest("GET", servers[1].URL+"/?name=a@two.com", nil)
+	req.Header.Set(FORWARDED_HEADER, "2")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Misdirected forward got %v, %v", resp, err)
+	}
+
+	// Only the next version, signed, gets through
+	m.Version = 2
+	m.Domains = map[string]shard.ShardId{"one.com": 1, "two.com": 1}
+	newer, _ := m.Sign(authority)
+	if status := put(1, shard.MAP_ENDPOINT, signed); status != http.StatusConflict {
+		t.Errorf("Putting the same version: %d", status)
+	}
+	forged, _ := m.Sign(testEntity(t))
+	if status := put(1, shard.MAP_ENDPOINT, forged); status != http.StatusBadRequest {
+		t.Errorf("Putting a forged map: %d", status)
+	}
+	for id, _ := range servers {
+		if status := put(id, shard.MAP_ENDPOINT, newer); status != http.StatusOK {
+			t.Fatalf("Putting version 2 on shard %d: %d", id, status)
+		}
+	}
+
+	// two.com's frozen until its history arrives: shard 2 won't take
+	// writes for it any more, and shard 1 won't yet, but it can still
+	// be looked up (at shard 2) either way round
+	if err := nodes[2].store.CreateKey("b@two.com", "x"); err != keystore.ErrWrongShard {
+		t.Errorf("Shard 2 writing to what it's given up: %v", err)
+	}
+	if err := nodes[1].store.CreateKey("b@two.com", "x"); err != keystore.ErrMoving {
+		t.Errorf("Shard 1 writing to what hasn't arrived: %v", err)
+	}
+	if resp, err := http.Post(servers[1].URL, "application/json", bytes.NewBufferString(`{"Alias":"b@two.com"}`)); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Create while two.com's moving got %v, %v", resp, err)
+	}
+	for id, _ := range servers {
+		if status, key := lookup(id, "a@two.com"); status != http.StatusOK || key != "k2" {
+			t.Errorf("Lookup for two.com through shard %d while it's moving: %d %q", id, status, key)
+		}
+	}
+
+	// Shard 2 exports it, the authority signs that, and shard 1 takes
+	// it in
+	resp, err := http.Get(servers[2].URL + EXPORT_ENDPOINT + "?to=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export keystore.ShardExport
+	json.NewDecoder(resp.Body).Decode(&export)
+	resp.Body.Close()
+	if export.Version != 2 || len(export.History["a@two.com"]) != 1 || len(export.History["a@one.com"]) != 0 {
+		t.Fatalf("Export: %+v", export)
+	}
+	forgedExport, _ := export.Sign(testEntity(t))
+	if status := put(1, IMPORT_ENDPOINT, forgedExport); status != http.StatusBadRequest {
+		t.Errorf("Importing a forged export: %d", status)
+	}
+	signedExport, _ := export.Sign(authority)
+	if status := put(1, IMPORT_ENDPOINT, signedExport); status != http.StatusOK {
+		t.Fatalf("Importing: %d", status)
+	}
+	if _, moving := nodes[1].store.Moving("a@two.com"); moving {
+		t.Error("a@two.com still moving after the import")
+	}
+	if ok, key := nodes[1].store.LookupKey("a@two.com"); !ok || key != "k2" {
+		t.Errorf("Shard 1 has a@two.com as %q, %v", key, ok)
+	}
+	if err := nodes[1].store.CreateKey("b@two.com", "x"); err != nil {
+		t.Errorf("Shard 1 writing to two.com once it's arrived: %v", err)
+	}
+	if status, key := lookup(2, "b@two.com"); status != http.StatusOK || key != "x" {
+		t.Errorf("Lookup for two.com through shard 2 after the move: %d %q", status, key)
+	}
+}
+
+func testEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("someone", "", "someone@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"pbft"
+	"sort"
+)
+
+// ** FEDERATED BYZANTINE AGREEMENT ** //
+
+// The Stellar Consensus Protocol (Mazières, 2015), more or less. Instead
+// of the whole cluster agreeing on who's in it, every node picks whose
+// agreement it needs: its quorum set (pbft.QuorumSet), which describes
+// its quorum slices. A quorum is a set of nodes that contains a slice
+// of each of its members. As long as every two quorums share an honest
+// node, honest nodes in each other's quorums agree.
+//
+// Each slot (one per batch of requests) runs nomination, to come up
+// with values (batches) worth trying, and then the ballot protocol, to
+// commit to exactly one. Both are built out of federated voting: a node
+// accepts a statement once a quorum has voted for or accepted it, or
+// once a v-blocking set (one that has a member in each of its slices)
+// has accepted it, and confirms it once a quorum has accepted it.
+//
+// Nodes send each other everything they're saying about a slot as one
+// statement, and only the latest statement from each node counts.
+// scpSlot is the protocol for one slot; scp_engine.go runs the slots
+// and moves statements around.
+
+var (
+	ErrBadQuorumSet   = errors.New("Invalid quorum set")
+	ErrBadStatement   = errors.New("Invalid SCP statement")
+	ErrStaleStatement = errors.New("Already have a newer statement from that node")
+)
+
+// How deep quorum sets can nest
+const SCP_MAX_QUORUM_DEPTH int = 4
+
+// ** QUORUM SETS ** //
+
+// Whether nodes contain one of q's slices.
+func quorumSetSatisfied(q pbft.QuorumSet, nodes map[pbft.NodeId]bool) bool {
+	if q.Threshold <= 0 {
+		return false
+	}
+	count := 0
+	for _, node := range q.Validators {
+		if nodes[node] {
+			count++
+		}
+	}
+	for _, inner := range q.InnerSets {
+		if quorumSetSatisfied(inner, nodes) {
+			count++
+		}
+	}
+	return count >= q.Threshold
+}
+
+// Whether nodes has a member in every one of q's slices (so q can't be
+// satisfied without one of them).
+func quorumSetBlocked(q pbft.QuorumSet, nodes map[pbft.NodeId]bool) bool {
+	if q.Threshold <= 0 {
+		return false
+	}
+	count := 0
+	for _, node := range q.Validators {
+		if nodes[node] {
+			count++
+		}
+	}
+	for _, inner := range q.InnerSets {
+		if quorumSetBlocked(inner, nodes) {
+			count++
+		}
+	}
+	return count > len(q.Validators)+len(q.InnerSets)-q.Threshold
+}
+
+// Everybody q mentions.
+func quorumSetMembers(q pbft.QuorumSet) []pbft.NodeId {
+	members := append([]pbft.NodeId(nil), q.Validators...)
+	for _, inner := range q.InnerSets {
+		members = append(members, quorumSetMembers(inner)...)
+	}
+	return members
+}
+
+// Checks that thresholds make sense, and that q only mentions nodes we
+// know (once each).
+func checkQuorumSet(q pbft.QuorumSet, known map[pbft.NodeId]bool) error {
+	seen := make(map[pbft.NodeId]bool)
+	var check func(q pbft.QuorumSet, depth int) error
+	check = func(q pbft.QuorumSet, depth int) error {
+		if depth > SCP_MAX_QUORUM_DEPTH {
+			return fmt.Errorf("%v: nested more than %d deep", ErrBadQuorumSet, SCP_MAX_QUORUM_DEPTH)
+		}
+		if q.Threshold < 1 || q.Threshold > len(q.Validators)+len(q.InnerSets) {
+			return fmt.Errorf("%v: threshold %d of %d", ErrBadQuorumSet, q.Threshold, len(q.Validators)+len(q.InnerSets))
+		}
+		for _, node := range q.Validators {
+			if !known[node] {
+				return fmt.Errorf("%v: no node %d", ErrBadQuorumSet, node)
+			} else if seen[node] {
+				return fmt.Errorf("%v: node %d is in there twice", ErrBadQuorumSet, node)
+			}
+			seen[node] = true
+		}
+		for _, inner := range q.InnerSets {
+			if err := check(inner, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(q, 1)
+}
+
+// ** VALUES & BALLOTS ** //
+
+type scpDigest [sha256.Size]byte
+
+// What a slot decides on: a batch of requests, in the order they're
+// applied.
+type scpValue struct {
+	Requests []pbft.Request
+}
+
+func (v scpValue) digest() (scpDigest, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return scpDigest{}, err
+	}
+	return scpDigest(sha256.Sum256(encoded)), nil
+}
+
+// Puts everything in the candidates into one value. Requests are
+// ordered by client and timestamp, so each client's run in the order
+// it sent them.
+func combineValues(values []scpValue) scpValue {
+	seen := make(map[[sha256.Size]byte]bool)
+	type entry struct {
+		request pbft.Request
+		digest  [sha256.Size]byte
+	}
+	var entries []entry
+	for _, value := range values {
+		for _, request := range value.Requests {
+			digest, err := request.Digest()
+			if err != nil || seen[digest] {
+				continue
+			}
+			seen[digest] = true
+			entries = append(entries, entry{request, digest})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.request.Client != b.request.Client {
+			return a.request.Client < b.request.Client
+		} else if a.request.Timestamp != b.request.Timestamp {
+			return a.request.Timestamp < b.request.Timestamp
+		}
+		return bytes.Compare(a.digest[:], b.digest[:]) < 0
+	})
+	combined := scpValue{Requests: make([]pbft.Request, 0, len(entries))}
+	for _, e := range entries {
+		combined.Requests = append(combined.Requests, e.request)
+	}
+	return combined
+}
+
+// Counters only go up; the infinite ballot stands for "every counter".
+const SCP_INFINITY uint32 = math.MaxUint32
+
+type scpBallot struct {
+	Counter uint32
+	Value   scpDigest
+}
+
+func compareBallots(a, b scpBallot) int {
+	if a.Counter < b.Counter {
+		return -1
+	} else if a.Counter > b.Counter {
+		return 1
+	}
+	return bytes.Compare(a.Value[:], b.Value[:])
+}
+
+func ballotsCompatible(a, b scpBallot) bool {
+	return a.Value == b.Value
+}
+
+func ballotsLessAndCompatible(a, b scpBallot) bool {
+	return compareBallots(a, b) <= 0 && ballotsCompatible(a, b)
+}
+
+func ballotsLessAndIncompatible(a, b scpBallot) bool {
+	return compareBallots(a, b) <= 0 && !ballotsCompatible(a, b)
+}
+
+// ** STATEMENTS ** //
+
+type scpPhase int
+
+const (
+	scpNone        scpPhase = iota // not balloting yet
+	scpPrepare                     // trying to prepare a ballot
+	scpConfirm                     // accepted a commit, trying to confirm it
+	scpExternalize                 // done
+)
+
+func (p scpPhase) String() string {
+	switch p {
+	case scpPrepare:
+		return "PREPARE"
+	case scpConfirm:
+		return "CONFIRM"
+	case scpExternalize:
+		return "EXTERNALIZE"
+	}
+	return "NONE"
+}
+
+// Everything a node has to say about a slot.
+type scpStatement struct {
+	Domain    pbft.Domain // for signing; the slot doesn't care
+	Node      pbft.NodeId
+	Slot      int
+	Seq       uint64 // later statements replace earlier ones
+	QuorumSet pbft.QuorumSet
+
+	// Nomination: values it's voted to nominate, and accepted as
+	// nominated
+	Votes    []scpDigest `json:",omitempty"`
+	Accepted []scpDigest `json:",omitempty"`
+
+	// Ballot protocol. In PREPARE, it votes to prepare Ballot, has
+	// accepted Prepared and PreparedPrime as prepared, has confirmed
+	// <NHigh, Ballot.Value> prepared and votes to commit NCommit to
+	// NHigh (if NCommit isn't 0). In CONFIRM, it has accepted
+	// <NPrepared, Ballot.Value> as prepared, and commits from NCommit
+	// to NHigh. In EXTERNALIZE, Ballot is the lowest committed ballot
+	// and NHigh the highest.
+	Phase         scpPhase
+	Ballot        scpBallot
+	Prepared      *scpBallot `json:",omitempty"`
+	PreparedPrime *scpBallot `json:",omitempty"`
+	NPrepared     uint32
+	NCommit       uint32
+	NHigh         uint32
+
+	// Every value mentioned above
+	Values []scpValue
+}
+
+// What it's balloting on, as far as bumping is concerned.
+func (st *scpStatement) workingCounter() uint32 {
+	if st.Phase == scpExternalize {
+		return SCP_INFINITY
+	}
+	return st.Ballot.Counter
+}
+
+// Whether it votes to prepare ballot (or has accepted it as prepared).
+func (st *scpStatement) votesPrepared(ballot scpBallot) bool {
+	switch st.Phase {
+	case scpPrepare:
+		return ballotsLessAndCompatible(ballot, st.Ballot)
+	case scpConfirm, scpExternalize:
+		return ballotsCompatible(ballot, st.Ballot)
+	}
+	return false
+}
+
+// Whether it has accepted ballot as prepared.
+func (st *scpStatement) acceptsPrepared(ballot scpBallot) bool {
+	switch st.Phase {
+	case scpPrepare:
+		return (st.Prepared != nil && ballotsLessAndCompatible(ballot, *st.Prepared)) ||
+			(st.PreparedPrime != nil && ballotsLessAndCompatible(ballot, *st.PreparedPrime))
+	case scpConfirm:
+		return ballotsLessAndCompatible(ballot, scpBallot{st.NPrepared, st.Ballot.Value})
+	case scpExternalize:
+		return ballotsCompatible(ballot, st.Ballot)
+	}
+	return false
+}
+
+// Whether it votes to commit value with every counter from low to high
+// (or has accepted that).
+func (st *scpStatement) votesCommit(value scpDigest, low, high uint32) bool {
+	if st.Ballot.Value != value {
+		return false
+	}
+	switch st.Phase {
+	case scpPrepare:
+		return st.NCommit != 0 && st.NCommit <= low && high <= st.NHigh
+	case scpConfirm:
+		return st.NCommit <= low
+	case scpExternalize:
+		return st.Ballot.Counter <= low
+	}
+	return false
+}
+
+// Whether it has accepted committing value with every counter from low
+// to high.
+func (st *scpStatement) acceptsCommit(value scpDigest, low, high uint32) bool {
+	if st.Ballot.Value != value {
+		return false
+	}
+	switch st.Phase {
+	case scpConfirm:
+		return st.NCommit <= low && high <= st.NHigh
+	case scpExternalize:
+		return st.Ballot.Counter <= low
+	}
+	return false
+}
+
+// Catches statements that no honest node would make, and indexes the
+// values they mention.
+func (st *scpStatement) check(known map[pbft.NodeId]bool) (map[scpDigest]scpValue, error) {
+	if err := checkQuorumSet(st.QuorumSet, known); err != nil {
+		return nil, err
+	}
+	values := make(map[scpDigest]scpValue)
+	for _, value := range st.Values {
+		digest, err := value.digest()
+		if err != nil {
+			return nil, err
+		}
+		values[digest] = value
+	}
+	mentioned := append(append([]scpDigest(nil), st.Votes...), st.Accepted...)
+	switch st.Phase {
+	case scpNone:
+	case scpPrepare:
+		mentioned = append(mentioned, st.Ballot.Value)
+		if st.Prepared != nil {
+			mentioned = append(mentioned, st.Prepared.Value)
+		}
+		if st.PreparedPrime != nil {
+			if st.Prepared == nil || compareBallots(*st.PreparedPrime, *st.Prepared) >= 0 || ballotsCompatible(*st.PreparedPrime, *st.Prepared) {
+				return nil, ErrBadStatement
+			}
+			mentioned = append(mentioned, st.PreparedPrime.Value)
+		}
+		if st.NHigh > st.Ballot.Counter || st.NCommit > st.NHigh {
+			return nil, ErrBadStatement
+		}
+	case scpConfirm:
+		mentioned = append(mentioned, st.Ballot.Value)
+		if st.NCommit > st.NHigh || st.NHigh > st.Ballot.Counter {
+			return nil, ErrBadStatement
+		}
+	case scpExternalize:
+		mentioned = append(mentioned, st.Ballot.Value)
+		if st.Ballot.Counter == 0 || st.Ballot.Counter > st.NHigh {
+			return nil, ErrBadStatement
+		}
+	default:
+		return nil, ErrBadStatement
+	}
+	for _, digest := range mentioned {
+		if _, ok := values[digest]; !ok {
+			return nil, ErrBadStatement
+		}
+	}
+	return values, nil
+}
+
+// ** SLOTS ** //
+
+type scpSlot struct {
+	index int
+	id    pbft.NodeId
+	qset  pbft.QuorumSet
+	known map[pbft.NodeId]bool // who can send us statements
+
+	statements map[pbft.NodeId]*scpStatement // the latest from everybody, us included
+	values     map[scpDigest]scpValue
+	seq        uint64 // of our latest statement
+
+	// Nomination
+	nominating bool
+	round      int
+	leaders    map[pbft.NodeId]bool
+	own        *scpDigest // what we'd like to nominate
+	votes      map[scpDigest]bool
+	accepted   map[scpDigest]bool
+	candidates map[scpDigest]bool
+	composite  *scpDigest // all the candidates put together
+
+	// Ballot protocol: b, p, p', h and c from the paper
+	phase         scpPhase
+	ballot        *scpBallot
+	prepared      *scpBallot
+	preparedPrime *scpBallot
+	high          *scpBallot
+	commit        *scpBallot
+	override      *scpDigest // once we've confirmed something prepared, stick with it
+
+	externalized *scpValue
+}
+
+func newSCPSlot(index int, id pbft.NodeId, qset pbft.QuorumSet, known map[pbft.NodeId]bool) *scpSlot {
+	return &scpSlot{
+		index:      index,
+		id:         id,
+		qset:       qset,
+		known:      known,
+		statements: make(map[pbft.NodeId]*scpStatement),
+		values:     make(map[scpDigest]scpValue),
+		leaders:    make(map[pbft.NodeId]bool),
+		votes:      make(map[scpDigest]bool),
+		accepted:   make(map[scpDigest]bool),
+		candidates: make(map[scpDigest]bool),
+		phase:      scpPrepare,
+	}
+}
+
+// Picks a slot back up from our latest statement about it (after a
+// restart), so we carry on from what we last said: the same votes, the
+// same ballot state, and a higher Seq next time.
+func restoreSCPSlot(st *scpStatement, id pbft.NodeId, qset pbft.QuorumSet, known map[pbft.NodeId]bool) (*scpSlot, error) {
+	s := newSCPSlot(st.Slot, id, qset, known)
+	values, err := st.check(known)
+	if err != nil {
+		return nil, err
+	}
+	s.values = values
+	for _, digest := range st.Votes {
+		s.votes[digest] = true
+	}
+	for _, digest := range st.Accepted {
+		s.accepted[digest] = true
+	}
+	s.nominating = len(st.Votes) > 0 || len(st.Accepted) > 0
+	value := st.Ballot.Value
+	counter := func(n uint32) *scpBallot {
+		if n == 0 {
+			return nil
+		}
+		return &scpBallot{n, value}
+	}
+	switch st.Phase {
+	case scpPrepare:
+		ballot := st.Ballot
+		s.ballot = &ballot
+		s.prepared = st.Prepared
+		s.preparedPrime = st.PreparedPrime
+		s.high = counter(st.NHigh)
+		s.commit = counter(st.NCommit)
+	case scpConfirm:
+		ballot := st.Ballot
+		s.ballot = &ballot
+		s.phase = scpConfirm
+		s.prepared = counter(st.NPrepared)
+		s.high = counter(st.NHigh)
+		s.commit = counter(st.NCommit)
+	case scpExternalize:
+		// we'd have kept the slot's record instead
+		return nil, ErrBadStatement
+	}
+	if s.high != nil {
+		// we'd confirmed it prepared
+		s.override = &value
+	}
+	s.statements[id] = st
+	s.seq = st.Seq
+	return s, nil
+}
+
+// Our latest statement (nil if we haven't said anything yet).
+func (s *scpSlot) statement() *scpStatement {
+	return s.statements[s.id]
+}
+
+// Starts nominating, with own if it's not nil. If we've already
+// started, just updates what we'd like to nominate.
+func (s *scpSlot) nominate(own *scpValue) error {
+	if own != nil && len(own.Requests) > 0 {
+		digest, err := own.digest()
+		if err != nil {
+			return err
+		}
+		s.values[digest] = *own
+		s.own = &digest
+	}
+	if !s.nominating {
+		s.nominating = true
+		s.nextRound()
+	}
+	return nil
+}
+
+// Each round, one more node gets to pick what we nominate.
+func (s *scpSlot) nextRound() {
+	s.round++
+	neighbours := append(quorumSetMembers(s.qset), s.id)
+	var leader pbft.NodeId
+	var best uint64
+	for _, node := range neighbours {
+		if priority := s.priority(node); leader == 0 || priority > best {
+			leader, best = node, priority
+		}
+	}
+	s.leaders[leader] = true
+	s.update()
+}
+
+func (s *scpSlot) priority(node pbft.NodeId) uint64 {
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint64(buf, uint64(s.index))
+	binary.BigEndian.PutUint64(buf[8:], uint64(s.round))
+	binary.BigEndian.PutUint64(buf[16:], uint64(node))
+	h := sha256.Sum256(buf)
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// Someone else's statement about this slot.
+func (s *scpSlot) receive(st *scpStatement) error {
+	if st.Slot != s.index || st.Node == s.id || !s.known[st.Node] {
+		return ErrBadStatement
+	}
+	if last, ok := s.statements[st.Node]; ok && last.Seq >= st.Seq {
+		return ErrStaleStatement
+	}
+	values, err := st.check(s.known)
+	if err != nil {
+		return err
+	}
+	for digest, value := range values {
+		s.values[digest] = value
+	}
+	s.statements[st.Node] = st
+	s.update()
+	return nil
+}
+
+// Our ballot timer ran out: try again with a higher counter.
+func (s *scpSlot) timeout() {
+	if s.abandonBallot(0) {
+		s.update()
+	}
+}
+
+// The ballot counter we should be running a timer for, if any: once a
+// quorum is at (or past) our counter, we give it a while to finish
+// before moving on.
+func (s *scpSlot) ballotTimer() (uint32, bool) {
+	if s.ballot == nil || s.phase == scpExternalize {
+		return 0, false
+	}
+	counter := s.ballot.Counter
+	heard := s.isQuorum(func(st *scpStatement) bool {
+		return st.Phase != scpNone && st.workingCounter() >= counter
+	})
+	return counter, heard
+}
+
+// Keeps taking steps until there's nothing left to do, updating our
+// statement as we go.
+func (s *scpSlot) update() {
+	s.restate()
+	for s.phase != scpExternalize {
+		if !s.nominationStep() && !s.ballotStep() {
+			break
+		}
+		s.restate()
+	}
+	s.restate()
+}
+
+// Rebuilds our statement, if anything's changed.
+func (s *scpSlot) restate() {
+	st := &scpStatement{
+		Node:      s.id,
+		Slot:      s.index,
+		QuorumSet: s.qset,
+		Votes:     sortedDigests(s.votes),
+		Accepted:  sortedDigests(s.accepted),
+	}
+	if s.ballot != nil {
+		st.Phase = s.phase
+		switch s.phase {
+		case scpPrepare:
+			st.Ballot = *s.ballot
+			st.Prepared = s.prepared
+			st.PreparedPrime = s.preparedPrime
+			if s.high != nil {
+				st.NHigh = s.high.Counter
+			}
+			if s.commit != nil {
+				st.NCommit = s.commit.Counter
+			}
+		case scpConfirm:
+			st.Ballot = *s.ballot
+			st.NPrepared = s.prepared.Counter
+			st.NCommit = s.commit.Counter
+			st.NHigh = s.high.Counter
+		case scpExternalize:
+			st.Ballot = *s.commit
+			st.NHigh = s.high.Counter
+		}
+	}
+	if last := s.statement(); last != nil && sameStatement(last, st) {
+		return
+	}
+	mentioned := make(map[scpDigest]bool)
+	for _, digest := range st.Votes {
+		mentioned[digest] = true
+	}
+	for _, digest := range st.Accepted {
+		mentioned[digest] = true
+	}
+	if st.Phase != scpNone {
+		mentioned[st.Ballot.Value] = true
+		if st.Prepared != nil {
+			mentioned[st.Prepared.Value] = true
+		}
+		if st.PreparedPrime != nil {
+			mentioned[st.PreparedPrime.Value] = true
+		}
+	}
+	for _, digest := range sortedDigests(mentioned) {
+		st.Values = append(st.Values, s.values[digest])
+	}
+	s.seq++
+	st.Seq = s.seq
+	s.statements[s.id] = st
+}
+
+// Whether two of our statements say the same thing (ignoring Seq and
+// Values, which follow from the rest).
+func sameStatement(a, b *scpStatement) bool {
+	if a.Phase != b.Phase || a.Ballot != b.Ballot || a.NPrepared != b.NPrepared ||
+		a.NCommit != b.NCommit || a.NHigh != b.NHigh ||
+		!sameBallot(a.Prepared, b.Prepared) || !sameBallot(a.PreparedPrime, b.PreparedPrime) ||
+		len(a.Votes) != len(b.Votes) || len(a.Accepted) != len(b.Accepted) {
+		return false
+	}
+	for i, _ := range a.Votes {
+		if a.Votes[i] != b.Votes[i] {
+			return false
+		}
+	}
+	for i, _ := range a.Accepted {
+		if a.Accepted[i] != b.Accepted[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameBallot(a, b *scpBallot) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func sortedDigests(set map[scpDigest]bool) []scpDigest {
+	digests := make([]scpDigest, 0, len(set))
+	for digest, _ := range set {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i][:], digests[j][:]) < 0
+	})
+	return digests
+}
+
+// ** FEDERATED VOTING ** //
+
+// Whether the nodes whose statements satisfy pred include a quorum
+// (of ours).
+func (s *scpSlot) isQuorum(pred func(*scpStatement) bool) bool {
+	nodes := make(map[pbft.NodeId]bool)
+	for node, st := range s.statements {
+		if pred(st) {
+			nodes[node] = true
+		}
+	}
+	// keep dropping nodes that don't have a slice among the rest
+	for removed := true; removed; {
+		removed = false
+		for node, _ := range nodes {
+			if !quorumSetSatisfied(s.statements[node].QuorumSet, nodes) {
+				delete(nodes, node)
+				removed = true
+			}
+		}
+	}
+	return quorumSetSatisfied(s.qset, nodes)
+}
+
+func (s *scpSlot) federatedAccept(voted, accepted func(*scpStatement) bool) bool {
+	acceptedBy := make(map[pbft.NodeId]bool)
+	for node, st := range s.statements {
+		if accepted(st) {
+			acceptedBy[node] = true
+		}
+	}
+	if quorumSetBlocked(s.qset, acceptedBy) {
+		return true
+	}
+	return s.isQuorum(func(st *scpStatement) bool {
+		return voted(st) || accepted(st)
+	})
+}
+
+func (s *scpSlot) federatedRatify(pred func(*scpStatement) bool) bool {
+	return s.isQuorum(pred)
+}
+
+// ** NOMINATION ** //
+
+func containsDigest(digests []scpDigest, digest scpDigest) bool {
+	for _, d := range digests {
+		if d == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scpSlot) nominationStep() bool {
+	if !s.nominating {
+		return false
+	}
+	changed := false
+
+	// until something's confirmed, vote for whatever our leaders want
+	if len(s.candidates) == 0 {
+		for leader, _ := range s.leaders {
+			if leader == s.id {
+				if s.own != nil && !s.votes[*s.own] {
+					s.votes[*s.own] = true
+					changed = true
+				}
+			} else if st, ok := s.statements[leader]; ok {
+				if value, ok := s.favourite(st); ok && !s.votes[value] {
+					s.votes[value] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	nominated := make(map[scpDigest]bool)
+	for _, st := range s.statements {
+		for _, digest := range st.Votes {
+			nominated[digest] = true
+		}
+		for _, digest := range st.Accepted {
+			nominated[digest] = true
+		}
+	}
+	for _, value := range sortedDigests(nominated) {
+		if s.accepted[value] {
+			continue
+		}
+		voted := func(st *scpStatement) bool { return containsDigest(st.Votes, value) }
+		accepted := func(st *scpStatement) bool { return containsDigest(st.Accepted, value) }
+		if s.federatedAccept(voted, accepted) {
+			s.votes[value] = true
+			s.accepted[value] = true
+			changed = true
+		}
+	}
+
+	confirmed := false
+	for _, value := range sortedDigests(s.accepted) {
+		if s.candidates[value] {
+			continue
+		}
+		if s.federatedRatify(func(st *scpStatement) bool { return containsDigest(st.Accepted, value) }) {
+			s.candidates[value] = true
+			confirmed = true
+		}
+	}
+	if confirmed {
+		var values []scpValue
+		for _, digest := range sortedDigests(s.candidates) {
+			values = append(values, s.values[digest])
+		}
+		composite := combineValues(values)
+		digest, err := composite.digest()
+		if err == nil {
+			s.values[digest] = composite
+			s.composite = &digest
+			s.bumpState(digest, false)
+		}
+		changed = true
+	}
+	return changed
+}
+
+// The value a leader's most keen on (the same one whoever asks).
+func (s *scpSlot) favourite(st *scpStatement) (scpDigest, bool) {
+	options := st.Votes
+	if len(st.Accepted) > 0 {
+		options = st.Accepted
+	}
+	var best scpDigest
+	var bestHash [sha256.Size]byte
+	found := false
+	for _, digest := range options {
+		buf := make([]byte, 8+len(digest))
+		binary.BigEndian.PutUint64(buf, uint64(s.index))
+		copy(buf[8:], digest[:])
+		h := sha256.Sum256(buf)
+		if !found || bytes.Compare(h[:], bestHash[:]) > 0 {
+			best, bestHash, found = digest, h, true
+		}
+	}
+	return best, found
+}
+
+// ** BALLOTS ** //
+
+func (s *scpSlot) ballotStep() bool {
+	return s.attemptAcceptPrepared() || s.attemptConfirmPrepared() ||
+		s.attemptAcceptCommit() || s.attemptConfirmCommit() || s.attemptBump()
+}
+
+// Every ballot anybody's said anything about, highest first.
+func (s *scpSlot) prepareCandidates() []scpBallot {
+	seen := make(map[scpBallot]bool)
+	for _, st := range s.statements {
+		switch st.Phase {
+		case scpPrepare:
+			seen[st.Ballot] = true
+			if st.Prepared != nil {
+				seen[*st.Prepared] = true
+			}
+			if st.PreparedPrime != nil {
+				seen[*st.PreparedPrime] = true
+			}
+		case scpConfirm:
+			seen[scpBallot{st.NPrepared, st.Ballot.Value}] = true
+			seen[scpBallot{SCP_INFINITY, st.Ballot.Value}] = true
+		case scpExternalize:
+			seen[scpBallot{SCP_INFINITY, st.Ballot.Value}] = true
+		}
+	}
+	candidates := make([]scpBallot, 0, len(seen))
+	for ballot, _ := range seen {
+		if ballot.Counter != 0 {
+			candidates = append(candidates, ballot)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return compareBallots(candidates[i], candidates[j]) > 0
+	})
+	return candidates
+}
+
+func (s *scpSlot) attemptAcceptPrepared() bool {
+	if s.phase != scpPrepare && s.phase != scpConfirm {
+		return false
+	}
+	for _, ballot := range s.prepareCandidates() {
+		// once we're confirming, only our value matters
+		if s.phase == scpConfirm && !ballotsLessAndCompatible(*s.prepared, ballot) {
+			continue
+		}
+		if s.preparedPrime != nil && ballotsLessAndCompatible(ballot, *s.preparedPrime) {
+			continue
+		}
+		if s.prepared != nil && ballotsLessAndCompatible(ballot, *s.prepared) {
+			continue
+		}
+		b := ballot
+		if s.federatedAccept(
+			func(st *scpStatement) bool { return st.votesPrepared(b) },
+			func(st *scpStatement) bool { return st.acceptsPrepared(b) }) {
+			return s.setAcceptPrepared(b)
+		}
+	}
+	return false
+}
+
+func (s *scpSlot) setAcceptPrepared(ballot scpBallot) bool {
+	changed := false
+	if s.prepared == nil {
+		s.prepared = &ballot
+		changed = true
+	} else if cmp := compareBallots(*s.prepared, ballot); cmp < 0 {
+		if !ballotsCompatible(*s.prepared, ballot) {
+			s.preparedPrime = s.prepared
+		}
+		s.prepared = &ballot
+		changed = true
+	} else if cmp > 0 && !ballotsCompatible(*s.prepared, ballot) &&
+		(s.preparedPrime == nil || compareBallots(*s.preparedPrime, ballot) < 0) {
+		s.preparedPrime = &ballot
+		changed = true
+	}
+	// we can't vote to commit something we've accepted an abort of
+	if s.commit != nil && s.high != nil &&
+		((s.prepared != nil && ballotsLessAndIncompatible(*s.high, *s.prepared)) ||
+			(s.preparedPrime != nil && ballotsLessAndIncompatible(*s.high, *s.preparedPrime))) {
+		s.commit = nil
+		changed = true
+	}
+	return changed
+}
+
+func (s *scpSlot) attemptConfirmPrepared() bool {
+	if s.phase != scpPrepare || s.prepared == nil {
+		return false
+	}
+	candidates := s.prepareCandidates()
+	acceptsPrepared := func(ballot scpBallot) func(*scpStatement) bool {
+		return func(st *scpStatement) bool { return st.acceptsPrepared(ballot) }
+	}
+
+	// the highest ballot a quorum has accepted as prepared...
+	i := 0
+	var newHigh *scpBallot
+	for ; i < len(candidates); i++ {
+		ballot := candidates[i]
+		if s.high != nil && compareBallots(*s.high, ballot) >= 0 {
+			break
+		}
+		if s.federatedRatify(acceptsPrepared(ballot)) {
+			newHigh = &ballot
+			break
+		}
+	}
+	if newHigh == nil {
+		return false
+	}
+
+	// ...and the lowest we can start voting to commit
+	var newCommit *scpBallot
+	if s.commit == nil &&
+		(s.prepared == nil || !ballotsLessAndIncompatible(*newHigh, *s.prepared)) &&
+		(s.preparedPrime == nil || !ballotsLessAndIncompatible(*newHigh, *s.preparedPrime)) {
+		for ; i < len(candidates); i++ {
+			ballot := candidates[i]
+			if s.ballot != nil && compareBallots(ballot, *s.ballot) < 0 {
+				break
+			}
+			if !ballotsLessAndCompatible(ballot, *newHigh) {
+				continue
+			}
+			if !s.federatedRatify(acceptsPrepared(ballot)) {
+				break
+			}
+			newCommit = &ballot
+		}
+	}
+	return s.setConfirmPrepared(newCommit, *newHigh)
+}
+
+func (s *scpSlot) setConfirmPrepared(newCommit *scpBallot, newHigh scpBallot) bool {
+	changed := false
+	value := newHigh.Value
+	s.override = &value
+	if s.ballot == nil || ballotsCompatible(*s.ballot, newHigh) {
+		if s.high == nil || compareBallots(newHigh, *s.high) > 0 {
+			s.high = &newHigh
+			changed = true
+		}
+		if newCommit != nil {
+			s.commit = newCommit
+			changed = true
+		}
+	}
+	return s.updateCurrentIfNeeded(newHigh) || changed
+}
+
+// Commit counter boundaries people have mentioned for value, highest
+// first.
+func (s *scpSlot) commitBoundaries(value scpDigest) []uint32 {
+	seen := make(map[uint32]bool)
+	for _, st := range s.statements {
+		if st.Ballot.Value != value {
+			continue
+		}
+		switch st.Phase {
+		case scpPrepare:
+			if st.NCommit != 0 {
+				seen[st.NCommit] = true
+				seen[st.NHigh] = true
+			}
+		case scpConfirm:
+			seen[st.NCommit] = true
+			seen[st.NHigh] = true
+		case scpExternalize:
+			seen[st.Ballot.Counter] = true
+			seen[st.NHigh] = true
+			seen[SCP_INFINITY] = true
+		}
+	}
+	boundaries := make([]uint32, 0, len(seen))
+	for b, _ := range seen {
+		if b != 0 {
+			boundaries = append(boundaries, b)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] > boundaries[j] })
+	return boundaries
+}
+
+// The widest [low, high] that pred holds for, starting from the top.
+// low is 0 if there isn't one.
+func findInterval(boundaries []uint32, pred func(low, high uint32) bool) (uint32, uint32) {
+	var low, high uint32
+	for _, b := range boundaries {
+		curLow, curHigh := b, b
+		if high != 0 {
+			curHigh = high
+		}
+		if pred(curLow, curHigh) {
+			low, high = curLow, curHigh
+		} else if high != 0 {
+			break
+		}
+	}
+	return low, high
+}
+
+func (s *scpSlot) attemptAcceptCommit() bool {
+	if s.phase != scpPrepare && s.phase != scpConfirm {
+		return false
+	}
+	tried := make(map[scpDigest]bool)
+	for _, st := range s.statements {
+		if st.Phase == scpNone || (st.Phase == scpPrepare && st.NCommit == 0) {
+			continue
+		}
+		value := st.Ballot.Value
+		if tried[value] || (s.phase == scpConfirm && value != s.high.Value) {
+			continue
+		}
+		tried[value] = true
+		low, high := findInterval(s.commitBoundaries(value), func(low, high uint32) bool {
+			return s.federatedAccept(
+				func(st *scpStatement) bool { return st.votesCommit(value, low, high) },
+				func(st *scpStatement) bool { return st.acceptsCommit(value, low, high) })
+		})
+		if low != 0 && (s.phase != scpConfirm || high > s.high.Counter) {
+			return s.setAcceptCommit(scpBallot{low, value}, scpBallot{high, value})
+		}
+	}
+	return false
+}
+
+func (s *scpSlot) setAcceptCommit(commit, high scpBallot) bool {
+	value := high.Value
+	s.override = &value
+	s.commit = &commit
+	s.high = &high
+	if s.phase == scpPrepare {
+		s.phase = scpConfirm
+		if s.ballot != nil && !ballotsLessAndCompatible(high, *s.ballot) {
+			s.bumpToBallot(high)
+		}
+		s.preparedPrime = nil
+	}
+	// committing high means we've accepted it as prepared, too
+	if s.prepared == nil || !ballotsLessAndCompatible(high, *s.prepared) {
+		s.prepared = &high
+	}
+	s.updateCurrentIfNeeded(high)
+	return true
+}
+
+func (s *scpSlot) attemptConfirmCommit() bool {
+	if s.phase != scpConfirm {
+		return false
+	}
+	value := s.high.Value
+	low, high := findInterval(s.commitBoundaries(value), func(low, high uint32) bool {
+		return s.federatedRatify(func(st *scpStatement) bool { return st.acceptsCommit(value, low, high) })
+	})
+	if low == 0 {
+		return false
+	}
+	s.commit = &scpBallot{low, value}
+	s.high = &scpBallot{high, value}
+	s.updateCurrentIfNeeded(*s.high)
+	s.phase = scpExternalize
+	externalized := s.values[value]
+	s.externalized = &externalized
+	return true
+}
+
+// If a v-blocking set is on higher counters than us, we're not going to
+// get anywhere on ours: catch up.
+func (s *scpSlot) attemptBump() bool {
+	if s.phase != scpPrepare && s.phase != scpConfirm {
+		return false
+	}
+	var ours uint32
+	if s.ballot != nil {
+		ours = s.ballot.Counter
+	}
+	above := func(counter uint32) map[pbft.NodeId]bool {
+		nodes := make(map[pbft.NodeId]bool)
+		for node, st := range s.statements {
+			if node != s.id && st.Phase != scpNone && st.workingCounter() > counter {
+				nodes[node] = true
+			}
+		}
+		return nodes
+	}
+	if !quorumSetBlocked(s.qset, above(ours)) {
+		return false
+	}
+	seen := make(map[uint32]bool)
+	for node, st := range s.statements {
+		if node != s.id && st.Phase != scpNone && st.workingCounter() > ours {
+			seen[st.workingCounter()] = true
+		}
+	}
+	counters := make([]uint32, 0, len(seen))
+	for counter, _ := range seen {
+		counters = append(counters, counter)
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i] < counters[j] })
+	for _, counter := range counters {
+		if !quorumSetBlocked(s.qset, above(counter)) {
+			return s.abandonBallot(counter)
+		}
+	}
+	return false
+}
+
+// Moves on to counter (or the next one, if that's 0).
+func (s *scpSlot) abandonBallot(counter uint32) bool {
+	var value scpDigest
+	if s.composite != nil {
+		value = *s.composite
+	} else if s.ballot != nil {
+		value = s.ballot.Value
+	} else {
+		return false
+	}
+	if counter == 0 {
+		return s.bumpState(value, true)
+	}
+	return s.bumpStateTo(value, counter)
+}
+
+// Starts balloting on value, or (if force) moves on to the next
+// counter.
+func (s *scpSlot) bumpState(value scpDigest, force bool) bool {
+	if !force && s.ballot != nil {
+		return false
+	}
+	counter := uint32(1)
+	if s.ballot != nil {
+		counter = s.ballot.Counter + 1
+	}
+	return s.bumpStateTo(value, counter)
+}
+
+func (s *scpSlot) bumpStateTo(value scpDigest, counter uint32) bool {
+	if s.phase != scpPrepare && s.phase != scpConfirm {
+		return false
+	}
+	if s.override != nil {
+		value = *s.override
+	}
+	ballot := scpBallot{counter, value}
+	if s.ballot == nil {
+		s.bumpToBallot(ballot)
+		return true
+	}
+	if s.commit != nil && !ballotsCompatible(*s.commit, ballot) {
+		return false
+	}
+	if compareBallots(*s.ballot, ballot) >= 0 {
+		return false
+	}
+	s.bumpToBallot(ballot)
+	return true
+}
+
+func (s *scpSlot) updateCurrentIfNeeded(high scpBallot) bool {
+	if s.ballot == nil || compareBallots(*s.ballot, high) < 0 {
+		s.bumpToBallot(high)
+		return true
+	}
+	return false
+}
+
+func (s *scpSlot) bumpToBallot(ballot scpBallot) {
+	s.ballot = &ballot
+	// h and c have to stay compatible with b
+	if s.high != nil && !ballotsCompatible(ballot, *s.high) {
+		s.high = nil
+		s.commit = nil
+	}
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"distributepki/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"pbft"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+// ** SCP ** //
+
+// Runs SCP slots (see scp.go) one after another, and applies whatever
+// each one decides. Nodes talk over HTTP on their consensus port (like
+// the raft engine), and sign their statements with their PGP keys.
+// Client requests are flooded to every node, so whoever ends up leading
+// nomination has them.
+//
+// With an EngineFile, a node keeps what it's said and decided there
+// (see scp_storage.go), and picks up where it left off when it
+// restarts. Without one it starts again from slot 1, and catches up
+// from its peers' final statements, as long as they still remember the
+// slots it missed (the last SCP_HISTORY). Either way it catches up on
+// slots it missed while it was down the same way.
+//
+// Every checkpoint interval's worth of slots, we snapshot the
+// application, so there's less to replay.
+
+const SCP_ENDPOINT string = "/scp"
+
+// Timers are checked every tick. Nomination rounds and ballots get
+// longer the longer they go on (up to SCP_MAX_TIMEOUTS times as long).
+const SCP_TICK time.Duration = 50 * time.Millisecond
+const SCP_NOMINATION_TIMEOUT time.Duration = 500 * time.Millisecond
+const SCP_BALLOT_TIMEOUT time.Duration = time.Second
+const SCP_MAX_TIMEOUTS int = 30
+
+// We resend our statement this often, in case anybody missed it
+const SCP_REBROADCAST time.Duration = time.Second
+
+// How many finished slots we remember, for nodes that are behind, and
+// how far ahead we keep statements for
+const SCP_HISTORY int = 1024
+const SCP_FUTURE_SLOTS int = 64
+
+const SCP_QUEUE_SIZE int = 256
+const SCP_SEND_TIMEOUT time.Duration = time.Second
+
+type scpMessage struct {
+	Statement *scpStatement `json:",omitempty"`
+	Signature []byte        `json:",omitempty"`
+	Request   *pbft.Request `json:",omitempty"` // flooded from whoever the client asked
+}
+
+// How messages get to other nodes. (Tests swap in their own.)
+type scpTransport interface {
+	send(to pbft.NodeId, message *scpMessage)
+	stop(ctx context.Context) error
+}
+
+type scpEngine struct {
+	*committer
+	id        pbft.NodeId
+	qset      pbft.QuorumSet
+	members   []pbft.NodeId
+	known     map[pbft.NodeId]bool
+	signer    pbft.Signer
+	verifier  pbft.Verifier
+	logger    *capnslog.PackageLogger
+	transport scpTransport
+	storage   *scpStorage
+	maxPool   int
+
+	snapshotInterval int // in slots
+
+	incoming      chan *scpMessage
+	requests      chan *pbft.Request
+	statusChannel chan chan scpStatus
+	failure       chan error
+	quit          chan struct{}
+	done          chan struct{}
+	stopOnce      sync.Once
+
+	// Only touched by run()
+	slot                *scpSlot
+	signed              *scpMessage // our latest statement for this slot
+	future              map[int]map[pbft.NodeId]*scpStatement
+	history             map[int]*scpMessage // our final statements for past slots
+	pool                map[[sha256.Size]byte]pbft.Request
+	lastSnapshot        int // slot
+	nominationDeadline  time.Time
+	ballotCounter       uint32 // 0 if the ballot timer isn't running
+	ballotDeadline      time.Time
+	rebroadcastDeadline time.Time
+}
+
+type scpStatus struct {
+	Engine     string
+	Id         pbft.NodeId
+	QuorumSet  pbft.QuorumSet
+	Slot       int
+	Round      int // of nomination
+	Candidates int
+	Phase      string
+	Ballot     uint32        // counter
+	Heard      []pbft.NodeId // who we've heard from about this slot
+	Executed   int
+	Pooled     int // flooded requests waiting for a slot
+	Proposals  int // waiting to be applied
+}
+
+// Without a quorum set in its config, a node needs 2f+1 of the whole
+// cluster, like PBFT.
+func scpQuorumSet(config pbft.NodeConfig, cluster pbft.ClusterConfig) (pbft.QuorumSet, error) {
+	members := clusterMembers(cluster)
+	if config.QuorumSet == nil {
+		f := (len(members) - 1) / 3
+		return pbft.QuorumSet{Threshold: 2*f + 1, Validators: members}, nil
+	}
+	known := make(map[pbft.NodeId]bool)
+	for _, member := range members {
+		known[member] = true
+	}
+	return *config.QuorumSet, checkQuorumSet(*config.QuorumSet, known)
+}
+
+func newSCPEngine(config pbft.NodeConfig, cluster pbft.ClusterConfig, app pbft.StateMachine) (*scpEngine, error) {
+	qset, err := scpQuorumSet(config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	entity, err := pbft.ReadPrivateKey(config.PrivateKeyFile, config.PassPhraseFile)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := cluster.Domain()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := pbft.NewVerifier(cluster)
+	if err != nil {
+		return nil, err
+	}
+	e := &scpEngine{
+		committer:     newCommitter(app, cluster.MaxPendingRequests),
+		id:            config.Id,
+		qset:          qset,
+		members:       clusterMembers(cluster),
+		known:         make(map[pbft.NodeId]bool),
+		signer:        pbft.Signer{Entity: entity, Domain: domain},
+		verifier:      verifier,
+		logger:        capnslog.NewPackageLogger("github.com/sydli/distributePKI", fmt.Sprintf("SCP [Node %v]", config.Id)),
+		maxPool:       cluster.MaxPendingRequests,
+		incoming:      make(chan *scpMessage, SCP_QUEUE_SIZE),
+		requests:      make(chan *pbft.Request, SCP_QUEUE_SIZE),
+		statusChannel: make(chan chan scpStatus),
+		failure:       make(chan error, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+		future:        make(map[int]map[pbft.NodeId]*scpStatement),
+		history:       make(map[int]*scpMessage),
+		pool:          make(map[[sha256.Size]byte]pbft.Request),
+	}
+	if e.maxPool <= 0 {
+		e.maxPool = pbft.MAX_PENDING_REQUESTS
+	}
+	for _, member := range e.members {
+		e.known[member] = true
+	}
+	e.snapshotInterval = cluster.CheckpointInterval
+	if e.snapshotInterval <= 0 {
+		e.snapshotInterval = int(pbft.CHECKPOINT)
+	}
+	if !e.known[e.id] {
+		return nil, fmt.Errorf("Node %d isn't in the cluster", e.id)
+	}
+	if e.storage, err = openSCPStorage(config.EngineFile); err != nil {
+		return nil, err
+	}
+	if err := e.load(); err != nil {
+		e.storage.close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Starts from whatever we kept last time (see scp_storage.go).
+func (e *scpEngine) load() error {
+	saved, err := e.storage.load()
+	if err != nil {
+		return err
+	}
+	if saved.base == nil {
+		// first time: remember what the application started from
+		base, err := e.snapshot()
+		if err != nil {
+			return err
+		}
+		e.slot = newSCPSlot(1, e.id, e.qset, e.known)
+		return e.storage.saveBase(base)
+	}
+	from := 0
+	if saved.snapshot != nil {
+		err = e.restore(saved.snapshot.Data)
+		from = saved.snapshot.Slot
+	} else {
+		err = e.restore(saved.base)
+	}
+	if err != nil {
+		return err
+	}
+	e.lastSnapshot = from
+	for index := from + 1; index <= saved.last; index++ {
+		record, ok := saved.slots[index]
+		if !ok || record.Value == nil {
+			return fmt.Errorf("Missing slot %d", index)
+		}
+		for _, request := range record.Value.Requests {
+			e.execute(request)
+		}
+	}
+	for index, record := range saved.slots {
+		if index > saved.last-SCP_HISTORY {
+			e.history[index] = record.Final
+		}
+	}
+	e.slot = newSCPSlot(saved.last+1, e.id, e.qset, e.known)
+	if st := saved.statement; st != nil && st.Statement != nil && st.Statement.Slot == saved.last+1 {
+		if e.slot, err = restoreSCPSlot(st.Statement, e.id, e.qset, e.known); err != nil {
+			return err
+		}
+		e.signed = st
+	}
+	e.logger.Infof("Picking up from slot %d", e.slot.index)
+	return nil
+}
+
+func startSCPEngine(config pbft.NodeConfig, cluster pbft.ClusterConfig, app pbft.StateMachine) (*scpEngine, error) {
+	e, err := newSCPEngine(config, cluster, app)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newSCPHTTPTransport(e, config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	e.start(transport)
+	e.logger.Infof("Listening on %v with quorum set %+v", SCP_ENDPOINT, e.qset)
+	return e, nil
+}
+
+func (e *scpEngine) start(transport scpTransport) {
+	e.transport = transport
+	go e.run()
+}
+
+func (e *scpEngine) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(SCP_TICK)
+	defer ticker.Stop()
+	e.rebroadcastDeadline = time.Now().Add(SCP_REBROADCAST)
+	for {
+		select {
+		case message := <-e.incoming:
+			if message.Statement != nil {
+				e.handleStatement(message)
+			} else {
+				e.addRequest(message.Request, false)
+			}
+		case request := <-e.requests:
+			e.addRequest(request, true)
+		case reply := <-e.statusChannel:
+			reply <- e.status()
+		case now := <-ticker.C:
+			e.tick(now)
+		case <-e.quit:
+			e.shutdown(pbft.ErrStopped)
+			return
+		}
+		if err := e.advance(); err != nil {
+			// we can't promise anything we can't keep
+			e.logger.Errorf("Saving SCP state: %v", err)
+			select {
+			case e.failure <- err:
+			default:
+			}
+			e.shutdown(pbft.ErrStopped)
+			return
+		}
+	}
+}
+
+func (e *scpEngine) shutdown(err error) {
+	e.proposals.failAll(err)
+	e.stream.Close()
+	if err := e.storage.close(); err != nil {
+		e.logger.Errorf("Closing SCP storage: %v", err)
+	}
+}
+
+// After everything that happens: apply whatever's been decided, tell
+// everybody what we think now, and keep the ballot timer right.
+// Whatever we say is saved before it's sent.
+func (e *scpEngine) advance() error {
+	for e.slot.externalized != nil {
+		if err := e.externalize(); err != nil {
+			return err
+		}
+	}
+	if !e.slot.nominating && len(e.pool) > 0 {
+		e.nominate()
+	}
+	if st := e.slot.statement(); st != nil && (e.signed == nil || e.signed.Statement.Seq != st.Seq) {
+		signed := e.sign(st)
+		if err := e.storage.saveStatement(signed); err != nil {
+			return err
+		}
+		e.signed = signed
+		e.broadcast(e.signed)
+	}
+	if counter, heard := e.slot.ballotTimer(); !heard {
+		e.ballotCounter = 0
+	} else if counter != e.ballotCounter {
+		e.ballotCounter = counter
+		e.ballotDeadline = time.Now().Add(scpTimeout(SCP_BALLOT_TIMEOUT, int(counter)))
+	}
+	return nil
+}
+
+func (e *scpEngine) tick(now time.Time) {
+	if e.slot.nominating && len(e.slot.candidates) == 0 && now.After(e.nominationDeadline) {
+		// somebody else might have better luck
+		own := e.batch()
+		e.slot.nominate(&own)
+		e.slot.nextRound()
+		e.nominationDeadline = now.Add(scpTimeout(SCP_NOMINATION_TIMEOUT, e.slot.round))
+	}
+	if e.ballotCounter != 0 && now.After(e.ballotDeadline) {
+		e.ballotCounter = 0
+		e.slot.timeout()
+	}
+	if now.After(e.rebroadcastDeadline) {
+		if e.signed != nil {
+			e.broadcast(e.signed)
+		}
+		e.rebroadcastDeadline = now.Add(SCP_REBROADCAST)
+	}
+}
+
+func scpTimeout(base time.Duration, round int) time.Duration {
+	if round > SCP_MAX_TIMEOUTS {
+		round = SCP_MAX_TIMEOUTS
+	}
+	return time.Duration(round) * base
+}
+
+// ** SLOTS ** //
+
+// What we'd like the current slot to decide on: everything we've got.
+func (e *scpEngine) batch() scpValue {
+	batch := scpValue{Requests: make([]pbft.Request, 0, len(e.pool))}
+	for _, request := range e.pool {
+		batch.Requests = append(batch.Requests, request)
+	}
+	return combineValues([]scpValue{batch})
+}
+
+func (e *scpEngine) nominate() {
+	own := e.batch()
+	if err := e.slot.nominate(&own); err != nil {
+		e.logger.Errorf("Nominating for slot %d: %v", e.slot.index, err)
+		return
+	}
+	e.nominationDeadline = time.Now().Add(scpTimeout(SCP_NOMINATION_TIMEOUT, e.slot.round))
+}
+
+func (e *scpEngine) handleStatement(message *scpMessage) {
+	st := message.Statement
+	if st.Slot < e.slot.index {
+		// they're behind: tell them how it ended
+		if final, ok := e.history[st.Slot]; ok && st.Phase != scpExternalize {
+			e.transport.send(st.Node, final)
+		}
+		return
+	}
+	if st.Slot > e.slot.index {
+		if st.Slot-e.slot.index > SCP_FUTURE_SLOTS {
+			return
+		}
+		if e.future[st.Slot] == nil {
+			e.future[st.Slot] = make(map[pbft.NodeId]*scpStatement)
+		}
+		if last, ok := e.future[st.Slot][st.Node]; !ok || last.Seq < st.Seq {
+			e.future[st.Slot][st.Node] = st
+		}
+		return
+	}
+	e.receive(st)
+}
+
+func (e *scpEngine) receive(st *scpStatement) {
+	if err := e.slot.receive(st); err == ErrStaleStatement {
+		return
+	} else if err != nil {
+		e.logger.Warningf("Statement from node %d about slot %d: %v", st.Node, st.Slot, err)
+		return
+	}
+	// join in once anybody's nominating
+	if !e.slot.nominating && (len(st.Votes) > 0 || len(st.Accepted) > 0 || st.Phase != scpNone) {
+		e.nominate()
+	}
+}
+
+// The current slot's decided: apply it and move on to the next one.
+func (e *scpEngine) externalize() error {
+	index := e.slot.index
+	value := e.slot.externalized
+	final := e.sign(e.slot.statement())
+	if err := e.storage.saveSlot(index, scpSlotRecord{Final: final, Value: value}); err != nil {
+		return err
+	}
+	if e.signed == nil || e.signed.Statement.Seq != final.Statement.Seq {
+		e.broadcast(final)
+	}
+	e.history[index] = final
+	delete(e.history, index-SCP_HISTORY)
+	for _, request := range value.Requests {
+		e.execute(request)
+	}
+	e.logger.Debugf("Slot %d externalized %d requests", index, len(value.Requests))
+	if index-e.lastSnapshot >= e.snapshotInterval {
+		// (we can always replay from the last one)
+		if err := e.saveSnapshot(index); err != nil {
+			e.logger.Errorf("Snapshotting slot %d: %v", index, err)
+		}
+	}
+
+	e.slot = newSCPSlot(index+1, e.id, e.qset, e.known)
+	e.signed = nil
+	e.ballotCounter = 0
+	statements := e.future[index+1]
+	delete(e.future, index+1)
+	nodes := make([]pbft.NodeId, 0, len(statements))
+	for node, _ := range statements {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	for _, node := range nodes {
+		e.receive(statements[node])
+	}
+	return nil
+}
+
+// Snapshots the application as of slot, so a restart doesn't have to
+// replay everything before it.
+func (e *scpEngine) saveSnapshot(slot int) error {
+	data, err := e.snapshot()
+	if err != nil {
+		return err
+	}
+	if err := e.storage.saveSnapshot(scpSnapshot{Slot: slot, Data: data}, slot-SCP_HISTORY); err != nil {
+		return err
+	}
+	e.lastSnapshot = slot
+	return nil
+}
+
+func (e *scpEngine) execute(request pbft.Request) {
+	digest, err := request.Digest()
+	if err != nil {
+		e.logger.Errorf("Digesting externalized request: %v", err)
+		return
+	}
+	delete(e.pool, digest)
+	e.commitNext(request)
+}
+
+// ** REQUESTS ** //
+
+func (e *scpEngine) Propose(ctx context.Context, request *pbft.Request) *pbft.Proposal {
+	digest, err := request.Digest()
+	p := pbft.NewProposal(digest)
+	if err != nil {
+		p.Resolve(pbft.ProposalResult{}, err)
+		return p
+	}
+	select {
+	case <-e.quit:
+		p.Resolve(pbft.ProposalResult{}, pbft.ErrStopped)
+		return p
+	default:
+	}
+	if !e.proposals.add(digest, p) {
+		p.Resolve(pbft.ProposalResult{}, pbft.ErrOverloaded)
+		return p
+	}
+	select {
+	case e.requests <- request:
+	default:
+		e.proposals.fail(digest, p, pbft.ErrOverloaded)
+		return p
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.proposals.fail(digest, p, ctx.Err())
+		case <-p.Done():
+		}
+	}()
+	return p
+}
+
+// Pools a request until a slot picks it up. Requests from our own
+// clients get passed on to everybody else. (Peers' requests get the
+// same checks ours do.)
+func (e *scpEngine) addRequest(request *pbft.Request, ours bool) {
+	if request == nil {
+		return
+	}
+	digest, err := request.Digest()
+	if err != nil {
+		return
+	}
+	if err := e.admit(request); err != nil {
+		e.proposals.resolve(digest, pbft.ProposalResult{}, err)
+		return
+	}
+	if result, err, done := e.replied(request, digest); done {
+		e.proposals.resolve(digest, result, err)
+		return
+	}
+	if _, ok := e.pool[digest]; ok {
+		return
+	}
+	if len(e.pool) >= e.maxPool {
+		e.proposals.resolve(digest, pbft.ProposalResult{}, pbft.ErrOverloaded)
+		return
+	}
+	e.pool[digest] = *request
+	if ours {
+		e.broadcast(&scpMessage{Request: request})
+	}
+}
+
+// Until the next nomination round, at least
+func (e *scpEngine) RetryAfter(err error) time.Duration {
+	return SCP_NOMINATION_TIMEOUT
+}
+
+// ** MESSAGES ** //
+
+func (e *scpEngine) sign(st *scpStatement) *scpMessage {
+	st.Domain = e.signer.Domain
+	signature, err := e.signer.Sign(*st)
+	if err != nil {
+		e.logger.Errorf("Signing statement: %v", err)
+	}
+	return &scpMessage{Statement: st, Signature: signature}
+}
+
+func (e *scpEngine) broadcast(message *scpMessage) {
+	for _, member := range e.members {
+		if member != e.id {
+			e.transport.send(member, message)
+		}
+	}
+}
+
+// Takes a message from another node. Statements have to be signed by
+// whoever they're from.
+func (e *scpEngine) deliver(message *scpMessage) error {
+	if st := message.Statement; st != nil {
+		signer, err := e.verifier.Verify(st.Domain, *st, message.Signature)
+		if err != nil {
+			return err
+		} else if signer != st.Node {
+			return errors.New("Statement not signed by the node it's from")
+		}
+	} else if message.Request == nil {
+		return errors.New("Empty message")
+	}
+	select {
+	case e.incoming <- message:
+		return nil
+	case <-e.quit:
+		return pbft.ErrStopped
+	default:
+		return pbft.ErrOverloaded
+	}
+}
+
+// ** TRANSPORT ** //
+
+type scpHTTPTransport struct {
+	peers   map[pbft.NodeId]string // id => URL
+	clients map[pbft.NodeId]*http.Client
+	server  *http.Server
+	logger  *capnslog.PackageLogger
+}
+
+func newSCPHTTPTransport(e *scpEngine, config pbft.NodeConfig, cluster pbft.ClusterConfig) (*scpHTTPTransport, error) {
+	serverTLS, err := pbft.ServerTLSConfig(config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	dialTLS, err := pbft.DialTLSConfigs(config, cluster)
+	if err != nil {
+		return nil, err
+	}
+	t := &scpHTTPTransport{
+		peers:   make(map[pbft.NodeId]string),
+		clients: make(map[pbft.NodeId]*http.Client),
+		logger:  e.logger,
+	}
+	scheme := "http"
+	if serverTLS != nil {
+		scheme = "https"
+	}
+	for _, node := range cluster.Nodes {
+		if node.Id == config.Id {
+			continue
+		}
+		t.peers[node.Id] = scheme + "://" + util.GetHostname(node.Host, node.Port) + SCP_ENDPOINT
+		transport := &http.Transport{}
+		if dialTLS != nil {
+			transport.TLSClientConfig = dialTLS[node.Id]
+		}
+		t.clients[node.Id] = &http.Client{Transport: transport, Timeout: SCP_SEND_TIMEOUT}
+	}
+
+	listener, err := net.Listen("tcp", util.GetHostname("", config.Port))
+	if err != nil {
+		return nil, err
+	}
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(SCP_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var message scpMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, "Error decoding message", http.StatusBadRequest)
+			return
+		}
+		if err := e.deliver(&message); err == pbft.ErrOverloaded || err == pbft.ErrStopped {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	t.server = &http.Server{Handler: mux}
+	go func() {
+		if err := t.server.Serve(listener); err != http.ErrServerClosed {
+			t.logger.Errorf("Serving SCP: %v", err)
+			select {
+			case e.failure <- err:
+			default:
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Doesn't wait; statements get resent anyway.
+func (t *scpHTTPTransport) send(to pbft.NodeId, message *scpMessage) {
+	client, ok := t.clients[to]
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.logger.Errorf("Encoding message: %v", err)
+		return
+	}
+	go func() {
+		resp, err := client.Post(t.peers[to], "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.logger.Debugf("Sending to node %d: %v", to, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.logger.Debugf("Node %d answered %s", to, resp.Status)
+		}
+	}()
+}
+
+func (t *scpHTTPTransport) stop(ctx context.Context) error {
+	return t.server.Shutdown(ctx)
+}
+
+// ** ConsensusEngine ** //
+
+func (e *scpEngine) Id() pbft.NodeId {
+	return e.id
+}
+
+func (e *scpEngine) Members() []pbft.NodeId {
+	return e.members
+}
+
+func (e *scpEngine) status() scpStatus {
+	status := scpStatus{
+		Engine:     ENGINE_SCP,
+		Id:         e.id,
+		QuorumSet:  e.qset,
+		Slot:       e.slot.index,
+		Round:      e.slot.round,
+		Candidates: len(e.slot.candidates),
+		Phase:      e.slot.phase.String(),
+		Executed:   e.applied(),
+		Pooled:     len(e.pool),
+		Proposals:  e.proposals.count(),
+	}
+	if e.slot.ballot != nil {
+		status.Ballot = e.slot.ballot.Counter
+	}
+	for node, _ := range e.slot.statements {
+		status.Heard = append(status.Heard, node)
+	}
+	sort.Slice(status.Heard, func(i, j int) bool { return status.Heard[i] < status.Heard[j] })
+	return status
+}
+
+func (e *scpEngine) Status() interface{} {
+	reply := make(chan scpStatus, 1)
+	select {
+	case e.statusChannel <- reply:
+		return <-reply
+	case <-e.done:
+		return scpStatus{Engine: ENGINE_SCP, Id: e.id, QuorumSet: e.qset}
+	}
+}
+
+func (e *scpEngine) Down() bool {
+	return false
+}
+
+func (e *scpEngine) Failure() <-chan error {
+	return e.failure
+}
+
+func (e *scpEngine) Stop(ctx context.Context) error {
+	e.stopOnce.Do(func() {
+		e.logger.Info("STOPPING")
+		close(e.quit)
+	})
+	err := e.transport.stop(ctx)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// ** SCP STORAGE ** //
+
+// What a node that restarts needs so as not to contradict itself: our
+// latest signed statement about the current slot (its Seq carries on
+// from there, so peers don't take what we say next as stale), and for
+// every slot we've externalized, our final statement and the value.
+// Every so often we snapshot the application too, and forget the
+// values (but not the final statements peers might ask for) before it.
+// It all goes in a bolt database at the node's EngineFile, and each
+// statement's written before it's sent. Like the raft engine, we keep
+// what the application first started from (the base), for restarts
+// before the first snapshot.
+
+// How long to wait for another process to let go of the file
+const SCP_BOLT_TIMEOUT time.Duration = time.Second
+
+var (
+	scpStateBucket = []byte("state")
+	scpSlotsBucket = []byte("slots")
+	statementField = []byte("statement")
+)
+
+type scpStorage struct {
+	db *bolt.DB // nil if we're not keeping anything
+}
+
+// An externalized slot.
+type scpSlotRecord struct {
+	Final *scpMessage
+	Value *scpValue `json:",omitempty"` // nil once it's in a snapshot
+}
+
+type scpSnapshot struct {
+	Slot int // the last one it includes
+	Data []byte
+}
+
+// What was on disk when we started.
+type scpSaved struct {
+	base      []byte // nil if we've never started before
+	snapshot  *scpSnapshot
+	statement *scpMessage // about the slot after the last in slots
+	slots     map[int]scpSlotRecord
+	last      int // the last slot externalized
+}
+
+// An empty file name keeps nothing.
+func openSCPStorage(file string) (*scpStorage, error) {
+	if file == "" {
+		return &scpStorage{}, nil
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: SCP_BOLT_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(scpStateBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(scpSlotsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &scpStorage{db: db}, nil
+}
+
+func scpSlotKey(slot int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(slot))
+	return key
+}
+
+func (s *scpStorage) load() (scpSaved, error) {
+	saved := scpSaved{slots: make(map[int]scpSlotRecord)}
+	if s.db == nil {
+		return saved, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket(scpStateBucket)
+		if base := state.Get(baseField); base != nil {
+			saved.base = append([]byte(nil), base...)
+		}
+		if data := state.Get(snapshotField); data != nil {
+			saved.snapshot = new(scpSnapshot)
+			if err := json.Unmarshal(data, saved.snapshot); err != nil {
+				return err
+			}
+			saved.last = saved.snapshot.Slot
+		}
+		if data := state.Get(statementField); data != nil {
+			saved.statement = new(scpMessage)
+			if err := json.Unmarshal(data, saved.statement); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(scpSlotsBucket).ForEach(func(key, data []byte) error {
+			var record scpSlotRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			slot := int(binary.BigEndian.Uint64(key))
+			saved.slots[slot] = record
+			if slot > saved.last {
+				saved.last = slot
+			}
+			return nil
+		})
+	})
+	return saved, err
+}
+
+// Only the first time we start.
+func (s *scpStorage) saveBase(base []byte) error {
+	return s.put(scpStateBucket, baseField, base)
+}
+
+func (s *scpStorage) saveStatement(message *scpMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.put(scpStateBucket, statementField, data)
+}
+
+// The slot's over: its record replaces our statement about it.
+func (s *scpStorage) saveSlot(slot int, record scpSlotRecord) error {
+	if s.db == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(scpStateBucket).Delete(statementField); err != nil {
+			return err
+		}
+		return tx.Bucket(scpSlotsBucket).Put(scpSlotKey(slot), data)
+	})
+}
+
+// Keeps a snapshot as of slot, drops the values it covers, and the
+// records we no longer keep for peers (before forget).
+func (s *scpStorage) saveSnapshot(snapshot scpSnapshot, forget int) error {
+	if s.db == nil {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(scpStateBucket).Put(snapshotField, data); err != nil {
+			return err
+		}
+		slots := tx.Bucket(scpSlotsBucket)
+		var forgotten [][]byte
+		covered := make(map[int][]byte)
+		c := slots.Cursor()
+		for key, data := c.First(); key != nil; key, data = c.Next() {
+			slot := int(binary.BigEndian.Uint64(key))
+			if slot > snapshot.Slot {
+				break
+			} else if slot < forget {
+				forgotten = append(forgotten, append([]byte(nil), key...))
+			} else {
+				covered[slot] = append([]byte(nil), data...)
+			}
+		}
+		if err := deleteKeys(slots, forgotten); err != nil {
+			return err
+		}
+		for slot, data := range covered {
+			var record scpSlotRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.Value == nil {
+				continue
+			}
+			record.Value = nil
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := slots.Put(scpSlotKey(slot), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *scpStorage) put(bucket []byte, key []byte, value []byte) error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, value)
+	})
+}
+
+func (s *scpStorage) close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pbft"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ** IN-PROCESS SCP HARNESS ** //
+
+// Delivers messages between engines in this process, unless either end
+// has been cut off.
+type testSCPNetwork struct {
+	mu      sync.Mutex
+	engines map[pbft.NodeId]*scpEngine
+	apps    map[pbft.NodeId]*testApp
+	cut     map[pbft.NodeId]bool
+	config  pbft.ClusterConfig
+	t       *testing.T
+}
+
+type testSCPTransport struct {
+	network *testSCPNetwork
+	from    pbft.NodeId
+}
+
+func (t *testSCPTransport) send(to pbft.NodeId, message *scpMessage) {
+	// a copy, like it'd get over the wire
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.network.t.Errorf("encoding message: %v", err)
+		return
+	}
+	go func() {
+		t.network.mu.Lock()
+		engine := t.network.engines[to]
+		cut := t.network.cut[to] || t.network.cut[t.from]
+		t.network.mu.Unlock()
+		if engine == nil || cut {
+			return
+		}
+		var copied scpMessage
+		if err := json.Unmarshal(data, &copied); err != nil {
+			t.network.t.Errorf("decoding message: %v", err)
+			return
+		}
+		engine.deliver(&copied)
+	}()
+}
+
+func (t *testSCPTransport) stop(ctx context.Context) error {
+	return nil
+}
+
+func writeTestKey(t *testing.T, path string, blockType string, serialize func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := armor.Encode(f, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+// n nodes with fresh PGP keys. The network doesn't need ports.
+func newTestSCPConfig(t *testing.T, n int) pbft.ClusterConfig {
+	dir, err := ioutil.TempDir("", "scp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := filepath.Join(dir, "passphrase.txt")
+	if err := ioutil.WriteFile(passphrase, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := pbft.ClusterConfig{Endpoint: "/scp-test"}
+	for i := 1; i <= n; i++ {
+		entity, err := openpgp.NewEntity(fmt.Sprintf("node%d", i), "", "", &packet.Config{RSABits: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		public := filepath.Join(dir, fmt.Sprintf("node%d.pub", i))
+		private := filepath.Join(dir, fmt.Sprintf("node%d.key", i))
+		writeTestKey(t, public, openpgp.PublicKeyType, entity.Serialize)
+		writeTestKey(t, private, openpgp.PrivateKeyType, func(w io.Writer) error {
+			return entity.SerializePrivate(w, nil)
+		})
+		config.Nodes = append(config.Nodes, pbft.NodeConfig{
+			Id:             pbft.NodeId(i),
+			Host:           "localhost",
+			PublicKeyFile:  public,
+			PrivateKeyFile: private,
+			PassPhraseFile: passphrase,
+		})
+	}
+	return config
+}
+
+func startTestSCP(t *testing.T, config pbft.ClusterConfig) *testSCPNetwork {
+	network := &testSCPNetwork{
+		engines: make(map[pbft.NodeId]*scpEngine),
+		apps:    make(map[pbft.NodeId]*testApp),
+		cut:     make(map[pbft.NodeId]bool),
+		config:  config,
+		t:       t,
+	}
+	for _, node := range config.Nodes {
+		network.start(node.Id)
+	}
+	return network
+}
+
+func (n *testSCPNetwork) start(id pbft.NodeId) {
+	for _, node := range n.config.Nodes {
+		if node.Id != id {
+			continue
+		}
+		app := &testApp{}
+		engine, err := newSCPEngine(node, n.config, app)
+		if err != nil {
+			n.t.Fatal(err)
+		}
+		n.mu.Lock()
+		n.engines[id] = engine
+		n.apps[id] = app
+		n.mu.Unlock()
+		engine.start(&testSCPTransport{network: n, from: id})
+		return
+	}
+	n.t.Fatalf("no node %d", id)
+}
+
+func (n *testSCPNetwork) stop(id pbft.NodeId) {
+	n.mu.Lock()
+	engine := n.engines[id]
+	delete(n.engines, id)
+	n.mu.Unlock()
+	if err := engine.Stop(context.Background()); err != nil {
+		n.t.Fatalf("stopping node %d: %v", id, err)
+	}
+}
+
+func (n *testSCPNetwork) stopAll() {
+	n.mu.Lock()
+	ids := make([]pbft.NodeId, 0, len(n.engines))
+	for id, _ := range n.engines {
+		ids = append(ids, id)
+	}
+	n.mu.Unlock()
+	for _, id := range ids {
+		n.stop(id)
+	}
+}
+
+func (n *testSCPNetwork) setCut(id pbft.NodeId, cut bool) {
+	n.mu.Lock()
+	n.cut[id] = cut
+	n.mu.Unlock()
+}
+
+func (n *testSCPNetwork) propose(t *testing.T, at pbft.NodeId, timestamp int64, op string, timeout time.Duration) (pbft.ProposalResult, error) {
+	n.mu.Lock()
+	engine := n.engines[at]
+	n.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return engine.Propose(ctx, &pbft.Request{Client: "client", Timestamp: timestamp, Operation: op}).Result()
+}
+
+// Waits for every node in ids to have applied exactly expected.
+func (n *testSCPNetwork) waitForApplied(t *testing.T, ids []pbft.NodeId, expected []string) {
+	for _, id := range ids {
+		deadline := time.Now().Add(10 * time.Second)
+		for strings.Join(n.apps[id].ops(), ",") != strings.Join(expected, ",") {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d applied %v, expected %v", id, n.apps[id].ops(), expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// ** TESTS ** //
+
+func TestQuorumSets(t *testing.T) {
+	// 1 and 2, plus two of 3, 4 and 5
+	q := pbft.QuorumSet{
+		Threshold:  3,
+		Validators: []pbft.NodeId{1, 2},
+		InnerSets:  []pbft.QuorumSet{{Threshold: 2, Validators: []pbft.NodeId{3, 4, 5}}},
+	}
+	set := func(ids ...pbft.NodeId) map[pbft.NodeId]bool {
+		nodes := make(map[pbft.NodeId]bool)
+		for _, id := range ids {
+			nodes[id] = true
+		}
+		return nodes
+	}
+	if !quorumSetSatisfied(q, set(1, 2, 3, 5)) {
+		t.Error("expected {1, 2, 3, 5} to satisfy it")
+	}
+	if quorumSetSatisfied(q, set(1, 3, 4, 5)) || quorumSetSatisfied(q, set(1, 2, 3)) {
+		t.Error("expected a slice to need 1, 2 and two of the rest")
+	}
+	if !quorumSetBlocked(q, set(2)) || !quorumSetBlocked(q, set(3, 4)) {
+		t.Error("expected {2} and {3, 4} to be v-blocking")
+	}
+	if quorumSetBlocked(q, set(3)) {
+		t.Error("expected {3} not to be v-blocking")
+	}
+
+	known := set(1, 2, 3, 4, 5)
+	if err := checkQuorumSet(q, known); err != nil {
+		t.Error(err)
+	}
+	bad := []pbft.QuorumSet{
+		{Threshold: 0, Validators: []pbft.NodeId{1}},
+		{Threshold: 2, Validators: []pbft.NodeId{1}},
+		{Threshold: 1, Validators: []pbft.NodeId{6}},
+		{Threshold: 1, Validators: []pbft.NodeId{1}, InnerSets: []pbft.QuorumSet{{Threshold: 1, Validators: []pbft.NodeId{1}}}},
+	}
+	for _, q := range bad {
+		if err := checkQuorumSet(q, known); err == nil {
+			t.Errorf("expected %+v to be rejected", q)
+		}
+	}
+}
+
+func TestSCPEngine(t *testing.T) {
+	network := startTestSCP(t, newTestSCPConfig(t, 4))
+	defer network.stopAll()
+
+	var expected []string
+	for i := 0; i < 6; i++ {
+		op := fmt.Sprintf("op%d", i)
+		result, err := network.propose(t, pbft.NodeId(i%4+1), int64(i+1), op, 10*time.Second)
+		if err != nil {
+			t.Fatalf("proposing %s: %v", op, err)
+		} else if result.Result != strings.ToUpper(op) || result.SeqNumber != i+1 {
+			t.Fatalf("unexpected result %+v for %s", result, op)
+		}
+		expected = append(expected, op)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4}, expected)
+
+	// a retry gets the same answer, without being applied again
+	result, err := network.propose(t, 2, 6, "op5", 10*time.Second)
+	if err != nil || result.Result != "OP5" || result.SeqNumber != 6 {
+		t.Fatalf("unexpected retry result %+v, %v", result, err)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4}, expected)
+}
+
+func TestSCPEngineFailures(t *testing.T) {
+	network := startTestSCP(t, newTestSCPConfig(t, 4))
+	defer network.stopAll()
+
+	// 3 of 4 is still a quorum
+	network.setCut(4, true)
+	if _, err := network.propose(t, 1, 1, "first", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3}, []string{"first"})
+
+	// 2 of 4 isn't
+	network.setCut(3, true)
+	if _, err := network.propose(t, 1, 2, "second", 2*time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected no progress without a quorum, got %v", err)
+	}
+
+	// once they're back, everybody catches up (including 4, which
+	// missed the first slot). The second request might have made it in
+	// too, or might not: its client gave up on it.
+	network.setCut(3, false)
+	network.setCut(4, false)
+	if _, err := network.propose(t, 2, 3, "third", 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	applied := network.apps[2].ops()
+	if joined := strings.Join(applied, ","); joined != "first,third" && joined != "first,second,third" {
+		t.Fatalf("unexpected operations applied: %v", applied)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4}, applied)
+}
+
+func TestSCPFederated(t *testing.T) {
+	// 1-4 trust each other; 5 and 6 each trust themselves and three of
+	// the core, but not each other
+	config := newTestSCPConfig(t, 6)
+	core := pbft.QuorumSet{Threshold: 3, Validators: []pbft.NodeId{1, 2, 3, 4}}
+	for i, _ := range config.Nodes {
+		node := &config.Nodes[i]
+		if node.Id <= 4 {
+			node.QuorumSet = &core
+		} else {
+			node.QuorumSet = &pbft.QuorumSet{
+				Threshold:  2,
+				Validators: []pbft.NodeId{node.Id},
+				InnerSets:  []pbft.QuorumSet{core},
+			}
+		}
+	}
+	network := startTestSCP(t, config)
+	defer network.stopAll()
+
+	var expected []string
+	for i, at := range []pbft.NodeId{5, 6, 1} {
+		op := fmt.Sprintf("op%d", i)
+		if _, err := network.propose(t, at, int64(i+1), op, 10*time.Second); err != nil {
+			t.Fatalf("proposing %s at node %d: %v", op, at, err)
+		}
+		expected = append(expected, op)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4, 5, 6}, expected)
+
+	// the core doesn't need 5 or 6
+	network.setCut(5, true)
+	network.setCut(6, true)
+	if _, err := network.propose(t, 2, 4, "core", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4}, append(expected, "core"))
+
+	// but 5 can't get anything done without the core
+	network.setCut(5, false)
+	network.setCut(6, false)
+	for _, id := range []pbft.NodeId{1, 2} {
+		network.setCut(id, true)
+	}
+	if _, err := network.propose(t, 5, 5, "alone", 2*time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected no progress without the core, got %v", err)
+	}
+}
+
+func TestSCPRestart(t *testing.T) {
+	config := newTestSCPConfig(t, 4)
+	config.CheckpointInterval = 2
+	dir := filepath.Dir(config.Nodes[0].PublicKeyFile)
+	defer os.RemoveAll(dir)
+	for i, _ := range config.Nodes {
+		config.Nodes[i].EngineFile = filepath.Join(dir, fmt.Sprintf("scp%d.db", i+1))
+	}
+	network := startTestSCP(t, config)
+	defer network.stopAll()
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		op := fmt.Sprintf("op%d", i)
+		if _, err := network.propose(t, 1, int64(i+1), op, 10*time.Second); err != nil {
+			t.Fatalf("proposing %s: %v", op, err)
+		}
+		expected = append(expected, op)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 3, 4}, expected)
+
+	// 4 comes back with nothing but its engine file (and its snapshot
+	// and slots since are enough to get its state back)...
+	network.stop(4)
+	network.start(4)
+	if ops := network.apps[4].ops(); strings.Join(ops, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected node 4 to restore %v, got %v", expected, ops)
+	}
+	// ...and 1, 2 and 4 are a quorum without 3
+	network.setCut(3, true)
+	if _, err := network.propose(t, 4, 6, "after", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	network.waitForApplied(t, []pbft.NodeId{1, 2, 4}, append(expected, "after"))
+}
+
+func TestSCPRestoreSlot(t *testing.T) {
+	value := scpValue{Requests: []pbft.Request{{Client: "client", Timestamp: 1, Operation: "op"}}}
+	digest, err := value.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qset := pbft.QuorumSet{Threshold: 3, Validators: []pbft.NodeId{1, 2, 3, 4}}
+	known := map[pbft.NodeId]bool{1: true, 2: true, 3: true, 4: true}
+	st := &scpStatement{
+		Node:      1,
+		Slot:      3,
+		Seq:       7,
+		QuorumSet: qset,
+		Votes:     []scpDigest{digest},
+		Phase:     scpConfirm,
+		Ballot:    scpBallot{2, digest},
+		NPrepared: 2,
+		NCommit:   1,
+		NHigh:     2,
+		Values:    []scpValue{value},
+	}
+	s, err := restoreSCPSlot(st, 1, qset, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.index != 3 || s.phase != scpConfirm || s.commit.Counter != 1 || s.high.Counter != 2 || !s.votes[digest] {
+		t.Fatalf("unexpected slot %+v", s)
+	}
+	// nothing's changed, so we'd say the same thing (and the next thing
+	// we say gets a higher Seq)
+	s.restate()
+	if s.statement().Seq != 7 || s.seq != 7 {
+		t.Fatalf("expected to still be at seq 7, got %d", s.statement().Seq)
+	}
+}
@@ -0,0 +1,142 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** LOOKUP CLIENT ** //
+
+// Every response from a sharded node says which version of the map it
+// has, so clients know when theirs is out of date.
+const VERSION_HEADER string = "X-Shard-Map-Version"
+
+// Where nodes serve (and take new versions of) the signed map
+const MAP_ENDPOINT string = "/shardmap"
+
+const CLIENT_TIMEOUT time.Duration = 5 * time.Second
+
+var (
+	ErrNotFound   = errors.New("Key not found")
+	ErrStaleMap   = errors.New("Shard map is older than the one we have")
+	ErrNoEndpoint = errors.New("No endpoint for the shard answered")
+)
+
+// Looks keys up straight from the shard that owns them. Keeps the
+// latest signed map it's seen.
+type Client struct {
+	authorities openpgp.EntityList
+	http        *http.Client
+	mu          sync.RWMutex
+	current     SignedShardMap
+}
+
+// Starts with the map served at bootstrap (a node's client API base
+// URL).
+func NewClient(authorities openpgp.EntityList, bootstrap string) (*Client, error) {
+	c := &Client{
+		authorities: authorities,
+		http:        &http.Client{Timeout: CLIENT_TIMEOUT},
+	}
+	if err := c.Refresh(bootstrap); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) Map() ShardMap {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.Map
+}
+
+// Fetches the map from endpoint, and switches to it if it's signed and
+// newer than ours.
+func (c *Client) Refresh(endpoint string) error {
+	resp, err := c.http.Get(strings.TrimSuffix(endpoint, "/") + MAP_ENDPOINT)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fetching shard map: %s", resp.Status)
+	}
+	var signed SignedShardMap
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return err
+	}
+	if err := signed.Verify(c.authorities); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current.Signature != nil && signed.Map.Version <= c.current.Map.Version {
+		if signed.Map.Version < c.current.Map.Version {
+			return ErrStaleMap
+		}
+		return nil
+	}
+	c.current = signed
+	return nil
+}
+
+// The key for alias, from the shard that owns it. If the shard's nodes
+// have a newer map, we move to it and try again (once).
+func (c *Client) Lookup(alias string) (string, error) {
+	key, newer, err := c.lookup(alias)
+	if newer == "" {
+		return key, err
+	}
+	if err := c.Refresh(newer); err != nil {
+		return "", err
+	}
+	key, _, err = c.lookup(alias)
+	return key, err
+}
+
+// Also returns an endpoint with a newer map than ours, if we came across
+// one.
+func (c *Client) lookup(alias string) (string, string, error) {
+	m := c.Map()
+	shard, _ := m.Shard(m.ShardFor(alias))
+	err := ErrNoEndpoint
+	for _, endpoint := range shard.Endpoints {
+		// just the key, without a proof (see the keynode's lookups)
+		resp, getErr := c.http.Get(strings.TrimSuffix(endpoint, "/") + "/?merkle=false&name=" + url.QueryEscape(alias))
+		if getErr != nil {
+			err = getErr
+			continue
+		}
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if version, _ := strconv.Atoi(resp.Header.Get(VERSION_HEADER)); version > m.Version {
+			return "", endpoint, nil
+		}
+		switch {
+		case readErr != nil:
+			err = readErr
+		case resp.StatusCode == http.StatusNotFound:
+			return "", "", ErrNotFound
+		case resp.StatusCode != http.StatusOK:
+			err = fmt.Errorf("Looking up %s: %s", alias, strings.TrimSpace(string(body)))
+		default:
+			var key string
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&key); err != nil {
+				return "", "", err
+			}
+			return key, "", nil
+		}
+	}
+	return "", "", err
+}
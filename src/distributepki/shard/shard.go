@@ -0,0 +1,237 @@
+package shard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** SHARD MAP ** //
+
+// The alias namespace is split across independent PBFT clusters
+// (shards). Every alias belongs to its domain (whatever's after the
+// last '@', or the whole alias), and every domain to one shard: the one
+// the map assigns it (or its closest parent domain) to, or else one
+// picked by hashing the domain. So all of a domain's aliases live
+// together.
+//
+// The map is signed by the authority (the same one that signs
+// creates), and versioned. Nodes and clients only ever move to a newer
+// version with a valid signature.
+
+type ShardId int
+
+type Shard struct {
+	Id        ShardId
+	Endpoints []string // client API base URLs of the shard's nodes, e.g. "http://localhost:8001"
+}
+
+type ShardMap struct {
+	Version int
+	Shards  []Shard
+	Domains map[string]ShardId `json:",omitempty"` // explicit assignments
+}
+
+type SignedShardMap struct {
+	Map       ShardMap
+	Signature []byte
+}
+
+var (
+	ErrBadShardMap  = errors.New("Shard map is invalid")
+	ErrBadSignature = errors.New("Shard map isn't signed by the authority")
+)
+
+// The domain an alias belongs to.
+func Domain(alias string) string {
+	if at := strings.LastIndex(alias, "@"); at >= 0 {
+		alias = alias[at+1:]
+	}
+	return strings.ToLower(strings.TrimSuffix(alias, "."))
+}
+
+func (m ShardMap) Validate() error {
+	if len(m.Shards) == 0 {
+		return fmt.Errorf("%s: no shards", ErrBadShardMap.Error())
+	}
+	ids := make(map[ShardId]bool)
+	for _, shard := range m.Shards {
+		if ids[shard.Id] {
+			return fmt.Errorf("%s: shard %d listed twice", ErrBadShardMap.Error(), shard.Id)
+		} else if len(shard.Endpoints) == 0 {
+			return fmt.Errorf("%s: shard %d has no endpoints", ErrBadShardMap.Error(), shard.Id)
+		}
+		ids[shard.Id] = true
+	}
+	for domain, id := range m.Domains {
+		if !ids[id] {
+			return fmt.Errorf("%s: %s assigned to missing shard %d", ErrBadShardMap.Error(), domain, id)
+		}
+	}
+	return nil
+}
+
+// Which shard owns alias.
+func (m ShardMap) ShardFor(alias string) ShardId {
+	domain := Domain(alias)
+	if id, ok := m.assigned(domain); ok {
+		return id
+	}
+	h := sha256.Sum256([]byte(domain))
+	return m.Shards[binary.BigEndian.Uint32(h[:4])%uint32(len(m.Shards))].Id
+}
+
+// The shard the domain's assigned to, or its closest parent is.
+func (m ShardMap) assigned(domain string) (ShardId, bool) {
+	for parent := domain; parent != ""; {
+		if id, ok := m.Domains[parent]; ok {
+			return id, true
+		}
+		dot := strings.Index(parent, ".")
+		if dot < 0 {
+			break
+		}
+		parent = parent[dot+1:]
+	}
+	return 0, false
+}
+
+func (m ShardMap) Shard(id ShardId) (Shard, bool) {
+	for _, shard := range m.Shards {
+		if shard.Id == id {
+			return shard, true
+		}
+	}
+	return Shard{}, false
+}
+
+// ** MOVES ** //
+
+// The shards that might own, under from, some alias that to gives shard
+// id, in order. If the list of shards changed, that's every other one,
+// since a hashed domain could land anywhere. Otherwise it's whoever had
+// the domains whose assignment changed (and every other shard again if
+// they were hashed).
+func Sources(from, to ShardMap, id ShardId) []ShardId {
+	if _, ok := to.Shard(id); !ok {
+		return nil
+	}
+	sources := make(map[ShardId]bool)
+	everyone := func() {
+		for _, s := range from.Shards {
+			sources[s.Id] = true
+		}
+	}
+	if !sameShards(from, to) {
+		everyone()
+	}
+	domains := make(map[string]bool)
+	for domain, _ := range from.Domains {
+		domains[domain] = true
+	}
+	for domain, _ := range to.Domains {
+		domains[domain] = true
+	}
+	for domain, _ := range domains {
+		before, wasAssigned := from.Domains[domain]
+		after, isAssigned := to.Domains[domain]
+		if wasAssigned == isAssigned && before == after {
+			continue
+		}
+		if owner, ok := to.assigned(domain); ok && owner != id {
+			continue
+		}
+		if owner, ok := from.assigned(domain); ok {
+			sources[owner] = true
+		} else {
+			everyone()
+		}
+	}
+	delete(sources, id)
+	ids := make([]ShardId, 0, len(sources))
+	for source, _ := range sources {
+		ids = append(ids, source)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// The same shards, in the same order (which hashing depends on).
+func sameShards(a, b ShardMap) bool {
+	if len(a.Shards) != len(b.Shards) {
+		return false
+	}
+	for i, _ := range a.Shards {
+		if a.Shards[i].Id != b.Shards[i].Id {
+			return false
+		}
+	}
+	return true
+}
+
+// ** SIGNING ** //
+
+func (m ShardMap) Sign(authority *openpgp.Entity) (*SignedShardMap, error) {
+	signature, err := SignJSON(m, authority)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedShardMap{Map: m, Signature: signature}, nil
+}
+
+// Checks the map is valid, and signed by one of the authorities.
+func (s *SignedShardMap) Verify(authorities openpgp.EntityList) error {
+	if err := s.Map.Validate(); err != nil {
+		return err
+	}
+	if err := VerifyJSON(s.Map, s.Signature, authorities); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// A detached signature over v's JSON. (The authority signs other
+// things about shards this way too; see keystore/sharding.go.)
+func SignJSON(v interface{}, authority *openpgp.Entity) ([]byte, error) {
+	var sig, buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := openpgp.DetachSign(&sig, authority, &buf, nil); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+func VerifyJSON(v interface{}, signature []byte, authorities openpgp.EntityList) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	_, err := openpgp.CheckDetachedSignature(authorities, &buf, bytes.NewReader(signature))
+	return err
+}
+
+// Reads and verifies a signed map.
+func LoadSignedShardMap(filename string, authorities openpgp.EntityList) (*SignedShardMap, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var signed SignedShardMap
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	if err := signed.Verify(authorities); err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
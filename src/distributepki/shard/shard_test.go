@@ -0,0 +1,188 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func testMap() ShardMap {
+	return ShardMap{
+		Version: 1,
+		Shards: []Shard{
+			{Id: 1, Endpoints: []string{"http://localhost:8001"}},
+			{Id: 2, Endpoints: []string{"http://localhost:9001"}},
+			{Id: 3, Endpoints: []string{"http://localhost:10001"}},
+		},
+		Domains: map[string]ShardId{"example.com": 2},
+	}
+}
+
+func testAuthority(t *testing.T) *openpgp.Entity {
+	authority, err := openpgp.NewEntity("authority", "", "authority@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+func TestShardFor(t *testing.T) {
+	m := testMap()
+	// Explicit assignments cover subdomains too
+	for _, alias := range []string{"a@example.com", "b@mail.example.com", "EXAMPLE.COM", "c@example.com."} {
+		if id := m.ShardFor(alias); id != 2 {
+			t.Errorf("%s should be on shard 2, not %d", alias, id)
+		}
+	}
+	// Everyone at a hashed domain ends up together
+	for i := 0; i < 20; i++ {
+		domain := fmt.Sprintf("domain%d.org", i)
+		id := m.ShardFor("a@" + domain)
+		if _, ok := m.Shard(id); !ok {
+			t.Fatalf("%s hashed to missing shard %d", domain, id)
+		}
+		if other := m.ShardFor("b@" + domain); other != id {
+			t.Errorf("%s split across shards %d and %d", domain, id, other)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	m := testMap()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m.Domains = map[string]ShardId{"example.com": 4}
+	if m.Validate() == nil {
+		t.Error("Assignment to a missing shard should be invalid")
+	}
+	m = testMap()
+	m.Shards = append(m.Shards, Shard{Id: 1, Endpoints: []string{"http://localhost:11001"}})
+	if m.Validate() == nil {
+		t.Error("Duplicate shard should be invalid")
+	}
+}
+
+func TestSources(t *testing.T) {
+	from := testMap()
+	to := testMap()
+	to.Version = 2
+	if sources := Sources(from, to, 1); len(sources) != 0 {
+		t.Errorf("Nothing moved, but shard 1 expects aliases from %v", sources)
+	}
+	// Only the shard that had example.com is giving anything up
+	to.Domains = map[string]ShardId{"example.com": 1}
+	if sources := fmt.Sprint(Sources(from, to, 1)); sources != "[2]" {
+		t.Errorf("Moving example.com to shard 1: sources %s", sources)
+	}
+	if sources := Sources(from, to, 3); len(sources) != 0 {
+		t.Errorf("Shard 3 isn't getting anything, but expects aliases from %v", sources)
+	}
+	// A newly assigned domain was hashed before, so it could be anywhere
+	to.Domains = map[string]ShardId{"example.com": 2, "other.com": 3}
+	if sources := fmt.Sprint(Sources(from, to, 3)); sources != "[1 2]" {
+		t.Errorf("Assigning other.com to shard 3: sources %s", sources)
+	}
+	// And so could everything, once there's another shard
+	to = testMap()
+	to.Shards = append(to.Shards, Shard{Id: 4, Endpoints: []string{"http://localhost:11001"}})
+	if sources := fmt.Sprint(Sources(from, to, 4)); sources != "[1 2 3]" {
+		t.Errorf("Adding shard 4: sources %s", sources)
+	}
+	// A shard the new map leaves out isn't getting anything
+	if sources := Sources(to, from, 4); len(sources) != 0 {
+		t.Errorf("Removing shard 4: it expects aliases from %v", sources)
+	}
+}
+
+func TestSignedShardMap(t *testing.T) {
+	authority := testAuthority(t)
+	signed, err := testMap().Sign(authority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.Verify(openpgp.EntityList{authority}); err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.Verify(openpgp.EntityList{testAuthority(t)}); err != ErrBadSignature {
+		t.Errorf("Map signed by someone else: got %v", err)
+	}
+	signed.Map.Domains["evil.com"] = 1
+	if err := signed.Verify(openpgp.EntityList{authority}); err != ErrBadSignature {
+		t.Errorf("Tampered map: got %v", err)
+	}
+}
+
+// A fake shard that knows one key, and serves whatever map it's given.
+func testShard(t *testing.T, keys map[string]string, signed **SignedShardMap) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VERSION_HEADER, strconv.Itoa((*signed).Map.Version))
+		if r.URL.Path == MAP_ENDPOINT {
+			json.NewEncoder(w).Encode(*signed)
+			return
+		}
+		key, ok := keys[r.URL.Query().Get("name")]
+		if !ok {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(key)
+	}))
+}
+
+func TestClientLookup(t *testing.T) {
+	authority := testAuthority(t)
+	var current *SignedShardMap
+	one := testShard(t, map[string]string{"a@one.com": "key-one"}, &current)
+	defer one.Close()
+	two := testShard(t, map[string]string{"a@two.com": "key-two"}, &current)
+	defer two.Close()
+
+	m := ShardMap{
+		Version: 1,
+		Shards:  []Shard{{Id: 1, Endpoints: []string{one.URL}}, {Id: 2, Endpoints: []string{two.URL}}},
+		Domains: map[string]ShardId{"one.com": 1, "two.com": 2},
+	}
+	var err error
+	if current, err = m.Sign(authority); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(openpgp.EntityList{authority}, one.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := client.Lookup("a@two.com"); err != nil || key != "key-two" {
+		t.Fatalf("Lookup a@two.com: %q, %v", key, err)
+	}
+	if _, err := client.Lookup("b@one.com"); err != ErrNotFound {
+		t.Errorf("Lookup b@one.com: %v", err)
+	}
+
+	// two.com moves to shard 1; the client should notice and follow
+	m.Version = 2
+	m.Domains["two.com"] = 1
+	if current, err = m.Sign(authority); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Lookup("a@two.com"); err != ErrNotFound {
+		t.Errorf("Lookup a@two.com after the move: %v", err)
+	}
+	if client.Map().Version != 2 {
+		t.Errorf("Client still has map version %d", client.Map().Version)
+	}
+
+	// but not to a forged one
+	forged, _ := ShardMap{Version: 3, Shards: m.Shards}.Sign(testAuthority(t))
+	current = forged
+	if err := client.Refresh(one.URL); err != ErrBadSignature {
+		t.Errorf("Refresh to a forged map: %v", err)
+	}
+	if client.Map().Version != 2 {
+		t.Errorf("Client moved to forged map version %d", client.Map().Version)
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"github.com/coreos/pkg/capnslog"
 	"golang.org/x/crypto/openpgp"
 
+	"bufio"
 	"crypto/sha256"
+	"crypto/tls"
 	"errors"
+	"io"
+	"net/http"
 	"net/rpc"
 	"os"
 	"strconv"
@@ -23,12 +27,17 @@ func GetHostname(host string, port int) string {
 }
 
 func SendRpc(hostName string, endpoint string, rpcFunction string, message interface{}, response interface{}, rpcRetries int, timeout time.Duration) error {
+	return SendRpcTLS(hostName, endpoint, rpcFunction, message, response, rpcRetries, timeout, nil)
+}
+
+// Same as SendRpc, but over TLS if tlsConfig isn't nil.
+func SendRpcTLS(hostName string, endpoint string, rpcFunction string, message interface{}, response interface{}, rpcRetries int, timeout time.Duration, tlsConfig *tls.Config) error {
 	if timeout <= 0 {
 		timeout = time.Second
 	}
-	rpcClient, err := rpc.DialHTTPPath("tcp", hostName, endpoint)
+	rpcClient, err := DialHTTPPath(hostName, endpoint, tlsConfig)
 	for nRetries := 0; err != nil && rpcRetries < nRetries; nRetries++ {
-		rpcClient, err = rpc.DialHTTPPath("tcp", hostName, endpoint)
+		rpcClient, err = DialHTTPPath(hostName, endpoint, tlsConfig)
 	}
 	if err != nil {
 		return err
@@ -46,6 +55,28 @@ func SendRpc(hostName string, endpoint string, rpcFunction string, message inter
 	return nil
 }
 
+// rpc.DialHTTPPath, optionally over TLS.
+func DialHTTPPath(hostName string, path string, tlsConfig *tls.Config) (*rpc.Client, error) {
+	if tlsConfig == nil {
+		return rpc.DialHTTPPath("tcp", hostName, path)
+	}
+	conn, err := tls.Dial("tcp", hostName, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	// same handshake as net/rpc does over plain HTTP
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == "200 Connected to Go RPC" {
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, err
+}
+
 func GenerateDigest(s string) ([sha256.Size]byte, error) {
 	return sha256.Sum256([]byte(s)), nil
 }
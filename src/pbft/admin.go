@@ -0,0 +1,224 @@
+package pbft
+
+import (
+	"distributepki/util"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** ADMIN ENDPOINT ** //
+
+// Admin commands (DebugMessages: taking a node down, bringing it back
+// up, ...) don't go over the consensus endpoint. Nodes that set
+// NodeConfig.AdminPort listen for them separately, and only act on
+// commands signed by one of the cluster's operators
+// (ClusterConfig.Operators) for this node, this cluster and epoch, and
+// recently enough. Every command, accepted or not, is audit-logged.
+
+const ADMIN_ENDPOINT string = "/admin"
+
+// How far an admin command's timestamp can be from our clock
+const ADMIN_CLOCK_SKEW time.Duration = time.Minute
+
+var (
+	ErrUnknownOperator = errors.New("Admin command isn't signed by an operator")
+	ErrWrongNode       = errors.New("Admin command is for a different node")
+	ErrStaleCommand    = errors.New("Admin command is too old, or a replay")
+)
+
+type AdminCommand struct {
+	Domain
+	Node      NodeId
+	Timestamp int64 // unix nanoseconds; has to go up for each operator
+	Message   DebugMessage
+}
+
+type SignedAdminCommand struct {
+	Command   AdminCommand
+	Signature []byte
+}
+
+func (c *AdminCommand) Sign(s Signer) (*SignedAdminCommand, error) {
+	c.Domain = s.Domain
+	sig, err := s.sign(*c)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedAdminCommand{
+		Command:   *c,
+		Signature: sig,
+	}, nil
+}
+
+// Signs message for node, as of now.
+func NewAdminCommand(operator Signer, node NodeId, message DebugMessage) (*SignedAdminCommand, error) {
+	command := AdminCommand{
+		Node:      node,
+		Timestamp: time.Now().UnixNano(),
+		Message:   message,
+	}
+	return command.Sign(operator)
+}
+
+// The signer for an operator's key, for cluster.
+func OperatorSigner(privateKeyFile string, passPhraseFile string, cluster ClusterConfig) (Signer, error) {
+	entity, err := ReadPrivateKey(privateKeyFile, passPhraseFile)
+	if err != nil {
+		return Signer{}, err
+	}
+	domain, err := cluster.Domain()
+	if err != nil {
+		return Signer{}, err
+	}
+	return Signer{Entity: entity, Domain: domain}, nil
+}
+
+// One line of the audit log
+type AuditEntry struct {
+	Time     time.Time
+	Operator string // empty if we couldn't tell who it was
+	Node     NodeId
+	Op       string
+	Request  string `json:",omitempty"`
+	Error    string `json:",omitempty"` // why we refused it, if we did
+}
+
+type adminServer struct {
+	node      *PBFTNode
+	domain    Domain
+	operators openpgp.EntityList
+	names     map[EntityFingerprint]string
+	auditFile string
+	server    *http.Server
+
+	// Admin RPCs come in concurrently; this guards lastTimestamp and
+	// the audit log.
+	mux           sync.Mutex
+	lastTimestamp map[string]int64 // operator => newest command we've accepted
+}
+
+func newAdminServer(node *PBFTNode, host NodeConfig, cluster ClusterConfig) (*adminServer, error) {
+	a := &adminServer{
+		node:          node,
+		domain:        node.keys.signer().Domain,
+		operators:     make(openpgp.EntityList, 0, len(cluster.Operators)),
+		names:         make(map[EntityFingerprint]string),
+		auditFile:     host.AuditLogFile,
+		lastTimestamp: make(map[string]int64),
+	}
+	for _, operator := range cluster.Operators {
+		list, err := ReadPgpKeyFile(operator.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		} else if len(list) != 1 {
+			return nil, errors.New("Expected exactly 1 PGP entity in " + operator.PublicKeyFile)
+		}
+		a.operators = append(a.operators, list[0])
+		a.names[list[0].PrimaryKey.Fingerprint] = operator.Name
+	}
+	if len(a.operators) == 0 {
+		node.Log("No operators configured, so every admin command will be refused")
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Admin", a); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(ADMIN_ENDPOINT, server)
+	a.server = &http.Server{Handler: mux}
+	return a, nil
+}
+
+func (a *adminServer) listen(port int) error {
+	listener, err := net.Listen("tcp", util.GetHostname("", port))
+	if err != nil {
+		return err
+	}
+	a.node.Log("Listening for admin commands on port %d", port)
+	go func() {
+		if err := a.server.Serve(listener); err != http.ErrServerClosed {
+			plog.Errorf("[Node %d] Serving admin RPCs: %v", a.node.id, err)
+		}
+	}()
+	return nil
+}
+
+// Works out who sent the command, and whether we should run it.
+// Returns the operator's name whenever we can tell. Must hold a.mux!
+func (a *adminServer) authenticate(req *SignedAdminCommand) (string, error) {
+	command := req.Command
+	if command.Domain.Cluster != a.domain.Cluster {
+		return "", ErrWrongCluster
+	} else if command.Domain.Epoch != a.domain.Epoch {
+		return "", ErrWrongEpoch
+	}
+	signer, err := checkSignature(a.operators, command, req.Signature)
+	if err != nil {
+		return "", ErrUnknownOperator
+	}
+	operator := a.names[signer.PrimaryKey.Fingerprint]
+	if command.Node != a.node.id {
+		return operator, ErrWrongNode
+	}
+	skew := time.Duration(time.Now().UnixNano() - command.Timestamp)
+	if skew > ADMIN_CLOCK_SKEW || skew < -ADMIN_CLOCK_SKEW || command.Timestamp <= a.lastTimestamp[operator] {
+		return operator, ErrStaleCommand
+	}
+	a.lastTimestamp[operator] = command.Timestamp
+	return operator, nil
+}
+
+// Logs the command, and appends it to the audit log file if we have
+// one. Must hold a.mux!
+func (a *adminServer) audit(command AdminCommand, operator string, refused error) error {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Operator: operator,
+		Node:     command.Node,
+		Op:       command.Message.Op.String(),
+		Request:  command.Message.Request,
+	}
+	if refused != nil {
+		entry.Error = refused.Error()
+		a.node.Log("ADMIN %s from %q refused: %s", entry.Op, operator, entry.Error)
+	} else {
+		a.node.Log("ADMIN %s from %q", entry.Op, operator)
+	}
+	if a.auditFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(a.auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (a *adminServer) Command(req *SignedAdminCommand, res *Ack) error {
+	a.mux.Lock()
+	operator, err := a.authenticate(req)
+	auditErr := a.audit(req.Command, operator, err)
+	a.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	// nothing happens off the record
+	if auditErr != nil {
+		plog.Errorf("[Node %d] Writing audit log: %v", a.node.id, auditErr)
+		return errors.New("Couldn't write the audit log")
+	}
+	return a.node.debug(&req.Command.Message)
+}
@@ -0,0 +1,89 @@
+package pbft
+
+import (
+	"sort"
+)
+
+// ** EARLY MESSAGES ** //
+
+// Pre-prepares, prepares and commits for a view we haven't entered
+// yet, or past our high watermark, are kept (once we've checked their
+// signatures) and replayed when we get there, so peers don't have to
+// retransmit them.
+
+// How many early messages we keep per sender, by default
+const MESSAGE_BUFFER_SIZE int = 256
+
+type bufferedMessage struct {
+	sender  NodeId
+	number  SlotId
+	message interface{} // *FullPrePrepare, *SignedPrepare or *SignedCommit
+}
+
+// Replay pre-prepares before prepares before commits, same as they'd
+// normally arrive.
+func (m bufferedMessage) order() int {
+	switch m.message.(type) {
+	case *FullPrePrepare:
+		return 0
+	case *SignedPrepare:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (n *PBFTNode) isEarly(number SlotId) bool {
+	return number.ViewNumber > n.viewNumber || number.SeqNumber > n.highWatermark()
+}
+
+// Buffers the (already authenticated) message if it's early. Returns
+// whether it did, in which case the caller should drop it for now.
+func (n *PBFTNode) bufferIfEarly(sender NodeId, number SlotId, message interface{}) bool {
+	if !n.isEarly(number) {
+		return false
+	}
+	buffered := append(n.buffered[sender], bufferedMessage{sender: sender, number: number, message: message})
+	sort.SliceStable(buffered, func(i, j int) bool {
+		return buffered[i].number.Before(buffered[j].number)
+	})
+	// when full, give up on whatever's furthest off
+	if len(buffered) > n.bufferSize {
+		buffered = buffered[:n.bufferSize]
+	}
+	n.buffered[sender] = buffered
+	return true
+}
+
+// Feeds everything that's no longer early back into the handlers.
+// Called whenever we enter a view or our watermarks move.
+func (n *PBFTNode) replayBuffered() {
+	var ready []bufferedMessage
+	for sender, buffered := range n.buffered {
+		var later []bufferedMessage
+		for _, m := range buffered {
+			if m.number.ViewNumber < n.viewNumber || m.number.SeqNumber <= n.lowWatermark() {
+				// we've missed it after all
+				continue
+			} else if n.isEarly(m.number) {
+				later = append(later, m)
+			} else {
+				ready = append(ready, m)
+			}
+		}
+		if len(later) == 0 {
+			delete(n.buffered, sender)
+		} else {
+			n.buffered[sender] = later
+		}
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		if ready[i].number != ready[j].number {
+			return ready[i].number.Before(ready[j].number)
+		}
+		return ready[i].order() < ready[j].order()
+	})
+	for _, m := range ready {
+		n.handleAuthenticated(authenticated{sender: m.sender, message: m.message})
+	}
+}
@@ -0,0 +1,444 @@
+package pbft
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** COMMIT CERTIFICATES ** //
+
+// Every request we execute is kept along with its commit certificate
+// (a quorum of matching signed commits), so anybody with the cluster's public
+// keys can check that the cluster agreed to it, long after the log's
+// been flushed. Nodes that set NodeConfig.CertificateFile keep them
+// across restarts. Requests we skipped over by restoring a checkpoint
+// weren't executed here, so we don't have certificates for them.
+// Everything else gets one, no-ops and duplicates included, so a
+// replica that restarts can tell it's been sent every sequence number
+// it missed (see durable.go).
+
+var (
+	ErrNoQuorum            = errors.New("Certificate doesn't have a quorum of commits")
+	ErrCertificateMismatch = errors.New("Commit is for a different slot or request than its certificate")
+)
+
+// A request and the proof that it committed.
+type CertifiedRequest struct {
+	Request     Request
+	Certificate CommitCertificate
+}
+
+// A verifier that knows every node in the cluster (a node's own
+// verifier only knows its peers). Doesn't need any private keys.
+func NewVerifier(cluster ClusterConfig) (Verifier, error) {
+	domain, err := cluster.Domain()
+	if err != nil {
+		return Verifier{}, err
+	}
+	weights, err := cluster.Weights()
+	if err != nil {
+		return Verifier{}, err
+	}
+	v := Verifier{
+		Peers:   make(openpgp.EntityList, 0, len(cluster.Nodes)),
+		PeerMap: make(map[EntityFingerprint]NodeId),
+		Domain:  domain,
+		Weights: weights,
+	}
+	for _, node := range cluster.Nodes {
+		list, err := ReadPgpKeyFile(node.PublicKeyFile)
+		if err != nil {
+			return Verifier{}, err
+		} else if len(list) != 1 {
+			return Verifier{}, errors.New("Expected exactly 1 PGP entity in " + node.PublicKeyFile)
+		}
+		v.Peers = append(v.Peers, list[0])
+		v.PeerMap[list[0].PrimaryKey.Fingerprint] = node.Id
+	}
+	return v, nil
+}
+
+// Checks that a quorum (see weights.go) signed commits for this
+// certificate's slot and request. v has to know every node in the
+// cluster (see NewVerifier), and be for the epoch the request
+// committed in.
+func (c *CommitCertificate) Verify(v Verifier) error {
+	signed := make(map[NodeId]bool)
+	for node, commit := range c.Commits {
+		signer, err := commit.SignatureValid(v)
+		if err != nil {
+			return err
+		}
+		if signer != node || signer != commit.CommitMessage.Node {
+			return errors.New("Commit not signed by the node it's from")
+		}
+		if commit.CommitMessage.Number != c.Number || commit.CommitMessage.RequestDigest != c.RequestDigest {
+			return ErrCertificateMismatch
+		}
+		signed[signer] = true
+	}
+	if v.Weights.Of(signed) < v.Weights.Quorum {
+		return ErrNoQuorum
+	}
+	return nil
+}
+
+// Checks the certificate, and that it's for this request.
+func (c *CertifiedRequest) Verify(v Verifier) error {
+	digest, err := c.Request.Digest()
+	if err != nil {
+		return err
+	}
+	if digest != c.Certificate.RequestDigest {
+		return errors.New("Certificate is for a different request")
+	}
+	return c.Certificate.Verify(v)
+}
+
+// Checks a certificate against the public keys in a cluster's
+// configuration, without needing a node.
+func VerifyCertificate(cluster ClusterConfig, certified CertifiedRequest) error {
+	v, err := NewVerifier(cluster)
+	if err != nil {
+		return err
+	}
+	return certified.Verify(v)
+}
+
+// Written by the execute stage, read by anybody. Certificates are
+// appended to the file as they come in, but only synced (and served) in
+// batches. The file's never rewritten: once a checkpoint's stable we
+// only stop keeping the ones before the previous one in memory, and
+// read them back from the file when somebody asks.
+type certificateStore struct {
+	mux      sync.RWMutex
+	bySeq    map[int]CertifiedRequest // the recent ones
+	byDigest map[[sha256.Size]byte]int
+	archived map[int]extent // where every synced one is in the file
+	synced   int64          // how much of the file that is
+	base     int            // we've no certificates up to here (skipped by restoring, or forgotten with no file)
+	through  int            // we've executed (or restored) everything up to here
+	r        *os.File       // for reading archived ones back
+
+	// Only the execute stage touches these.
+	file     string // where to append them; empty to keep them in memory only
+	f        *os.File
+	w        *bufio.Writer
+	written  int64 // the file's length, counting what's buffered
+	unsynced []CertifiedRequest
+	at       []extent // where each unsynced one's going
+	forget   int64    // forget everything up to here at the next sync; set by the main routine
+}
+
+// Where a certificate's line is in the file.
+type extent struct {
+	offset int64
+	length int64
+}
+
+func newCertificateStore(file string) (*certificateStore, error) {
+	s := &certificateStore{
+		file:     file,
+		bySeq:    make(map[int]CertifiedRequest),
+		byDigest: make(map[[sha256.Size]byte]int),
+		archived: make(map[int]extent),
+		base:     -1, // until we know where we start from
+	}
+	if file == "" {
+		return s, nil
+	}
+	// only the index is loaded; the certificates stay in the file
+	err := scanCertificates(file, func(certified CertifiedRequest, at extent) bool {
+		seq := certified.Certificate.Number.SeqNumber
+		if s.base < 0 || seq != s.through+1 {
+			// we skipped ahead by restoring, so only vouch from here on
+			s.base = seq - 1
+		}
+		s.archived[seq] = at
+		s.through = seq
+		s.synced = at.offset + at.length
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Calls each with every certificate in the file, in order, until it
+// returns false.
+func scanCertificates(file string, each func(CertifiedRequest, extent) bool) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanFrom(f, each)
+}
+
+func scanFrom(r io.Reader, each func(CertifiedRequest, extent) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var offset int64
+	for scanner.Scan() {
+		var certified CertifiedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &certified); err != nil {
+			return err
+		}
+		at := extent{offset: offset, length: int64(len(scanner.Bytes())) + 1}
+		offset += at.length
+		if !each(certified, at) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *certificateStore) open() error {
+	f, err := os.OpenFile(s.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r, err := os.Open(s.file)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.w, s.r = f, bufio.NewWriter(f), r
+	s.written = info.Size()
+	return nil
+}
+
+func (s *certificateStore) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.mux.Lock()
+	s.r.Close()
+	s.f, s.w, s.r = nil, nil, nil
+	s.mux.Unlock()
+	return err
+}
+
+// Must hold s.mux (or be the only one with s)!
+func (s *certificateStore) index(certified CertifiedRequest) {
+	seq := certified.Certificate.Number.SeqNumber
+	if s.base < 0 {
+		// everything's certified from the first one we get on
+		s.base = seq - 1
+	}
+	s.bySeq[seq] = certified
+	if certified.Request.isNoOp() {
+		return
+	}
+	// a duplicate only executed the first time it was ordered
+	if _, ok := s.byDigest[certified.Certificate.RequestDigest]; !ok {
+		s.byDigest[certified.Certificate.RequestDigest] = seq
+	}
+}
+
+// Writes the certificate out. It's only remembered (and served) once
+// it's synced, so we never serve one we'd lose on a restart.
+func (s *certificateStore) add(certified CertifiedRequest) error {
+	s.unsynced = append(s.unsynced, certified)
+	if s.w == nil {
+		return nil
+	}
+	data, err := json.Marshal(certified)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.at = append(s.at, extent{offset: s.written, length: int64(len(data))})
+	s.written += int64(len(data))
+	return nil
+}
+
+// Syncs everything added since last time with one fsync, then
+// remembers it. Forgets old certificates too, if we've been told to.
+func (s *certificateStore) sync() error {
+	if s.f != nil && len(s.unsynced) > 0 {
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.mux.Lock()
+	for i, certified := range s.unsynced {
+		s.index(certified)
+		if i < len(s.at) {
+			s.archived[certified.Certificate.Number.SeqNumber] = s.at[i]
+		}
+	}
+	if s.f != nil {
+		s.synced = s.written
+	}
+	s.unsynced, s.at = nil, nil
+	s.mux.Unlock()
+	s.drop(int(atomic.LoadInt64(&s.forget)))
+	return nil
+}
+
+// Tells the execute stage it can forget everything up to seq. Called by
+// the main routine when a checkpoint goes stable.
+func (s *certificateStore) forgetThrough(seq int) {
+	if int64(seq) > atomic.LoadInt64(&s.forget) {
+		atomic.StoreInt64(&s.forget, int64(seq))
+	}
+}
+
+// Stops keeping everything up to seq in memory. They're still in the
+// file, if there is one; if there isn't, they're gone.
+func (s *certificateStore) drop(seq int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for n, _ := range s.bySeq {
+		if n <= seq {
+			delete(s.bySeq, n)
+		}
+	}
+	for digest, n := range s.byDigest {
+		if n <= seq {
+			delete(s.byDigest, digest)
+		}
+	}
+	if s.file == "" && seq > s.base {
+		s.base = seq
+	}
+}
+
+// Called by the execute stage once it's done with seq (whether or not
+// there was a request to certify).
+func (s *certificateStore) executedThrough(seq int) {
+	s.mux.Lock()
+	if seq > s.through {
+		s.through = seq
+	}
+	s.mux.Unlock()
+}
+
+// Called by the execute stage when it skips ahead to a checkpoint: we
+// won't have certificates for what it skipped, so we can't vouch for a
+// run of them going back past there. (The ones we do have from before
+// are still served by sequence number and digest.)
+func (s *certificateStore) restoredThrough(seq int) {
+	s.executedThrough(seq)
+	s.drop(seq)
+	s.mux.Lock()
+	if seq > s.base {
+		s.base = seq
+	}
+	s.mux.Unlock()
+}
+
+// Must hold s.mux (read is fine)!
+func (s *certificateStore) get(seq int) (CertifiedRequest, bool) {
+	if certified, ok := s.bySeq[seq]; ok {
+		return certified, true
+	}
+	at, ok := s.archived[seq]
+	if !ok || s.r == nil {
+		return CertifiedRequest{}, false
+	}
+	data := make([]byte, at.length)
+	if _, err := s.r.ReadAt(data, at.offset); err != nil {
+		return CertifiedRequest{}, false
+	}
+	var certified CertifiedRequest
+	if err := json.Unmarshal(data, &certified); err != nil {
+		return CertifiedRequest{}, false
+	}
+	return certified, true
+}
+
+func (s *certificateStore) bySequence(seq int) (CertifiedRequest, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.get(seq)
+}
+
+// Archived ones aren't indexed by digest, so they take a pass over the
+// file.
+func (s *certificateStore) byRequestDigest(digest [sha256.Size]byte) (CertifiedRequest, bool) {
+	s.mux.RLock()
+	if seq, ok := s.byDigest[digest]; ok {
+		certified := s.bySeq[seq]
+		s.mux.RUnlock()
+		return certified, true
+	}
+	r, synced := s.r, s.synced
+	s.mux.RUnlock()
+	if r == nil {
+		return CertifiedRequest{}, false
+	}
+	// (without the lock, so the execute stage isn't held up; if we're
+	// closed meanwhile, the reads just fail)
+	var found CertifiedRequest
+	var ok bool
+	scanFrom(io.NewSectionReader(r, 0, synced), func(certified CertifiedRequest, _ extent) bool {
+		if certified.Certificate.RequestDigest == digest && !certified.Request.isNoOp() {
+			found, ok = certified, true
+		}
+		return !ok
+	})
+	return found, ok
+}
+
+// Up to limit certificates from start on, in order, and how far they
+// cover: every sequence number from start up to there. Nothing, if we
+// don't have certificates going back to start. (For observers and
+// replicas catching up; see observer.go and durable.go.)
+func (s *certificateStore) since(start int, limit int) ([]CertifiedRequest, int) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if start <= s.base || s.base < 0 {
+		return nil, start - 1
+	}
+	var certified []CertifiedRequest
+	for seq := start; seq <= s.through; seq++ {
+		c, ok := s.get(seq)
+		if !ok || len(certified) == limit {
+			return certified, seq - 1
+		}
+		certified = append(certified, c)
+	}
+	return certified, s.through
+}
+
+// The request we executed at seq, and its certificate.
+func (n *PBFTNode) CertificateBySeq(seq int) (CertifiedRequest, bool) {
+	return n.certificates.bySequence(seq)
+}
+
+// The request with this digest (see Request.Digest), and its
+// certificate. (We only ever execute a request once.)
+func (n *PBFTNode) CertificateByDigest(digest [sha256.Size]byte) (CertifiedRequest, bool) {
+	return n.certificates.byRequestDigest(digest)
+}
@@ -1,6 +1,7 @@
 package pbft
 
 import (
+	"crypto/sha256"
 	"errors"
 )
 
@@ -9,7 +10,10 @@ func (n *PBFTNode) checkpointed(checkpoint CheckpointProof) {
 	if checkpoint.Number.Before(n.lastCheckpoint.Number) {
 		return
 	}
+	previous := n.lastCheckpoint.Number.SeqNumber
 	n.lastCheckpoint = checkpoint
+	// certificates before the last stable checkpoint are just history
+	n.certificates.forgetThrough(previous)
 	//flush pending checkpoints
 	var stable []SlotId
 	for slot, _ := range n.pendingCheckpoints {
@@ -20,138 +24,172 @@ func (n *PBFTNode) checkpointed(checkpoint CheckpointProof) {
 	for _, slot := range stable {
 		delete(n.pendingCheckpoints, slot)
 	}
-	//flush the log
+	//flush the log (by sequence number; slots from older views can
+	//have higher ones)
 	var stableLog []SlotId
 	for slot, _ := range n.log {
-		if slot.BeforeOrEqual(checkpoint.Number) {
+		if slot.SeqNumber <= checkpoint.Number.SeqNumber {
 			stableLog = append(stableLog, slot)
 		}
 	}
-	for _, slot := range stable {
+	for _, slot := range stableLog {
 		delete(n.log, slot)
+		delete(n.committedSlots, slot.SeqNumber)
 	}
-	// if checkpoint's is before my current seq... probably wanna apply it~
-	// n.Log("%d, %d", n.sequenceNumber, checkpoint.Number.SeqNumber)
-	if n.sequenceNumber < checkpoint.Number.SeqNumber {
-		n.Snapshotted() <- &checkpoint.Snapshot
-		n.sequenceNumber = checkpoint.Number.SeqNumber
+	//forget requests that have been outstanding for a whole checkpoint
+	//interval; if the client still cares it'll retry
+	for digest, info := range n.requests {
+		if info.checkpoint < previous {
+			delete(n.requests, digest)
+		}
 	}
+	if n.recovery == RECOVERY_FETCH {
+		// a recovering replica can't trust anything it had, so it
+		// starts over from here (unless it's from before a key change
+		// we've seen, in which case it waits for the next one)
+		if checkpoint.Number.SeqNumber < n.keys.latestChange() {
+		} else if checkpoint.Snapshot != nil {
+			n.finishRecovery(checkpoint)
+		} else if !n.fetchingSnapshot {
+			n.fetchingSnapshot = true
+			go n.fetchCheckpoint()
+		}
+	} else if n.deliveredSequenceNumber < checkpoint.Number.SeqNumber {
+		// if we haven't executed up to the checkpoint yet, skip ahead to it
+		if n.sequenceNumber < checkpoint.Number.SeqNumber {
+			n.sequenceNumber = checkpoint.Number.SeqNumber
+		}
+		if checkpoint.Snapshot != nil {
+			n.skipToCheckpoint(checkpoint)
+		} else if !n.fetchingSnapshot {
+			// we didn't get there ourselves, so we need somebody's snapshot
+			n.fetchingSnapshot = true
+			go n.fetchSnapshot(0)
+		}
+	}
+	// the window moved, so some early messages might be in it now
+	n.replayBuffered()
 }
 
 func (n *PBFTNode) isStable(checkpoint *Checkpoint) bool {
-	info := n.pendingCheckpoints[checkpoint.Number]
-	return checkpoint.Number.BeforeOrEqual(n.lastCheckpoint.Number) ||
-		len(info.Proof) >= 2*(len(n.peermap)/3)+1
+	info := n.pendingCheckpoints[checkpoint.Number][checkpoint.matchKey()]
+	if checkpoint.Number.BeforeOrEqual(n.lastCheckpoint.Number) {
+		return true
+	}
+	voted := make(map[NodeId]bool)
+	for node, _ := range info.Proof {
+		voted[node] = true
+	}
+	return n.keys.verifier().Weights.Of(voted) >= n.keys.verifier().Weights.Quorum
 }
 
-func (n *PBFTNode) handleCheckpointProof(proof *SignedCheckpointProof) {
+func (n *PBFTNode) handleCheckpointProof(sender NodeId, proof *SignedCheckpointProof) {
 	if n.timeoutTimer != nil {
 		n.timeoutTimer.Reset(n.getTimeout())
 	}
-	sender, err := proof.SignatureValid(n.peerEntities, n.peerEntityMap)
-	if err != nil {
-		n.Log("Validating CheckpointProof signature: " + err.Error())
-		return
-	} else if sender != proof.Message.Node {
+	if sender != proof.Message.Node {
 		n.Log("Error: received CheckpointProof not signed by correct sending node")
 		return
 	}
+	if err := verifyCheckpointProof(n.keys.verifyAll(), proof.Message.Proof); err != nil {
+		n.Log("Error: received CheckpointProof that doesn't check out: %s", err.Error())
+		return
+	}
 	n.checkpointed(proof.Message.Proof)
 }
 
-func (n *PBFTNode) handleCheckpoint(message *SignedCheckpoint) {
-	sender, err := message.SignatureValid(n.peerEntities, n.peerEntityMap)
-	if err != nil {
-		n.Log("Validating Checkpoint signature: %s", err.Error())
-		return
-	} else if sender != message.CheckpointMessage.Node {
+func (n *PBFTNode) handleCheckpoint(sender NodeId, message *SignedCheckpoint) {
+	if sender != message.CheckpointMessage.Node {
 		n.Log("Error: received Checkpoint not signed by correct sending node")
 		return
 	}
 
-	n.handleCheckpointNoValidation(message)
+	n.handleCheckpointNoValidation(message, nil)
 }
 
-// Checkpoint signed by ourselves bypasses signature verification
-func (n *PBFTNode) handleCheckpointNoValidation(message *SignedCheckpoint) {
+// Checkpoint signed by ourselves bypasses signature verification (and
+// comes with our snapshot)
+func (n *PBFTNode) handleCheckpointNoValidation(message *SignedCheckpoint, snapshot []byte) {
 
 	checkpoint := message.CheckpointMessage
 	if n.isStable(&checkpoint) {
 		return
 	}
-	if _, ok := n.pendingCheckpoints[checkpoint.Number]; !ok {
-		n.pendingCheckpoints[checkpoint.Number] = CheckpointProof{
-			Number:   checkpoint.Number,
-			Snapshot: checkpoint.Snapshot,
-			Proof:    make(map[NodeId]SignedCheckpoint),
+	byDigest, ok := n.pendingCheckpoints[checkpoint.Number]
+	if !ok {
+		byDigest = make(map[[sha256.Size]byte]CheckpointProof)
+		n.pendingCheckpoints[checkpoint.Number] = byDigest
+	}
+	key := checkpoint.matchKey()
+	if _, ok := byDigest[key]; !ok {
+		byDigest[key] = CheckpointProof{
+			Number:         checkpoint.Number,
+			SnapshotDigest: checkpoint.SnapshotDigest,
+			StateDigest:    checkpoint.StateDigest,
+			StateRoot:      checkpoint.StateRoot,
+			Proof:          make(map[NodeId]SignedCheckpoint),
 		}
 	}
-	n.pendingCheckpoints[checkpoint.Number].Proof[checkpoint.Node] = *message
+	if snapshot != nil {
+		proof := byDigest[key]
+		proof.Snapshot = snapshot
+		byDigest[key] = proof
+	}
+	byDigest[key].Proof[checkpoint.Node] = *message
 	if n.isStable(&checkpoint) {
-		n.checkpointed(n.pendingCheckpoints[checkpoint.Number])
+		n.checkpointed(byDigest[key])
 	}
 }
 
-func (n *PBFTNode) handleRecvSnapshot(snap *snapshot) {
+// The execute stage snapshotted a checkpoint; sign it and tell
+// everyone about it.
+func (n *PBFTNode) handleSnapshot(snapshot checkpointSnapshot) {
+	// not while we're recovering: it's from state we threw away
+	if n.recovery == RECOVERY_FETCH {
+		return
+	}
 	checkpoint := Checkpoint{
-		Number:   snap.number,
-		Snapshot: snap.state,
-		Node:     n.id,
+		Number: SlotId{
+			ViewNumber: n.viewNumber,
+			SeqNumber:  snapshot.seq,
+		},
+		SnapshotDigest: sha256.Sum256(snapshot.snapshot),
+		StateDigest:    snapshot.stateDigest,
+		StateRoot:      snapshot.stateRoot,
+		Node:           n.id,
+	}
+	// if it's already stable, we can hand out the snapshot now
+	if last := &n.lastCheckpoint; last.Number.SeqNumber == snapshot.seq && last.Snapshot == nil && last.SnapshotDigest == checkpoint.SnapshotDigest {
+		last.Snapshot = snapshot.snapshot
 	}
 
-	signedCheckpoint, err := checkpoint.Sign(n.entity)
+	signedCheckpoint, err := checkpoint.Sign(n.keys.signer())
 	if err != nil {
 		n.Log("Signing checkpoint: " + err.Error())
 		return
 	}
 
-	n.handleCheckpointNoValidation(signedCheckpoint)
-	go n.broadcast("PBFTNode.Checkpoint", signedCheckpoint, 0)
-}
-
-func (n *PBFTNode) tryCheckpoint() {
-	if n.sequenceNumber%int(CHECKPOINT) != 0 {
-		// no checkpointing!
-		return
-	}
-	slot := SlotId{
-		ViewNumber: n.viewNumber,
-		SeqNumber:  n.sequenceNumber,
-	}
-	n.SnapshotRequested() <- slot
-}
-
-func (n PBFTNode) Snapshotted() chan *[]byte {
-	return n.snapshottedChannel
-}
-
-func (n PBFTNode) SnapshotRequested() chan SlotId {
-	return n.requestSnapshotChannel
+	n.handleCheckpointNoValidation(signedCheckpoint, snapshot.snapshot)
+	n.broadcast("PBFTNode.Checkpoint", signedCheckpoint, 0)
 }
 
-func (n *PBFTNode) SnapshotReply(number SlotId, state []byte) {
-	n.recvSnapshotChannel <- snapshot{
-		number: number,
-		state:  state,
-	}
-}
-
-func (n PBFTNode) Checkpoint(req *SignedCheckpoint, res *Ack) error {
+func (n *PBFTNode) Checkpoint(req *SignedCheckpoint, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.checkpointChannel <- req
-	return nil
+	return n.authenticate(req, func() (NodeId, error) { return req.SignatureValid(n.keys.verifier()) })
 }
 
-func (n PBFTNode) CheckpointProof(req *SignedCheckpointProof, res *SignedPPResponse) error {
+func (n *PBFTNode) CheckpointProof(req *SignedCheckpointProof, res *SignedPPResponse) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.checkpointProofChannel <- req
+	if err := n.authenticate(req, func() (NodeId, error) { return req.SignatureValid(n.keys.verifier()) }); err != nil {
+		return err
+	}
 
 	res.Response.SeqNumber = n.sequenceNumber
-	sig, err := res.Response.GetSignature(n.entity)
+	sig, err := res.Response.GetSignature(n.keys.signer())
 	if err != nil {
 		return err
 	}
@@ -159,3 +197,10 @@ func (n PBFTNode) CheckpointProof(req *SignedCheckpointProof, res *SignedPPRespo
 
 	return nil
 }
+
+// Our last stable checkpoint, for peers that only need to know it's
+// stable. Replicas that need the snapshot fetch it (see fetchSnapshot).
+func (p CheckpointProof) withoutSnapshot() CheckpointProof {
+	p.Snapshot = nil
+	return p
+}
@@ -0,0 +1,118 @@
+package pbft
+
+import (
+	"context"
+	"sync"
+)
+
+// ** COMMIT STREAM ** //
+
+// Anything that wants to follow along with what a node applies (a
+// backup, an index, an audit log) can, without being the application
+// itself. Other consensus engines (see distributepki) use these too.
+
+// How far a follower can fall behind before we give up on it
+const COMMIT_STREAM_BUFFER int = 256
+
+// An operation the application applied, and what it returned. (Our
+// own key changes and no-ops don't go to the application, so they're
+// not in the stream.)
+type CommittedEntry struct {
+	SeqNumber int
+	Operation string
+	Result    string
+}
+
+// Called with each snapshot of the application that's taken (at every
+// checkpoint), and the sequence number of the last operation in it.
+type SnapshotHook func(seq int, snapshot []byte)
+
+type CommitStream struct {
+	mu        sync.Mutex
+	followers map[chan CommittedEntry]struct{}
+	hooks     []SnapshotHook
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewCommitStream() *CommitStream {
+	return &CommitStream{
+		followers: make(map[chan CommittedEntry]struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Every operation applied from now on, in order, until ctx is done or
+// the stream's closed (when the node stops). Nothing waits for slow
+// followers: one that falls COMMIT_STREAM_BUFFER behind has its channel
+// closed early, and should catch up from a snapshot. Restoring a
+// snapshot skips ahead too, so followers should expect gaps in
+// SeqNumber.
+func (s *CommitStream) Committed(ctx context.Context) <-chan CommittedEntry {
+	follower := make(chan CommittedEntry, COMMIT_STREAM_BUFFER)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		close(follower)
+		return follower
+	default:
+	}
+	s.followers[follower] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.drop(follower)
+		case <-s.closed:
+		}
+	}()
+	return follower
+}
+
+func (s *CommitStream) OnSnapshot(hook SnapshotHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+func (s *CommitStream) Publish(entry CommittedEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for follower, _ := range s.followers {
+		select {
+		case follower <- entry:
+		default:
+			delete(s.followers, follower)
+			close(follower)
+		}
+	}
+}
+
+// Runs the snapshot hooks, in the order they were added.
+func (s *CommitStream) Snapshotted(seq int, snapshot []byte) {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for _, hook := range hooks {
+		hook(seq, snapshot)
+	}
+}
+
+func (s *CommitStream) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for follower, _ := range s.followers {
+		delete(s.followers, follower)
+		close(follower)
+	}
+}
+
+func (s *CommitStream) drop(follower chan CommittedEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.followers[follower]; ok {
+		delete(s.followers, follower)
+		close(follower)
+	}
+}
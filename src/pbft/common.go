@@ -5,8 +5,12 @@ import (
 
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"golang.org/x/crypto/openpgp"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
@@ -20,6 +24,64 @@ type ClusterConfig struct {
 	Nodes            []NodeConfig
 	AuthorityKeyFile string
 	Endpoint         string
+
+	// IDENTITY (see domain.go). Every signed message carries the
+	// cluster's id and configuration epoch.
+	Name      string // so clusters of the same nodes get different ids
+	Epoch     int    // bump whenever the configuration changes
+	GenesisId string // hex; overrides the id we'd work out from this config
+
+	// How much weight can be faulty before we stop promising anything
+	// (see weights.go)
+	FaultyWeight int
+
+	// Don't pick replicas we have misbehaviour evidence against as
+	// primary (see evidence.go).
+	SkipFaultyLeaders bool
+
+	// TIMING (see timeouts.go). Anything left out gets a default.
+	HeartbeatInterval  Duration // how often the primary sends heartbeats
+	ViewChangeTimeout  Duration // how long backups wait to hear from the primary
+	CheckpointInterval int      // sequence numbers between checkpoints
+	WatermarkWindow    int      // high watermark = low watermark + this
+	// Adaptive mode: the view change timeout follows observed commit
+	// latency, within [MinViewChangeTimeout, MaxViewChangeTimeout].
+	AdaptiveTimeout      bool
+	MinViewChangeTimeout Duration
+	MaxViewChangeTimeout Duration
+
+	// How many early messages to keep per peer (see buffer.go)
+	MessageBufferSize int
+
+	// How often each replica proactively recovers, with a new key and
+	// state fetched from its peers (see recovery.go). 0 for never.
+	RecoveryInterval Duration
+
+	// Admission control (see proposal.go): how many new requests can
+	// queue up for the main routine, and how many proposals can be
+	// outstanding, before we start turning them away.
+	RequestQueueSize   int
+	MaxPendingRequests int
+
+	// Replica pipeline (see pipeline.go): how many signature checks run
+	// at once, and how many authenticated peer messages and committed
+	// requests can queue up between stages.
+	AuthWorkers      int
+	PeerQueueSize    int
+	ExecuteQueueSize int
+
+	// Replicas talk over mutually authenticated TLS, using the
+	// certificates in each NodeConfig (see transport.go)
+	TLS bool
+
+	// Whose signed commands the admin endpoints accept (see admin.go)
+	Operators []OperatorConfig
+
+	// Non-voting replicas that follow the committed log (see
+	// observer.go), and how often they ask for more of it. They don't
+	// count towards anything, so they aren't part of the cluster id.
+	Observers       []NodeConfig
+	ObserveInterval Duration
 }
 
 func hash(data []byte) uint32 {
@@ -29,19 +91,62 @@ func hash(data []byte) uint32 {
 
 // Deterministic leader calculation
 func (c ClusterConfig) LeaderFor(viewNumber int) NodeId {
+	return c.LeaderExcluding(viewNumber, nil)
+}
+
+// Same as LeaderFor, but never picks an excluded node (unless they're
+// all excluded, in which case there's not much we can do).
+func (c ClusterConfig) LeaderExcluding(viewNumber int, excluded map[NodeId]bool) NodeId {
+	candidates := make([]NodeId, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		if !excluded[node.Id] {
+			candidates = append(candidates, node.Id)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, node := range c.Nodes {
+			candidates = append(candidates, node.Id)
+		}
+	}
 	buf := make([]byte, 4)
 	binary.LittleEndian.PutUint32(buf, uint32(viewNumber))
-	return c.Nodes[hash(buf)%uint32(len(c.Nodes))].Id
+	return candidates[hash(buf)%uint32(len(candidates))]
 }
 
 type NodeConfig struct {
-	ClientPort     int
-	Host           string
-	Id             NodeId
-	Port           int
-	PrivateKeyFile string
-	PublicKeyFile  string
-	PassPhraseFile string
+	ClientPort      int
+	Host            string
+	Id              NodeId
+	Port            int
+	PrivateKeyFile  string
+	PublicKeyFile   string
+	PassPhraseFile  string
+	EvidenceFile    string     // where to keep misbehaviour evidence (optional)
+	CertificateFile string     // where to keep commit certificates (optional)
+	CertFile        string     // PEM TLS certificate (if the cluster uses TLS)
+	TLSKeyFile      string     // PEM TLS private key (only needed on this node)
+	AdminPort       int        // where to listen for admin commands (0 for nowhere)
+	AuditLogFile    string     // where to log admin commands (optional)
+	QuorumSet       *QuorumSet // whose agreement this node needs (federated engines only)
+	Weight          int        // how much this node's vote counts (see weights.go)
+	KeyRingFile     string     // where to keep keys that changed in recovery (optional; see recovery.go)
+	StoreFile       string     // where the application keeps its state, to restart from (optional; see durable.go)
+	EngineFile      string     // where the raft and scp engines keep what they've agreed on, to restart from (optional)
+}
+
+// A node's quorum slices, for federated consensus (see distributepki's
+// scp engine): any Threshold of Validators and InnerSets, where an
+// inner set counts if its own threshold is met. Nodes should list
+// themselves.
+type QuorumSet struct {
+	Threshold  int
+	Validators []NodeId    `json:",omitempty"`
+	InnerSets  []QuorumSet `json:",omitempty"`
+}
+
+type OperatorConfig struct {
+	Name          string
+	PublicKeyFile string
 }
 
 type EndpointConfig struct {
@@ -60,8 +165,9 @@ type SlotId struct {
 }
 
 type Slot struct {
-	request       *string
+	request       *Request
 	requestDigest [sha256.Size]byte
+	accepted      time.Time // when we got the pre-prepare
 	preprepare    *SignedPrePrepare
 	prepares      map[NodeId]SignedPrepare
 	commits       map[NodeId]*SignedCommit
@@ -97,3 +203,22 @@ func ReadPgpKeyFile(path string) (openpgp.EntityList, error) {
 	}
 	return list, nil
 }
+
+// Reads a PGP private key and decrypts it with the passphrase in
+// passPhraseFile.
+func ReadPrivateKey(privateKeyFile string, passPhraseFile string) (*openpgp.Entity, error) {
+	list, err := ReadPgpKeyFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	} else if len(list) != 1 {
+		return nil, errors.New("Expected exactly 1 PGP entity in " + privateKeyFile)
+	}
+	phrase, err := ioutil.ReadFile(passPhraseFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := list[0].PrivateKey.Decrypt([]byte(strings.TrimSpace(string(phrase)))); err != nil {
+		return nil, err
+	}
+	return list[0], nil
+}
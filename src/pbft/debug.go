@@ -1,20 +1,45 @@
 package pbft
 
+import (
+	"time"
+)
+
 type DebugOp int
 
 const (
 	PUT DebugOp = iota
 	DOWN
 	UP
+	RECOVER
 )
 
+func (op DebugOp) String() string {
+	switch op {
+	case PUT:
+		return "PUT"
+	case DOWN:
+		return "DOWN"
+	case UP:
+		return "UP"
+	case RECOVER:
+		return "RECOVER"
+	}
+	return "UNKNOWN"
+}
+
 type DebugMessage struct {
 	Op      DebugOp
 	Request string
 }
 
-func (n *PBFTNode) Debug(req *DebugMessage, res *Ack) error {
-	n.debugChannel <- req
+// Hands a debug message to the main routine. Only reachable through
+// the admin endpoint (see admin.go), once the command's checked out.
+func (n *PBFTNode) debug(req *DebugMessage) error {
+	select {
+	case n.debugChannel <- req:
+	case <-n.quit:
+		return ErrStopped
+	}
 	return nil
 }
 
@@ -34,12 +59,18 @@ func (n *PBFTNode) handleDebug(debug *DebugMessage) {
 	// TODO (sydli): remove PUT operation (since we can use client http api)
 	case PUT:
 		n.Log("PUT %+v", debug.Request)
-		n.handleClientRequest(&debug.Request)
+		n.handleClientRequest(&Request{
+			Client:    "debug",
+			Timestamp: time.Now().UnixNano(),
+			Operation: debug.Request,
+		})
 	case DOWN:
 		n.Log("DOWN")
 		n.down = true
 	case UP:
 		n.Log("UP")
 		n.down = false
+	case RECOVER:
+		n.startRecovery()
 	}
 }
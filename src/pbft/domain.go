@@ -0,0 +1,86 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// ** CLUSTER IDENTITY ** //
+
+// A cluster's id is a hash of its genesis configuration: its name,
+// endpoint, and each node's id, address and PGP key. Timing, TLS and
+// file locations don't count, so they can change without forking the
+// cluster. Reconfigured clusters keep their original id by setting
+// ClusterConfig.GenesisId, and bump ClusterConfig.Epoch instead.
+
+func (id ClusterId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ClusterId) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ClusterId) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(id) {
+		return errors.New("Cluster id should be a hex SHA-256 hash")
+	}
+	copy(id[:], decoded)
+	return nil
+}
+
+type genesisNode struct {
+	Id          NodeId
+	Host        string
+	Port        int
+	Fingerprint EntityFingerprint
+}
+
+type genesisConfig struct {
+	Name     string
+	Endpoint string
+	Nodes    []genesisNode
+}
+
+func (c ClusterConfig) Id() (ClusterId, error) {
+	var id ClusterId
+	if c.GenesisId != "" {
+		err := id.UnmarshalText([]byte(c.GenesisId))
+		return id, err
+	}
+	genesis := genesisConfig{Name: c.Name, Endpoint: c.Endpoint}
+	for _, node := range c.Nodes {
+		list, err := ReadPgpKeyFile(node.PublicKeyFile)
+		if err != nil {
+			return id, err
+		} else if len(list) != 1 {
+			return id, errors.New("Expected exactly 1 PGP entity in " + node.PublicKeyFile)
+		}
+		genesis.Nodes = append(genesis.Nodes, genesisNode{
+			Id:          node.Id,
+			Host:        node.Host,
+			Port:        node.Port,
+			Fingerprint: list[0].PrimaryKey.Fingerprint,
+		})
+	}
+	encoded, err := json.Marshal(genesis)
+	if err != nil {
+		return id, err
+	}
+	return ClusterId(sha256.Sum256(encoded)), nil
+}
+
+// What our messages get stamped with.
+func (c ClusterConfig) Domain() (Domain, error) {
+	id, err := c.Id()
+	if err != nil {
+		return Domain{}, err
+	}
+	return Domain{Cluster: id, Epoch: c.Epoch}, nil
+}
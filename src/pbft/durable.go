@@ -0,0 +1,276 @@
+package pbft
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ** DURABLE STATE ** //
+
+// A replica whose application is a DurableStateMachine saves, with
+// every request it executes, how far it's got along with its reply
+// cache and keys. When it starts back up it carries on from there
+// (resume), and asks its peers for the certified requests it missed
+// (catchUp), the same way observers do (see observer.go), instead of
+// waiting for the next stable checkpoint and restoring all of it.
+// Every executed sequence number is certified (see certificates.go), so
+// we only take an unbroken run of them: a peer can't leave anything
+// out. If no peer has them all any more, we take its stable checkpoint.
+
+// Certified requests (and maybe a checkpoint to skip to first) that
+// catchUp fetched, for the main routine. fetchSnapshot hands over its
+// checkpoint the same way.
+type catchUpBatch struct {
+	checkpoint *CheckpointProof
+	requests   []CertifiedRequest
+	snapshot   bool   // from fetchSnapshot
+	from       NodeId // who sent the snapshot
+}
+
+// Persists the certificates for a batch of committed requests (with
+// one fsync) before we apply them (or skip them). Skips whatever
+// executeItem will. The batch can't have a restore in it, since
+// whether that checks out decides what comes after it. Runs on the
+// execute stage.
+func (n *PBFTNode) certify(batch []executeItem) {
+	executed := n.executed()
+	for _, item := range batch {
+		if n.skips(item, executed) {
+			continue
+		}
+		executed = item.seq
+		var certified CertifiedRequest
+		if item.request != nil {
+			certified = CertifiedRequest{Request: *item.request, Certificate: item.certificate}
+		} else if item.certificate.Commits != nil {
+			certified = CertifiedRequest{Certificate: item.certificate}
+		} else {
+			continue
+		}
+		if err := n.certificates.add(certified); err != nil {
+			n.Error("Persisting commit certificate: %s", err.Error())
+		}
+	}
+	if err := n.certificates.sync(); err != nil {
+		n.Error("Persisting commit certificates: %s", err.Error())
+	}
+}
+
+// Our reply cache (plus any replies the caller's about to add) and
+// rotated keys, for a durable application to save.
+func (n *PBFTNode) replicaState(replies map[string]cachedReply) []byte {
+	state := checkpointState{
+		Replies: make(map[string]cachedReply, len(n.lastReply)+len(replies)),
+		Keys:    n.keys.rotatedKeys(),
+	}
+	for client, reply := range n.lastReply {
+		state.Replies[client] = reply
+	}
+	for client, reply := range replies {
+		state.Replies[client] = reply
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		n.Error("Encoding replica state: %s", err.Error())
+	}
+	return encoded
+}
+
+// Tells a durable application we're at seq, if something other than
+// it changed. Runs on the execute stage.
+func (n *PBFTNode) save(seq int, replies map[string]cachedReply) {
+	durable, ok := n.app.(DurableStateMachine)
+	if !ok {
+		return
+	}
+	if err := durable.Save(seq, n.replicaState(replies)); err != nil {
+		n.Error("Saving state at %d: %s", seq, err.Error())
+	}
+}
+
+// Picks up from whatever a durable application last saved. Returns
+// whether there was anything, in which case we've some catching up to
+// do. Must be called before the node starts!
+func (n *PBFTNode) resume() (bool, error) {
+	durable, ok := n.app.(DurableStateMachine)
+	if !ok {
+		return false, nil
+	}
+	seq, saved, err := durable.Saved()
+	if err != nil || seq <= n.deliveredSequenceNumber {
+		return false, err
+	}
+	var state checkpointState
+	if err := json.Unmarshal(saved, &state); err != nil {
+		return false, err
+	}
+	if err := n.keys.restore(state.Keys, seq); err == ErrStaleKeys {
+		// we crashed between saving the key ring and the application;
+		// the key ring's newer, and the key change will run again
+		n.Log("Key ring is ahead of the application; keeping it")
+	} else if err != nil {
+		return false, err
+	}
+	if state.Replies != nil {
+		n.lastReply = state.Replies
+	}
+	n.deliveredSequenceNumber = seq
+	n.executedSequenceNumber = int64(seq)
+	if n.sequenceNumber < seq {
+		n.sequenceNumber = seq
+	}
+	if n.issuedSequenceNumber < seq {
+		n.issuedSequenceNumber = seq
+	}
+	n.Log("RESUMED at %d", seq)
+	return true, nil
+}
+
+// Asks our peers, one after another, for the certified requests after
+// the last one we executed, and hands them to the main routine. Stops
+// once a peer has sent everything it has, or none of them could help.
+// Runs on its own goroutine.
+func (n *PBFTNode) catchUp() {
+	var peers []NodeId
+	for id, _ := range n.peermap {
+		peers = append(peers, id)
+	}
+	for failed, i := 0, 0; failed < len(peers); i++ {
+		peer := peers[i%len(peers)]
+		batch, more, err := n.fetchSuffix(peer, n.executed()+1)
+		if err != nil {
+			n.Log("Catching up from %d: %s", peer, err.Error())
+			failed++
+			continue
+		}
+		if batch.checkpoint == nil && len(batch.requests) == 0 {
+			failed++
+			continue
+		}
+		failed = 0
+		select {
+		case n.catchUpChannel <- batch:
+		case <-n.quit:
+			return
+		}
+		if !more {
+			return
+		}
+		n.waitForExecution(batch)
+	}
+}
+
+// Asks peer for the certified requests from from on. Returns what
+// checks out, and whether it has more.
+func (n *PBFTNode) fetchSuffix(peer NodeId, from int) (catchUpBatch, bool, error) {
+	var batch catchUpBatch
+	request := ObserveRequest{From: from, Checkpoint: from - 1, Suffix: true}
+	var response ObserveResponse
+	err := sendRpc(n.id, peer, n.peermap[peer], "PBFTNode.Observe", n.cluster.Endpoint, &request, &response, 1, OBSERVE_TIMEOUT, n.peerTLS)
+	if err != nil {
+		return batch, false, err
+	}
+	verifier := n.keys.verifyAll()
+	next := from
+	if checkpoint := response.Checkpoint; checkpoint != nil && checkpoint.Number.SeqNumber >= from {
+		if err := verifyCheckpointProof(verifier, *checkpoint); err != nil {
+			return batch, false, err
+		}
+		batch.checkpoint = checkpoint
+		next = checkpoint.Number.SeqNumber + 1
+	}
+	for _, certified := range response.Requests {
+		seq := certified.Certificate.Number.SeqNumber
+		if seq < next {
+			continue
+		} else if seq > next {
+			// we don't know what was in between
+			break
+		}
+		if err := certified.Verify(verifier); err != nil {
+			return batch, false, err
+		}
+		batch.requests = append(batch.requests, certified)
+		next++
+	}
+	return batch, len(response.Requests) == OBSERVE_BATCH, nil
+}
+
+// Waits (a little) for the execute stage to get through a batch, so we
+// don't ask for it again.
+func (n *PBFTNode) waitForExecution(batch catchUpBatch) {
+	last := 0
+	if batch.checkpoint != nil {
+		last = batch.checkpoint.Number.SeqNumber
+	}
+	if len(batch.requests) > 0 {
+		last = batch.requests[len(batch.requests)-1].Certificate.Number.SeqNumber
+	}
+	deadline := time.After(OBSERVE_TIMEOUT)
+	for n.executed() < last {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			return
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// Fetches a stable checkpoint we're behind, snapshot and all, for when
+// peers only told us it was stable (or the snapshot we had didn't check
+// out; then we don't ask whoever sent it, avoid). Runs on its own
+// goroutine.
+func (n *PBFTNode) fetchSnapshot(avoid NodeId) {
+	batch := catchUpBatch{snapshot: true}
+	checkpoint, from, err := n.fetchStableCheckpoint(avoid)
+	if err != nil {
+		n.Log("Fetching checkpoint snapshot: %s", err.Error())
+	} else if checkpoint == nil {
+		n.Log("No peer sent a checkpoint snapshot that checks out")
+	}
+	batch.checkpoint, batch.from = checkpoint, from
+	select {
+	case n.catchUpChannel <- batch:
+	case <-n.quit:
+	}
+}
+
+// Queues up what catchUp fetched, as long as it follows on from what
+// we've already delivered. Must be called on the main routine!
+func (n *PBFTNode) handleCatchUp(batch catchUpBatch) {
+	if batch.snapshot {
+		// (if it didn't get us there, the next checkpoint proof we hear
+		// about will try again)
+		n.fetchingSnapshot = false
+		n.snapshotFrom = batch.from
+	}
+	if n.recovery != RECOVERY_NONE {
+		// a recovering replica gets everything from a checkpoint
+		return
+	}
+	if checkpoint := batch.checkpoint; checkpoint != nil && n.deliveredSequenceNumber < checkpoint.Number.SeqNumber {
+		n.checkpointed(*checkpoint)
+	}
+	for _, certified := range batch.requests {
+		seq := certified.Certificate.Number.SeqNumber
+		if seq != n.deliveredSequenceNumber+1 {
+			continue
+		}
+		n.deliveredSequenceNumber = seq
+		item := executeItem{seq: seq, certificate: certified.Certificate}
+		if !certified.Request.isNoOp() {
+			request := certified.Request
+			item.request = &request
+			item.digest = certified.Certificate.RequestDigest
+			delete(n.requests, item.digest)
+		}
+		n.toExecute = append(n.toExecute, item)
+	}
+	if n.sequenceNumber < n.deliveredSequenceNumber {
+		n.sequenceNumber = n.deliveredSequenceNumber
+	}
+	// we might have already committed what comes next
+	n.executeCommitted()
+}
@@ -0,0 +1,271 @@
+package pbft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+
+	"crypto/sha256"
+)
+
+// ** MISBEHAVIOUR EVIDENCE ** //
+
+// A replica that signs two different requests for the same slot is
+// provably faulty. We keep both signed messages around so anybody
+// with the cluster's public keys can check for themselves.
+type EvidenceKind int
+
+const (
+	CONFLICTING_PREPREPARE EvidenceKind = iota
+	CONFLICTING_PREPARE
+	CONFLICTING_COMMIT
+)
+
+// Exactly one of PrePrepares, Prepares or Commits is filled in
+// (with two messages), depending on Kind.
+type MisbehaviourEvidence struct {
+	Kind        EvidenceKind
+	Node        NodeId
+	Number      SlotId
+	PrePrepares []SignedPrePrepare `json:",omitempty"`
+	Prepares    []SignedPrepare    `json:",omitempty"`
+	Commits     []SignedCommit     `json:",omitempty"`
+}
+
+// We only need one piece of evidence per offence.
+type evidenceKey struct {
+	Kind   EvidenceKind
+	Node   NodeId
+	Number SlotId
+}
+
+func (e *MisbehaviourEvidence) key() evidenceKey {
+	return evidenceKey{Kind: e.Kind, Node: e.Node, Number: e.Number}
+}
+
+// Checks that both messages are validly signed by the accused node,
+// are for the same slot, and disagree on the request.
+func (e *MisbehaviourEvidence) Verify(v Verifier) error {
+	var signers, claimed []NodeId
+	var numbers []SlotId
+	var digests [][sha256.Size]byte
+	switch e.Kind {
+	case CONFLICTING_PREPREPARE:
+		for _, pp := range e.PrePrepares {
+			signer, err := pp.SignatureValid(v)
+			if err != nil {
+				return err
+			}
+			signers = append(signers, signer)
+			claimed = append(claimed, signer) // pre-prepares don't name their sender
+			numbers = append(numbers, pp.PrePrepareMessage.Number)
+			digests = append(digests, pp.PrePrepareMessage.RequestDigest)
+		}
+	case CONFLICTING_PREPARE:
+		for _, p := range e.Prepares {
+			signer, err := p.SignatureValid(v)
+			if err != nil {
+				return err
+			}
+			signers = append(signers, signer)
+			claimed = append(claimed, p.PrepareMessage.Node)
+			numbers = append(numbers, p.PrepareMessage.Number)
+			digests = append(digests, p.PrepareMessage.RequestDigest)
+		}
+	case CONFLICTING_COMMIT:
+		for _, c := range e.Commits {
+			signer, err := c.SignatureValid(v)
+			if err != nil {
+				return err
+			}
+			signers = append(signers, signer)
+			claimed = append(claimed, c.CommitMessage.Node)
+			numbers = append(numbers, c.CommitMessage.Number)
+			digests = append(digests, c.CommitMessage.RequestDigest)
+		}
+	default:
+		return errors.New("Unknown kind of evidence")
+	}
+	if len(signers) != 2 {
+		return errors.New("Evidence needs exactly two messages")
+	}
+	for i, _ := range signers {
+		if signers[i] != e.Node || claimed[i] != e.Node {
+			return errors.New("Evidence message not signed by the accused node")
+		}
+		if numbers[i] != e.Number {
+			return errors.New("Evidence message is for a different slot")
+		}
+	}
+	if digests[0] == digests[1] {
+		return errors.New("Evidence messages don't conflict")
+	}
+	return nil
+}
+
+// Verifies and records evidence. New evidence gets persisted and
+// passed on to everybody else. Must be called on the main routine!
+func (n *PBFTNode) recordEvidence(evidence *MisbehaviourEvidence) {
+	if evidence.Node == n.id {
+		return
+	}
+	if err := evidence.Verify(n.keys.verifier()); err != nil {
+		n.Log("Invalid misbehaviour evidence against %d: %s", evidence.Node, err.Error())
+		return
+	}
+	n.evidenceMux.Lock()
+	_, seen := n.evidence[evidence.key()]
+	if !seen {
+		n.evidence[evidence.key()] = *evidence
+	}
+	n.evidenceMux.Unlock()
+	if seen {
+		return
+	}
+	plog.Errorf("[Node %d] Node %d signed conflicting messages for slot %+v", n.id, evidence.Node, evidence.Number)
+	if n.evidenceFile != "" {
+		if err := appendEvidence(n.evidenceFile, evidence); err != nil {
+			n.Error("Persisting evidence: %s", err.Error())
+		}
+	}
+	n.broadcast("PBFTNode.ReportMisbehaviour", evidence, 0)
+	// don't wait around for a faulty primary to time out
+	if n.cluster.SkipFaultyLeaders && !n.viewChange.inProgress && evidence.Node == n.leaderFor(n.viewNumber) {
+		n.startViewChange(n.viewNumber + 1)
+	}
+}
+
+// Everything we've got so far, in slot order.
+func (n *PBFTNode) Evidence() []MisbehaviourEvidence {
+	n.evidenceMux.RLock()
+	evidence := make([]MisbehaviourEvidence, 0, len(n.evidence))
+	for _, e := range n.evidence {
+		evidence = append(evidence, e)
+	}
+	n.evidenceMux.RUnlock()
+	sort.Slice(evidence, func(i, j int) bool {
+		if evidence[i].Number != evidence[j].Number {
+			return evidence[i].Number.Before(evidence[j].Number)
+		}
+		if evidence[i].Node != evidence[j].Node {
+			return evidence[i].Node < evidence[j].Node
+		}
+		return evidence[i].Kind < evidence[j].Kind
+	})
+	return evidence
+}
+
+// Who's leader when we skip replicas known to be faulty (if the
+// cluster's configured to). Replicas have to agree on who's leader, so
+// "known" can't mean whatever evidence we happen to have: it's the
+// evidence carried by the view changes in the last NewView, which
+// everybody that installed the view has seen. That applies from the
+// next view on; the view itself was picked with the set before.
+type leaderExclusion struct {
+	view     int
+	before   map[NodeId]bool
+	excluded map[NodeId]bool
+}
+
+func (n *PBFTNode) leaderFor(view int) NodeId {
+	if !n.cluster.SkipFaultyLeaders {
+		return n.cluster.LeaderFor(view)
+	}
+	if view <= n.exclusion.view {
+		return n.cluster.LeaderExcluding(view, n.exclusion.before)
+	}
+	return n.cluster.LeaderExcluding(view, n.exclusion.excluded)
+}
+
+// Works out who's excluded from the view changes a NewView for view
+// carries. Their evidence is ours too from now on, so it goes in our
+// next view change. Must be called on the main routine, after we've
+// entered the view!
+func (n *PBFTNode) agreeExclusions(view int, viewChanges map[NodeId]SignedViewChange) {
+	excluded := make(map[NodeId]bool)
+	var agreed []MisbehaviourEvidence
+	for _, vc := range viewChanges {
+		if vc.Message.ViewNumber != view {
+			continue
+		}
+		for _, e := range vc.Message.Evidence {
+			if err := e.Verify(n.keys.verifier()); err != nil {
+				continue
+			}
+			excluded[e.Node] = true
+			agreed = append(agreed, e)
+		}
+	}
+	n.exclusion = leaderExclusion{view: view, before: n.exclusion.excluded, excluded: excluded}
+	for i, _ := range agreed {
+		n.recordEvidence(&agreed[i])
+	}
+}
+
+// Evidence is appended to the file as one JSON object per line.
+func appendEvidence(path string, evidence *MisbehaviourEvidence) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(evidence); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readEvidence(path string) ([]MisbehaviourEvidence, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var evidence []MisbehaviourEvidence
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e MisbehaviourEvidence
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		evidence = append(evidence, e)
+	}
+	return evidence, scanner.Err()
+}
+
+// Picks up evidence from a previous run. Called before the main
+// routine starts.
+func (n *PBFTNode) loadEvidence() error {
+	if n.evidenceFile == "" {
+		return nil
+	}
+	evidence, err := readEvidence(n.evidenceFile)
+	if err != nil {
+		return err
+	}
+	for _, e := range evidence {
+		if err := e.Verify(n.keys.verifier()); err != nil {
+			n.Log("Skipping invalid evidence against %d: %s", e.Node, err.Error())
+			continue
+		}
+		n.evidence[e.key()] = e
+	}
+	return nil
+}
+
+func (n *PBFTNode) ReportMisbehaviour(req *MisbehaviourEvidence, res *Ack) error {
+	if n.down {
+		return errors.New("I'm down")
+	}
+	select {
+	case n.evidenceChannel <- req:
+	case <-n.quit:
+		return ErrStopped
+	}
+	return nil
+}
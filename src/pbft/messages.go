@@ -22,10 +22,41 @@ type ClientReply struct {
 	digest     [sha256.Size]byte
 }
 
+// Every signed message says which cluster (and which configuration
+// of it) it's for, so signatures can't be replayed into another
+// cluster that uses the same replica keys, or from an old epoch.
+type ClusterId [sha256.Size]byte
+
+type Domain struct {
+	Cluster ClusterId
+	Epoch   int
+}
+
+// REQUEST:
+// client id, timestamp, operation
+// Timestamps only have to increase per client. Replicas use them to
+// tell retries (same request again) from stale requests (older ones).
+// Op says what the operation is for; almost everything's for the
+// StateMachine.
+type Request struct {
+	Client    string
+	Timestamp int64
+	Operation string
+	Op        RequestOp `json:",omitempty"`
+}
+
+type RequestOp int
+
+const (
+	OP_APPLY      RequestOp = iota // StateMachine.Apply
+	OP_KEY_CHANGE                  // a replica's key change (see recovery.go)
+)
+
 // PRE-PREPARE:
 // viewnum, seqnum, client message (digest)
 // (signed by node)
 type PrePrepare struct {
+	Domain
 	Number        SlotId
 	RequestDigest [sha256.Size]byte
 }
@@ -37,11 +68,12 @@ type SignedPrePrepare struct {
 
 type FullPrePrepare struct {
 	SignedMessage SignedPrePrepare
-	Request       string
+	Request       Request
 }
 
 // hehehe peepee
 type PPResponse struct {
+	Domain
 	SeqNumber int
 }
 
@@ -54,6 +86,7 @@ type SignedPPResponse struct {
 // viewnum, seqnum, client message (digest), node addr
 // (signed by node i)
 type Prepare struct {
+	Domain
 	Number        SlotId
 	RequestDigest [sha256.Size]byte
 	Node          NodeId
@@ -68,6 +101,7 @@ type SignedPrepare struct {
 // viewnum, seqnum, client message (digest), node addr
 // (signed by node i)
 type Commit struct {
+	Domain
 	Number        SlotId
 	RequestDigest [sha256.Size]byte
 	Node          NodeId
@@ -84,13 +118,16 @@ type SignedCommit struct {
 
 // CHECKPOINT:
 // seqnum, digest of state, node addr
-// 2f + 1 of these is a proof for a particular seqnum's
-// checkpoint
+// 2f + 1 of these (with matching digests) is a proof for a
+// particular seqnum's checkpoint
 // (signed by node i)
 type Checkpoint struct {
-	Number   SlotId
-	Snapshot []byte
-	Node     NodeId
+	Domain
+	Number         SlotId
+	SnapshotDigest [sha256.Size]byte // the snapshot itself only goes to replicas that fetch it
+	StateDigest    [sha256.Size]byte
+	StateRoot      [sha256.Size]byte // see state_root.go; zero if the app has none
+	Node           NodeId
 }
 
 type SignedCheckpoint struct {
@@ -99,12 +136,16 @@ type SignedCheckpoint struct {
 }
 
 type CheckpointProof struct {
-	Number   SlotId
-	Snapshot []byte
-	Proof    map[NodeId]SignedCheckpoint
+	Number         SlotId
+	Snapshot       []byte // nil unless we took it ourselves, or fetched it
+	SnapshotDigest [sha256.Size]byte
+	StateDigest    [sha256.Size]byte
+	StateRoot      [sha256.Size]byte
+	Proof          map[NodeId]SignedCheckpoint
 }
 
 type CheckpointProofMessage struct {
+	Domain
 	Proof CheckpointProof
 	Node  NodeId
 }
@@ -116,7 +157,7 @@ type SignedCheckpointProof struct {
 
 type PreparedProof struct {
 	Number        SlotId
-	Request       string
+	Request       Request
 	Preprepare    SignedPrePrepare
 	RequestDigest [sha256.Size]byte
 	Prepares      map[NodeId]SignedPrepare
@@ -129,11 +170,13 @@ type PreparedProof struct {
 //    1 Preprepare message (signed) and 2f+1 prepares per
 // (signed by node i)
 type ViewChange struct {
-	ViewNumber      int                // v + 1
-	Checkpoint      SlotId             // n
-	CheckpointProof CheckpointProofMap // C
-	Proofs          PreparedProofMap   // P
-	Node            NodeId             // i
+	Domain
+	ViewNumber      int                    // v + 1
+	Checkpoint      SlotId                 // n
+	CheckpointProof CheckpointProofMap     // C
+	Proofs          PreparedProofMap       // P
+	Node            NodeId                 // i
+	Evidence        []MisbehaviourEvidence `json:",omitempty"` // who i can prove is faulty
 }
 
 // random JSON serialization workarounds
@@ -162,7 +205,7 @@ func (m *CheckpointProofMap) UnmarshalJSON(b []byte) error {
 func (m CheckpointProofMap) MarshalJSON() ([]byte, error) {
 	strMap := make(map[string]SignedCheckpoint)
 	for k, v := range m {
-		strMap[string(k)] = v
+		strMap[strconv.Itoa(int(k))] = v
 	}
 
 	return json.Marshal(strMap)
@@ -201,7 +244,7 @@ func (m *PreparedProofMap) UnmarshalJSON(b []byte) error {
 func (m PreparedProofMap) MarshalJSON() ([]byte, error) {
 	strMap := make(map[string]PreparedProof)
 	for k, v := range m {
-		strMap[string(k.ViewNumber)+":"+string(k.SeqNumber)] = v
+		strMap[strconv.Itoa(k.ViewNumber)+":"+strconv.Itoa(k.SeqNumber)] = v
 	}
 
 	return json.Marshal(strMap)
@@ -218,6 +261,7 @@ type SignedViewChange struct {
 // O: a set of pre-prepare messages
 // (signed by node i)
 type NewView struct {
+	Domain
 	ViewNumber  int                  // v + 1
 	ViewChanges NewViewViewChangeMap // V
 	PrePrepares NewViewPrePrepareMap // O
@@ -266,7 +310,7 @@ func (m *NewViewPrePrepareMap) UnmarshalJSON(b []byte) error {
 func (m NewViewPrePrepareMap) MarshalJSON() ([]byte, error) {
 	strMap := make(map[string]FullPrePrepare)
 	for k, v := range m {
-		strMap[string(k.ViewNumber)+":"+string(k.SeqNumber)] = v
+		strMap[strconv.Itoa(k.ViewNumber)+":"+strconv.Itoa(k.SeqNumber)] = v
 	}
 
 	return json.Marshal(strMap)
@@ -294,7 +338,7 @@ func (m *NewViewViewChangeMap) UnmarshalJSON(b []byte) error {
 func (m NewViewViewChangeMap) MarshalJSON() ([]byte, error) {
 	strMap := make(map[string]SignedViewChange)
 	for k, v := range m {
-		strMap[string(k)] = v
+		strMap[strconv.Itoa(int(k))] = v
 	}
 
 	return json.Marshal(strMap)
@@ -3,7 +3,9 @@ package pbft
 import (
 	"distributepki/util"
 
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"golang.org/x/crypto/openpgp"
 	"io/ioutil"
@@ -12,6 +14,7 @@ import (
 	"net/rpc"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,42 +22,75 @@ type PBFTNode struct {
 	//////
 	// Immutable config data
 	//////
-	id            NodeId
-	host          string
-	port          int
-	primary       bool
-	peermap       map[NodeId]string // id => hostname
-	hostToPeer    map[string]NodeId // hostname => id
-	cluster       ClusterConfig
-	entity        *openpgp.Entity
-	peerEntityMap map[EntityFingerprint]NodeId
-	peerEntities  openpgp.EntityList
+	id         NodeId
+	host       string
+	port       int
+	primary    bool
+	peermap    map[NodeId]string // id => hostname
+	hostToPeer map[string]NodeId // hostname => id
+	cluster    ClusterConfig
+	keys       *keyRing // signs as us, and checks messages are from our peers, for this cluster & epoch (see recovery.go)
+	app        StateMachine
+	commits    *CommitStream // what the execute stage applies (see commits.go)
 
 	// MAIN MESSAGE CHANNELS.
 	// Main execution loop selects from these.
-	debugChannel           chan *DebugMessage
-	requestChannel         chan *string
-	recvSnapshotChannel    chan snapshot
-	preprepareChannel      chan *FullPrePrepare
-	prepareChannel         chan *SignedPrepare
-	checkpointChannel      chan *SignedCheckpoint
-	checkpointProofChannel chan *SignedCheckpointProof
-	commitChannel          chan *SignedCommit
-	viewChangeChannel      chan *SignedViewChange
-	newViewChannel         chan *SignedNewView
-	requestTimeoutChannel  chan bool
-
-	// CLIENT CHANNELS.
-	// We write to these when we learn the
-	// result of a client request.
-	errorChannel           chan error
-	requestSnapshotChannel chan SlotId
-	committedChannel       chan *string
-	snapshottedChannel     chan *[]byte
-
-	// Requests: did they finish yet?
+	debugChannel          chan *DebugMessage
+	statusChannel         chan chan NodeStatus
+	requestChannel        chan *Request
+	peerChannel           chan authenticated // from the authenticate stage
+	snapshotChannel       chan checkpointSnapshot
+	executedChannel       chan struct{} // execute stage has room again
+	evidenceChannel       chan *MisbehaviourEvidence
+	requestTimeoutChannel chan bool
+
+	// PIPELINE (see pipeline.go). toExecute and
+	// deliveredSequenceNumber belong to the main routine;
+	// executedSequenceNumber to the execute stage (read it atomically).
+	authSlots               chan struct{}
+	executeQueue            chan executeItem
+	replyQueue              chan reply
+	toExecute               []executeItem
+	deliveredSequenceNumber int
+	executedSequenceNumber  int64
+	refusedRestore          bool // the execute stage's: the last restore didn't check out
+	stages                  *sync.WaitGroup
+
+	// Signalled if the node dies (e.g. can't serve RPCs).
+	errorChannel chan error
+
+	// Requests we've seen but not executed yet, so we don't order
+	// the same one twice. Pruned at stable checkpoints.
 	requests map[[sha256.Size]byte]requestInfo
 
+	// Last request executed for each client, and what it returned.
+	// Part of the checkpointed state, since every replica has to agree
+	// on which requests get skipped. Written by the execute stage.
+	lastReply  map[string]cachedReply
+	repliesMux sync.RWMutex
+
+	// Every request we've executed, with its commit certificate.
+	certificates *certificateStore
+
+	// MISBEHAVIOUR EVIDENCE against our peers, and who the cluster has
+	// agreed not to pick as leader because of it. evidence is read by
+	// Evidence() outside the main routine, so we lock it; exclusion is
+	// only touched by the main routine.
+	evidence     map[evidenceKey]MisbehaviourEvidence
+	evidenceMux  sync.RWMutex
+	evidenceFile string
+	exclusion    leaderExclusion
+
+	// Proposals waiting for their request to execute, by digest.
+	// Written to by Propose (in the caller's goroutine), so we lock it.
+	proposals           map[[sha256.Size]byte][]*Proposal
+	pendingProposals    int // across all digests
+	maxPendingProposals int
+	proposalsMux        sync.Mutex
+
+	// Requests we've turned away with ErrOverloaded (updated atomically)
+	rejectedRequests uint64
+
 	//////
 	// The below are all mutable, but writes should ALWAYS
 	// happen on the main routine unless otherwise indicated.
@@ -65,6 +101,7 @@ type PBFTNode struct {
 	// a node with seqnum 0 hasn't yet "committed" to the
 	// current view.
 	log                  map[SlotId]*Slot
+	committedSlots       map[int]SlotId // by sequence number, the latest view's
 	viewNumber           int
 	sequenceNumber       int
 	issuedSequenceNumber int
@@ -73,15 +110,22 @@ type PBFTNode struct {
 	// if viewChange.inProgress.
 	viewChange *viewChangeInfo
 
-	// CHECKPOINT STATE.
+	// CHECKPOINT STATE. Pending checkpoints are grouped by state
+	// digest, since only matching ones count towards stability.
 	lastCheckpoint     CheckpointProof
-	pendingCheckpoints map[SlotId]CheckpointProof
+	pendingCheckpoints map[SlotId]map[[sha256.Size]byte]CheckpointProof
+
+	// EARLY MESSAGES (see buffer.go), by sender.
+	buffered   map[NodeId][]bufferedMessage
+	bufferSize int
 
 	// TIMEOUTS. The heartbeat ticker allows the primary to
 	// continually send timeouts; replicas use the timeout
 	// timer to determine if the leader has been active.
 	heartbeatTicker *time.Ticker
 	timeoutTimer    *time.Timer
+	timing          timing
+	latency         *latencyEstimator // commit latency, for adaptive timeouts
 
 	// LEADER STATE (to catch up stragglers)
 	// if some nodes aren't caught up, newView is broadcasted
@@ -93,15 +137,37 @@ type PBFTNode struct {
 	caughtUpMux sync.RWMutex
 	newView     *NewView // view message to continually broadcast
 
+	// TRANSPORT. How to dial each peer; nil unless the cluster uses TLS.
+	peerTLS map[NodeId]*tls.Config
+
+	// SHUTDOWN. quit is closed by Stop to reject further RPCs and
+	// tell the main loop to exit; done is closed once it has.
+	server   *http.Server
+	admin    *adminServer // nil if we don't take admin commands
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce *sync.Once
+
+	// PROACTIVE RECOVERY (see recovery.go). Both the timer and the
+	// stage belong to the main routine.
+	recovery        recoveryStage
+	recoveryTimer   *time.Timer // nil if we never recover
+	recoveryChannel chan recoveryStep
+	fetchChannel    chan chan CheckpointProof // recovering peers asking for our last checkpoint
+
+	// DURABLE STATE (see durable.go). What we missed while we were
+	// down, from catchUp (or a snapshot from fetchSnapshot).
+	catchUpChannel   chan catchUpBatch
+	fetchingSnapshot bool
+	snapshotFrom     NodeId   // who sent the last snapshot we fetched
+	refusedChannel   chan int // the execute stage refused a restore (see restoreCheckpoint)
+
 	// Debug states
 	down bool
 	slow bool
 }
 
-type snapshot struct {
-	number SlotId
-	state  []byte
-}
+var ErrStopped = errors.New("Node stopped")
 
 // // last stable checkpoint & proof
 // // unstable checkpoints & building proofs
@@ -112,8 +178,8 @@ type snapshot struct {
 // }
 
 type requestInfo struct {
-	committed bool
-	// also info about the reply that we sent
+	view       int // retries in a later view should go to the new primary
+	checkpoint int // last stable checkpoint when we got it
 }
 
 // Information associated with current view change.
@@ -123,17 +189,13 @@ type viewChangeInfo struct {
 	viewNumber int
 }
 
-// Heartbeat ticker
-const TIMEOUT time.Duration = time.Duration(500 * time.Millisecond)
-
-// How many sequence numbers to wait before checkpointing
-const CHECKPOINT uint = 100
-
 // Entry point for each PBFT node.
 // NodeConfig: configuration for this node
 // ClusterConfig: configuration for entire cluster
-// ready channel: send item when node is up & running
-func StartNode(host NodeConfig, cluster ClusterConfig) *PBFTNode {
+// StateMachine: the application that committed requests are applied to
+func StartNode(host NodeConfig, cluster ClusterConfig, app StateMachine) *PBFTNode {
+	// our own copy, so nobody can change the weights under us
+	cluster.Nodes = append([]NodeConfig(nil), cluster.Nodes...)
 
 	// 1. Read PGP private key
 	hostEntityList, err := ReadPgpKeyFile(host.PrivateKeyFile)
@@ -159,8 +221,7 @@ func StartNode(host NodeConfig, cluster ClusterConfig) *PBFTNode {
 	// 2. Create id <=> peer hostname maps from list, read PGP public keys
 	peermap := make(map[NodeId]string)
 	hostToPeer := make(map[string]NodeId)
-	peerEntityMap := make(map[EntityFingerprint]NodeId)
-	peerEntities := make(openpgp.EntityList, 0)
+	peerKeys := make(map[NodeId]*openpgp.Entity)
 	for _, p := range cluster.Nodes {
 		if p.Id != host.Id {
 			hostname := util.GetHostname(p.Host, p.Port)
@@ -173,91 +234,228 @@ func StartNode(host NodeConfig, cluster ClusterConfig) *PBFTNode {
 			} else if len(list) != 1 {
 				plog.Errorf("StartNode(%d) reading node %d public key: expected only 1 PGP entity, got %d", host.Id, p.Id, len(list))
 			}
-			peerEntityMap[list[0].PrimaryKey.Fingerprint] = p.Id
-			peerEntities = append(peerEntities, list[0])
+			peerKeys[p.Id] = list[0]
 		}
 	}
 
-	// 3. Create the node
+	// 3. Load TLS certificates (if we're using them)
+	serverTLS, err := ServerTLSConfig(host, cluster)
+	if err != nil {
+		plog.Fatalf("StartNode(%d) loading TLS certificates: %s", host.Id, err.Error())
+	}
+	peerTLS, err := DialTLSConfigs(host, cluster)
+	if err != nil {
+		plog.Fatalf("StartNode(%d) loading TLS certificates: %s", host.Id, err.Error())
+	}
+
+	// 4. Create the node
+	// Messages are signed for (and only accepted from) this cluster and
+	// configuration epoch
+	domain, err := cluster.Domain()
+	if err != nil {
+		plog.Fatalf("StartNode(%d) working out cluster id: %s", host.Id, err.Error())
+	}
+	weights, err := cluster.Weights()
+	if err != nil {
+		plog.Fatalf("StartNode(%d) checking voting weights: %s", host.Id, err.Error())
+	}
+	if err := cluster.checkRecovery(weights); err != nil {
+		plog.Fatalf("StartNode(%d) checking recovery: %s", host.Id, err.Error())
+	}
+	keys, err := newKeyRing(host.Id, hostEntity, peerKeys, domain, weights, host.KeyRingFile, []byte(passphrase))
+	if err != nil {
+		plog.Fatalf("StartNode(%d) loading key ring: %s", host.Id, err.Error())
+	}
+	authWorkers := cluster.AuthWorkers
+	if authWorkers <= 0 {
+		authWorkers = defaultAuthWorkers()
+	}
 	node := PBFTNode{
-		id:                     host.Id,
-		host:                   host.Host,
-		port:                   host.Port,
-		peermap:                peermap,
-		hostToPeer:             hostToPeer,
-		cluster:                cluster,
-		entity:                 hostEntity,
-		peerEntityMap:          peerEntityMap,
-		peerEntities:           peerEntities,
-		debugChannel:           make(chan *DebugMessage),
-		committedChannel:       make(chan *string),
-		requestSnapshotChannel: make(chan SlotId),
-		errorChannel:           make(chan error),
-		requestChannel:         make(chan *string, 10), // some nice inherent rate limiting
-		recvSnapshotChannel:    make(chan snapshot, 1), // buffer to prevent deadlock
-		snapshottedChannel:     make(chan *[]byte),
-		preprepareChannel:      make(chan *FullPrePrepare),
-		prepareChannel:         make(chan *SignedPrepare),
-		commitChannel:          make(chan *SignedCommit),
-		checkpointChannel:      make(chan *SignedCheckpoint),
-		checkpointProofChannel: make(chan *SignedCheckpointProof),
-		viewChangeChannel:      make(chan *SignedViewChange),
-		newViewChannel:         make(chan *SignedNewView),
-		requestTimeoutChannel:  make(chan bool),
-		requests:               make(map[[sha256.Size]byte]requestInfo),
-		log:                    make(map[SlotId]*Slot),
-		viewNumber:             0,
-		sequenceNumber:         1,
-		issuedSequenceNumber:   1,
-		viewChange:             &viewChangeInfo{inProgress: false, viewNumber: 0, messages: make(map[NodeId]SignedViewChange)},
+		id:                      host.Id,
+		host:                    host.Host,
+		port:                    host.Port,
+		peermap:                 peermap,
+		hostToPeer:              hostToPeer,
+		cluster:                 cluster,
+		keys:                    keys,
+		app:                     app,
+		peerTLS:                 peerTLS,
+		debugChannel:            make(chan *DebugMessage),
+		recoveryChannel:         make(chan recoveryStep),
+		fetchChannel:            make(chan chan CheckpointProof),
+		catchUpChannel:          make(chan catchUpBatch),
+		refusedChannel:          make(chan int),
+		statusChannel:           make(chan chan NodeStatus),
+		errorChannel:            make(chan error, 1),
+		requestChannel:          make(chan *Request, queueSize(cluster.RequestQueueSize, REQUEST_QUEUE_SIZE)),
+		peerChannel:             make(chan authenticated, queueSize(cluster.PeerQueueSize, PEER_QUEUE_SIZE)),
+		snapshotChannel:         make(chan checkpointSnapshot),
+		executedChannel:         make(chan struct{}, 1),
+		evidenceChannel:         make(chan *MisbehaviourEvidence),
+		authSlots:               make(chan struct{}, authWorkers),
+		executeQueue:            make(chan executeItem, queueSize(cluster.ExecuteQueueSize, EXECUTE_QUEUE_SIZE)),
+		replyQueue:              make(chan reply, REPLY_QUEUE_SIZE),
+		stages:                  new(sync.WaitGroup),
+		requestTimeoutChannel:   make(chan bool),
+		requests:                make(map[[sha256.Size]byte]requestInfo),
+		lastReply:               make(map[string]cachedReply),
+		proposals:               make(map[[sha256.Size]byte][]*Proposal),
+		maxPendingProposals:     cluster.MaxPendingRequests,
+		evidence:                make(map[evidenceKey]MisbehaviourEvidence),
+		evidenceFile:            host.EvidenceFile,
+		log:                     make(map[SlotId]*Slot),
+		committedSlots:          make(map[int]SlotId),
+		commits:                 NewCommitStream(),
+		viewNumber:              0,
+		sequenceNumber:          1,
+		issuedSequenceNumber:    1,
+		deliveredSequenceNumber: 1,
+		executedSequenceNumber:  1,
+		viewChange:              &viewChangeInfo{inProgress: false, viewNumber: 0, messages: make(map[NodeId]SignedViewChange)},
 		lastCheckpoint: CheckpointProof{
-			Number:   SlotId{ViewNumber: 0, SeqNumber: 0},
-			Snapshot: make([]byte, 0),
-			Proof:    make(map[NodeId]SignedCheckpoint)},
-		pendingCheckpoints: make(map[SlotId]CheckpointProof),
+			Number:      SlotId{ViewNumber: 0, SeqNumber: 0},
+			Snapshot:    make([]byte, 0),
+			StateDigest: app.StateDigest(),
+			Proof:       make(map[NodeId]SignedCheckpoint)},
+		pendingCheckpoints: make(map[SlotId]map[[sha256.Size]byte]CheckpointProof),
 		heartbeatTicker:    nil,
 		timeoutTimer:       nil,
+		timing:             cluster.timing(),
+		latency:            new(latencyEstimator),
+		buffered:           make(map[NodeId][]bufferedMessage),
+		bufferSize:         cluster.MessageBufferSize,
 		caughtUp:           make(map[NodeId]int),
 		newView:            &NewView{ViewNumber: 0, Node: host.Id},
+		quit:               make(chan struct{}),
+		done:               make(chan struct{}),
+		stopOnce:           &sync.Once{},
 		down:               false,
 		slow:               false,
 	}
 	for p, _ := range node.peermap {
 		node.caughtUp[p] = 1
 	}
+	if node.bufferSize <= 0 {
+		node.bufferSize = MESSAGE_BUFFER_SIZE
+	}
+	if node.maxPendingProposals <= 0 {
+		node.maxPendingProposals = MAX_PENDING_REQUESTS
+	}
+	if err := node.loadEvidence(); err != nil {
+		node.Error("Loading evidence: %v", err)
+	}
+	certificates, err := newCertificateStore(host.CertificateFile)
+	if err != nil {
+		node.Error("Loading commit certificates: %v", err)
+	}
+	node.certificates = certificates
+	resumed, err := node.resume()
+	if err != nil {
+		node.Error("Resuming from saved state: %v", err)
+	}
 
-	// 4. Start RPC server
+	// 5. Start RPC server. Each node gets its own mux (rather than
+	// http.DefaultServeMux) so we can stop & restart it in-process.
 	server := rpc.NewServer()
 	server.Register(&node)
-	node.Log(cluster.Endpoint)
-	server.HandleHTTP(cluster.Endpoint, "/debug/"+cluster.Endpoint)
-	node.Log("Listening on %v", cluster.Endpoint)
+	mux := http.NewServeMux()
+	mux.Handle(cluster.Endpoint, server)
+	node.server = &http.Server{Handler: mux}
+	node.Log("Listening on %v (cluster %s, epoch %d)", cluster.Endpoint, domain.Cluster, domain.Epoch)
 	listener, e := net.Listen("tcp", util.GetHostname("", node.port))
 	if e != nil {
 		node.Error("Listen error: %v", e)
 		return nil
 	}
+	if serverTLS != nil {
+		// peers without a pinned certificate fail the handshake
+		listener = tls.NewListener(listener, serverTLS)
+	}
 	if node.isPrimary() {
 		node.heartbeatTicker = time.NewTicker(node.getTimeout())
 	} else {
 		node.timeoutTimer = time.NewTimer(node.getTimeout())
 	}
-	go http.Serve(listener, nil)
+	go node.serve(listener)
+	if host.AdminPort != 0 {
+		admin, err := newAdminServer(&node, host, cluster)
+		if err != nil {
+			node.Error("Setting up admin endpoint: %v", err)
+		}
+		if err := admin.listen(host.AdminPort); err != nil {
+			node.Error("Admin listen error: %v", err)
+		}
+		node.admin = admin
+	}
 
-	// 5. Start exec loop
+	// 6. Start exec loop, and the stages after it
+	node.stages.Add(2)
+	go node.executeLoop()
+	go node.replyLoop()
+	node.scheduleRecovery()
 	go node.handleMessages()
+	if resumed {
+		go node.catchUp()
+	}
 	return &node
 }
 
+func (n *PBFTNode) serve(listener net.Listener) {
+	if err := n.server.Serve(listener); err != http.ErrServerClosed {
+		plog.Errorf("[Node %d] Serving RPCs: %v", n.id, err)
+		select {
+		case n.errorChannel <- err:
+		default:
+		}
+	}
+}
+
+// Stops the node: further RPCs are rejected with ErrStopped, the
+// listener is closed, and we wait for the main loop to exit (which
+// stops the timers on its way out). Safe to call more than once.
+func (n *PBFTNode) Stop(ctx context.Context) error {
+	n.stopOnce.Do(func() {
+		n.Log("STOPPING")
+		close(n.quit)
+	})
+	err := n.server.Shutdown(ctx)
+	if n.admin != nil {
+		if adminErr := n.admin.server.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+	select {
+	case <-n.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
+// Closed once the node has completely stopped.
+func (n *PBFTNode) Stopped() <-chan struct{} {
+	return n.done
+}
+
+// Every operation the node applies from now on (see CommitStream).
+func (n *PBFTNode) Committed(ctx context.Context) <-chan CommittedEntry {
+	return n.commits.Committed(ctx)
+}
+
+// Called with the application's snapshot at every checkpoint we take.
+func (n *PBFTNode) OnSnapshot(hook SnapshotHook) {
+	n.commits.OnSnapshot(hook)
+}
+
 // ** HELPERS ** //
 
 // Helper functions for logging! (prepends node id to logs) //
-func (n PBFTNode) Log(format string, args ...interface{}) {
+func (n *PBFTNode) Log(format string, args ...interface{}) {
 	args = append([]interface{}{n.id}, args...)
 	plog.Infof("[Node %d] "+format, args...)
 }
 
-func (n PBFTNode) Error(format string, args ...interface{}) {
+func (n *PBFTNode) Error(format string, args ...interface{}) {
 	args = append([]interface{}{n.id}, args...)
 	plog.Fatalf("[Node %d] "+format, args...)
 }
@@ -280,12 +478,12 @@ func (n *PBFTNode) ensureMapping(num SlotId) *Slot {
 	return slot
 }
 
-func (n PBFTNode) isPrimary() bool {
-	return n.cluster.LeaderFor(n.viewNumber) == n.id
+func (n *PBFTNode) isPrimary() bool {
+	return n.leaderFor(n.viewNumber) == n.id
 }
 
-func (n PBFTNode) getPrimary() (NodeId, string) {
-	primaryId := n.cluster.LeaderFor(n.viewNumber)
+func (n *PBFTNode) getPrimary() (NodeId, string) {
+	primaryId := n.leaderFor(n.viewNumber)
 	for i, p := range n.peermap {
 		if i == primaryId {
 			return i, p
@@ -294,73 +492,158 @@ func (n PBFTNode) getPrimary() (NodeId, string) {
 	return NodeId(0), ""
 }
 
-func (n PBFTNode) isPrepared(slot *Slot) bool {
-	// # Prepares received >= 2f = 2 * ((N - 1) / 3)
-	return slot.preprepare != nil && len(slot.prepares) >= 2*(len(n.peermap)/3)
+// Sequence numbers we accept pre-prepares for are in (low, high]
+func (n *PBFTNode) lowWatermark() int {
+	return n.lastCheckpoint.Number.SeqNumber
 }
 
-func (n PBFTNode) isCommitted(slot *Slot) bool {
-	// # Commits received >= 2f = 2 * ((N - 1) / 3)
-	return len(slot.commits) >= 2*(len(n.peermap)/3)
+func (n *PBFTNode) highWatermark() int {
+	return n.lowWatermark() + n.timing.watermarkWindow
+}
+
+func (n *PBFTNode) isPrepared(slot *Slot) bool {
+	if slot.preprepare == nil {
+		return false
+	}
+	// Prepares received (including our own), plus the primary's
+	// pre-prepare standing in for its prepare, make up a quorum
+	voted := map[NodeId]bool{n.leaderFor(slot.preprepare.PrePrepareMessage.Number.ViewNumber): true}
+	for node, _ := range slot.prepares {
+		voted[node] = true
+	}
+	return n.keys.verifier().Weights.Of(voted) >= n.keys.verifier().Weights.Quorum
+}
+
+func (n *PBFTNode) isCommitted(slot *Slot) bool {
+	// Commits received (including our own) make up a quorum
+	voted := make(map[NodeId]bool)
+	for node, _ := range slot.commits {
+		voted[node] = true
+	}
+	return n.keys.verifier().Weights.Of(voted) >= n.keys.verifier().Weights.Quorum
 }
 
 // ** ALL THE MESSAGE HANDLERS ** //
 // MAIN EXECUTION LOOP
 func (n *PBFTNode) handleMessages() {
+	burst := 0
 	for {
+		// Messages from our peers go before new client requests, so a
+		// flood of requests can't hold up ordering the ones we've got.
+		// Only so many in a row though, or a flood of peer messages
+		// would hold up everything else.
+		if burst < PEER_BURST && n.handlePeerMessage() {
+			burst++
+			continue
+		}
+		burst = 0
 		select {
 		// come from RPCS
 		case msg := <-n.debugChannel:
 			n.handleDebug(msg)
-		case msg := <-n.preprepareChannel:
-			n.handlePrePrepare(msg)
+		case reply := <-n.statusChannel:
+			reply <- n.buildStatus()
+		case msg := <-n.peerChannel:
+			n.handleAuthenticated(msg)
 		case msg := <-n.requestChannel:
 			n.handleClientRequest(msg)
-		case msg := <-n.prepareChannel:
-			n.handlePrepare(msg)
-		case msg := <-n.commitChannel:
-			n.handleCommit(msg)
-		case msg := <-n.checkpointChannel:
-			n.handleCheckpoint(msg)
-		case msg := <-n.checkpointProofChannel:
-			n.handleCheckpointProof(msg)
-		case msg := <-n.viewChangeChannel:
-			n.handleViewChange(msg)
-		case msg := <-n.newViewChannel:
-			n.handleNewView(msg)
-		// from client
-		case snapshot := <-n.recvSnapshotChannel:
-			n.handleRecvSnapshot(&snapshot)
+		case msg := <-n.evidenceChannel:
+			n.recordEvidence(msg)
+		// Come from the execute stage
+		case snapshot := <-n.snapshotChannel:
+			n.handleSnapshot(snapshot)
+		case <-n.executedChannel:
+			n.flushExecuteQueue()
 		// Come from internal timers
 		case <-n.requestTimeoutChannel: // one of my client requests timed out!
 			n.startViewChange(n.viewNumber + 1)
 		case <-n.getTimer(): // timer expired
 			n.handleHeartbeatTimeout()
+		case <-n.recoveryTimerChannel():
+			n.startRecovery()
+			n.scheduleRecovery()
+		case step := <-n.recoveryChannel:
+			n.handleRecoveryStep(step)
+		case reply := <-n.fetchChannel:
+			reply <- n.lastCheckpoint
+		case batch := <-n.catchUpChannel:
+			n.handleCatchUp(batch)
+		case executed := <-n.refusedChannel:
+			n.handleRefusedRestore(executed)
+		case <-n.quit:
+			n.stopTimers()
+			if n.recoveryTimer != nil {
+				n.recoveryTimer.Stop()
+			}
+			n.failAllProposals(ErrStopped)
+			n.stages.Wait()
+			n.commits.Close()
+			if err := n.certificates.close(); err != nil {
+				n.Log("Closing commit certificates: %s", err.Error())
+			}
+			close(n.done)
+			return
 		}
 	}
 }
 
+// Handles a message from a peer, if there's one waiting. Returns
+// whether there was.
+func (n *PBFTNode) handlePeerMessage() bool {
+	select {
+	case msg := <-n.peerChannel:
+		n.handleAuthenticated(msg)
+	case msg := <-n.evidenceChannel:
+		n.recordEvidence(msg)
+	default:
+		return false
+	}
+	return true
+}
+
 // does appropriate actions after receivin a client request
 // i.e. send out preprepares and stuff
-func (n *PBFTNode) handleClientRequest(request *string) {
-	if n.viewChange.inProgress {
+func (n *PBFTNode) handleClientRequest(request *Request) {
+	if n.viewChange.inProgress || request == nil {
+		return
+	}
+	requestDigest, err := request.Digest()
+	if err != nil {
+		n.Log(err.Error())
 		return
 	}
-	requestDigest, err := util.GenerateDigest(*request)
-	if _, ok := n.requests[requestDigest]; ok {
+	// (execute checks this too, since a faulty primary could order one
+	// anyway)
+	if request.reservedClient() && !request.isKeyChange() {
+		n.resolveProposals(requestDigest, ProposalResult{}, ErrReservedClient)
+		return
+	}
+	if err := AdmitRequest(n.app, *request); err != nil {
+		n.resolveProposals(requestDigest, ProposalResult{}, err)
+		return
+	}
+	n.repliesMux.RLock()
+	last, ok := n.lastReply[request.Client]
+	n.repliesMux.RUnlock()
+	if ok && request.Timestamp <= last.Timestamp {
+		if requestDigest == last.Digest {
+			// a retry of something we already executed
+			n.resolveProposals(requestDigest, last.result(), nil)
+		} else {
+			n.resolveProposals(requestDigest, ProposalResult{}, ErrStaleRequest)
+		}
+		return
+	}
+	if info, ok := n.requests[requestDigest]; ok && info.view == n.viewNumber {
 		// we've already processed this client request
 		return
 	}
-	n.requests[requestDigest] = requestInfo{committed: false}
+	n.requests[requestDigest] = requestInfo{
+		view:       n.viewNumber,
+		checkpoint: n.lastCheckpoint.Number.SeqNumber,
+	}
 
 	if n.isPrimary() {
-		if request == nil {
-			return
-		}
-		if err != nil {
-			n.Log(err.Error())
-			return
-		}
 		n.issuedSequenceNumber = n.issuedSequenceNumber + 1
 		id := SlotId{
 			ViewNumber: n.viewNumber,
@@ -372,7 +655,7 @@ func (n *PBFTNode) handleClientRequest(request *string) {
 			Number:        id,
 			RequestDigest: requestDigest,
 		}
-		signedMessage, err := message.Sign(n.entity)
+		signedMessage, err := message.Sign(n.keys.signer())
 		if err != nil {
 			n.Log("Signing pre-prepare: " + err.Error())
 			return
@@ -382,31 +665,36 @@ func (n *PBFTNode) handleClientRequest(request *string) {
 			Request:       *request,
 		}
 
-		n.log[id] = &Slot{
+		slot := &Slot{
 			request:       request,
 			requestDigest: requestDigest,
+			accepted:      time.Now(),
 			preprepare:    &fullMessage.SignedMessage,
 			prepares:      make(map[NodeId]SignedPrepare),
 			commits:       make(map[NodeId]*SignedCommit),
 			prepared:      false,
 			committed:     false,
 		}
-		go n.broadcast("PBFTNode.PrePrepare", &fullMessage, 0)
+		n.log[id] = slot
+		n.broadcast("PBFTNode.PrePrepare", &fullMessage, 0)
+		if n.isPrepared(slot) {
+			n.sendCommit(slot, id, requestDigest)
+		}
 	} else {
 		// forward to all ma frandz if im not da leader
-		go n.broadcast("PBFTNode.ClientRequest", request, 0)
+		n.broadcast("PBFTNode.ClientRequest", request, 0)
 	}
 }
 
-func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
-	if n.viewChange.inProgress || n.isPrimary() {
+func (n *PBFTNode) handlePrePrepare(sendingNode NodeId, preprepare *FullPrePrepare) {
+	if n.isPrimary() {
 		return
 	}
 
-	sendingNode, err := preprepare.SignedMessage.SignatureValid(n.peerEntities, n.peerEntityMap)
 	sameView := preprepare.SignedMessage.PrePrepareMessage.Number.ViewNumber == n.viewNumber
-	if err != nil {
-		n.Log("Validating PrePrepare signature: " + err.Error())
+	if number := preprepare.SignedMessage.PrePrepareMessage.Number; number != (SlotId{}) && n.bufferIfEarly(sendingNode, number, preprepare) {
+		return
+	} else if n.viewChange.inProgress {
 		return
 	} else if primaryNode, _ := n.getPrimary(); sameView && sendingNode != primaryNode {
 		n.Log("Error: received PrePrepare not signed by current primary")
@@ -417,7 +705,7 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 	n.timeoutTimer.Reset(n.getTimeout())
 	preprepareMessage := preprepare.SignedMessage.PrePrepareMessage
 	//NO-OP heartbeat... don't bother processing
-	if preprepareMessage == (PrePrepare{}) {
+	if preprepareMessage.isHeartbeat() {
 		return
 	}
 
@@ -428,14 +716,14 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 	}
 	// 2. the sequence number in the preprepare message is between the
 	//    low water-mark h and high water-mark H
-	if preprepareMessage.Number.SeqNumber > n.lastCheckpoint.Number.SeqNumber+int(CHECKPOINT*3) ||
-		preprepareMessage.Number.SeqNumber <= n.lastCheckpoint.Number.SeqNumber {
+	if preprepareMessage.Number.SeqNumber > n.highWatermark() ||
+		preprepareMessage.Number.SeqNumber <= n.lowWatermark() {
 		return
 	}
 	// 3. the signatures in the request and the pre-prepare message are
 	//    correct (message signature checked above) and d is the digest for message m
 	// TODO: (jlwatson) check request signature. most likely a call into KeyNode
-	requestDigest, err := util.GenerateDigest(preprepare.Request)
+	requestDigest, err := preprepare.Request.Digest()
 	if err != nil {
 		n.Log(err.Error())
 		return
@@ -444,6 +732,10 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 		n.Log("Error: PrePrepare request digest does not match the request data")
 		return
 	}
+	if err := AdmitRequest(n.app, preprepare.Request); err != nil {
+		n.Log("Error: PrePrepare for a request we won't take: %s", err.Error())
+		return
+	}
 
 	slot := n.ensureMapping(preprepareMessage.Number)
 
@@ -452,6 +744,14 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 		//    num n containing a different digest
 		if slot.requestDigest != preprepareMessage.RequestDigest {
 			plog.Errorf("Received pre-prepare for slot id %+v with mismatched digest.", preprepareMessage.Number)
+			if slot.preprepare != nil {
+				n.recordEvidence(&MisbehaviourEvidence{
+					Kind:        CONFLICTING_PREPREPARE,
+					Node:        sendingNode,
+					Number:      preprepareMessage.Number,
+					PrePrepares: []SignedPrePrepare{*slot.preprepare, preprepare.SignedMessage},
+				})
+			}
 		}
 		return
 	}
@@ -463,6 +763,7 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 
 	slot.request = &preprepare.Request
 	slot.requestDigest = preprepareMessage.RequestDigest
+	slot.accepted = time.Now()
 	slot.preprepare = &preprepare.SignedMessage
 
 	prepare := Prepare{
@@ -470,7 +771,7 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 		RequestDigest: preprepareMessage.RequestDigest,
 		Node:          n.id,
 	}
-	signedMessage, err := prepare.Sign(n.entity)
+	signedMessage, err := prepare.Sign(n.keys.signer())
 	if err != nil {
 		n.Log("Signing prepare: " + err.Error())
 		return
@@ -478,20 +779,18 @@ func (n *PBFTNode) handlePrePrepare(preprepare *FullPrePrepare) {
 
 	slot.prepares[n.id] = *signedMessage
 	n.log[preprepareMessage.Number].preprepare = &preprepare.SignedMessage
-	go n.broadcast("PBFTNode.Prepare", signedMessage, 0)
+	n.broadcast("PBFTNode.Prepare", signedMessage, 0)
+	if n.isPrepared(slot) {
+		n.sendCommit(slot, preprepareMessage.Number, preprepareMessage.RequestDigest)
+	}
 }
 
-func (n *PBFTNode) handlePrepare(message *SignedPrepare) {
-	if n.viewChange.inProgress {
+func (n *PBFTNode) handlePrepare(sender NodeId, message *SignedPrepare) {
+	if sender != message.PrepareMessage.Node {
+		n.Log("Error: received Prepare not signed by correct sending node")
 		return
 	}
-
-	sender, err := message.SignatureValid(n.peerEntities, n.peerEntityMap)
-	if err != nil {
-		n.Log("Validating Prepare signature: " + err.Error())
-		return
-	} else if sender != message.PrepareMessage.Node {
-		n.Log("Error: received Prepare not signed by correct sending node")
+	if n.bufferIfEarly(sender, message.PrepareMessage.Number, message) || n.viewChange.inProgress {
 		return
 	}
 
@@ -500,42 +799,54 @@ func (n *PBFTNode) handlePrepare(message *SignedPrepare) {
 	if slot.request != nil && slot.requestDigest != prepare.RequestDigest {
 		plog.Errorf("Received prepare for slot id %+v with mismatched digest.", prepare.Number)
 	}
+	if previous, ok := slot.prepares[prepare.Node]; ok && previous.PrepareMessage.RequestDigest != prepare.RequestDigest {
+		n.recordEvidence(&MisbehaviourEvidence{
+			Kind:     CONFLICTING_PREPARE,
+			Node:     prepare.Node,
+			Number:   prepare.Number,
+			Prepares: []SignedPrepare{previous, *message},
+		})
+		return
+	}
 	slot.prepares[prepare.Node] = *message
 
 	n.log[prepare.Number] = slot
 	if n.isPrepared(slot) {
-		n.Log("PREPARED %+v", prepare.Number)
-		slot.prepared = true
-
-		commit := Commit{
-			Number:        prepare.Number,
-			RequestDigest: prepare.RequestDigest,
-			Node:          n.id,
-		}
-		signedMessage, err := commit.Sign(n.entity)
-		if err != nil {
-			n.Log("Signing commit: " + err.Error())
-			return
-		}
-
-		slot.commits[n.id] = signedMessage
-		go n.broadcast("PBFTNode.Commit", signedMessage, 0)
+		n.sendCommit(slot, prepare.Number, prepare.RequestDigest)
 	}
 }
 
-func (n *PBFTNode) handleCommit(message *SignedCommit) {
-	if n.viewChange.inProgress {
-		return
-	}
+// We're prepared, so commit. With voting weights our own vote might be
+// what tips a slot over, so this can happen without hearing from anyone
+// else.
+func (n *PBFTNode) sendCommit(slot *Slot, number SlotId, digest [sha256.Size]byte) {
+	n.Log("PREPARED %+v", number)
+	slot.prepared = true
 
-	sender, err := message.SignatureValid(n.peerEntities, n.peerEntityMap)
+	commit := Commit{
+		Number:        number,
+		RequestDigest: digest,
+		Node:          n.id,
+	}
+	signedMessage, err := commit.Sign(n.keys.signer())
 	if err != nil {
-		n.Log("Validating Commit signature: " + err.Error())
+		n.Log("Signing commit: " + err.Error())
 		return
-	} else if sender != message.CommitMessage.Node {
+	}
+
+	slot.commits[n.id] = signedMessage
+	n.broadcast("PBFTNode.Commit", signedMessage, 0)
+	n.checkCommitted(slot, number)
+}
+
+func (n *PBFTNode) handleCommit(sender NodeId, message *SignedCommit) {
+	if sender != message.CommitMessage.Node {
 		n.Log("Error: received Commit not signed by correct sending node")
 		return
 	}
+	if n.bufferIfEarly(sender, message.CommitMessage.Number, message) || n.viewChange.inProgress {
+		return
+	}
 
 	commit := message.CommitMessage
 	if commit.Number.Before(n.lastCheckpoint.Number) {
@@ -546,35 +857,42 @@ func (n *PBFTNode) handleCommit(message *SignedCommit) {
 	if slot.request != nil && slot.requestDigest != commit.RequestDigest {
 		plog.Errorf("Received commit for slot id %+v with mismatched digest.", commit.Number)
 	}
+	if previous, ok := slot.commits[commit.Node]; ok && previous.CommitMessage.RequestDigest != commit.RequestDigest {
+		n.recordEvidence(&MisbehaviourEvidence{
+			Kind:    CONFLICTING_COMMIT,
+			Node:    commit.Node,
+			Number:  commit.Number,
+			Commits: []SignedCommit{*previous, *message},
+		})
+		return
+	}
 	slot.commits[commit.Node] = message
+	n.checkCommitted(slot, commit.Number)
+}
+
+func (n *PBFTNode) checkCommitted(slot *Slot, number SlotId) {
 	nowCommitted := !slot.committed && n.isCommitted(slot)
 	if nowCommitted {
-		n.Log("COMMITTED %+v", commit.Number)
+		n.Log("COMMITTED %+v", number)
 		slot.committed = true
-		// info := n.requests[commit.Message.Id] //.committed = true
-		// n.requests[commit.Message.Id] = requestInfo{
-		// 	id:        info.id,
-		// 	committed: true,
-		// 	request:   info.request,
-		// }
-		if commit.Number.SeqNumber > n.sequenceNumber {
-			n.sequenceNumber = commit.Number.SeqNumber
+		if id, ok := n.committedSlots[number.SeqNumber]; !ok || id.ViewNumber < number.ViewNumber {
+			n.committedSlots[number.SeqNumber] = number
+		}
+		if !slot.accepted.IsZero() {
+			n.latency.observe(time.Since(slot.accepted))
+		}
+		if number.SeqNumber > n.sequenceNumber {
+			n.sequenceNumber = number.SeqNumber
 		}
 	}
-	n.log[commit.Number] = slot
+	n.log[number] = slot
 	if nowCommitted {
-		// TODO: try to execute as many sequential queries as possible and
-		// then reply to the clients via committedChannel. Figure out what
-		// the highest committed operation sequence number was and apply
-		// up to that
-		// TODO: fix this
-		n.Committed() <- slot.request
-		n.tryCheckpoint()
+		n.executeCommitted()
 	}
 }
 
 type requestView struct {
-	request       string
+	request       Request
 	requestDigest [sha256.Size]byte
 	view          int
 }
@@ -584,11 +902,11 @@ type requestView struct {
 func (n *PBFTNode) getTimeout() time.Duration {
 	// When primary times out, it send a heartbeat
 	if n.isPrimary() {
-		return TIMEOUT
+		return n.timing.heartbeat
 	} else {
 		// When non-primaries timeout with no heartbeat,
 		// they start view change
-		return TIMEOUT * time.Duration(len(n.peermap)) / 2
+		return n.viewChangeTimeout()
 	}
 }
 
@@ -610,21 +928,21 @@ func (n *PBFTNode) handleHeartbeatTimeout() {
 func (n *PBFTNode) heartbeatMessage(peerSequence int) (string, interface{}) {
 	if n.sequenceNumber == peerSequence {
 		pp := PrePrepare{}
-		signedMessage, err := pp.Sign(n.entity)
+		signedMessage, err := pp.Sign(n.keys.signer())
 		if err != nil {
 			plog.Fatal("Error signing empty heartbeat PrePrepare")
 		}
 		return "PBFTNode.PrePrepare", FullPrePrepare{
 			SignedMessage: *signedMessage,
-			Request:       "",
+			Request:       Request{},
 		}
 	}
 	if peerSequence < n.lastCheckpoint.Number.SeqNumber {
 		message := CheckpointProofMessage{
-			Proof: n.lastCheckpoint,
+			Proof: n.lastCheckpoint.withoutSnapshot(),
 			Node:  n.id,
 		}
-		signedMessage, err := message.Sign(n.entity)
+		signedMessage, err := message.Sign(n.keys.signer())
 		if err != nil {
 			plog.Fatal("Error signing checkpoint proof")
 		}
@@ -642,7 +960,7 @@ func (n *PBFTNode) heartbeatMessage(peerSequence int) (string, interface{}) {
 }
 
 func (n *PBFTNode) sendHeartbeat() {
-	if !n.isPrimary() {
+	if !n.isPrimary() || n.recovery == RECOVERY_FETCH {
 		return
 	}
 	for id, hostname := range n.peermap {
@@ -658,7 +976,7 @@ func (n *PBFTNode) sendHeartbeat() {
 		if caughtUp == 0 {
 			rpcType = "PBFTNode.NewView"
 			var newViewMessage NewView = *n.newView
-			signedMessage, err := newViewMessage.Sign(n.entity)
+			signedMessage, err := newViewMessage.Sign(n.keys.signer())
 			if err != nil {
 				n.Log("Signing NewView heartbeat: " + err.Error())
 				return
@@ -675,7 +993,7 @@ func (n *PBFTNode) sendHeartbeat() {
 			rpcType, msg = n.heartbeatMessage(caughtUp)
 			after = func(id NodeId, response SignedPPResponse, err error) {
 				if err == nil {
-					respId, err := response.SignatureValid(n.peerEntities, n.peerEntityMap)
+					respId, err := response.SignatureValid(n.keys.verifier())
 					if err != nil {
 						n.Log("Error validating heartbeat signature: " + err.Error())
 					} else if respId != id {
@@ -690,7 +1008,7 @@ func (n *PBFTNode) sendHeartbeat() {
 		}
 		go func(id NodeId, hostname string, rpcType string, msg interface{}, after func(NodeId, SignedPPResponse, error)) {
 			resp := SignedPPResponse{}
-			err := sendRpc(n.id, id, hostname, rpcType, n.cluster.Endpoint, msg, &resp, 1, time.Duration(100*time.Millisecond))
+			err := sendRpc(n.id, id, hostname, rpcType, n.cluster.Endpoint, msg, &resp, 1, time.Duration(100*time.Millisecond), n.peerTLS)
 			after(id, resp, err)
 		}(id, hostname, rpcType, msg, after)
 	}
@@ -723,42 +1041,45 @@ func (n *PBFTNode) startTimers() {
 	}
 }
 
-func (n PBFTNode) Id() NodeId {
+func (n *PBFTNode) Id() NodeId {
 	return n.id
 }
 
-func (n PBFTNode) Down() bool {
+func (n *PBFTNode) Down() bool {
 	return n.down
 }
 
-func (n PBFTNode) Failure() chan error {
+func (n *PBFTNode) Failure() chan error {
 	return n.errorChannel
 }
 
-func (n PBFTNode) Committed() chan *string {
-	return n.committedChannel
-}
-
-func (n *PBFTNode) Propose(operation *string) {
-	n.requestChannel <- operation
-}
-
-func (n PBFTNode) ClientRequest(req *string, res *Ack) error {
+func (n *PBFTNode) ClientRequest(req *Request, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.requestChannel <- req
+	select {
+	case n.requestChannel <- req:
+	case <-n.quit:
+		return ErrStopped
+	default:
+		// the sender (or the client) can retry
+		atomic.AddUint64(&n.rejectedRequests, 1)
+		return ErrOverloaded
+	}
 	return nil
 }
 
-func (n PBFTNode) PrePrepare(req *FullPrePrepare, res *SignedPPResponse) error {
+func (n *PBFTNode) PrePrepare(req *FullPrePrepare, res *SignedPPResponse) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.preprepareChannel <- req
+	err := n.authenticate(req, func() (NodeId, error) { return req.SignedMessage.SignatureValid(n.keys.verifier()) })
+	if err != nil {
+		return err
+	}
 
 	res.Response.SeqNumber = n.sequenceNumber
-	sig, err := res.Response.GetSignature(n.entity)
+	sig, err := res.Response.GetSignature(n.keys.signer())
 	if err != nil {
 		return err
 	}
@@ -767,31 +1088,36 @@ func (n PBFTNode) PrePrepare(req *FullPrePrepare, res *SignedPPResponse) error {
 	return nil
 }
 
-func (n PBFTNode) Prepare(req *SignedPrepare, res *Ack) error {
+func (n *PBFTNode) Prepare(req *SignedPrepare, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.prepareChannel <- req
-	return nil
+	return n.authenticate(req, func() (NodeId, error) { return req.SignatureValid(n.keys.verifier()) })
 }
 
-func (n PBFTNode) Commit(req *SignedCommit, res *Ack) error {
+func (n *PBFTNode) Commit(req *SignedCommit, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.commitChannel <- req
-	return nil
+	return n.authenticate(req, func() (NodeId, error) { return req.SignatureValid(n.keys.verifier()) })
 }
 
-func (n PBFTNode) broadcast(rpcName string, message interface{}, timeout time.Duration) {
-	broadcast(n.id, n.peermap, rpcName, n.cluster.Endpoint, message, timeout)
+// Doesn't block (every peer gets its own goroutine). Must be called on
+// the main routine!
+func (n *PBFTNode) broadcast(rpcName string, message interface{}, timeout time.Duration) {
+	// a recovering replica keeps quiet until it's restored a checkpoint
+	if n.recovery == RECOVERY_FETCH {
+		return
+	}
+	broadcast(n.id, n.peermap, rpcName, n.cluster.Endpoint, message, timeout, n.peerTLS)
 }
 
 // ** RPC helpers ** //
-func broadcast(fromId NodeId, peers map[NodeId]string, rpcName string, endpoint string, message interface{}, timeout time.Duration) {
+// peerTLS: how to dial each peer (nil/missing for plain HTTP)
+func broadcast(fromId NodeId, peers map[NodeId]string, rpcName string, endpoint string, message interface{}, timeout time.Duration, peerTLS map[NodeId]*tls.Config) {
 	for i, p := range peers {
 		go func(i NodeId, hostname string) {
-			err := sendRpc(fromId, i, hostname, rpcName, endpoint, message, nil, 10, 0)
+			err := sendRpc(fromId, i, hostname, rpcName, endpoint, message, nil, 10, 0, peerTLS)
 			if err != nil {
 				plog.Info(err)
 			}
@@ -799,7 +1125,7 @@ func broadcast(fromId NodeId, peers map[NodeId]string, rpcName string, endpoint
 	}
 }
 
-func sendRpc(fromId NodeId, peerId NodeId, hostName string, rpcName string, endpoint string, message interface{}, response interface{}, retries int, timeout time.Duration) error {
+func sendRpc(fromId NodeId, peerId NodeId, hostName string, rpcName string, endpoint string, message interface{}, response interface{}, retries int, timeout time.Duration, peerTLS map[NodeId]*tls.Config) error {
 	// plog.Infof("[Node %d] Sending RPC (%s) to Node %d", fromId, rpcName, peerId)
-	return util.SendRpc(hostName, endpoint, rpcName, message, response, retries, 0)
+	return util.SendRpcTLS(hostName, endpoint, rpcName, message, response, retries, 0, peerTLS[peerId])
 }
@@ -0,0 +1,1689 @@
+package pbft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"distributepki/util"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ** IN-PROCESS TEST CLUSTER ** //
+
+type testCluster struct {
+	t      testing.TB
+	config ClusterConfig
+	nodes  map[NodeId]*PBFTNode
+	apps   map[NodeId]*testStateMachine
+}
+
+// Remembers everything applied to it, in order, and notifies
+// anybody waiting. Takes delay to apply each request, if set.
+type testStateMachine struct {
+	mu      sync.Mutex
+	applied []string
+	updated chan struct{}
+	delay   time.Duration
+}
+
+func newTestStateMachine() *testStateMachine {
+	return &testStateMachine{applied: make([]string, 0), updated: make(chan struct{}, 1)}
+}
+
+func (sm *testStateMachine) Apply(seq int, request string) string {
+	sm.mu.Lock()
+	sm.applied = append(sm.applied, request)
+	delay := sm.delay
+	sm.mu.Unlock()
+	time.Sleep(delay)
+	select {
+	case sm.updated <- struct{}{}:
+	default:
+	}
+	return strings.ToUpper(request)
+}
+
+func (sm *testStateMachine) Snapshot() ([]byte, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return json.Marshal(sm.applied)
+}
+
+func (sm *testStateMachine) Restore(snapshot []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return json.Unmarshal(snapshot, &sm.applied)
+}
+
+func (sm *testStateMachine) StateDigest() [sha256.Size]byte {
+	snapshot, _ := sm.Snapshot()
+	return sha256.Sum256(snapshot)
+}
+
+func (sm *testStateMachine) has(request string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, applied := range sm.applied {
+		if applied == request {
+			return true
+		}
+	}
+	return false
+}
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func writeArmoredKey(t testing.TB, path string, blockType string, serialize func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := armor.Encode(f, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+// Self-signed TLS certificate & key, written as PEM.
+func writeTestCert(t testing.TB, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".tlskey")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Generates fresh keys for n nodes listening on free localhost ports.
+func newTestConfig(t testing.TB, n int) ClusterConfig {
+	dir, err := ioutil.TempDir("", "pbft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := filepath.Join(dir, "passphrase.txt")
+	if err := ioutil.WriteFile(passphrase, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := ClusterConfig{Endpoint: "/pbft"}
+	for i := 1; i <= n; i++ {
+		entity, err := openpgp.NewEntity(fmt.Sprintf("node%d", i), "", "", &packet.Config{RSABits: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		public := filepath.Join(dir, fmt.Sprintf("node%d.pub", i))
+		private := filepath.Join(dir, fmt.Sprintf("node%d.key", i))
+		writeArmoredKey(t, public, openpgp.PublicKeyType, entity.Serialize)
+		writeArmoredKey(t, private, openpgp.PrivateKeyType, func(w io.Writer) error {
+			return entity.SerializePrivate(w, nil)
+		})
+		certFile, tlsKeyFile := writeTestCert(t, dir, fmt.Sprintf("node%d", i))
+		config.Nodes = append(config.Nodes, NodeConfig{
+			Id:              NodeId(i),
+			Host:            "localhost",
+			Port:            freePort(t),
+			PublicKeyFile:   public,
+			PrivateKeyFile:  private,
+			PassPhraseFile:  passphrase,
+			EvidenceFile:    filepath.Join(dir, fmt.Sprintf("node%d.evidence", i)),
+			CertificateFile: filepath.Join(dir, fmt.Sprintf("node%d.certificates", i)),
+			CertFile:        certFile,
+			TLSKeyFile:      tlsKeyFile,
+		})
+	}
+	return config
+}
+
+// Saves what it's as of along with every request, like a
+// DurableStateMachine on disk would, and keeps it across restarts.
+type durableTestStateMachine struct {
+	*testStateMachine
+	seq     int
+	replica []byte
+}
+
+func (sm *durableTestStateMachine) ApplyDurably(seq int, request string, replica func(result string) []byte) string {
+	result := sm.Apply(seq, request)
+	sm.Save(seq, replica(result))
+	return result
+}
+
+func (sm *durableTestStateMachine) Save(seq int, replica []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.seq, sm.replica = seq, replica
+	return nil
+}
+
+func (sm *durableTestStateMachine) Saved() (int, []byte, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.seq, sm.replica, nil
+}
+
+func (sm *durableTestStateMachine) Restore(snapshot []byte) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.seq, sm.replica = 0, nil
+	return json.Unmarshal(snapshot, &sm.applied)
+}
+
+func startTestCluster(t testing.TB, n int) *testCluster {
+	return startTestClusterWith(t, n, func(*ClusterConfig) {})
+}
+
+// Lets tests tweak the cluster config before starting it.
+func startTestClusterWith(t testing.TB, n int, configure func(*ClusterConfig)) *testCluster {
+	config := newTestConfig(t, n)
+	configure(&config)
+	c := &testCluster{
+		t:      t,
+		config: config,
+		nodes:  make(map[NodeId]*PBFTNode),
+		apps:   make(map[NodeId]*testStateMachine),
+	}
+	for _, node := range c.config.Nodes {
+		c.start(node.Id)
+	}
+	return c
+}
+
+func (c *testCluster) start(id NodeId) {
+	app := newTestStateMachine()
+	c.startWith(id, app, app)
+}
+
+// Starts a node on app, which applies everything to sm.
+func (c *testCluster) startWith(id NodeId, app StateMachine, sm *testStateMachine) {
+	for _, config := range c.config.Nodes {
+		if config.Id == id {
+			node := StartNode(config, c.config, app)
+			if node == nil {
+				c.t.Fatalf("node %d failed to start", id)
+			}
+			c.nodes[id] = node
+			c.apps[id] = sm
+			return
+		}
+	}
+	c.t.Fatalf("no node %d", id)
+}
+
+func (c *testCluster) stop(id NodeId) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.nodes[id].Stop(ctx); err != nil {
+		c.t.Fatalf("stopping node %d: %v", id, err)
+	}
+}
+
+func (c *testCluster) stopAll() {
+	for id, _ := range c.nodes {
+		c.stop(id)
+	}
+}
+
+func (c *testCluster) primary() NodeId {
+	return c.config.LeaderFor(0)
+}
+
+func (c *testCluster) backup() NodeId {
+	for _, node := range c.config.Nodes {
+		if node.Id != c.primary() {
+			return node.Id
+		}
+	}
+	return 0
+}
+
+// Waits for the given node to apply the request to its state machine.
+func (c *testCluster) waitForCommit(id NodeId, request string) {
+	timeout := time.After(10 * time.Second)
+	app := c.apps[id]
+	for !app.has(request) {
+		select {
+		case <-app.updated:
+		case <-timeout:
+			c.t.Fatalf("node %d never committed %q", id, request)
+		}
+	}
+}
+
+// Reads a node's private key, so tests can sign things as it.
+// Signs messages as node id would.
+func (c *testCluster) signer(id NodeId) Signer {
+	domain, err := c.config.Domain()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for _, config := range c.config.Nodes {
+		if config.Id == id {
+			list, err := ReadPgpKeyFile(config.PrivateKeyFile)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			return Signer{Entity: list[0], Domain: domain}
+		}
+	}
+	c.t.Fatalf("no node %d", id)
+	return Signer{}
+}
+
+// Waits for the given node to have evidence against another.
+func (c *testCluster) waitForEvidence(id NodeId, against NodeId) MisbehaviourEvidence {
+	timeout := time.After(10 * time.Second)
+	for {
+		for _, evidence := range c.nodes[id].Evidence() {
+			if evidence.Node == against {
+				return evidence
+			}
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			c.t.Fatalf("node %d never got evidence against %d", id, against)
+		}
+	}
+}
+
+// Proposes the request at the given node and waits for the result.
+func (c *testCluster) propose(id NodeId, request *Request) (ProposalResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.nodes[id].Propose(ctx, request).Result()
+}
+
+func testRequest(client string, timestamp int64, operation string) *Request {
+	return &Request{Client: client, Timestamp: timestamp, Operation: operation}
+}
+
+// ** TESTS ** //
+
+func TestProposeResult(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+
+	// proposals at backups get forwarded, but still resolve locally
+	for _, id := range []NodeId{c.primary(), c.backup()} {
+		request := fmt.Sprintf("hello from %d", id)
+		result, err := c.propose(id, testRequest(request, 1, request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Result != strings.ToUpper(request) {
+			t.Fatalf("expected result %q, got %q", strings.ToUpper(request), result.Result)
+		}
+		cert := result.Certificate
+		if cert.Number.SeqNumber != result.SeqNumber {
+			t.Fatalf("certificate is for %+v, but request executed at %d", cert.Number, result.SeqNumber)
+		}
+		if len(cert.Commits) < 2*((len(c.nodes)-1)/3)+1 {
+			t.Fatalf("certificate only has %d commits", len(cert.Commits))
+		}
+		for _, commit := range cert.Commits {
+			if commit.CommitMessage.RequestDigest != cert.RequestDigest {
+				t.Fatalf("commit from %d doesn't match certificate digest", commit.CommitMessage.Node)
+			}
+		}
+	}
+
+	// already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.nodes[c.primary()].Propose(ctx, testRequest("late", 1, "too late")).Result(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestClientDeduplication(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+
+	first, err := c.propose(c.primary(), testRequest("alice", 10, "first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an exact retry (at any node) gets the original reply, without
+	// executing again
+	for _, id := range []NodeId{c.primary(), c.backup()} {
+		retry, err := c.propose(id, testRequest("alice", 10, "first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry.Result != first.Result || retry.SeqNumber != first.SeqNumber {
+			t.Fatalf("retry got %+v, expected %+v", retry, first)
+		}
+	}
+
+	// older (or reused) timestamps are stale
+	if _, err := c.propose(c.primary(), testRequest("alice", 9, "older")); err != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %v", err)
+	}
+	if _, err := c.propose(c.primary(), testRequest("alice", 10, "different")); err != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %v", err)
+	}
+
+	// other clients and newer timestamps go through
+	if _, err := c.propose(c.primary(), testRequest("bob", 1, "first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.propose(c.primary(), testRequest("alice", 11, "second")); err != nil {
+		t.Fatal(err)
+	}
+	for id, _ := range c.nodes {
+		c.waitForCommit(id, "second")
+		app := c.apps[id]
+		app.mu.Lock()
+		applied := strings.Join(app.applied, ",")
+		app.mu.Unlock()
+		if applied != "first,first,second" {
+			t.Fatalf("node %d applied %s", id, applied)
+		}
+	}
+}
+
+func TestMisbehaviourEvidence(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+
+	// pick a faulty backup, and somebody else to tell
+	var faulty, witness NodeId
+	for _, node := range c.config.Nodes {
+		if node.Id == c.primary() {
+			continue
+		} else if faulty == 0 {
+			faulty = node.Id
+		} else if witness == 0 {
+			witness = node.Id
+		}
+	}
+
+	number := SlotId{ViewNumber: 0, SeqNumber: 50}
+	for _, request := range []string{"one thing", "another"} {
+		digest, _ := testRequest("client", 1, request).Digest()
+		prepare := Prepare{Number: number, RequestDigest: digest, Node: faulty}
+		signed, err := prepare.Sign(c.signer(faulty))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.nodes[witness].Prepare(signed, &Ack{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evidence := c.waitForEvidence(witness, faulty)
+	if evidence.Kind != CONFLICTING_PREPARE || evidence.Number != number {
+		t.Fatalf("unexpected evidence %+v", evidence)
+	}
+	// everybody else hears about it too
+	for id, _ := range c.nodes {
+		if id != faulty {
+			c.waitForEvidence(id, faulty)
+		}
+	}
+
+	// it's only evidence if the messages conflict
+	tampered := evidence
+	tampered.Prepares = []SignedPrepare{evidence.Prepares[0], evidence.Prepares[0]}
+	node := c.nodes[witness]
+	if err := tampered.Verify(node.keys.verifier()); err == nil {
+		t.Fatal("expected non-conflicting evidence to be rejected")
+	}
+
+	// and it survives a restart
+	c.stop(witness)
+	c.start(witness)
+	if len(c.nodes[witness].Evidence()) != 1 {
+		t.Fatalf("expected evidence to be reloaded, got %+v", c.nodes[witness].Evidence())
+	}
+}
+
+func TestLeaderExcluding(t *testing.T) {
+	config := ClusterConfig{Nodes: []NodeConfig{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}}
+	for view := 0; view < 100; view++ {
+		leader := config.LeaderFor(view)
+		if config.LeaderExcluding(view, nil) != leader {
+			t.Fatalf("view %d: excluding nobody should give %d", view, leader)
+		}
+		if config.LeaderExcluding(view, map[NodeId]bool{leader: true}) == leader {
+			t.Fatalf("view %d: excluded leader %d picked anyway", view, leader)
+		}
+	}
+}
+
+func TestLeaderForAgreedExclusions(t *testing.T) {
+	config := ClusterConfig{Nodes: []NodeConfig{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}, SkipFaultyLeaders: true}
+	n := &PBFTNode{cluster: config}
+	// the NewView for view 2 agreed to skip view 3's leader
+	skipped := config.LeaderFor(3)
+	n.exclusion = leaderExclusion{view: 2, excluded: map[NodeId]bool{skipped: true}}
+	if n.leaderFor(3) == skipped {
+		t.Fatalf("excluded node %d is still leader of view 3", skipped)
+	}
+	// but view 2 itself was picked before that
+	if n.leaderFor(2) != config.LeaderFor(2) {
+		t.Fatal("exclusion changed the leader of the view it was agreed in")
+	}
+}
+
+func TestViewChange(t *testing.T) {
+	// view changes don't time out yet (see startViewChange), so this
+	// needs view 1's leader to be somebody else: with five nodes it is
+	c := startTestClusterWith(t, 5, func(config *ClusterConfig) {
+		config.HeartbeatInterval = Duration(100 * time.Millisecond)
+		config.ViewChangeTimeout = Duration(500 * time.Millisecond)
+	})
+	defer c.stopAll()
+
+	if _, err := c.propose(c.primary(), testRequest("client", 1, "before")); err != nil {
+		t.Fatal(err)
+	}
+	// the backups give up on a dead primary, and agree on a new one
+	c.stop(c.primary())
+	leader := c.config.LeaderFor(1)
+	if leader == c.primary() {
+		t.Fatal("view 1 has the same leader as view 0")
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		if status := c.nodes[leader].GetStatus(); status.ViewNumber == 1 && status.Primary {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("node %d never took over: %+v", leader, status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := c.propose(leader, testRequest("client", 2, "after")); err != nil {
+		t.Fatal(err)
+	}
+	for id, _ := range c.nodes {
+		if id != c.primary() {
+			c.waitForCommit(id, "after")
+		}
+	}
+
+	// a NewView needs view changes from a quorum behind it
+	forged := NewView{ViewNumber: 5, Node: c.config.LeaderFor(5)}
+	backup := NodeId(0)
+	for id, _ := range c.nodes {
+		if id != c.primary() && id != leader && id != forged.Node {
+			backup = id
+		}
+	}
+	signed, err := forged.Sign(c.signer(forged.Node))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.nodes[backup].NewView(signed, &Ack{}); err != ErrNewViewQuorum {
+		t.Fatalf("expected ErrNewViewQuorum, got %v", err)
+	}
+	// and they have to be signed by who they say
+	vc := ViewChange{ViewNumber: 5, Node: backup}
+	signedVC, err := vc.Sign(c.signer(leader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.ViewChanges = NewViewViewChangeMap{backup: *signedVC}
+	if signed, err = forged.Sign(c.signer(forged.Node)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.nodes[backup].NewView(signed, &Ack{}); err != ErrViewChangeSigner {
+		t.Fatalf("expected ErrViewChangeSigner, got %v", err)
+	}
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.CheckpointInterval = 4
+		config.WatermarkWindow = 8
+	})
+	defer c.stopAll()
+	committed := c.nodes[c.primary()].Committed(context.Background())
+	snapshots := make(chan int, 10)
+	c.nodes[c.primary()].OnSnapshot(func(seq int, snapshot []byte) {
+		snapshots <- seq
+	})
+
+	// more than a window's worth, so we have to checkpoint to get through
+	for i := 0; i < 12; i++ {
+		if _, err := c.propose(c.primary(), testRequest("client", int64(i+1), fmt.Sprintf("request %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(10 * time.Second)
+	for id, node := range c.nodes {
+		for {
+			status := node.GetStatus()
+			if status.LowWatermark >= 12 {
+				if status.HighWatermark != status.LowWatermark+8 {
+					t.Fatalf("node %d has watermarks %d-%d", id, status.LowWatermark, status.HighWatermark)
+				}
+				break
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-timeout:
+				t.Fatalf("node %d stuck at checkpoint %d", id, status.LowWatermark)
+			}
+		}
+	}
+
+	// the primary's followers saw every request, in order
+	last := 0
+	for i := 0; i < 12; i++ {
+		entry := <-committed
+		if entry.Operation != fmt.Sprintf("request %d", i) || entry.SeqNumber <= last {
+			t.Fatalf("expected request %d after seq %d, got %+v", i, last, entry)
+		}
+		last = entry.SeqNumber
+	}
+	if seq := <-snapshots; seq != 4 {
+		t.Fatalf("expected the first snapshot at 4, got %d", seq)
+	}
+}
+
+func TestCheckpointSnapshotFetch(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.CheckpointInterval = 4
+		config.WatermarkWindow = 8
+	})
+	defer c.stopAll()
+
+	// a backup misses a couple of checkpoints' worth...
+	backup := c.backup()
+	c.stop(backup)
+	for i := 0; i < 12; i++ {
+		if _, err := c.propose(c.primary(), testRequest("client", int64(i+1), fmt.Sprintf("request %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ...and comes back to find only that they're stable, so it has to
+	// fetch a snapshot to catch up
+	c.start(backup)
+	timeout := time.After(10 * time.Second)
+	for !c.apps[backup].has("request 11") {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("backup never caught up (at %d)", c.nodes[backup].executed())
+		}
+	}
+}
+
+func TestRefusedRestore(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+	if _, err := c.propose(c.primary(), testRequest("client", 1, "before")); err != nil {
+		t.Fatal(err)
+	}
+	backup := c.backup()
+	c.waitForCommit(backup, "before")
+	c.stop(backup)
+	node := c.nodes[backup]
+
+	// a snapshot of somebody else's state, which the quorum didn't sign
+	other := newTestStateMachine()
+	other.Apply(1, "other")
+	app, _ := other.Snapshot()
+	snapshot, _ := json.Marshal(checkpointState{App: app})
+	checkpoint := CheckpointProof{Number: SlotId{SeqNumber: 8}, Snapshot: snapshot}
+	if err := node.restore(checkpoint); err != ErrCheckpointDigest {
+		t.Fatalf("expected ErrCheckpointDigest, got %v", err)
+	}
+	if !c.apps[backup].has("before") || c.apps[backup].has("other") {
+		t.Fatal("a snapshot that didn't check out got installed")
+	}
+	checkpoint.StateDigest = digestState(other, make(map[string]cachedReply), node.keys)
+	checkpoint.StateRoot[0] = 1
+	if err := node.restore(checkpoint); err != ErrCheckpointRoot {
+		t.Fatalf("expected ErrCheckpointRoot, got %v", err)
+	}
+	if !c.apps[backup].has("before") {
+		t.Fatal("a snapshot that didn't check out got installed")
+	}
+	// and one that does
+	checkpoint.StateRoot = stateRoot(other, 8)
+	if err := node.restore(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if !c.apps[backup].has("other") {
+		t.Fatal("snapshot wasn't installed")
+	}
+}
+
+func TestEarlyMessages(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.CheckpointInterval = 4
+		config.WatermarkWindow = 4
+		config.MessageBufferSize = 3
+	})
+	defer c.stopAll()
+
+	var backup, peer NodeId
+	for _, node := range c.config.Nodes {
+		if node.Id == c.primary() {
+			continue
+		} else if backup == 0 {
+			backup = node.Id
+		} else if peer == 0 {
+			peer = node.Id
+		}
+	}
+	sendPrepare := func(number SlotId, request *Request) {
+		digest, _ := request.Digest()
+		prepare := Prepare{Number: number, RequestDigest: digest, Node: peer}
+		signed, err := prepare.Sign(c.signer(peer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.nodes[backup].Prepare(signed, &Ack{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(i int) *Request {
+		return testRequest("client", int64(i+1), fmt.Sprintf("request %d", i))
+	}
+
+	// past the high watermark (requests start at sequence number 2,
+	// so this is what the peer would send for request 8 anyway)
+	sendPrepare(SlotId{ViewNumber: 0, SeqNumber: 10}, request(8))
+	// a view that's nowhere near started; only the first 2 fit
+	for i := 0; i < 5; i++ {
+		sendPrepare(SlotId{ViewNumber: 7, SeqNumber: 100 + i}, request(i))
+	}
+	if buffered := c.nodes[backup].GetStatus().BufferedMessages[peer]; buffered != 3 {
+		t.Fatalf("expected 3 buffered messages, got %d", buffered)
+	}
+
+	// moving the window replays the first one
+	for i := 0; i < 12; i++ {
+		if _, err := c.propose(c.primary(), request(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.waitForCommit(backup, "request 11")
+	if buffered := c.nodes[backup].GetStatus().BufferedMessages[peer]; buffered != 2 {
+		t.Fatalf("expected 2 buffered messages after checkpointing, got %d", buffered)
+	}
+	if evidence := c.nodes[backup].Evidence(); len(evidence) != 0 {
+		t.Fatalf("replayed message conflicted: %+v", evidence)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.TLS = true
+	})
+	defer c.stopAll()
+
+	if _, err := c.propose(c.primary(), testRequest("client", 1, "over tls")); err != nil {
+		t.Fatal(err)
+	}
+
+	node := c.config.Nodes[0]
+	hostname := util.GetHostname(node.Host, node.Port)
+	status := func(tlsConfig *tls.Config) error {
+		var status NodeStatus
+		return util.SendRpcTLS(hostname, c.config.Endpoint, "PBFTNode.Status", &Ack{}, &status, 0, time.Second, tlsConfig)
+	}
+
+	// cluster members get in...
+	configs, err := DialTLSConfigs(c.config.Nodes[1], c.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := status(configs[node.Id]); err != nil {
+		t.Fatalf("cluster member rejected: %v", err)
+	}
+	// ...but plaintext and strangers don't
+	if err := status(nil); err == nil {
+		t.Fatal("plaintext RPC accepted")
+	}
+	dir, err := ioutil.TempDir("", "pbft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeTestCert(t, dir, "stranger")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	if err := status(stranger); err == nil {
+		t.Fatal("RPC with unknown certificate accepted")
+	}
+}
+
+func TestClusterIdentity(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.Name = "test"
+		config.Epoch = 3
+	})
+	defer c.stopAll()
+
+	// the id covers who's in the cluster, not how it's tuned
+	id, err := c.config.Id()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, tuned, reconfigured := c.config, c.config, c.config
+	renamed.Name = "other"
+	tuned.HeartbeatInterval = Duration(time.Second)
+	reconfigured.GenesisId = id.String()
+	reconfigured.Nodes = reconfigured.Nodes[1:]
+	for _, config := range []ClusterConfig{renamed, tuned, reconfigured} {
+		other, err := config.Id()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (other == id) == (config.Name == "other") {
+			t.Fatalf("unexpected cluster id %s for %+v", other, config)
+		}
+	}
+
+	var backup, peer NodeId
+	for _, node := range c.config.Nodes {
+		if node.Id == c.primary() {
+			continue
+		} else if backup == 0 {
+			backup = node.Id
+		} else if peer == 0 {
+			peer = node.Id
+		}
+	}
+	digest, _ := testRequest("client", 1, "elsewhere").Digest()
+	// turned away as soon as they arrive
+	sendPrepare := func(signer Signer, expected error) {
+		prepare := Prepare{Number: SlotId{ViewNumber: 0, SeqNumber: 2}, RequestDigest: digest, Node: peer}
+		signed, err := prepare.Sign(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.nodes[backup].Prepare(signed, &Ack{}); err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+	otherCluster := c.signer(peer)
+	otherCluster.Domain.Cluster[0]++
+	sendPrepare(otherCluster, ErrWrongCluster)
+	otherEpoch := c.signer(peer)
+	otherEpoch.Domain.Epoch--
+	sendPrepare(otherEpoch, ErrWrongEpoch)
+	sendPrepare(otherEpoch, ErrWrongEpoch)
+
+	status := c.nodes[backup].GetStatus()
+	if status.WrongClusterMessages != 1 || status.WrongEpochMessages != 2 {
+		t.Fatalf("expected 1 wrong cluster and 2 wrong epoch messages, got %d and %d",
+			status.WrongClusterMessages, status.WrongEpochMessages)
+	}
+
+	// and the cluster itself still works
+	if _, err := c.propose(c.primary(), testRequest("client", 1, "here")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator, err := openpgp.NewEntity("operator", "", "", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorKey := filepath.Join(dir, "operator.pub")
+	writeArmoredKey(t, operatorKey, openpgp.PublicKeyType, operator.Serialize)
+	auditLog := filepath.Join(dir, "audit.log")
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.Operators = []OperatorConfig{{Name: "alice", PublicKeyFile: operatorKey}}
+		for i, _ := range config.Nodes {
+			config.Nodes[i].AdminPort = freePort(t)
+			config.Nodes[i].AuditLogFile = auditLog
+		}
+	})
+	defer c.stopAll()
+
+	backup := c.backup()
+	var node NodeConfig
+	for _, config := range c.config.Nodes {
+		if config.Id == backup {
+			node = config
+		}
+	}
+	domain, err := c.config.Domain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(command *SignedAdminCommand) error {
+		return util.SendRpc(util.GetHostname(node.Host, node.AdminPort), ADMIN_ENDPOINT, "Admin.Command", command, &Ack{}, 0, time.Second)
+	}
+	command := func(signer Signer, id NodeId, op DebugOp) *SignedAdminCommand {
+		signed, err := NewAdminCommand(signer, id, DebugMessage{Op: op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	alice := Signer{Entity: operator, Domain: domain}
+
+	down := command(alice, backup, DOWN)
+	if err := send(down); err != nil {
+		t.Fatal(err)
+	}
+	if !c.nodes[backup].GetStatus().Down {
+		t.Fatal("expected node to be down")
+	}
+	refused := []struct {
+		command *SignedAdminCommand
+		err     error
+	}{
+		{down, ErrStaleCommand}, // replayed
+		{command(c.signer(backup), backup, UP), ErrUnknownOperator}, // a replica isn't an operator
+		{command(alice, c.primary(), UP), ErrWrongNode},
+	}
+	for _, r := range refused {
+		if err := send(r.command); err == nil || err.Error() != r.err.Error() {
+			t.Fatalf("expected %v, got %v", r.err, err)
+		}
+	}
+	if !c.nodes[backup].GetStatus().Down {
+		t.Fatal("expected node to still be down")
+	}
+	if err := send(command(alice, backup, UP)); err != nil {
+		t.Fatal(err)
+	}
+	if c.nodes[backup].GetStatus().Down {
+		t.Fatal("expected node to be back up")
+	}
+
+	// the consensus endpoint doesn't take admin commands at all
+	hostname := util.GetHostname(node.Host, node.Port)
+	if err := util.SendRpc(hostname, c.config.Endpoint, "PBFTNode.Debug", &DebugMessage{Op: DOWN}, &Ack{}, 0, time.Second); err == nil {
+		t.Fatal("debug message accepted on the consensus endpoint")
+	}
+
+	// everything's in the audit log, refusals included
+	data, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 audit log entries, got %d", len(lines))
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Operator != "alice" || entry.Op != "DOWN" || entry.Error != ErrStaleCommand.Error() {
+		t.Fatalf("unexpected audit log entry %+v", entry)
+	}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.MaxPendingRequests = 2
+		config.ViewChangeTimeout = Duration(time.Minute)
+	})
+	defer c.stopAll()
+
+	// without a quorum, nothing executes, so proposals pile up...
+	stopped := 0
+	for id, _ := range c.nodes {
+		if id != c.primary() && stopped < 2 {
+			c.stop(id)
+			stopped++
+		}
+	}
+	primary := c.nodes[c.primary()]
+	var proposals []*Proposal
+	for i := 0; i < 3; i++ {
+		proposals = append(proposals, primary.Propose(context.Background(), testRequest("client", int64(i+1), "stuck")))
+	}
+	// ...until there's no room for more
+	select {
+	case <-proposals[0].Done():
+		t.Fatal("expected first proposal to be pending")
+	case <-proposals[1].Done():
+		t.Fatal("expected second proposal to be pending")
+	default:
+	}
+	if _, err := proposals[2].Result(); err != ErrOverloaded {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	status := primary.GetStatus()
+	if status.PendingRequests != 2 || status.RejectedRequests != 1 {
+		t.Fatalf("expected 2 pending and 1 rejected request, got %d and %d", status.PendingRequests, status.RejectedRequests)
+	}
+	if primary.RetryAfter(ErrOverloaded) != TIMEOUT || primary.RetryAfter(ErrViewChange) != time.Minute {
+		t.Fatal("unexpected retry after")
+	}
+}
+
+func TestClusterTiming(t *testing.T) {
+	var config ClusterConfig
+	err := json.Unmarshal([]byte(`{
+		"HeartbeatInterval": "100ms",
+		"ViewChangeTimeout": 1000000000,
+		"CheckpointInterval": 10,
+		"WatermarkWindow": 5
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timing := config.timing()
+	if timing.heartbeat != 100*time.Millisecond || timing.viewChange != time.Second {
+		t.Fatalf("unexpected timeouts %+v", timing)
+	}
+	// window has to fit a whole checkpoint interval
+	if timing.checkpoint != 10 || timing.watermarkWindow != 10 {
+		t.Fatalf("unexpected intervals %+v", timing)
+	}
+	if defaults := (ClusterConfig{}).timing(); defaults.heartbeat != TIMEOUT || defaults.checkpoint != int(CHECKPOINT) {
+		t.Fatalf("unexpected defaults %+v", defaults)
+	}
+	// backups wait half a heartbeat per peer by default, as they always have
+	four := ClusterConfig{Nodes: []NodeConfig{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}}
+	if timeout := four.timing().viewChange; timeout != 750*time.Millisecond {
+		t.Fatalf("expected a 750ms default view change timeout, got %v", timeout)
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	n := &PBFTNode{timing: ClusterConfig{
+		HeartbeatInterval:    Duration(100 * time.Millisecond),
+		ViewChangeTimeout:    Duration(time.Second),
+		AdaptiveTimeout:      true,
+		MinViewChangeTimeout: Duration(300 * time.Millisecond),
+		MaxViewChangeTimeout: Duration(5 * time.Second),
+	}.timing(), latency: new(latencyEstimator)}
+	if n.viewChangeTimeout() != time.Second {
+		t.Fatalf("expected configured timeout before any commits, got %v", n.viewChangeTimeout())
+	}
+	// fast commits bottom out at the floor
+	for i := 0; i < 20; i++ {
+		n.latency.observe(10 * time.Millisecond)
+	}
+	if n.viewChangeTimeout() != 300*time.Millisecond {
+		t.Fatalf("expected floor, got %v", n.viewChangeTimeout())
+	}
+	// and slow ones push it up, but not past the ceiling
+	n.latency.observe(time.Second)
+	if timeout := n.viewChangeTimeout(); timeout <= 300*time.Millisecond || timeout > 5*time.Second {
+		t.Fatalf("expected timeout to grow, got %v", timeout)
+	}
+	for i := 0; i < 20; i++ {
+		n.latency.observe(time.Minute)
+	}
+	if n.viewChangeTimeout() != 5*time.Second {
+		t.Fatalf("expected ceiling, got %v", n.viewChangeTimeout())
+	}
+}
+
+func TestStopAndRestart(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+
+	first := "first"
+	c.nodes[c.primary()].Propose(context.Background(), testRequest("client", 1, first))
+	for id, _ := range c.nodes {
+		c.waitForCommit(id, first)
+	}
+
+	// Stopping is idempotent, and rejects further RPCs.
+	backup := c.backup()
+	c.stop(backup)
+	c.stop(backup)
+	if err := c.nodes[backup].Prepare(&SignedPrepare{}, &Ack{}); err != ErrStopped {
+		t.Fatalf("expected ErrStopped from stopped node, got %v", err)
+	}
+
+	// Restart on the same port, in the same process.
+	c.start(backup)
+	second := "second"
+	c.nodes[c.primary()].Propose(context.Background(), testRequest("client", 2, second))
+	for id, _ := range c.nodes {
+		c.waitForCommit(id, second)
+	}
+}
+
+func TestCommitCertificates(t *testing.T) {
+	c := startTestCluster(t, 4)
+	defer c.stopAll()
+
+	request := testRequest("client", 1, "certified")
+	digest, _ := request.Digest()
+	result, err := c.propose(c.primary(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, node := range c.nodes {
+		c.waitForCommit(id, "certified")
+		certified, ok := node.CertificateBySeq(result.SeqNumber)
+		if !ok {
+			t.Fatalf("node %d has no certificate for %d", id, result.SeqNumber)
+		}
+		if err := VerifyCertificate(c.config, certified); err != nil {
+			t.Fatalf("node %d's certificate: %v", id, err)
+		}
+		if byDigest, ok := node.CertificateByDigest(digest); !ok || byDigest.Certificate.Number != certified.Certificate.Number {
+			t.Fatalf("node %d can't find the certificate by digest", id)
+		}
+	}
+
+	certified, _ := c.nodes[c.primary()].CertificateBySeq(result.SeqNumber)
+	forged := certified
+	forged.Request.Operation = "something else"
+	if err := VerifyCertificate(c.config, forged); err == nil {
+		t.Fatal("expected certificate for a different request to be rejected")
+	}
+	short := certified
+	short.Certificate.Commits = make(map[NodeId]SignedCommit)
+	for id, commit := range certified.Certificate.Commits {
+		if len(short.Certificate.Commits) < 2 {
+			short.Certificate.Commits[id] = commit
+		}
+	}
+	if err := VerifyCertificate(c.config, short); err != ErrNoQuorum {
+		t.Fatalf("expected ErrNoQuorum, got %v", err)
+	}
+
+	// and they survive a restart
+	backup := c.backup()
+	c.stop(backup)
+	c.start(backup)
+	if restored, ok := c.nodes[backup].CertificateBySeq(result.SeqNumber); !ok {
+		t.Fatal("certificate lost on restart")
+	} else if err := VerifyCertificate(c.config, restored); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbft-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "certificates")
+	store, err := newCertificateStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certify := func(seq int) CertifiedRequest {
+		request := Request{Client: "client", Timestamp: int64(seq), Operation: "op"}
+		digest, _ := request.Digest()
+		return CertifiedRequest{Request: request, Certificate: CommitCertificate{Number: SlotId{SeqNumber: seq}, RequestDigest: digest}}
+	}
+	for seq := 1; seq <= 10; seq++ {
+		store.add(certify(seq))
+		if seq == 5 {
+			store.sync()
+		}
+		store.executedThrough(seq)
+	}
+	// nothing's served until it's synced
+	if _, through := store.since(1, 100); through != 5 {
+		t.Fatalf("expected only the synced ones, through 5, got %d", through)
+	}
+	store.forgetThrough(5)
+	if err := store.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.bySeq) != 5 || len(store.byDigest) != 5 {
+		t.Fatalf("kept %d certificates (%d digests) in memory", len(store.bySeq), len(store.byDigest))
+	}
+	// the forgotten ones still come from the file
+	lookup := func(store *certificateStore, seq int) {
+		if certified, ok := store.bySequence(seq); !ok || certified.Certificate.Number.SeqNumber != seq {
+			t.Fatalf("lost certificate %d", seq)
+		}
+		if certified, ok := store.byRequestDigest(certify(seq).Certificate.RequestDigest); !ok || certified.Certificate.Number.SeqNumber != seq {
+			t.Fatalf("lost certificate %d by digest", seq)
+		}
+	}
+	lookup(store, 3)
+	lookup(store, 8)
+	if certified, through := store.since(3, 100); len(certified) != 8 || through != 10 {
+		t.Fatalf("expected 3 to 10, got %d through %d", len(certified), through)
+	}
+
+	// skipping ahead breaks the run, but not what we had from before
+	store.restoredThrough(20)
+	store.add(certify(21))
+	store.sync()
+	store.executedThrough(21)
+	if certified, through := store.since(3, 100); len(certified) != 0 || through != 2 {
+		t.Fatalf("vouched for %d certificates past a restore (through %d)", len(certified), through)
+	}
+	if certified, through := store.since(21, 100); len(certified) != 1 || through != 21 {
+		t.Fatalf("expected 21, got %d through %d", len(certified), through)
+	}
+	lookup(store, 3)
+
+	// and the file has all of them
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newCertificateStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	if len(reopened.archived) != 11 || len(reopened.bySeq) != 0 || reopened.base != 20 || reopened.through != 21 {
+		t.Fatalf("reopened with %d certificates (%d in memory), from %d through %d", len(reopened.archived), len(reopened.bySeq), reopened.base, reopened.through)
+	}
+	lookup(reopened, 1)
+	lookup(reopened, 10)
+	lookup(reopened, 21)
+	// six equal replicas need four commits, not 2f+1 = 3
+	six := ClusterConfig{Nodes: []NodeConfig{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}, {Id: 5}, {Id: 6}}}
+	if weights, err := six.Weights(); err != nil || weights.Quorum != 4 {
+		t.Fatalf("unexpected quorum for six %+v, %v", weights, err)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	config := ClusterConfig{Nodes: []NodeConfig{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}}
+	weights, err := config.Weights()
+	if err != nil || weights.Total != 4 || weights.Faulty != 1 || weights.Quorum != 3 || weights.Weak != 2 {
+		t.Fatalf("unexpected default weights %+v, %v", weights, err)
+	}
+	config.Nodes[0].Weight = 3
+	weights, err = config.Weights()
+	if err != nil || weights.Total != 6 || weights.Faulty != 1 || weights.Quorum != 4 {
+		t.Fatalf("unexpected weights %+v, %v", weights, err)
+	}
+	config.FaultyWeight = 2
+	if _, err := config.Weights(); err == nil {
+		t.Fatal("expected a total of 6 not to tolerate 2 faulty")
+	}
+}
+
+func TestWeightedQuorums(t *testing.T) {
+	// The primary weighs 3 and everyone else 1, so it only needs one
+	// backup to make a quorum of 4
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		for i, node := range config.Nodes {
+			if node.Id == config.LeaderFor(0) {
+				config.Nodes[i].Weight = 3
+			}
+		}
+	})
+	defer c.stopAll()
+
+	var running NodeId
+	for id, _ := range c.nodes {
+		if id == c.primary() {
+			continue
+		} else if running == 0 {
+			running = id
+		} else {
+			c.stop(id)
+		}
+	}
+	result, err := c.propose(c.primary(), testRequest("client", 1, "weighty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitForCommit(running, "weighty")
+
+	// and its certificate only has the two of them
+	certified, ok := c.nodes[c.primary()].CertificateBySeq(result.SeqNumber)
+	if !ok {
+		t.Fatal("no certificate")
+	}
+	if len(certified.Certificate.Commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d", len(certified.Certificate.Commits))
+	}
+	if err := VerifyCertificate(c.config, certified); err != nil {
+		t.Fatal(err)
+	}
+	// which wouldn't be enough if everyone counted the same (on a copy:
+	// the running nodes still have the real one)
+	equal := c.config
+	equal.Nodes = append([]NodeConfig(nil), c.config.Nodes...)
+	for i, _ := range equal.Nodes {
+		equal.Nodes[i].Weight = 0
+	}
+	if err := VerifyCertificate(equal, certified); err != ErrNoQuorum {
+		t.Fatalf("expected ErrNoQuorum, got %v", err)
+	}
+}
+
+func TestProactiveRecovery(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.CheckpointInterval = 2
+		for i, node := range config.Nodes {
+			config.Nodes[i].KeyRingFile = filepath.Join(filepath.Dir(node.PublicKeyFile), fmt.Sprintf("node%d.keyring", node.Id))
+		}
+	})
+	defer c.stopAll()
+
+	timestamp := int64(0)
+	propose := func(operation string) {
+		timestamp++
+		if _, err := c.propose(c.primary(), testRequest("client", timestamp, operation)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keeps the cluster busy (so checkpoints keep coming) until the
+	// backup's caught up with the latest request.
+	catchUp := func(backup NodeId, name string) {
+		for i := 0; i < 20; i++ {
+			operation := fmt.Sprintf("%s%d", name, i)
+			propose(operation)
+			for j := 0; j < 10; j++ {
+				if c.apps[backup].has(operation) {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		t.Fatalf("node %d never caught up", backup)
+	}
+	propose("first")
+	propose("second")
+
+	backup := c.backup()
+	if err := c.nodes[backup].debug(&DebugMessage{Op: RECOVER}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for i := 0; ; i++ {
+		_, rotated := c.nodes[c.primary()].keys.rotatedKeys()[backup]
+		if status := c.nodes[backup].GetStatus(); rotated && status.Recovery == "" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("node %d never recovered: %+v", backup, status)
+		}
+		propose(fmt.Sprintf("during%d", i))
+		time.Sleep(50 * time.Millisecond)
+	}
+	catchUp(backup, "after")
+
+	// the old key's no good any more
+	prepare := Prepare{Number: SlotId{ViewNumber: 0, SeqNumber: 100}, Node: backup}
+	signed, err := prepare.Sign(c.signer(backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.nodes[c.primary()].Prepare(signed, &Ack{}); err == nil {
+		t.Fatal("expected a prepare signed with the old key to be rejected")
+	}
+
+	// nobody else can make a key change, or take its client id, so the
+	// backup's place in the reply cache is safe
+	forged := KeyChange{Node: backup, Key: "forged", Timestamp: math.MaxInt64}
+	signedChange, err := forged.Sign(c.signer(c.primary()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation, _ := json.Marshal(signedChange)
+	request := &Request{Client: keyChangeClient(backup), Timestamp: math.MaxInt64, Operation: string(operation), Op: OP_KEY_CHANGE}
+	if _, err := c.propose(c.primary(), request); err == nil {
+		t.Fatal("expected a key change signed by somebody else to be rejected")
+	}
+	if _, err := c.propose(c.primary(), testRequest(keyChangeClient(backup), math.MaxInt64, "op")); err != ErrReservedClient {
+		t.Fatalf("expected ErrReservedClient, got %v", err)
+	}
+	c.nodes[c.primary()].repliesMux.RLock()
+	last := c.nodes[c.primary()].lastReply[keyChangeClient(backup)]
+	c.nodes[c.primary()].repliesMux.RUnlock()
+	if last.Timestamp == math.MaxInt64 {
+		t.Fatal("forged key change got into the reply cache")
+	}
+	// checkpoints from before the key change can't roll it back
+	if err := c.nodes[c.primary()].keys.restore(nil, 0); err != ErrStaleKeys {
+		t.Fatalf("expected ErrStaleKeys, got %v", err)
+	}
+
+	// the backup keeps its new private key to itself, encrypted
+	for _, node := range c.config.Nodes {
+		if node.Id != backup {
+			continue
+		}
+		info, err := os.Stat(node.KeyRingFile)
+		if err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != 0600 {
+			t.Fatalf("key ring file has mode %v", info.Mode())
+		}
+		contents, _ := ioutil.ReadFile(node.KeyRingFile)
+		if strings.Contains(string(contents), openpgp.PrivateKeyType) {
+			t.Fatal("key ring file has an unencrypted private key")
+		}
+	}
+
+	// and the new one survives a restart
+	c.stop(backup)
+	c.start(backup)
+	catchUp(backup, "restarted")
+}
+
+// ** BENCHMARKS ** //
+
+// Throughput of the whole replica: concurrent clients proposing to the
+// primary of a 4 node cluster, with an application that's instant and
+// one that takes 5ms to apply each request (like one that writes to
+// disk).
+func BenchmarkPropose(b *testing.B) {
+	for _, delay := range []time.Duration{0, 5 * time.Millisecond} {
+		b.Run(fmt.Sprintf("apply=%v", delay), func(b *testing.B) {
+			benchmarkPropose(b, delay)
+		})
+	}
+}
+
+func benchmarkPropose(b *testing.B, delay time.Duration) {
+	c := startTestClusterWith(b, 4, func(config *ClusterConfig) {
+		config.RequestQueueSize = 100
+	})
+	defer c.stopAll()
+	for _, app := range c.apps {
+		app.mu.Lock()
+		app.delay = delay
+		app.mu.Unlock()
+	}
+
+	primary := c.nodes[c.primary()]
+	var clients int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client := fmt.Sprintf("client%d", atomic.AddInt64(&clients, 1))
+		timestamp := int64(0)
+		for pb.Next() {
+			timestamp++
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				_, err := primary.Propose(ctx, testRequest(client, timestamp, "op")).Result()
+				cancel()
+				if err == nil {
+					break
+				} else if err != ErrOverloaded && err != ErrViewChange {
+					b.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	})
+}
+
+func TestObserver(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		config.CheckpointInterval = 2
+		config.ObserveInterval = Duration(20 * time.Millisecond)
+		config.Observers = []NodeConfig{{Id: 10}, {Id: 11}}
+	})
+	defer c.stopAll()
+
+	// (polls, since observers can catch up by restoring a checkpoint
+	// rather than applying)
+	waitFor := func(app *testStateMachine, operation string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !app.has(operation) {
+			if time.Now().After(deadline) {
+				t.Fatalf("observer never applied %q", operation)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	early := newTestStateMachine()
+	observer, err := StartObserver(10, c.config, early)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Stop()
+	for i := 1; i <= 5; i++ {
+		if _, err := c.propose(c.primary(), testRequest("client", int64(i), fmt.Sprintf("op%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(early, "op5")
+
+	// one that starts late has to catch up from a checkpoint
+	late := newTestStateMachine()
+	lateObserver, err := StartObserver(11, c.config, late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lateObserver.Stop()
+	if _, err := c.propose(c.primary(), testRequest("client", 6, "op6")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(late, "op6")
+	waitFor(early, "op6")
+
+	verifier, err := NewVerifier(c.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []*Observer{observer, lateObserver} {
+		var digest [sha256.Size]byte
+		proof := o.Read(func() { digest = o.app.StateDigest() })
+		if proof.SeqNumber < 6 {
+			t.Errorf("observer %d only current as of %d", o.Id(), proof.SeqNumber)
+		}
+		if err := proof.Verify(verifier); err != nil {
+			t.Errorf("observer %d proof: %v", o.Id(), err)
+		}
+		if digest != c.apps[c.primary()].StateDigest() {
+			t.Errorf("observer %d state doesn't match the primary's", o.Id())
+		}
+	}
+	if lateObserver.Status().Checkpoint.SeqNumber == 0 {
+		t.Error("late observer should have picked up a stable checkpoint")
+	}
+
+	// a replica can't skip an observer past requests it didn't send
+	executed := observer.Status().Executed
+	if err := observer.apply(&ObserveResponse{Through: executed + 10}); err == nil {
+		t.Error("expected a response claiming more than its certificates to be rejected")
+	}
+	if status := observer.Status(); status.Executed != executed {
+		t.Errorf("observer skipped ahead to %d", status.Executed)
+	}
+}
+
+func TestDurableRestart(t *testing.T) {
+	c := startTestClusterWith(t, 4, func(config *ClusterConfig) {
+		// so there's no stable checkpoint to restore: the restarted node
+		// has to fetch what it missed
+		config.CheckpointInterval = 100
+	})
+	defer c.stopAll()
+
+	backup := c.backup()
+	c.stop(backup)
+	durable := &durableTestStateMachine{testStateMachine: newTestStateMachine()}
+	c.startWith(backup, durable, durable.testStateMachine)
+	propose := func(from int, to int) {
+		for i := from; i <= to; i++ {
+			if _, err := c.propose(c.primary(), testRequest("client", int64(i), fmt.Sprintf("op%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	propose(1, 3)
+	c.waitForCommit(backup, "op3")
+	if seq, _, _ := durable.Saved(); seq < 4 {
+		t.Fatalf("only saved through %d", seq)
+	}
+
+	// it carries on from where it was, and only applies what it missed
+	c.stop(backup)
+	propose(4, 6)
+	c.startWith(backup, durable, durable.testStateMachine)
+	deadline := time.Now().Add(10 * time.Second)
+	for !durable.has("op6") {
+		if time.Now().After(deadline) {
+			t.Fatal("restarted node never caught up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	durable.mu.Lock()
+	applied := strings.Join(durable.applied, ",")
+	durable.mu.Unlock()
+	if applied != "op1,op2,op3,op4,op5,op6" {
+		t.Fatalf("restarted node applied %s", applied)
+	}
+	if durable.StateDigest() != c.apps[c.primary()].StateDigest() {
+		t.Fatal("restarted node's state doesn't match the primary's")
+	}
+
+	// and its reply cache came back with it
+	result, err := c.propose(backup, testRequest("client", 6, "op6"))
+	if err != nil || result.Result != "OP6" {
+		t.Fatalf("retried request got %+v, %v", result, err)
+	}
+	propose(7, 7)
+	c.waitForCommit(backup, "op7")
+}
+
+// Has a (made up) state root, so it goes in checkpoints.
+type rootedTestStateMachine struct {
+	*testStateMachine
+}
+
+func (sm rootedTestStateMachine) StateRoot(seq int) [sha256.Size]byte {
+	digest := sm.StateDigest()
+	return sha256.Sum256(append([]byte(fmt.Sprintf("%d:", seq)), digest[:]...))
+}
+
+func TestStateRoot(t *testing.T) {
+	config := newTestConfig(t, 4)
+	config.CheckpointInterval = 4
+	c := &testCluster{
+		t:      t,
+		config: config,
+		nodes:  make(map[NodeId]*PBFTNode),
+		apps:   make(map[NodeId]*testStateMachine),
+	}
+	for _, node := range config.Nodes {
+		app := newTestStateMachine()
+		c.startWith(node.Id, rootedTestStateMachine{app}, app)
+	}
+	defer c.stopAll()
+
+	for i := 0; i < 6; i++ {
+		if _, err := c.propose(c.primary(), testRequest("client", int64(i+1), fmt.Sprintf("request %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var proof StateRootProof
+	deadline := time.Now().Add(10 * time.Second)
+	for proof.Number.SeqNumber == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no stable checkpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if proof, err = c.nodes[c.backup()].StateRootProof(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if proof.StateRoot == ([sha256.Size]byte{}) {
+		t.Fatal("checkpoint has no state root")
+	}
+	// checks out with just the cluster config, and no snapshot
+	if err := VerifyStateRoot(config, proof, proof.Number.SeqNumber); err != nil {
+		t.Fatal(err)
+	}
+	// but not for a client that's seen a later one
+	if err := VerifyStateRoot(config, proof, proof.Number.SeqNumber+1); err != ErrStaleRoot {
+		t.Errorf("stale root: %v", err)
+	}
+	// or that's moved on to another epoch
+	nextEpoch := config
+	nextEpoch.Epoch++
+	if err := VerifyStateRoot(nextEpoch, proof, 0); err != ErrWrongEpoch {
+		t.Errorf("root from the last epoch: %v", err)
+	}
+	// one signature from elsewhere doesn't sink the rest
+	mixed := proof
+	mixed.Signatures = make(map[NodeId]SignedCheckpointHeader)
+	for node, header := range proof.Signatures {
+		mixed.Signatures[node] = header
+		header.Header.Domain.Epoch--
+		mixed.Signatures[99] = header
+	}
+	if err := VerifyStateRoot(config, mixed, 0); err != nil {
+		t.Errorf("root with a stale signature as well: %v", err)
+	}
+
+	forged := proof
+	forged.StateRoot[0] ^= 1
+	if err := VerifyStateRoot(config, forged, 0); err != ErrUnverifiedRoot {
+		t.Errorf("forged root: %v", err)
+	}
+	short := proof
+	short.Signatures = make(map[NodeId]SignedCheckpointHeader)
+	for node, header := range proof.Signatures {
+		short.Signatures[node] = header
+		break
+	}
+	if err := VerifyStateRoot(config, short, 0); err != ErrUnverifiedRoot {
+		t.Errorf("root signed by one node: %v", err)
+	}
+}
@@ -0,0 +1,468 @@
+package pbft
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"distributepki/util"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ** OBSERVERS ** //
+
+// Observers (ClusterConfig.Observers) keep a copy of the application
+// without voting: they don't prepare, commit, checkpoint or take part in
+// view changes, so adding them doesn't make quorums any bigger. Every so
+// often an observer asks a replica (a different one each time) for
+// what's been executed since it last asked, and gets back:
+//  - the replica's last stable checkpoint, if it's newer than ours
+//  - the certified requests (see certificates.go) after that, in order
+//    and without gaps
+//  - how far those go
+// We check every certificate and checkpoint signature against the
+// replicas' keys, so a replica can't make us apply anything the cluster
+// didn't agree to, or skip us past anything it did (we only move as far
+// as the certificates go). It could leave something out of a request,
+// but then our state won't match the next stable checkpoint, and we'll
+// restore that.
+
+// How often observers ask for more, by default
+const OBSERVE_INTERVAL time.Duration = time.Duration(500 * time.Millisecond)
+
+const OBSERVE_TIMEOUT time.Duration = time.Duration(2 * time.Second)
+
+// Most certified requests a replica sends an observer at once
+const OBSERVE_BATCH int = 100
+
+var (
+	ErrNotObserver      = errors.New("No such observer in the cluster config")
+	ErrCheckpointDigest = errors.New("State restored from checkpoint doesn't match its digest")
+	ErrCheckpointRoot   = errors.New("State restored from checkpoint doesn't match its Merkle root")
+)
+
+type ObserveRequest struct {
+	From       int  // first sequence number we want
+	Checkpoint int  // sequence number of our last stable checkpoint
+	Suffix     bool // we'd rather have everything from From on than a newer checkpoint (see durable.go)
+}
+
+type ObserveResponse struct {
+	Checkpoint *CheckpointProof // if it's newer than the observer's
+	Requests   []CertifiedRequest
+	Through    int
+}
+
+// Answers an observer. What we send is all signed by a quorum, so there's
+// nothing to authenticate.
+func (n *PBFTNode) Observe(req *ObserveRequest, res *ObserveResponse) error {
+	if n.down {
+		return errors.New("I'm down")
+	}
+	reply := make(chan CheckpointProof, 1)
+	select {
+	case n.fetchChannel <- reply:
+	case <-n.quit:
+		return ErrStopped
+	}
+	var checkpoint CheckpointProof
+	select {
+	case checkpoint = <-reply:
+	case <-n.quit:
+		return ErrStopped
+	}
+	start := req.From
+	_, haveSuffix := n.CertificateBySeq(req.From)
+	if checkpoint.Number.SeqNumber > req.Checkpoint && checkpoint.Proof != nil && !(req.Suffix && haveSuffix) {
+		res.Checkpoint = &checkpoint
+		if start <= checkpoint.Number.SeqNumber {
+			start = checkpoint.Number.SeqNumber + 1
+		}
+	}
+	res.Requests, res.Through = n.certificates.since(start, OBSERVE_BATCH)
+	return nil
+}
+
+// What an observer's state is current as of, and the proof: a stable
+// checkpoint signed by a quorum, and the certificate of every request
+// applied since.
+type ObserverProof struct {
+	SeqNumber  int
+	Checkpoint CheckpointProof
+	Requests   []CertifiedRequest
+}
+
+// Checks the proof against the replicas' keys (see NewVerifier).
+func (p *ObserverProof) Verify(v Verifier) error {
+	if p.Checkpoint.Proof != nil {
+		if err := verifyCheckpointProof(v, p.Checkpoint); err != nil {
+			return err
+		}
+	}
+	last := p.Checkpoint.Number.SeqNumber
+	for _, certified := range p.Requests {
+		seq := certified.Certificate.Number.SeqNumber
+		if seq <= last || seq > p.SeqNumber {
+			return fmt.Errorf("Request %d out of order", seq)
+		}
+		if err := certified.Verify(v); err != nil {
+			return err
+		}
+		last = seq
+	}
+	return nil
+}
+
+type ObserverStatus struct {
+	Id         NodeId
+	Executed   int
+	Checkpoint SlotId
+	LastAsked  NodeId
+}
+
+type Observer struct {
+	id           NodeId
+	cluster      ClusterConfig
+	app          StateMachine
+	keys         *keyRing
+	replicas     []NodeId
+	hostnames    map[NodeId]string
+	peerTLS      map[NodeId]*tls.Config
+	interval     time.Duration
+	checkpoint   int // interval between checkpoints
+	certificates *certificateStore
+	commits      *CommitStream
+
+	// Held while we apply anything, so readers can see a consistent
+	// state (see Read).
+	mu             sync.RWMutex
+	executed       int
+	lastReply      map[string]cachedReply
+	lastCheckpoint CheckpointProof
+	applied        []CertifiedRequest // since lastCheckpoint
+	// our state digest at each checkpoint sequence number we've passed,
+	// until we hear the stable checkpoint for it
+	digests   map[int][sha256.Size]byte
+	lastAsked NodeId
+	next      int
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Starts following the cluster as the observer with this id, applying
+// committed requests to app.
+func StartObserver(id NodeId, cluster ClusterConfig, app StateMachine) (*Observer, error) {
+	var self *NodeConfig
+	for i, observer := range cluster.Observers {
+		if observer.Id == id {
+			self = &cluster.Observers[i]
+		}
+	}
+	if self == nil {
+		return nil, ErrNotObserver
+	}
+	domain, err := cluster.Domain()
+	if err != nil {
+		return nil, err
+	}
+	weights, err := cluster.Weights()
+	if err != nil {
+		return nil, err
+	}
+	hostnames := make(map[NodeId]string)
+	genesis := make(map[NodeId]*openpgp.Entity)
+	var replicas []NodeId
+	for _, node := range cluster.Nodes {
+		if node.Id == id {
+			return nil, fmt.Errorf("Observer %d has the same id as a replica", id)
+		}
+		list, err := ReadPgpKeyFile(node.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		} else if len(list) != 1 {
+			return nil, errors.New("Expected exactly 1 PGP entity in " + node.PublicKeyFile)
+		}
+		genesis[node.Id] = list[0]
+		hostnames[node.Id] = util.GetHostname(node.Host, node.Port)
+		replicas = append(replicas, node.Id)
+	}
+	// (observers don't have private keys to keep)
+	keys, err := newKeyRing(id, nil, genesis, domain, weights, self.KeyRingFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	peerTLS, err := DialTLSConfigs(*self, cluster)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := newCertificateStore(self.CertificateFile)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(cluster.ObserveInterval)
+	if interval <= 0 {
+		interval = OBSERVE_INTERVAL
+	}
+	o := &Observer{
+		id:           id,
+		cluster:      cluster,
+		app:          app,
+		keys:         keys,
+		replicas:     replicas,
+		hostnames:    hostnames,
+		peerTLS:      peerTLS,
+		interval:     interval,
+		checkpoint:   cluster.timing().checkpoint,
+		certificates: certificates,
+		lastReply:    make(map[string]cachedReply),
+		digests:      make(map[int][sha256.Size]byte),
+		commits:      NewCommitStream(),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go o.loop()
+	return o, nil
+}
+
+func (o *Observer) Id() NodeId {
+	return o.id
+}
+
+func (o *Observer) Log(format string, args ...interface{}) {
+	args = append([]interface{}{o.id}, args...)
+	plog.Infof("[Observer %d] "+format, args...)
+}
+
+func (o *Observer) Stop() {
+	close(o.quit)
+	<-o.done
+	o.commits.Close()
+	if err := o.certificates.close(); err != nil {
+		o.Log("Closing commit certificates: %s", err.Error())
+	}
+}
+
+// Every operation we apply from now on (see CommitStream).
+func (o *Observer) Committed(ctx context.Context) <-chan CommittedEntry {
+	return o.commits.Committed(ctx)
+}
+
+// We never snapshot anything ourselves (we restore the replicas'
+// checkpoints), so the hooks never run.
+func (o *Observer) OnSnapshot(hook SnapshotHook) {
+	o.commits.OnSnapshot(hook)
+}
+
+func (o *Observer) Status() ObserverStatus {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return ObserverStatus{
+		Id:         o.id,
+		Executed:   o.executed,
+		Checkpoint: o.lastCheckpoint.Number,
+		LastAsked:  o.lastAsked,
+	}
+}
+
+// Runs read against the application with nothing being applied, and
+// returns what that state is current as of.
+func (o *Observer) Read(read func()) ObserverProof {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	read()
+	return ObserverProof{
+		SeqNumber:  o.executed,
+		Checkpoint: o.lastCheckpoint.withoutSnapshot(),
+		Requests:   append([]CertifiedRequest(nil), o.applied...),
+	}
+}
+
+func (o *Observer) CertificateBySeq(seq int) (CertifiedRequest, bool) {
+	return o.certificates.bySequence(seq)
+}
+
+func (o *Observer) CertificateByDigest(digest [sha256.Size]byte) (CertifiedRequest, bool) {
+	return o.certificates.byRequestDigest(digest)
+}
+
+func (o *Observer) loop() {
+	defer close(o.done)
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		// if the replica had more than it could send, ask again straight away
+		for o.poll() {
+			select {
+			case <-o.quit:
+				return
+			default:
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+// Asks the next replica for what we're missing. Returns whether there's
+// more.
+func (o *Observer) poll() bool {
+	replica := o.replicas[o.next%len(o.replicas)]
+	o.next++
+	o.mu.Lock()
+	o.lastAsked = replica
+	request := ObserveRequest{From: o.executed + 1, Checkpoint: o.lastCheckpoint.Number.SeqNumber}
+	o.mu.Unlock()
+	var response ObserveResponse
+	err := sendRpc(o.id, replica, o.hostnames[replica], "PBFTNode.Observe", o.cluster.Endpoint, &request, &response, 1, OBSERVE_TIMEOUT, o.peerTLS)
+	if err != nil {
+		o.Log("Observing %d: %s", replica, err.Error())
+		return false
+	}
+	if err := o.apply(&response); err != nil {
+		o.Log("From %d: %s", replica, err.Error())
+		return false
+	}
+	return len(response.Requests) == OBSERVE_BATCH
+}
+
+func (o *Observer) apply(response *ObserveResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if checkpoint := response.Checkpoint; checkpoint != nil && o.lastCheckpoint.Number.SeqNumber < checkpoint.Number.SeqNumber {
+		if err := o.checkpointed(*checkpoint); err != nil {
+			return err
+		}
+	}
+	// the requests have to pick up where we are and leave no gaps, and
+	// the replica can't claim to be any further than they go
+	through := o.executed
+	for _, certified := range response.Requests {
+		seq := certified.Certificate.Number.SeqNumber
+		if seq <= through {
+			continue
+		} else if seq != through+1 {
+			return fmt.Errorf("Sent request %d after %d", seq, through)
+		} else if seq > response.Through {
+			return fmt.Errorf("Sent request %d, but only executed through %d", seq, response.Through)
+		}
+		through = seq
+	}
+	if response.Through > through {
+		return fmt.Errorf("Claims to have executed through %d, but only sent certificates through %d", response.Through, through)
+	}
+	for _, certified := range response.Requests {
+		seq := certified.Certificate.Number.SeqNumber
+		if seq <= o.executed {
+			continue
+		}
+		if err := certified.Verify(o.keys.verifyAll()); err != nil {
+			return err
+		}
+		o.execute(certified)
+		o.advance(seq)
+	}
+	if err := o.certificates.sync(); err != nil {
+		o.Log("Persisting commit certificates: %s", err.Error())
+	}
+	return nil
+}
+
+// Moves up to seq, remembering our state at any checkpoints on the way.
+// Must hold o.mu!
+func (o *Observer) advance(seq int) {
+	for next := (o.executed/o.checkpoint + 1) * o.checkpoint; next <= seq; next += o.checkpoint {
+		o.digests[next] = digestState(o.app, o.lastReply, o.keys)
+	}
+	if seq > o.executed {
+		o.executed = seq
+	}
+}
+
+// The same as a replica's execute stage. Must hold o.mu!
+func (o *Observer) execute(certified CertifiedRequest) {
+	request := certified.Request
+	seq := certified.Certificate.Number.SeqNumber
+	if request.isNoOp() {
+		return
+	}
+	change, err := o.keys.checkRequest(seq, request)
+	if err == nil {
+		err = CheckRequest(o.app, request)
+	}
+	if err != nil {
+		return
+	}
+	if last, ok := o.lastReply[request.Client]; ok && request.Timestamp <= last.Timestamp {
+		return
+	}
+	if err := o.certificates.add(certified); err != nil {
+		o.Log("Persisting commit certificate: %s", err.Error())
+	}
+	var result string
+	if change != nil {
+		result = o.keys.apply(seq, change)
+	} else {
+		result = o.app.Apply(seq, request.Operation)
+		o.commits.Publish(CommittedEntry{SeqNumber: seq, Operation: request.Operation, Result: result})
+	}
+	o.lastReply[request.Client] = cachedReply{
+		Timestamp: request.Timestamp,
+		Digest:    certified.Certificate.RequestDigest,
+		SeqNumber: seq,
+		Result:    result,
+	}
+	o.applied = append(o.applied, certified)
+}
+
+// A newer stable checkpoint. If we're past it, our state back then had
+// better match; if it didn't, or we're not there yet, we restore it.
+// Must hold o.mu!
+func (o *Observer) checkpointed(checkpoint CheckpointProof) error {
+	if err := verifyCheckpointProof(o.keys.verifyAll(), checkpoint); err != nil {
+		return err
+	}
+	seq := checkpoint.Number.SeqNumber
+	if digest, ok := o.digests[seq]; seq > o.executed || !ok || digest != checkpoint.StateDigest {
+		if seq <= o.executed {
+			o.Log("Our state at %d doesn't match the stable checkpoint; restoring it", seq)
+		}
+		if checkpoint.Snapshot == nil {
+			return ErrNoSnapshot
+		}
+		replies, err := restoreState(checkpoint.Snapshot, seq, o.app, o.keys)
+		if err != nil {
+			return err
+		}
+		o.lastReply = replies
+		if digestState(o.app, o.lastReply, o.keys) != checkpoint.StateDigest || stateRoot(o.app, seq) != checkpoint.StateRoot {
+			return ErrCheckpointDigest
+		}
+		o.executed = seq
+		o.applied = nil
+		o.digests = make(map[int][sha256.Size]byte)
+	}
+	o.certificates.forgetThrough(o.lastCheckpoint.Number.SeqNumber)
+	o.lastCheckpoint = checkpoint
+	for s, _ := range o.digests {
+		if s <= seq {
+			delete(o.digests, s)
+		}
+	}
+	var applied []CertifiedRequest
+	for _, certified := range o.applied {
+		if certified.Certificate.Number.SeqNumber > seq {
+			applied = append(applied, certified)
+		}
+	}
+	o.applied = applied
+	o.Log("Stable checkpoint %d", seq)
+	return nil
+}
@@ -0,0 +1,330 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"runtime"
+	"sync/atomic"
+)
+
+// ** PIPELINE ** //
+
+// A replica works in four stages, connected by bounded queues:
+//
+//   authenticate: RPC handlers check signatures on peer messages, a few
+//                 at a time (ClusterConfig.AuthWorkers), and queue them
+//                 up for the main routine (peerChannel).
+//   order:        the main routine runs the protocol, signs our own
+//                 messages, and hands committed requests to execute, in
+//                 order (executeQueue). It never blocks on the later
+//                 stages; if execute falls behind, committed requests
+//                 wait in toExecute.
+//   execute:      applies requests to the StateMachine, keeps the reply
+//                 cache, and snapshots at checkpoints (which go back to
+//                 the main routine to be signed).
+//   reply:        resolves proposals (replyQueue).
+//
+// So a slow application holds up execution but not ordering, and
+// signature checks don't queue up behind each other on the main routine.
+
+// Defaults, for anything the ClusterConfig leaves out.
+
+// Authenticated peer messages waiting for the main routine
+const PEER_QUEUE_SIZE int = 256
+
+// Committed requests waiting to execute
+const EXECUTE_QUEUE_SIZE int = 256
+
+// Most committed requests the execute stage takes at once (they share
+// an fsync; see certificates.go)
+const EXECUTE_BATCH int = 64
+
+// Results waiting to be handed back to proposers
+const REPLY_QUEUE_SIZE int = 256
+
+// How many peer messages the main routine handles in a row before it
+// looks at anything else (timers, status requests, snapshots)
+const PEER_BURST int = 64
+
+// ** AUTHENTICATE ** //
+
+// A peer message whose signature checked out, and who signed it.
+type authenticated struct {
+	sender  NodeId
+	message interface{} // *FullPrePrepare, *SignedPrepare, *SignedCommit, ...
+}
+
+func queueSize(configured int, fallback int) int {
+	if configured <= 0 {
+		return fallback
+	}
+	return configured
+}
+
+func defaultAuthWorkers() int {
+	return runtime.NumCPU()
+}
+
+// Checks a message's signature (in the RPC's goroutine, but only so
+// many at once) and queues it up for the main routine.
+func (n *PBFTNode) authenticate(message interface{}, check func() (NodeId, error)) error {
+	select {
+	case <-n.quit:
+		return ErrStopped
+	default:
+	}
+	select {
+	case n.authSlots <- struct{}{}:
+	case <-n.quit:
+		return ErrStopped
+	}
+	sender, err := check()
+	<-n.authSlots
+	if err != nil {
+		n.Log("Rejecting %T: %s", message, err.Error())
+		return err
+	}
+	select {
+	case n.peerChannel <- authenticated{sender: sender, message: message}:
+	case <-n.quit:
+		return ErrStopped
+	}
+	return nil
+}
+
+func (n *PBFTNode) handleAuthenticated(m authenticated) {
+	switch message := m.message.(type) {
+	case *FullPrePrepare:
+		n.handlePrePrepare(m.sender, message)
+	case *SignedPrepare:
+		n.handlePrepare(m.sender, message)
+	case *SignedCommit:
+		n.handleCommit(m.sender, message)
+	case *SignedCheckpoint:
+		n.handleCheckpoint(m.sender, message)
+	case *SignedCheckpointProof:
+		n.handleCheckpointProof(m.sender, message)
+	case *SignedViewChange:
+		n.handleViewChange(m.sender, message)
+	case *SignedNewView:
+		n.handleNewView(m.sender, message)
+	}
+}
+
+// ** ORDER => EXECUTE ** //
+
+// A committed request (or a checkpoint to skip ahead to).
+type executeItem struct {
+	seq         int
+	request     *Request // nil for no-ops
+	digest      [sha256.Size]byte
+	certificate CommitCertificate
+	restore     *CheckpointProof
+}
+
+// Hands every request that's committed, in order, to execute. Must be
+// called on the main routine!
+func (n *PBFTNode) executeCommitted() {
+	for {
+		id, slot := n.committedSlot(n.deliveredSequenceNumber + 1)
+		if slot == nil {
+			break
+		}
+		n.deliveredSequenceNumber++
+		item := executeItem{seq: n.deliveredSequenceNumber}
+		if slot.request != nil {
+			item.certificate = slot.certificate(id)
+			// empty requests are no-ops (from view changes)
+			if !slot.request.isNoOp() {
+				delete(n.requests, slot.requestDigest)
+				item.request = slot.request
+				item.digest = slot.requestDigest
+			}
+		}
+		n.toExecute = append(n.toExecute, item)
+	}
+	n.flushExecuteQueue()
+}
+
+// Moves as much as fits into executeQueue, without blocking. The
+// execute stage pokes executedChannel when there's room again.
+func (n *PBFTNode) flushExecuteQueue() {
+	for len(n.toExecute) > 0 {
+		select {
+		case n.executeQueue <- n.toExecute[0]:
+			n.toExecute = n.toExecute[1:]
+		default:
+			return
+		}
+	}
+}
+
+// Skips execution ahead to a stable checkpoint we haven't reached.
+// Anything still waiting to execute is older, so it can go. Must be
+// called on the main routine!
+func (n *PBFTNode) skipToCheckpoint(checkpoint CheckpointProof) {
+	n.toExecute = []executeItem{{seq: checkpoint.Number.SeqNumber, restore: &checkpoint}}
+	n.deliveredSequenceNumber = checkpoint.Number.SeqNumber
+	// we might have already committed what comes next
+	n.executeCommitted()
+}
+
+// The execute stage refused the snapshot we skipped to (see
+// restoreCheckpoint), so it's still at executed. Starts delivering again
+// from there, and fetches the checkpoint from somebody other than
+// whoever sent us that one. Must be called on the main routine!
+func (n *PBFTNode) handleRefusedRestore(executed int) {
+	n.deliveredSequenceNumber = executed
+	n.toExecute = nil
+	// we might still have what comes next
+	n.executeCommitted()
+	if !n.fetchingSnapshot {
+		n.fetchingSnapshot = true
+		go n.fetchSnapshot(n.snapshotFrom)
+	}
+}
+
+// ** EXECUTE ** //
+
+func (n *PBFTNode) executeLoop() {
+	defer n.stages.Done()
+	for {
+		select {
+		case item := <-n.executeQueue:
+			// take whatever else is waiting too, so the certificates
+			// all go to disk together
+			batch := []executeItem{item}
+		more:
+			for len(batch) < EXECUTE_BATCH {
+				select {
+				case item := <-n.executeQueue:
+					batch = append(batch, item)
+				default:
+					break more
+				}
+			}
+			n.executeBatch(batch)
+			select {
+			case n.executedChannel <- struct{}{}:
+			default:
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// Certifies and executes a batch, a stretch between restores at a
+// time: what comes after a restore depends on whether it checks out.
+func (n *PBFTNode) executeBatch(batch []executeItem) {
+	for len(batch) > 0 {
+		end := 0
+		for end < len(batch) && batch[end].restore == nil {
+			end++
+		}
+		n.certify(batch[:end])
+		for _, item := range batch[:end] {
+			n.executeItem(item)
+		}
+		if end < len(batch) {
+			n.executeItem(batch[end])
+			end++
+		}
+		batch = batch[end:]
+	}
+}
+
+// Whether the execute stage passes over item, having executed through
+// executed: it's old, or it's past a restore we refused.
+func (n *PBFTNode) skips(item executeItem, executed int) bool {
+	return item.seq <= executed || (n.refusedRestore && item.seq != executed+1)
+}
+
+func (n *PBFTNode) executed() int {
+	return int(atomic.LoadInt64(&n.executedSequenceNumber))
+}
+
+func (n *PBFTNode) executeItem(item executeItem) {
+	if item.restore != nil {
+		n.restoreCheckpoint(*item.restore)
+		return
+	}
+	if n.skips(item, n.executed()) {
+		return
+	}
+	atomic.StoreInt64(&n.executedSequenceNumber, int64(item.seq))
+	if item.request != nil {
+		n.execute(item)
+	}
+	if item.seq%n.timing.checkpoint == 0 {
+		n.snapshotCheckpoint(item.seq)
+	}
+	n.certificates.executedThrough(item.seq)
+}
+
+// If the snapshot doesn't check out, we stay where we were, and drop
+// everything after the checkpoint until the main routine's fetched
+// another one (see handleRefusedRestore).
+func (n *PBFTNode) restoreCheckpoint(checkpoint CheckpointProof) {
+	if err := n.restore(checkpoint); err != nil {
+		n.Log("Refusing checkpoint %+v: %s", checkpoint.Number, err.Error())
+		n.refusedRestore = true
+		select {
+		case n.refusedChannel <- n.executed():
+		case <-n.quit:
+		}
+		return
+	}
+	n.refusedRestore = false
+	n.save(checkpoint.Number.SeqNumber, nil)
+	atomic.StoreInt64(&n.executedSequenceNumber, int64(checkpoint.Number.SeqNumber))
+	n.certificates.restoredThrough(checkpoint.Number.SeqNumber)
+}
+
+// What the main routine needs to sign a checkpoint.
+type checkpointSnapshot struct {
+	seq         int
+	snapshot    []byte
+	stateDigest [sha256.Size]byte
+	stateRoot   [sha256.Size]byte
+}
+
+// Every checkpoint interval we snapshot the application, and hand it
+// to the main routine to tell everyone about.
+func (n *PBFTNode) snapshotCheckpoint(seq int) {
+	snapshot, err := n.snapshot(seq)
+	if err != nil {
+		n.Log("Snapshotting application: " + err.Error())
+		return
+	}
+	select {
+	case n.snapshotChannel <- checkpointSnapshot{seq: seq, snapshot: snapshot, stateDigest: n.stateDigest(), stateRoot: stateRoot(n.app, seq)}:
+	case <-n.quit:
+	}
+}
+
+// ** REPLY ** //
+
+type reply struct {
+	digest [sha256.Size]byte
+	result ProposalResult
+	err    error
+}
+
+func (n *PBFTNode) reply(digest [sha256.Size]byte, result ProposalResult, err error) {
+	select {
+	case n.replyQueue <- reply{digest: digest, result: result, err: err}:
+	case <-n.quit:
+	}
+}
+
+func (n *PBFTNode) replyLoop() {
+	defer n.stages.Done()
+	for {
+		select {
+		case r := <-n.replyQueue:
+			n.resolveProposals(r.digest, r.result, r.err)
+		case <-n.quit:
+			return
+		}
+	}
+}
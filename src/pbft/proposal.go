@@ -0,0 +1,199 @@
+package pbft
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ADMISSION CONTROL. Defaults, for anything the ClusterConfig leaves
+// out. Nothing that takes requests ever blocks on a full queue; the
+// request gets ErrOverloaded instead.
+
+// How many new requests can wait for the main routine
+const REQUEST_QUEUE_SIZE int = 10
+
+// How many proposals can be waiting to execute at once
+const MAX_PENDING_REQUESTS int = 1000
+
+var (
+	ErrOverloaded = errors.New("Too many outstanding requests, try again later")
+	ErrViewChange = errors.New("View change started before request executed, try again")
+	// The client already executed a later request.
+	ErrStaleRequest = errors.New("Request is older than the client's last executed request")
+)
+
+// Proof that a request committed at a sequence number: the quorum of
+// matching signed commits we collected for it.
+type CommitCertificate struct {
+	Number        SlotId
+	RequestDigest [sha256.Size]byte
+	Commits       map[NodeId]SignedCommit
+}
+
+type ProposalResult struct {
+	Result      string // from StateMachine.Apply
+	SeqNumber   int
+	Certificate CommitCertificate
+}
+
+// Handle for a request given to Propose. Resolves once the request
+// executes, or with an error if it never will (as far as we know).
+type Proposal struct {
+	digest [sha256.Size]byte
+	done   chan struct{}
+	once   sync.Once
+	result ProposalResult
+	err    error
+}
+
+// Other consensus engines (see distributepki) hand these out too.
+func NewProposal(digest [sha256.Size]byte) *Proposal {
+	return &Proposal{digest: digest, done: make(chan struct{})}
+}
+
+// Digest of the proposed request (see Request.Digest)
+func (p *Proposal) Digest() [sha256.Size]byte {
+	return p.digest
+}
+
+// Closed once the proposal resolves.
+func (p *Proposal) Done() <-chan struct{} {
+	return p.done
+}
+
+// Blocks until the proposal resolves.
+func (p *Proposal) Result() (ProposalResult, error) {
+	<-p.done
+	return p.result, p.err
+}
+
+// Only the first resolution counts.
+func (p *Proposal) Resolve(result ProposalResult, err error) {
+	p.once.Do(func() {
+		p.result = result
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Orders a request, without blocking. The returned proposal fails with
+// the context's error if ctx is done first, with ErrOverloaded if
+// there's no room for the request (too many outstanding, or the queue's
+// full), with ErrViewChange if a view change starts while
+// it's outstanding, or with ErrStaleRequest if the client has already
+// moved on. Retrying a request that already executed resolves with
+// the original result.
+func (n *PBFTNode) Propose(ctx context.Context, request *Request) *Proposal {
+	digest, err := request.Digest()
+	p := NewProposal(digest)
+	if err != nil {
+		p.Resolve(ProposalResult{}, err)
+		return p
+	}
+	if !n.addProposal(p) {
+		atomic.AddUint64(&n.rejectedRequests, 1)
+		p.Resolve(ProposalResult{}, ErrOverloaded)
+		return p
+	}
+	select {
+	case n.requestChannel <- request:
+	case <-n.quit:
+		n.failProposal(p, ErrStopped)
+		return p
+	default:
+		atomic.AddUint64(&n.rejectedRequests, 1)
+		n.failProposal(p, ErrOverloaded)
+		return p
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.failProposal(p, ctx.Err())
+		case <-p.done:
+		}
+	}()
+	return p
+}
+
+// Returns false (and doesn't add it) if there are too many already.
+func (n *PBFTNode) addProposal(p *Proposal) bool {
+	n.proposalsMux.Lock()
+	defer n.proposalsMux.Unlock()
+	if n.pendingProposals >= n.maxPendingProposals {
+		return false
+	}
+	n.proposals[p.digest] = append(n.proposals[p.digest], p)
+	n.pendingProposals++
+	return true
+}
+
+// How long clients should back off after err before retrying: a
+// heartbeat when we're overloaded, and a whole view change timeout
+// when we're changing views.
+func (n *PBFTNode) RetryAfter(err error) time.Duration {
+	if err == ErrViewChange {
+		return n.timing.viewChange
+	}
+	return n.timing.heartbeat
+}
+
+func (n *PBFTNode) failProposal(p *Proposal, err error) {
+	n.proposalsMux.Lock()
+	pending := n.proposals[p.digest]
+	for i, other := range pending {
+		if other == p {
+			pending = append(pending[:i], pending[i+1:]...)
+			n.pendingProposals--
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(n.proposals, p.digest)
+	} else {
+		n.proposals[p.digest] = pending
+	}
+	n.proposalsMux.Unlock()
+	p.Resolve(ProposalResult{}, err)
+}
+
+// Resolves everybody waiting on the request with this digest.
+func (n *PBFTNode) resolveProposals(digest [sha256.Size]byte, result ProposalResult, err error) {
+	n.proposalsMux.Lock()
+	pending := n.proposals[digest]
+	delete(n.proposals, digest)
+	n.pendingProposals -= len(pending)
+	n.proposalsMux.Unlock()
+	for _, p := range pending {
+		p.Resolve(result, err)
+	}
+}
+
+// Fails every outstanding proposal (e.g. when a view change starts).
+func (n *PBFTNode) failAllProposals(err error) {
+	n.proposalsMux.Lock()
+	proposals := n.proposals
+	n.proposals = make(map[[sha256.Size]byte][]*Proposal)
+	n.pendingProposals = 0
+	n.proposalsMux.Unlock()
+	for _, pending := range proposals {
+		for _, p := range pending {
+			p.Resolve(ProposalResult{}, err)
+		}
+	}
+}
+
+func (slot *Slot) certificate(id SlotId) CommitCertificate {
+	cert := CommitCertificate{
+		Number:        id,
+		RequestDigest: slot.requestDigest,
+		Commits:       make(map[NodeId]SignedCommit),
+	}
+	for node, commit := range slot.commits {
+		cert.Commits[node] = *commit
+	}
+	return cert
+}
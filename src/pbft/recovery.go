@@ -0,0 +1,907 @@
+package pbft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ** PROACTIVE RECOVERY ** //
+
+// A replica that's been compromised once would stay compromised, since
+// its key never changes. So every ClusterConfig.RecoveryInterval each
+// replica recovers (after PBFT-PR):
+//
+//   1. It makes a new key and orders a key change, signed with the old
+//      one, like any other request. Every replica switches to the new
+//      key when it executes the change, so after that the old key is
+//      worthless.
+//   2. It throws away its log, pending checkpoints and early messages,
+//      and stops sending anything, since none of that can be trusted.
+//   3. It fetches the latest stable checkpoint from its peers, checks
+//      that a quorum signed it, and restores it. If none of them check
+//      out (e.g. they're from before somebody's key change, or from
+//      before its own), it waits for the next checkpoint to go stable
+//      instead. Then it carries on.
+//
+// Replicas take turns. The interval is split into one window per
+// replica, in the order of ClusterConfig.Nodes, by wall clock, so only
+// one recovers at a time as long as recovering takes less than a
+// window. A recovering replica is as good as faulty, so none of them
+// can weigh more than the cluster's FaultyWeight. Operators can also
+// start a recovery with the RECOVER admin command.
+//
+// Everyone's current keys are part of the checkpointed state, along with
+// when they changed. Nodes that set NodeConfig.KeyRingFile keep them, and
+// their own current private key (encrypted with their passphrase),
+// across restarts. Otherwise a replica that restarts after recovering
+// signs with a key nobody accepts any more.
+
+// Key changes are OP_KEY_CHANGE requests from "pbft-recovery/<node id>".
+// Nothing else gets to use those client ids.
+const RECOVERY_CLIENT string = "pbft-recovery"
+
+const RECOVERY_KEY_BITS int = 2048
+
+// How long to wait on our key change before trying again
+const RECOVERY_PROPOSE_TIMEOUT time.Duration = 10 * time.Second
+
+// How long to wait on each peer for its checkpoint
+const RECOVERY_FETCH_TIMEOUT time.Duration = 2 * time.Second
+
+// What a key change executes to, if it worked
+const KEY_CHANGE_OK string = "OK"
+
+var (
+	ErrRecoveryWeight = errors.New("Recovering replicas can't weigh more than the cluster's faulty weight")
+	ErrReservedClient = errors.New("Client ids starting with " + RECOVERY_CLIENT + "/ are for key changes")
+	ErrBadKeyChange   = errors.New("Key change request doesn't match the change it carries")
+	ErrStaleKeys      = errors.New("Checkpoint is from before a key change we've made")
+)
+
+type recoveryStage int
+
+const (
+	RECOVERY_NONE recoveryStage = iota
+	RECOVERY_KEY_CHANGE
+	RECOVERY_FETCH
+)
+
+func (stage recoveryStage) String() string {
+	switch stage {
+	case RECOVERY_NONE:
+		return ""
+	case RECOVERY_KEY_CHANGE:
+		return "key change"
+	case RECOVERY_FETCH:
+		return "fetching state"
+	}
+	return "UNKNOWN"
+}
+
+// Every replica recovering on its own would count as faulty.
+func (c ClusterConfig) checkRecovery(weights Weights) error {
+	if c.RecoveryInterval <= 0 {
+		return nil
+	}
+	for node, weight := range weights.Nodes {
+		if weight > weights.Faulty {
+			return fmt.Errorf("%s: node %d weighs %d", ErrRecoveryWeight.Error(), node, weight)
+		}
+	}
+	return nil
+}
+
+// When node id is next due to recover: the start of its window in this
+// interval, or the next one.
+func (c ClusterConfig) nextRecovery(id NodeId, now time.Time) time.Time {
+	interval := time.Duration(c.RecoveryInterval)
+	index := 0
+	for i, node := range c.Nodes {
+		if node.Id == id {
+			index = i
+		}
+	}
+	window := interval * time.Duration(index) / time.Duration(len(c.Nodes))
+	next := now.Truncate(interval).Add(window)
+	if !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// ** KEY CHANGES ** //
+
+type KeyChange struct {
+	Domain
+	Node      NodeId
+	Key       string // the new public key, armored
+	Timestamp int64
+}
+
+type SignedKeyChange struct {
+	Message   KeyChange
+	Signature []byte // with the old key
+}
+
+func (k *KeyChange) Sign(s Signer) (*SignedKeyChange, error) {
+	k.Domain = s.Domain
+	sig, err := s.sign(*k)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedKeyChange{
+		Message:   *k,
+		Signature: sig,
+	}, nil
+}
+
+func (k *SignedKeyChange) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(k.Message.Domain, k.Message, k.Signature)
+}
+
+func keyChangeClient(id NodeId) string {
+	return fmt.Sprintf("%s/%d", RECOVERY_CLIENT, id)
+}
+
+func (r Request) isKeyChange() bool {
+	return r.Op == OP_KEY_CHANGE
+}
+
+func (r Request) reservedClient() bool {
+	return strings.HasPrefix(r.Client, RECOVERY_CLIENT+"/")
+}
+
+// Runs on the execute stage instead of StateMachine.Apply, so every
+// replica switches keys at the same point in the log. The change has
+// to have been through checkRequest.
+func (n *PBFTNode) applyKeyChange(seq int, change *KeyChange) string {
+	result := n.keys.apply(seq, change)
+	if result == KEY_CHANGE_OK {
+		n.Log("KEY CHANGE for node %d", change.Node)
+	}
+	return result
+}
+
+// ** KEY RING ** //
+
+// Everybody's current keys, and ours. The execute stage changes them
+// and everything else reads them, so they're behind a lock; the
+// signers and verifiers handed out are copies.
+type keyRing struct {
+	mu         sync.RWMutex
+	id         NodeId
+	self       Signer
+	pending    *openpgp.Entity            // what we're changing our key to
+	genesis    map[NodeId]*openpgp.Entity // from the cluster config
+	rotated    map[NodeId]rotatedKey      // changed since
+	peers      Verifier                   // everyone but us
+	everyone   Verifier
+	file       string // where to keep them (optional)
+	passphrase []byte // what our private keys are encrypted with there
+}
+
+type rotatedKey struct {
+	entity *openpgp.Entity
+	savedKey
+}
+
+// A key that changed, as it's checkpointed and saved
+type savedKey struct {
+	Key string // armored, exactly as it was in the key change
+	Seq int    // when the key change executed
+}
+
+// What goes in NodeConfig.KeyRingFile. The private keys are armored
+// PGP messages, encrypted with the node's passphrase.
+type keyRingFile struct {
+	Keys    map[NodeId]savedKey // public keys that changed
+	Private string              `json:",omitempty"` // our current private key, if it changed
+	Pending string              `json:",omitempty"` // ... and the one we're changing to
+}
+
+func newKeyRing(id NodeId, self *openpgp.Entity, genesis map[NodeId]*openpgp.Entity, domain Domain, weights Weights, file string, passphrase []byte) (*keyRing, error) {
+	k := &keyRing{
+		id:         id,
+		self:       Signer{Entity: self, Domain: domain},
+		genesis:    genesis,
+		rotated:    make(map[NodeId]rotatedKey),
+		file:       file,
+		passphrase: passphrase,
+	}
+	if self != nil {
+		k.genesis[id] = self
+	}
+	k.peers = Verifier{Domain: domain, Mismatches: &DomainMismatches{}, Weights: weights}
+	k.everyone = k.peers
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	k.rebuild()
+	return k, nil
+}
+
+func (k *keyRing) signer() Signer {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.self
+}
+
+// Checks messages from our peers (not from us)
+func (k *keyRing) verifier() Verifier {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.peers
+}
+
+// Checks messages from anyone, us included
+func (k *keyRing) verifyAll() Verifier {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.everyone
+}
+
+func (k *keyRing) key(id NodeId) *openpgp.Entity {
+	if rotated, ok := k.rotated[id]; ok {
+		return rotated.entity
+	}
+	return k.genesis[id]
+}
+
+// Must hold the lock!
+func (k *keyRing) rebuild() {
+	k.peers.Peers = make(openpgp.EntityList, 0, len(k.genesis))
+	k.peers.PeerMap = make(map[EntityFingerprint]NodeId)
+	k.everyone.Peers = make(openpgp.EntityList, 0, len(k.genesis))
+	k.everyone.PeerMap = make(map[EntityFingerprint]NodeId)
+	for id, _ := range k.genesis {
+		entity := k.key(id)
+		if id != k.id {
+			k.peers.Peers = append(k.peers.Peers, entity)
+			k.peers.PeerMap[entity.PrimaryKey.Fingerprint] = id
+		}
+		k.everyone.Peers = append(k.everyone.Peers, entity)
+		k.everyone.PeerMap[entity.PrimaryKey.Fingerprint] = id
+	}
+}
+
+// Checks a committed request before it's executed, and hands back the
+// key change if it's one. Key changes have to be signed by the current
+// key of the node they're for, and nothing else can pass for one. This
+// has to happen before the reply cache looks at the request, or anybody
+// could take a replica's place in it.
+func (k *keyRing) checkRequest(seq int, request Request) (*KeyChange, error) {
+	if !request.isKeyChange() {
+		if request.reservedClient() {
+			return nil, ErrReservedClient
+		}
+		return nil, nil
+	}
+	var change SignedKeyChange
+	if err := json.Unmarshal([]byte(request.Operation), &change); err != nil {
+		return nil, err
+	}
+	if request.Client != keyChangeClient(change.Message.Node) || request.Timestamp != change.Message.Timestamp {
+		return nil, ErrBadKeyChange
+	}
+	// If our key ring got saved but the application didn't (see
+	// resume), we run this one again. It checked out the first time,
+	// and the key it's signed with is gone now.
+	k.mu.RLock()
+	rotated, ok := k.rotated[change.Message.Node]
+	k.mu.RUnlock()
+	if ok && rotated.Seq == seq && rotated.Key == change.Message.Key {
+		return &change.Message, nil
+	}
+	signer, err := change.SignatureValid(k.verifyAll())
+	if err != nil {
+		return nil, err
+	} else if signer != change.Message.Node {
+		return nil, errors.New("Key change not signed by the node whose key it is")
+	}
+	return &change.Message, nil
+}
+
+// Applies a checked key change from the log at seq (see
+// applyKeyChange), and returns the result.
+func (k *keyRing) apply(seq int, change *KeyChange) string {
+	if err := k.rotate(change.Node, savedKey{Key: change.Key, Seq: seq}); err != nil {
+		return "Bad key change: " + err.Error()
+	}
+	return KEY_CHANGE_OK
+}
+
+// Switches node id to the public key. If it's us, we start signing
+// with the key we made for it.
+func (k *keyRing) rotate(id NodeId, key savedKey) error {
+	entity, err := readPublicKey(key.Key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.genesis[id]; !ok {
+		return fmt.Errorf("No node %d", id)
+	}
+	k.rotated[id] = rotatedKey{entity: entity, savedKey: key}
+	k.useOwnKey()
+	k.rebuild()
+	k.save()
+	return nil
+}
+
+// Must hold the lock!
+func (k *keyRing) useOwnKey() {
+	if k.self.Entity == nil {
+		// we're an observer, and don't sign anything
+		return
+	}
+	current := k.key(k.id)
+	if k.pending != nil && k.pending.PrimaryKey.Fingerprint == current.PrimaryKey.Fingerprint {
+		k.self.Entity = k.pending
+		k.pending = nil
+	} else if k.self.Entity.PrimaryKey.Fingerprint != current.PrimaryKey.Fingerprint {
+		plog.Errorf("[Node %d] Our key changed, but we don't have the private key for it!", k.id)
+	}
+}
+
+func (k *keyRing) setPending(entity *openpgp.Entity) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending = entity
+	k.save()
+}
+
+// The keys that changed, for checkpoints.
+func (k *keyRing) rotatedKeys() map[NodeId]savedKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make(map[NodeId]savedKey)
+	for id, rotated := range k.rotated {
+		keys[id] = rotated.savedKey
+	}
+	return keys
+}
+
+// When the latest key change we know of executed (0 if none has).
+func (k *keyRing) latestChange() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	latest := 0
+	for _, rotated := range k.rotated {
+		if rotated.Seq > latest {
+			latest = rotated.Seq
+		}
+	}
+	return latest
+}
+
+// Replaces the keys that changed with the ones from a checkpoint at
+// seq. A checkpoint from before a key change we've made would hand the
+// old key (and whoever stole it) its vote back, so we refuse those.
+func (k *keyRing) restore(keys map[NodeId]savedKey, seq int) error {
+	return k.replace(keys, seq, true)
+}
+
+// Puts back the keys we had before restoring a checkpoint that didn't
+// check out (so they can be older than the ones it gave us).
+func (k *keyRing) putBack(keys map[NodeId]savedKey) error {
+	return k.replace(keys, 0, false)
+}
+
+func (k *keyRing) replace(keys map[NodeId]savedKey, seq int, refuseStale bool) error {
+	rotated := make(map[NodeId]rotatedKey)
+	for id, key := range keys {
+		entity, err := readPublicKey(key.Key)
+		if err != nil {
+			return err
+		}
+		rotated[id] = rotatedKey{entity: entity, savedKey: key}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, current := range k.rotated {
+		if refuseStale && current.Seq > seq {
+			return ErrStaleKeys
+		}
+	}
+	k.rotated = rotated
+	k.useOwnKey()
+	k.rebuild()
+	k.save()
+	return nil
+}
+
+// Must hold the lock! Failing to save isn't fatal, so it's just logged.
+func (k *keyRing) save() {
+	if k.file == "" {
+		return
+	}
+	contents := keyRingFile{Keys: make(map[NodeId]savedKey)}
+	for id, rotated := range k.rotated {
+		contents.Keys[id] = rotated.savedKey
+	}
+	var err error
+	if _, ok := k.rotated[k.id]; ok {
+		if contents.Private, err = armorPrivateKey(k.self.Entity, k.passphrase); err != nil {
+			plog.Errorf("[Node %d] Saving key ring: %s", k.id, err.Error())
+			return
+		}
+	}
+	if k.pending != nil {
+		if contents.Pending, err = armorPrivateKey(k.pending, k.passphrase); err != nil {
+			plog.Errorf("[Node %d] Saving key ring: %s", k.id, err.Error())
+			return
+		}
+	}
+	encoded, err := json.Marshal(contents)
+	if err != nil {
+		plog.Errorf("[Node %d] Saving key ring: %s", k.id, err.Error())
+		return
+	}
+	// write the whole thing and swap it in, so a crash can't leave
+	// half a key ring
+	tmp := k.file + ".tmp"
+	if err := writeSecret(tmp, encoded); err != nil {
+		plog.Errorf("[Node %d] Saving key ring: %s", k.id, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, k.file); err != nil {
+		plog.Errorf("[Node %d] Saving key ring: %s", k.id, err.Error())
+	}
+}
+
+func (k *keyRing) load() error {
+	if k.file == "" {
+		return nil
+	}
+	encoded, err := ioutil.ReadFile(k.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var contents keyRingFile
+	if err := json.Unmarshal(encoded, &contents); err != nil {
+		return err
+	}
+	for id, key := range contents.Keys {
+		entity, err := readPublicKey(key.Key)
+		if err != nil {
+			return err
+		}
+		k.rotated[id] = rotatedKey{entity: entity, savedKey: key}
+	}
+	if contents.Private != "" {
+		if k.self.Entity, err = readPrivateKey(contents.Private, k.passphrase); err != nil {
+			return err
+		}
+	}
+	if contents.Pending != "" {
+		if k.pending, err = readPrivateKey(contents.Pending, k.passphrase); err != nil {
+			return err
+		}
+	}
+	k.useOwnKey()
+	return nil
+}
+
+func armorPublicKey(entity *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := entity.Serialize(w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Private keys are encrypted with the passphrase as a whole, in a
+// symmetrically encrypted PGP message.
+func armorPrivateKey(entity *openpgp.Entity, passphrase []byte) (string, error) {
+	var key bytes.Buffer
+	if err := entity.SerializePrivate(&key, nil); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openpgp.SymmetricallyEncrypt(w, passphrase, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := plaintext.Write(key.Bytes()); err != nil {
+		return "", err
+	}
+	if err := plaintext.Close(); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func readPublicKey(armored string) (*openpgp.Entity, error) {
+	list, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	} else if len(list) != 1 {
+		return nil, errors.New("Expected exactly 1 PGP entity in key")
+	}
+	return list[0], nil
+}
+
+func readPrivateKey(armored string, passphrase []byte) (*openpgp.Entity, error) {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// it asks again if the passphrase didn't work
+		if tried {
+			return nil, errors.New("Wrong passphrase for saved private key")
+		}
+		tried = true
+		return passphrase, nil
+	}
+	message, err := openpgp.ReadMessage(block.Body, nil, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	list, err := openpgp.ReadKeyRing(message.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	} else if len(list) != 1 || list[0].PrivateKey == nil {
+		return nil, errors.New("Expected exactly 1 PGP private key")
+	}
+	return list[0], nil
+}
+
+// Writes a file only we can read, creating it afresh (so it can't be
+// somebody else's, or have kept looser permissions), and syncs it.
+func writeSecret(path string, contents []byte) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ** RECOVERING ** //
+
+// What the recovery goroutines tell the main routine.
+type recoveryStep struct {
+	keyChanged bool             // our key change executed (or failed, if err is set)
+	checkpoint *CheckpointProof // the verified checkpoint to restore (nil if we didn't get one)
+	fetched    bool             // from fetchCheckpoint
+	err        error
+}
+
+func (n *PBFTNode) recoveryTimerChannel() <-chan time.Time {
+	if n.recoveryTimer == nil {
+		return nil
+	}
+	return n.recoveryTimer.C
+}
+
+func (n *PBFTNode) scheduleRecovery() {
+	if n.cluster.RecoveryInterval <= 0 {
+		return
+	}
+	next := n.cluster.nextRecovery(n.id, time.Now())
+	if n.recoveryTimer == nil {
+		n.recoveryTimer = time.NewTimer(time.Until(next))
+	} else {
+		n.recoveryTimer.Reset(time.Until(next))
+	}
+}
+
+// Must be called on the main routine!
+func (n *PBFTNode) startRecovery() {
+	if n.recovery != RECOVERY_NONE || n.down {
+		return
+	}
+	n.Log("RECOVERING")
+	n.recovery = RECOVERY_KEY_CHANGE
+	go n.changeKey(n.keys.signer())
+}
+
+// Makes a new key and orders the key change, on its own goroutine.
+func (n *PBFTNode) changeKey(old Signer) {
+	step := recoveryStep{keyChanged: true}
+	defer func() {
+		select {
+		case n.recoveryChannel <- step:
+		case <-n.quit:
+		}
+	}()
+
+	entity, err := openpgp.NewEntity(fmt.Sprintf("node%d", n.id), "", "", &packet.Config{RSABits: RECOVERY_KEY_BITS})
+	if err != nil {
+		step.err = err
+		return
+	}
+	armored, err := armorPublicKey(entity)
+	if err != nil {
+		step.err = err
+		return
+	}
+	change := KeyChange{Node: n.id, Key: armored, Timestamp: time.Now().UnixNano()}
+	signed, err := change.Sign(old)
+	if err != nil {
+		step.err = err
+		return
+	}
+	operation, err := json.Marshal(signed)
+	if err != nil {
+		step.err = err
+		return
+	}
+	n.keys.setPending(entity)
+
+	// the same request every time, so retries don't execute twice
+	request := &Request{Client: keyChangeClient(n.id), Timestamp: change.Timestamp, Operation: string(operation), Op: OP_KEY_CHANGE}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), RECOVERY_PROPOSE_TIMEOUT)
+		result, err := n.Propose(ctx, request).Result()
+		cancel()
+		switch err {
+		case nil:
+			if result.Result != KEY_CHANGE_OK {
+				step.err = errors.New(result.Result)
+			}
+			return
+		case ErrOverloaded, ErrViewChange, context.DeadlineExceeded:
+			select {
+			case <-time.After(n.RetryAfter(err)):
+			case <-n.quit:
+				return
+			}
+		default:
+			step.err = err
+			return
+		}
+	}
+}
+
+// Must be called on the main routine!
+func (n *PBFTNode) handleRecoveryStep(step recoveryStep) {
+	if step.fetched {
+		n.fetchingSnapshot = false
+	}
+	if step.err != nil {
+		n.Log("Recovery failed: %s", step.err.Error())
+		n.recovery = RECOVERY_NONE
+		return
+	}
+	if step.keyChanged && n.recovery == RECOVERY_KEY_CHANGE {
+		// none of this can be trusted
+		n.log = make(map[SlotId]*Slot)
+		n.committedSlots = make(map[int]SlotId)
+		n.pendingCheckpoints = make(map[SlotId]map[[sha256.Size]byte]CheckpointProof)
+		n.buffered = make(map[NodeId][]bufferedMessage)
+		n.toExecute = nil
+		n.recovery = RECOVERY_FETCH
+		n.fetchingSnapshot = true
+		go n.fetchCheckpoint()
+		return
+	}
+	if n.recovery == RECOVERY_FETCH && step.checkpoint != nil && step.checkpoint.Number.SeqNumber >= n.keys.latestChange() {
+		n.finishRecovery(*step.checkpoint)
+	} else if n.recovery == RECOVERY_FETCH {
+		n.Log("No verifiable checkpoint from peers; waiting for the next one")
+	}
+}
+
+// Restores a checkpoint a quorum signed, and starts taking part again.
+// Must be called on the main routine!
+func (n *PBFTNode) finishRecovery(checkpoint CheckpointProof) {
+	n.Log("RECOVERED from checkpoint %+v", checkpoint.Number)
+	n.recovery = RECOVERY_NONE
+	if checkpoint.Number.SeqNumber > n.sequenceNumber {
+		n.sequenceNumber = checkpoint.Number.SeqNumber
+	}
+	if checkpoint.Number.SeqNumber > n.issuedSequenceNumber {
+		n.issuedSequenceNumber = checkpoint.Number.SeqNumber
+	}
+	n.lastCheckpoint = checkpoint
+	n.skipToCheckpoint(checkpoint)
+}
+
+// Hands the main routine the newest stable checkpoint our peers have.
+// Runs on its own goroutine.
+func (n *PBFTNode) fetchCheckpoint() {
+	step := recoveryStep{fetched: true}
+	step.checkpoint, _, step.err = n.fetchStableCheckpoint(0)
+	select {
+	case n.recoveryChannel <- step:
+	case <-n.quit:
+	}
+}
+
+// A checkpoint a peer sent us.
+type fetchedCheckpoint struct {
+	proof *CheckpointProof
+	from  NodeId
+}
+
+// Asks every peer (but avoid, if it's set) for its last stable
+// checkpoint, snapshot and all, and returns the newest one that checks
+// out (nil if none of them do), and who sent it.
+func (n *PBFTNode) fetchStableCheckpoint(avoid NodeId) (*CheckpointProof, NodeId, error) {
+	request := CheckpointFetch{Node: n.id}
+	signed, err := request.Sign(n.keys.signer())
+	if err != nil {
+		return nil, 0, err
+	}
+	proofs := make(chan fetchedCheckpoint, len(n.peermap))
+	asked := 0
+	for id, hostname := range n.peermap {
+		if id == avoid {
+			continue
+		}
+		asked++
+		go func(id NodeId, hostname string) {
+			var response SignedCheckpointProof
+			err := sendRpc(n.id, id, hostname, "PBFTNode.FetchCheckpoint", n.cluster.Endpoint, signed, &response, 1, RECOVERY_FETCH_TIMEOUT, n.peerTLS)
+			if err != nil {
+				n.Log("Fetching checkpoint from %d: %s", id, err.Error())
+				proofs <- fetchedCheckpoint{}
+				return
+			}
+			if err := n.verifyFetchedCheckpoint(id, &response); err != nil {
+				n.Log("Checkpoint from %d: %s", id, err.Error())
+				proofs <- fetchedCheckpoint{}
+				return
+			}
+			proofs <- fetchedCheckpoint{proof: &response.Message.Proof, from: id}
+		}(id, hostname)
+	}
+	var newest fetchedCheckpoint
+	for i := 0; i < asked; i++ {
+		if fetched := <-proofs; fetched.proof != nil {
+			if newest.proof == nil || newest.proof.Number.Before(fetched.proof.Number) {
+				newest = fetched
+			}
+		}
+	}
+	return newest.proof, newest.from, nil
+}
+
+var (
+	ErrUnverifiedCheckpoint = errors.New("Checkpoint isn't signed by a quorum")
+	ErrNoSnapshot           = errors.New("Checkpoint came without its snapshot")
+	ErrSnapshotDigest       = errors.New("Checkpoint's snapshot doesn't match its digest")
+)
+
+// The response has to come from the peer we asked, and the checkpoint
+// has to check out (see verifyCheckpointProof) under everyone's current
+// keys.
+func (n *PBFTNode) verifyFetchedCheckpoint(from NodeId, response *SignedCheckpointProof) error {
+	verifier := n.keys.verifyAll()
+	signer, err := response.SignatureValid(verifier)
+	if err != nil {
+		return err
+	} else if signer != from || response.Message.Node != from {
+		return errors.New("Checkpoint not sent by the node we asked")
+	} else if response.Message.Proof.Snapshot == nil {
+		return ErrNoSnapshot
+	}
+	return verifyCheckpointProof(verifier, response.Message.Proof)
+}
+
+// A checkpoint needs a quorum's worth of matching signatures, and its
+// snapshot (if it came with one) has to be the one they signed.
+func verifyCheckpointProof(verifier Verifier, proof CheckpointProof) error {
+	if proof.Snapshot != nil && sha256.Sum256(proof.Snapshot) != proof.SnapshotDigest {
+		return ErrSnapshotDigest
+	}
+	signed := make(map[NodeId]bool)
+	for node, checkpoint := range proof.Proof {
+		signer, err := checkpoint.SignatureValid(verifier)
+		if err != nil || signer != node || checkpoint.CheckpointMessage.Node != node {
+			continue
+		}
+		if checkpoint.CheckpointMessage.Number != proof.Number || checkpoint.CheckpointMessage.StateDigest != proof.StateDigest ||
+			checkpoint.CheckpointMessage.StateRoot != proof.StateRoot || checkpoint.CheckpointMessage.SnapshotDigest != proof.SnapshotDigest {
+			continue
+		}
+		signed[node] = true
+	}
+	if verifier.Weights.Of(signed) < verifier.Weights.Quorum {
+		return ErrUnverifiedCheckpoint
+	}
+	return nil
+}
+
+// ** CHECKPOINT FETCHING ** //
+
+type CheckpointFetch struct {
+	Domain
+	Node NodeId
+}
+
+type SignedCheckpointFetch struct {
+	Message   CheckpointFetch
+	Signature []byte
+}
+
+func (c *CheckpointFetch) Sign(s Signer) (*SignedCheckpointFetch, error) {
+	c.Domain = s.Domain
+	sig, err := s.sign(*c)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedCheckpointFetch{
+		Message:   *c,
+		Signature: sig,
+	}, nil
+}
+
+func (c *SignedCheckpointFetch) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(c.Message.Domain, c.Message, c.Signature)
+}
+
+// Answers a recovering peer with our last stable checkpoint.
+func (n *PBFTNode) FetchCheckpoint(req *SignedCheckpointFetch, res *SignedCheckpointProof) error {
+	if n.down {
+		return errors.New("I'm down")
+	}
+	sender, err := req.SignatureValid(n.keys.verifier())
+	if err != nil {
+		return err
+	} else if sender != req.Message.Node {
+		return errors.New("Checkpoint fetch not signed by the node it's from")
+	}
+	reply := make(chan CheckpointProof, 1)
+	select {
+	case n.fetchChannel <- reply:
+	case <-n.quit:
+		return ErrStopped
+	}
+	var checkpoint CheckpointProof
+	select {
+	case checkpoint = <-reply:
+	case <-n.quit:
+		return ErrStopped
+	}
+	message := CheckpointProofMessage{Proof: checkpoint, Node: n.id}
+	signed, err := message.Sign(n.keys.signer())
+	if err != nil {
+		return err
+	}
+	*res = *signed
+	return nil
+}
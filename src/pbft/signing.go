@@ -4,9 +4,27 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"golang.org/x/crypto/openpgp"
+	"sync/atomic"
 )
 
+// Request //
+
+func (r Request) Digest() ([sha256.Size]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(r); err != nil {
+		var empty [sha256.Size]byte
+		return empty, err
+	}
+	return sha256.Sum256(buf.Bytes()), nil
+}
+
+// Null requests fill the gaps left by view changes.
+func (r Request) isNoOp() bool {
+	return r == Request{}
+}
+
 // ClientReply //
 
 func (cr *ClientReply) generateDigest() ([sha256.Size]byte, error) {
@@ -41,298 +59,239 @@ func (cr *ClientReply) DigestValid() bool {
 	}
 }
 
-// PrePrepare //
+// ** SIGNING ** //
+
+var (
+	ErrWrongCluster = errors.New("Message is for a different cluster")
+	ErrWrongEpoch   = errors.New("Message is for a different configuration epoch")
+)
+
+// Signs messages as one replica, stamping them with its cluster
+// identity first.
+type Signer struct {
+	Entity *openpgp.Entity
+	Domain Domain
+}
 
-func (pp *PrePrepare) Sign(node *openpgp.Entity) (*SignedPrePrepare, error) {
+func (s Signer) sign(message interface{}) ([]byte, error) {
 	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*pp); err != nil {
+	if err := json.NewEncoder(&buf).Encode(message); err != nil {
 		return nil, err
 	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
-	if err != nil {
+	if err := openpgp.DetachSign(&sig, s.Entity, &buf, nil); err != nil {
 		return nil, err
 	}
+	return sig.Bytes(), nil
+}
 
-	return &SignedPrePrepare{
-		PrePrepareMessage: *pp,
-		Signature:         sig.Bytes(),
-	}, nil
+// How many messages we've turned away for being from another cluster
+// or epoch.
+type DomainMismatches struct {
+	Cluster uint64
+	Epoch   uint64
 }
 
-func (pp *SignedPrePrepare) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(pp.PrePrepareMessage); err != nil {
-		return 0, err
-	}
+// Checks messages were signed by a peer, for our cluster and epoch.
+type Verifier struct {
+	Peers      openpgp.EntityList
+	PeerMap    map[EntityFingerprint]NodeId
+	Domain     Domain
+	Mismatches *DomainMismatches // updated atomically; can be nil
+	Weights    Weights           // what counts as a quorum
+}
 
-	if _, err := sig.Write(pp.Signature); err != nil {
-		return 0, err
+func (v Verifier) verify(domain Domain, message interface{}, signature []byte) (NodeId, error) {
+	// cheap checks first
+	if domain.Cluster != v.Domain.Cluster {
+		if v.Mismatches != nil {
+			atomic.AddUint64(&v.Mismatches.Cluster, 1)
+		}
+		return 0, ErrWrongCluster
 	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
+	if domain.Epoch != v.Domain.Epoch {
+		if v.Mismatches != nil {
+			atomic.AddUint64(&v.Mismatches.Epoch, 1)
+		}
+		return 0, ErrWrongEpoch
+	}
+
+	signer, err := checkSignature(v.Peers, message, signature)
 	if err != nil {
 		return 0, err
 	}
+	return v.PeerMap[signer.PrimaryKey.Fingerprint], nil
+}
 
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+// Other consensus engines (see distributepki) sign their messages the
+// same way. The message should carry s.Domain, and Verify should be
+// handed it back.
+func (s Signer) Sign(message interface{}) ([]byte, error) {
+	return s.sign(message)
 }
 
-// Enables RPC response messages without creating a new copy of the response
-func (pp *PPResponse) GetSignature(node *openpgp.Entity) ([]byte, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*pp); err != nil {
-		var emptyResult []byte
-		return emptyResult, err
+func (v Verifier) Verify(domain Domain, message interface{}, signature []byte) (NodeId, error) {
+	return v.verify(domain, message, signature)
+}
+
+// Which key in keyring signed message (or an error if none did).
+func checkSignature(keyring openpgp.EntityList, message interface{}, signature []byte) (*openpgp.Entity, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(message); err != nil {
+		return nil, err
 	}
+	return openpgp.CheckDetachedSignature(keyring, &buf, bytes.NewReader(signature))
+}
 
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+// PrePrepare //
+
+func (pp *PrePrepare) Sign(s Signer) (*SignedPrePrepare, error) {
+	pp.Domain = s.Domain
+	sig, err := s.sign(*pp)
 	if err != nil {
-		var emptyResult []byte
-		return emptyResult, err
+		return nil, err
 	}
+	return &SignedPrePrepare{
+		PrePrepareMessage: *pp,
+		Signature:         sig,
+	}, nil
+}
 
-	return sig.Bytes(), nil
+func (pp *SignedPrePrepare) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(pp.PrePrepareMessage.Domain, pp.PrePrepareMessage, pp.Signature)
+}
+
+// Empty pre-prepares are just the primary saying hi.
+func (pp PrePrepare) isHeartbeat() bool {
+	return pp.Number == (SlotId{}) && pp.RequestDigest == [sha256.Size]byte{}
 }
 
-func (pp *PPResponse) Sign(node *openpgp.Entity) (*SignedPPResponse, error) {
-	sig, err := pp.GetSignature(node)
+// Enables RPC response messages without creating a new copy of the response
+func (pp *PPResponse) GetSignature(s Signer) ([]byte, error) {
+	pp.Domain = s.Domain
+	return s.sign(*pp)
+}
+
+func (pp *PPResponse) Sign(s Signer) (*SignedPPResponse, error) {
+	sig, err := pp.GetSignature(s)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedPPResponse{
 		Response:  *pp,
 		Signature: sig,
 	}, nil
 }
 
-func (pp *SignedPPResponse) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(pp.Response); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(pp.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (pp *SignedPPResponse) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(pp.Response.Domain, pp.Response, pp.Signature)
 }
 
 // Prepare //
 
-func (p *Prepare) Sign(node *openpgp.Entity) (*SignedPrepare, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*p); err != nil {
-		return nil, err
-	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+func (p *Prepare) Sign(s Signer) (*SignedPrepare, error) {
+	p.Domain = s.Domain
+	sig, err := s.sign(*p)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedPrepare{
 		PrepareMessage: *p,
-		Signature:      sig.Bytes(),
+		Signature:      sig,
 	}, nil
 }
 
-func (p *SignedPrepare) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(p.PrepareMessage); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(p.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (p *SignedPrepare) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(p.PrepareMessage.Domain, p.PrepareMessage, p.Signature)
 }
 
 // Commit //
 
-func (c *Commit) Sign(node *openpgp.Entity) (*SignedCommit, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*c); err != nil {
-		return nil, err
-	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+func (c *Commit) Sign(s Signer) (*SignedCommit, error) {
+	c.Domain = s.Domain
+	sig, err := s.sign(*c)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedCommit{
 		CommitMessage: *c,
-		Signature:     sig.Bytes(),
+		Signature:     sig,
 	}, nil
 }
 
-func (c *SignedCommit) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(c.CommitMessage); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(c.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (c *SignedCommit) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(c.CommitMessage.Domain, c.CommitMessage, c.Signature)
 }
 
 // Checkpoint //
 
-func (c *Checkpoint) Sign(node *openpgp.Entity) (*SignedCheckpoint, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*c); err != nil {
-		return nil, err
-	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+// Checkpoints are signed without their snapshot (see CheckpointHeader),
+// so the signatures can be checked without it.
+func (c *Checkpoint) Sign(s Signer) (*SignedCheckpoint, error) {
+	c.Domain = s.Domain
+	sig, err := s.sign(c.Header())
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedCheckpoint{
 		CheckpointMessage: *c,
-		Signature:         sig.Bytes(),
+		Signature:         sig,
 	}, nil
 }
 
-func (c *SignedCheckpoint) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(c.CheckpointMessage); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(c.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (c *SignedCheckpoint) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(c.CheckpointMessage.Domain, c.CheckpointMessage.Header(), c.Signature)
 }
 
 // CheckpointProof //
 
-func (c *CheckpointProofMessage) Sign(node *openpgp.Entity) (*SignedCheckpointProof, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*c); err != nil {
-		return nil, err
-	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+func (c *CheckpointProofMessage) Sign(s Signer) (*SignedCheckpointProof, error) {
+	c.Domain = s.Domain
+	sig, err := s.sign(*c)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedCheckpointProof{
 		Message:   *c,
-		Signature: sig.Bytes(),
+		Signature: sig,
 	}, nil
 }
 
-func (c *SignedCheckpointProof) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(c.Message); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(c.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (c *SignedCheckpointProof) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(c.Message.Domain, c.Message, c.Signature)
 }
 
 // ViewChange //
 
-func (vc *ViewChange) Sign(node *openpgp.Entity) (*SignedViewChange, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*vc); err != nil {
-		return nil, err
-	}
-
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+func (vc *ViewChange) Sign(s Signer) (*SignedViewChange, error) {
+	vc.Domain = s.Domain
+	sig, err := s.sign(*vc)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedViewChange{
 		Message:   *vc,
-		Signature: sig.Bytes(),
+		Signature: sig,
 	}, nil
 }
 
-func (vc *SignedViewChange) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(vc.Message); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(vc.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (vc *SignedViewChange) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(vc.Message.Domain, vc.Message, vc.Signature)
 }
 
-func (nv *NewView) Sign(node *openpgp.Entity) (*SignedNewView, error) {
-	var sig, buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(*nv); err != nil {
-		return nil, err
-	}
+// NewView //
 
-	err := openpgp.DetachSign(&sig, node, &buf, nil)
+func (nv *NewView) Sign(s Signer) (*SignedNewView, error) {
+	nv.Domain = s.Domain
+	sig, err := s.sign(*nv)
 	if err != nil {
 		return nil, err
 	}
-
 	return &SignedNewView{
 		Message:   *nv,
-		Signature: sig.Bytes(),
+		Signature: sig,
 	}, nil
 }
 
-func (nv *SignedNewView) SignatureValid(peers openpgp.EntityList, peerMap map[EntityFingerprint]NodeId) (NodeId, error) {
-	var buf, sig bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(nv.Message); err != nil {
-		return 0, err
-	}
-
-	if _, err := sig.Write(nv.Signature); err != nil {
-		return 0, err
-	}
-	signer, err := openpgp.CheckDetachedSignature(peers, &buf, &sig)
-	if err != nil {
-		return 0, err
-	}
-
-	return peerMap[signer.PrimaryKey.Fingerprint], nil
+func (nv *SignedNewView) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(nv.Message.Domain, nv.Message, nv.Signature)
 }
@@ -0,0 +1,272 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+)
+
+// The application replicated by the cluster. The node calls it from
+// a single goroutine (its execute stage, see pipeline.go), once per
+// committed request and strictly in sequence number order, so
+// implementations don't need to worry about ordering. Slow ones hold
+// up execution, but not ordering.
+type StateMachine interface {
+	// Executes a committed request and returns the result for the
+	// client that sent it.
+	Apply(seq int, request string) string
+	// Serializes the entire application state, to be shipped to
+	// replicas that fall behind a checkpoint.
+	Snapshot() ([]byte, error)
+	// Replaces the application state with a snapshot taken by
+	// Snapshot (possibly on a different replica).
+	Restore(snapshot []byte) error
+	// Digest of the current state. Replicas only agree on a
+	// checkpoint if their digests match, so this must be deterministic.
+	StateDigest() [sha256.Size]byte
+}
+
+// Applications that keep their state on disk. Each write is saved
+// together with the sequence number it's as of and whatever else the
+// replica needs to carry on from there (its reply cache and keys), all
+// or nothing, so a replica that restarts picks up from its own disk and
+// only asks its peers for what it missed (see durable.go).
+type DurableStateMachine interface {
+	StateMachine
+	// Like Apply, but also saves seq and the replica's state (which
+	// depends on the result, so we hand over a function to work it out)
+	// in the same write.
+	ApplyDurably(seq int, request string, replica func(result string) []byte) string
+	// Saves seq and the replica's state, when something other than the
+	// application changed (or it was restored).
+	Save(seq int, replica []byte) error
+	// What was last saved; seq is 0 if nothing has been. Restore has to
+	// clear it in the same write, so we never start from a half
+	// restored snapshot.
+	Saved() (seq int, replica []byte, err error)
+}
+
+// Applications whose operations say who sent them (and when). The
+// reply cache trusts a request's Client and Timestamp, so without this
+// anybody could file an operation under someone else's client, or with
+// a timestamp so far ahead that nothing that client sends afterwards
+// gets executed.
+type RequestChecker interface {
+	// Whether the request's Client and Timestamp are the ones its
+	// operation was sent with (and whatever else the application wants
+	// checked before it's executed). Runs on every replica before the
+	// reply cache sees the request, so it must be deterministic.
+	CheckRequest(request Request) error
+	// Whether to take on a request at all, as of now (e.g. its timestamp
+	// isn't too far ahead of our clock). Backups check what the primary
+	// orders too.
+	AdmitRequest(request Request, now time.Time) error
+}
+
+// The application's say on a request that's about to be executed
+// (nil if it doesn't have one). Our own key changes aren't its business.
+func CheckRequest(app StateMachine, request Request) error {
+	checker, ok := app.(RequestChecker)
+	if !ok || request.isKeyChange() {
+		return nil
+	}
+	return checker.CheckRequest(request)
+}
+
+// The application's say on a request that's just arrived.
+func AdmitRequest(app StateMachine, request Request) error {
+	checker, ok := app.(RequestChecker)
+	if !ok || request.isKeyChange() {
+		return nil
+	}
+	return checker.AdmitRequest(request, time.Now())
+}
+
+// ** EXECUTION ** //
+
+// Finds the committed slot for a sequence number (in the highest view,
+// if it was re-proposed during a view change).
+func (n *PBFTNode) committedSlot(seq int) (SlotId, *Slot) {
+	id, ok := n.committedSlots[seq]
+	if !ok {
+		return SlotId{}, nil
+	}
+	return id, n.log[id]
+}
+
+// Runs on the execute stage.
+func (n *PBFTNode) execute(item executeItem) {
+	request := *item.request
+	change, err := n.keys.checkRequest(item.seq, request)
+	if err == nil {
+		err = CheckRequest(n.app, request)
+	}
+	if err != nil {
+		n.reply(item.digest, ProposalResult{}, err)
+		return
+	}
+	// The same request can get ordered twice (e.g. a client retries
+	// across a view change), so only apply requests newer than the
+	// client's last one. (Only the execute stage writes lastReply, so
+	// we don't need the lock to read it.)
+	if last, ok := n.lastReply[request.Client]; ok && request.Timestamp <= last.Timestamp {
+		if item.digest == last.Digest {
+			n.reply(item.digest, last.result(), nil)
+		} else {
+			n.reply(item.digest, ProposalResult{}, ErrStaleRequest)
+		}
+		return
+	}
+	n.Log("EXECUTE %d", item.seq)
+	replied := func(result string) cachedReply {
+		return cachedReply{
+			Timestamp:   request.Timestamp,
+			Digest:      item.digest,
+			SeqNumber:   item.seq,
+			Result:      result,
+			certificate: &item.certificate,
+		}
+	}
+	var result string
+	durable, isDurable := n.app.(DurableStateMachine)
+	if change != nil {
+		result = n.applyKeyChange(item.seq, change)
+		n.save(item.seq, map[string]cachedReply{request.Client: replied(result)})
+	} else if isDurable {
+		result = durable.ApplyDurably(item.seq, request.Operation, func(result string) []byte {
+			return n.replicaState(map[string]cachedReply{request.Client: replied(result)})
+		})
+	} else {
+		result = n.app.Apply(item.seq, request.Operation)
+	}
+	if change == nil {
+		n.commits.Publish(CommittedEntry{SeqNumber: item.seq, Operation: request.Operation, Result: result})
+	}
+	n.repliesMux.Lock()
+	n.lastReply[request.Client] = replied(result)
+	n.repliesMux.Unlock()
+	n.reply(item.digest, ProposalResult{
+		Result:      result,
+		SeqNumber:   item.seq,
+		Certificate: item.certificate,
+	}, nil)
+}
+
+// ** REPLY CACHE ** //
+
+// What we told a client about its last request. Has to be the same
+// on every replica, so the commit certificate isn't checkpointed.
+type cachedReply struct {
+	Timestamp   int64
+	Digest      [sha256.Size]byte
+	SeqNumber   int
+	Result      string
+	certificate *CommitCertificate // nil if we restored it from a checkpoint
+}
+
+func (reply cachedReply) result() ProposalResult {
+	result := ProposalResult{
+		Result:    reply.Result,
+		SeqNumber: reply.SeqNumber,
+	}
+	if reply.certificate != nil {
+		result.Certificate = *reply.certificate
+	}
+	return result
+}
+
+// What we checkpoint: the application's snapshot plus the reply cache,
+// and any keys that changed (see recovery.go).
+type checkpointState struct {
+	App     []byte
+	Replies map[string]cachedReply
+	Keys    map[NodeId]savedKey `json:",omitempty"`
+}
+
+func (n *PBFTNode) snapshot(seq int) ([]byte, error) {
+	app, err := n.app.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	n.commits.Snapshotted(seq, app)
+	return json.Marshal(checkpointState{App: app, Replies: n.lastReply, Keys: n.keys.rotatedKeys()})
+}
+
+// Restores a stable checkpoint's snapshot, as long as what we get
+// matches the digest and root the quorum signed. If it doesn't, we put
+// back what we had, so a bad snapshot never gets installed.
+func (n *PBFTNode) restore(checkpoint CheckpointProof) error {
+	seq := checkpoint.Number.SeqNumber
+	app, err := n.app.Snapshot()
+	if err != nil {
+		return err
+	}
+	keys := n.keys.rotatedKeys()
+	replies, err := restoreState(checkpoint.Snapshot, seq, n.app, n.keys)
+	if err == nil && digestState(n.app, replies, n.keys) != checkpoint.StateDigest {
+		err = ErrCheckpointDigest
+	} else if err == nil && stateRoot(n.app, seq) != checkpoint.StateRoot {
+		err = ErrCheckpointRoot
+	}
+	if err != nil {
+		if appErr := n.app.Restore(app); appErr != nil {
+			n.Error("Putting back state from before checkpoint %+v: %s", checkpoint.Number, appErr.Error())
+		}
+		if keyErr := n.keys.putBack(keys); keyErr != nil {
+			n.Error("Putting back keys from before checkpoint %+v: %s", checkpoint.Number, keyErr.Error())
+		}
+		return err
+	}
+	n.repliesMux.Lock()
+	n.lastReply = replies
+	n.repliesMux.Unlock()
+	// anybody waiting on a request we skipped over gets its result
+	for _, reply := range replies {
+		n.reply(reply.Digest, reply.result(), nil)
+	}
+	return nil
+}
+
+// Restores the application and keys from a snapshot at seq, and hands
+// back the reply cache. (Observers restore the same way; see
+// observer.go.)
+func restoreState(snapshot []byte, seq int, app StateMachine, keys *keyRing) (map[string]cachedReply, error) {
+	var state checkpointState
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return nil, err
+	}
+	// keys first: they're what refuses a checkpoint that's too old
+	if err := keys.restore(state.Keys, seq); err != nil {
+		return nil, err
+	}
+	if err := app.Restore(state.App); err != nil {
+		return nil, err
+	}
+	if state.Replies == nil {
+		state.Replies = make(map[string]cachedReply)
+	}
+	return state.Replies, nil
+}
+
+// Replicas agree on a checkpoint only if their application state,
+// their reply caches and their keys all match.
+func (n *PBFTNode) stateDigest() [sha256.Size]byte {
+	return digestState(n.app, n.lastReply, n.keys)
+}
+
+func digestState(app StateMachine, replies map[string]cachedReply, keys *keyRing) [sha256.Size]byte {
+	appDigest := app.StateDigest()
+	encoded, err := json.Marshal(replies)
+	if err != nil {
+		plog.Fatal(err)
+	}
+	state := append(appDigest[:], encoded...)
+	if rotated := keys.rotatedKeys(); len(rotated) > 0 {
+		encoded, err := json.Marshal(rotated)
+		if err != nil {
+			plog.Fatal(err)
+		}
+		state = append(state, encoded...)
+	}
+	return sha256.Sum256(state)
+}
@@ -0,0 +1,167 @@
+package pbft
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// ** STATE ROOTS ** //
+
+// Applications that can prove what's in their state (with a Merkle tree,
+// say) hand us its root at every checkpoint. It goes in the Checkpoint
+// we sign, so once the checkpoint is stable a quorum has vouched for
+// it, and clients can check the application's proofs against it
+// without trusting whichever replica they asked.
+
+var (
+	ErrUnverifiedRoot = errors.New("State root isn't signed by a quorum")
+	ErrStaleRoot      = errors.New("State root is older than one we've already seen")
+)
+
+type AuthenticatedStateMachine interface {
+	StateMachine
+	// The root as of sequence number seq. Called on the execute stage
+	// right after seq executes (or is restored), so the state is as of
+	// seq; has to be deterministic, like StateDigest.
+	StateRoot(seq int) [sha256.Size]byte
+}
+
+func stateRoot(app StateMachine, seq int) [sha256.Size]byte {
+	if authenticated, ok := app.(AuthenticatedStateMachine); ok {
+		return authenticated.StateRoot(seq)
+	}
+	return [sha256.Size]byte{}
+}
+
+// What a replica actually signs for a checkpoint.
+type CheckpointHeader struct {
+	Domain
+	Number         SlotId
+	SnapshotDigest [sha256.Size]byte
+	StateDigest    [sha256.Size]byte
+	StateRoot      [sha256.Size]byte
+	Node           NodeId
+}
+
+func (c Checkpoint) Header() CheckpointHeader {
+	return CheckpointHeader{
+		Domain:         c.Domain,
+		Number:         c.Number,
+		SnapshotDigest: c.SnapshotDigest,
+		StateDigest:    c.StateDigest,
+		StateRoot:      c.StateRoot,
+		Node:           c.Node,
+	}
+}
+
+// Checkpoints only count towards the same proof if they agree on the
+// root and the snapshot as well as the state.
+func (c Checkpoint) matchKey() [sha256.Size]byte {
+	key := append(c.StateDigest[:], c.StateRoot[:]...)
+	return sha256.Sum256(append(key, c.SnapshotDigest[:]...))
+}
+
+// A checkpoint's signature, without the snapshot.
+type SignedCheckpointHeader struct {
+	Header    CheckpointHeader
+	Signature []byte
+}
+
+func (c *SignedCheckpointHeader) SignatureValid(v Verifier) (NodeId, error) {
+	return v.verify(c.Header.Domain, c.Header, c.Signature)
+}
+
+// A state root, and the signatures of the quorum that agreed on it.
+// Small enough to hand to clients along with every proof.
+type StateRootProof struct {
+	Number     SlotId
+	StateRoot  [sha256.Size]byte
+	Signatures map[NodeId]SignedCheckpointHeader
+}
+
+func (p CheckpointProof) RootProof() StateRootProof {
+	proof := StateRootProof{
+		Number:     p.Number,
+		StateRoot:  p.StateRoot,
+		Signatures: make(map[NodeId]SignedCheckpointHeader, len(p.Proof)),
+	}
+	for node, checkpoint := range p.Proof {
+		proof.Signatures[node] = SignedCheckpointHeader{
+			Header:    checkpoint.CheckpointMessage.Header(),
+			Signature: checkpoint.Signature,
+		}
+	}
+	return proof
+}
+
+// Checks that a quorum signed checkpoints with this root, in v's cluster
+// and epoch, at minSeq or later. v has to know every node in the cluster
+// (see NewVerifier). A quorum signed every root the cluster ever had, so
+// clients should pass the latest sequence number they've seen (from a
+// root, or X-Sequence-Number), or a replica could answer them from any
+// old one.
+func (p *StateRootProof) Verify(v Verifier, minSeq int) error {
+	if p.Number.SeqNumber < minSeq {
+		return ErrStaleRoot
+	}
+	signed := make(map[NodeId]bool)
+	var foreign error // why we skipped a header, if it wasn't for us
+	for node, header := range p.Signatures {
+		// one stale or foreign signature doesn't spoil the rest
+		if header.Header.Domain.Cluster != v.Domain.Cluster {
+			foreign = ErrWrongCluster
+			continue
+		} else if header.Header.Domain.Epoch != v.Domain.Epoch {
+			foreign = ErrWrongEpoch
+			continue
+		}
+		signer, err := header.SignatureValid(v)
+		if err != nil || signer != node || header.Header.Node != node {
+			continue
+		}
+		if header.Header.Number != p.Number || header.Header.StateRoot != p.StateRoot {
+			continue
+		}
+		signed[node] = true
+	}
+	if v.Weights.Of(signed) < v.Weights.Quorum {
+		if len(signed) == 0 && foreign != nil {
+			return foreign
+		}
+		return ErrUnverifiedRoot
+	}
+	return nil
+}
+
+// Checks a state root against the public keys in a cluster's
+// configuration, without needing a node.
+func VerifyStateRoot(cluster ClusterConfig, proof StateRootProof, minSeq int) error {
+	v, err := NewVerifier(cluster)
+	if err != nil {
+		return err
+	}
+	return proof.Verify(v, minSeq)
+}
+
+// The root of our last stable checkpoint, with its quorum's signatures.
+func (n *PBFTNode) StateRootProof() (StateRootProof, error) {
+	reply := make(chan CheckpointProof, 1)
+	select {
+	case n.fetchChannel <- reply:
+	case <-n.quit:
+		return StateRootProof{}, ErrStopped
+	}
+	select {
+	case checkpoint := <-reply:
+		return checkpoint.RootProof(), nil
+	case <-n.quit:
+		return StateRootProof{}, ErrStopped
+	}
+}
+
+// Same, for the stable checkpoint an observer last heard about.
+func (o *Observer) StateRootProof() (StateRootProof, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.lastCheckpoint.RootProof(), nil
+}
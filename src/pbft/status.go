@@ -0,0 +1,110 @@
+package pbft
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ** STATUS / INTROSPECTION ** //
+
+// Read-only snapshot of a replica's protocol state. Only used for
+// debugging, so it's fine for it to be a little stale by the time
+// anybody reads it.
+type NodeStatus struct {
+	Id                      NodeId
+	ViewNumber              int
+	Primary                 bool
+	Down                    bool
+	ViewChangeInProgress    bool
+	ViewChangeViewNumber    int
+	ViewChangeVotes         map[NodeId]int // node => view it most recently voted for
+	IssuedSequenceNumber    int
+	CommittedSequenceNumber int
+	ExecutedSequenceNumber  int
+	LowWatermark            int
+	HighWatermark           int
+	ViewChangeTimeout       time.Duration
+	PendingCheckpoints      []SlotId
+	CaughtUp                map[NodeId]int // peer => sequence number (only tracked by primary)
+	OutstandingRequests     []string       // hex request digests
+	BufferedMessages        map[NodeId]int // peer => early messages we're holding on to
+	WrongClusterMessages    uint64         // rejected for being signed for another cluster
+	WrongEpochMessages      uint64         // ... or another configuration epoch
+	QueuedRequests          int            // waiting for the main routine
+	PendingRequests         int            // proposed but not executed yet
+	RejectedRequests        uint64         // turned away with ErrOverloaded
+	Recovery                string         // proactive recovery stage, if we're recovering
+}
+
+// Builds the status. Must be called on the main routine!
+func (n *PBFTNode) buildStatus() NodeStatus {
+	status := NodeStatus{
+		Id:                      n.id,
+		ViewNumber:              n.viewNumber,
+		Primary:                 n.isPrimary(),
+		Down:                    n.down,
+		ViewChangeInProgress:    n.viewChange.inProgress,
+		ViewChangeViewNumber:    n.viewChange.viewNumber,
+		ViewChangeVotes:         make(map[NodeId]int),
+		IssuedSequenceNumber:    n.issuedSequenceNumber,
+		CommittedSequenceNumber: n.sequenceNumber,
+		ExecutedSequenceNumber:  n.executed(),
+		LowWatermark:            n.lowWatermark(),
+		HighWatermark:           n.highWatermark(),
+		ViewChangeTimeout:       n.viewChangeTimeout(),
+		PendingCheckpoints:      make([]SlotId, 0, len(n.pendingCheckpoints)),
+		CaughtUp:                make(map[NodeId]int),
+		OutstandingRequests:     make([]string, 0),
+		BufferedMessages:        make(map[NodeId]int),
+		WrongClusterMessages:    atomic.LoadUint64(&n.keys.verifier().Mismatches.Cluster),
+		WrongEpochMessages:      atomic.LoadUint64(&n.keys.verifier().Mismatches.Epoch),
+		QueuedRequests:          len(n.requestChannel),
+		RejectedRequests:        atomic.LoadUint64(&n.rejectedRequests),
+		Recovery:                n.recovery.String(),
+	}
+	n.proposalsMux.Lock()
+	status.PendingRequests = n.pendingProposals
+	n.proposalsMux.Unlock()
+	for id, buffered := range n.buffered {
+		status.BufferedMessages[id] = len(buffered)
+	}
+	for id, msg := range n.viewChange.messages {
+		status.ViewChangeVotes[id] = msg.Message.ViewNumber
+	}
+	for slot, _ := range n.pendingCheckpoints {
+		status.PendingCheckpoints = append(status.PendingCheckpoints, slot)
+	}
+	sort.Slice(status.PendingCheckpoints, func(i, j int) bool {
+		return status.PendingCheckpoints[i].Before(status.PendingCheckpoints[j])
+	})
+	n.caughtUpMux.RLock()
+	for id, seq := range n.caughtUp {
+		status.CaughtUp[id] = seq
+	}
+	n.caughtUpMux.RUnlock()
+	for digest, _ := range n.requests {
+		status.OutstandingRequests = append(status.OutstandingRequests, hex.EncodeToString(digest[:]))
+	}
+	sort.Strings(status.OutstandingRequests)
+	return status
+}
+
+// Asks the main routine for a snapshot of our state.
+func (n *PBFTNode) GetStatus() NodeStatus {
+	reply := make(chan NodeStatus, 1)
+	select {
+	case n.statusChannel <- reply:
+		return <-reply
+	case <-n.quit:
+		return NodeStatus{Id: n.id, Down: true}
+	}
+}
+
+// Status is served even when the node is "down", since that's
+// exactly when we want to look at it.
+func (n *PBFTNode) Status(req *Ack, res *NodeStatus) error {
+	*res = n.GetStatus()
+	return nil
+}
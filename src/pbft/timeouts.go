@@ -0,0 +1,161 @@
+package pbft
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// ** TIMEOUTS & INTERVALS ** //
+
+// Defaults, for anything the ClusterConfig leaves out.
+
+// Heartbeat ticker
+const TIMEOUT time.Duration = time.Duration(500 * time.Millisecond)
+
+// How long backups wait without hearing from the primary before
+// starting a view change: half a heartbeat per peer (750ms for four
+// replicas), but at least a heartbeat
+func defaultViewChangeTimeout(heartbeat time.Duration, nodes int) time.Duration {
+	timeout := heartbeat * time.Duration(nodes-1) / 2
+	if timeout < heartbeat {
+		return heartbeat
+	}
+	return timeout
+}
+
+// How many sequence numbers to wait before checkpointing
+const CHECKPOINT uint = 100
+
+// How far past the last stable checkpoint we accept pre-prepares
+const WATERMARK_WINDOW uint = 3 * CHECKPOINT
+
+// A time.Duration that reads & writes JSON as a string like "500ms"
+// (plain numbers are taken as nanoseconds, like time.Duration).
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		var nanos int64
+		if err := json.Unmarshal(b, &nanos); err != nil {
+			return err
+		}
+		*d = Duration(nanos)
+		return nil
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// The cluster's timing settings with defaults filled in.
+type timing struct {
+	heartbeat       time.Duration
+	viewChange      time.Duration
+	checkpoint      int
+	watermarkWindow int
+	adaptive        bool
+	minViewChange   time.Duration
+	maxViewChange   time.Duration
+}
+
+func (c ClusterConfig) timing() timing {
+	t := timing{
+		heartbeat:       time.Duration(c.HeartbeatInterval),
+		viewChange:      time.Duration(c.ViewChangeTimeout),
+		checkpoint:      c.CheckpointInterval,
+		watermarkWindow: c.WatermarkWindow,
+		adaptive:        c.AdaptiveTimeout,
+		minViewChange:   time.Duration(c.MinViewChangeTimeout),
+		maxViewChange:   time.Duration(c.MaxViewChangeTimeout),
+	}
+	if t.heartbeat <= 0 {
+		t.heartbeat = TIMEOUT
+	}
+	if t.viewChange <= 0 {
+		t.viewChange = defaultViewChangeTimeout(t.heartbeat, len(c.Nodes))
+	}
+	if t.checkpoint <= 0 {
+		t.checkpoint = int(CHECKPOINT)
+	}
+	if t.watermarkWindow <= 0 {
+		t.watermarkWindow = int(WATERMARK_WINDOW)
+	}
+	// otherwise we'd never get far enough to checkpoint (and so never
+	// move the window)
+	if t.watermarkWindow < t.checkpoint {
+		t.watermarkWindow = t.checkpoint
+	}
+	// backups shouldn't give up on the primary between heartbeats
+	if t.minViewChange <= t.heartbeat {
+		t.minViewChange = 2 * t.heartbeat
+	}
+	if t.maxViewChange <= 0 {
+		t.maxViewChange = 10 * t.viewChange
+	}
+	if t.maxViewChange < t.minViewChange {
+		t.maxViewChange = t.minViewChange
+	}
+	return t
+}
+
+// Smoothed estimate of how long requests take to commit (the same
+// estimator TCP uses for RTTs, see RFC 6298). Locked, since the status
+// and timers can read it off the main routine.
+type latencyEstimator struct {
+	mu      sync.Mutex
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples int
+}
+
+func (e *latencyEstimator) observe(sample time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = sample
+		e.rttvar = sample / 2
+	} else {
+		diff := e.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + sample) / 8
+	}
+	e.samples++
+}
+
+// How long a commit takes plus four deviations, and whether we've got
+// any samples to go on.
+func (e *latencyEstimator) estimate() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt + 4*e.rttvar, e.samples > 0
+}
+
+// In adaptive mode, backups give the primary one heartbeat plus
+// however long requests have been taking to commit (with some slack
+// for variance), within the configured bounds. Until we've seen any
+// commits we stick with the configured timeout.
+func (n *PBFTNode) viewChangeTimeout() time.Duration {
+	latency, ok := n.latency.estimate()
+	if !n.timing.adaptive || !ok {
+		return n.timing.viewChange
+	}
+	timeout := n.timing.heartbeat + latency
+	if timeout < n.timing.minViewChange {
+		return n.timing.minViewChange
+	} else if timeout > n.timing.maxViewChange {
+		return n.timing.maxViewChange
+	}
+	return timeout
+}
@@ -2,20 +2,21 @@ package pbft
 
 import (
 	"crypto/sha256"
-	"distributepki/util"
 	"errors"
 	"time"
 )
 
 // ** VIEW CHANGES ** //
 
-func (n *PBFTNode) handleViewChange(message *SignedViewChange) {
+var (
+	ErrViewChangeSigner = errors.New("NewView carries a ViewChange signed by a different node")
+	ErrViewChangeView   = errors.New("NewView carries a ViewChange for a different view")
+	ErrNewViewQuorum    = errors.New("NewView doesn't carry view changes from a quorum")
+)
 
-	sender, err := message.SignatureValid(n.peerEntities, n.peerEntityMap)
-	if err != nil {
-		n.Log("Validating ViewChange signature: " + err.Error())
-		return
-	} else if sender != message.Message.Node {
+func (n *PBFTNode) handleViewChange(sender NodeId, message *SignedViewChange) {
+
+	if sender != message.Message.Node {
 		n.Log("Error: received ViewChange not signed by correct sending node")
 		return
 	}
@@ -36,18 +37,19 @@ func (n *PBFTNode) handleViewChange(message *SignedViewChange) {
 	n.viewChange.messages[vc.Node] = *message
 	// 1. If a replica receives a set of f+1 valid view change messages
 	// from other replicas for views higher than its current view...
+	// (by weight: more than could all be faulty)
 	if vc.ViewNumber > currentView {
-		higherThanCurrent := 0
+		higherThanCurrent := make(map[NodeId]bool)
 		lowestNewView := vc.ViewNumber
-		for _, msg := range n.viewChange.messages {
+		for node, msg := range n.viewChange.messages {
 			if msg.Message.ViewNumber > currentView {
-				higherThanCurrent += 1
+				higherThanCurrent[node] = true
 				if msg.Message.ViewNumber < lowestNewView {
 					lowestNewView = msg.Message.ViewNumber
 				}
 			}
 		}
-		if higherThanCurrent >= (len(n.peermap)/3)+1 {
+		if n.keys.verifier().Weights.Of(higherThanCurrent) >= n.keys.verifier().Weights.Weak {
 			// 2. Broadcast view-change messages for the next smallest
 			//    view in that set.
 			n.startViewChange(lowestNewView)
@@ -60,19 +62,28 @@ func (n *PBFTNode) handleViewChange(message *SignedViewChange) {
 	// Then it /enters/ view v+1: at this point it is able to accept messages for
 	// view v + 1.
 	// 0. If no new view change was started, and I'm the leader of this view change
-	if n.viewChange.inProgress && n.cluster.LeaderFor(vc.ViewNumber) == n.id {
-		// 1. See if we got 2f view-change messages for this view!
-		votes := 0
-		for _, msg := range n.viewChange.messages {
+	if n.viewChange.inProgress && n.leaderFor(vc.ViewNumber) == n.id {
+		// 1. See if we got 2f view-change messages for this view! (by
+		//    weight: with our own, a quorum)
+		votes := map[NodeId]bool{n.id: true}
+		for node, msg := range n.viewChange.messages {
 			if msg.Message.ViewNumber == vc.ViewNumber {
-				votes += 1
+				votes[node] = true
 			}
 		}
 		// 2. If so, multicast new-view (heartbeat)
-		if votes >= (2 * len(n.peermap) / 3) {
+		if n.keys.verifier().Weights.Of(votes) >= n.keys.verifier().Weights.Quorum {
+			// V is just the view changes for this view; older ones
+			// don't justify anything
+			viewChanges := make(NewViewViewChangeMap)
+			for node, msg := range n.viewChange.messages {
+				if msg.Message.ViewNumber == vc.ViewNumber {
+					viewChanges[node] = msg
+				}
+			}
 			newview := NewView{
 				ViewNumber:  vc.ViewNumber,
-				ViewChanges: n.viewChange.messages,
+				ViewChanges: viewChanges,
 				PrePrepares: n.generatePrepreparesForNewView(vc.ViewNumber),
 				Node:        n.id,
 			}
@@ -83,36 +94,37 @@ func (n *PBFTNode) handleViewChange(message *SignedViewChange) {
 			}
 			n.caughtUpMux.Unlock()
 			n.enterNewView(vc.ViewNumber)
+			n.agreeExclusions(vc.ViewNumber, newview.ViewChanges)
 			n.sendHeartbeat()
 		}
 	}
 }
 
-func (n *PBFTNode) handleNewView(message *SignedNewView) {
+func (n *PBFTNode) handleNewView(sender NodeId, message *SignedNewView) {
 	// Paper: section 4.4
 	// A backup accepts a new-view message for view v+1 if it is signed
 	// properly, if the view-change messages it contains are valid for view v+1,
 	// and if the set O is correct. It multicasts prepares for each
 	// message in O, and enters view + 1
-	/*
-		sender, err := message.SignatureValid(n.peerEntities, n.peerEntityMap)
-		if err != nil {
-			n.Log("Validating NewView signature: " + err.Error())
-			return
-		} else if sender != message.Message.Node {
-			n.Log("Error: received NewView not signed by correct sending node")
-			return
-		}
-	*/
+	// (the signatures, and the view changes' weight, were checked in
+	// the authenticate stage)
+	if sender != message.Message.Node {
+		n.Log("Error: received NewView not signed by correct sending node")
+		return
+	} else if sender != n.leaderFor(message.Message.ViewNumber) {
+		n.Log("Error: received NewView for view %d from %d, who isn't its leader", message.Message.ViewNumber, sender)
+		return
+	}
 
 	var currentView int
 	newViewMessage := message.Message
 	if n.viewChange.inProgress {
 		if newViewMessage.ViewNumber == n.viewChange.viewNumber {
 			n.enterNewView(newViewMessage.ViewNumber)
+			n.agreeExclusions(newViewMessage.ViewNumber, newViewMessage.ViewChanges)
 			for _, preprepare := range newViewMessage.PrePrepares {
 				if preprepare.SignedMessage.PrePrepareMessage.Number.SeqNumber > n.sequenceNumber {
-					n.handlePrePrepare(&preprepare)
+					n.handleNewViewPrePrepare(&preprepare)
 				}
 			}
 			return
@@ -125,14 +137,26 @@ func (n *PBFTNode) handleNewView(message *SignedNewView) {
 		// Multicast prepares for each message in O
 		// and enter view + 1
 		n.enterNewView(newViewMessage.ViewNumber)
+		n.agreeExclusions(newViewMessage.ViewNumber, newViewMessage.ViewChanges)
 		for _, preprepare := range newViewMessage.PrePrepares {
 			if preprepare.SignedMessage.PrePrepareMessage.Number.SeqNumber > n.sequenceNumber {
-				n.handlePrePrepare(&preprepare)
+				n.handleNewViewPrePrepare(&preprepare)
 			}
 		}
 	}
 }
 
+// The pre-prepares in a new view don't go through the authenticate
+// stage on their own, so we check them here.
+func (n *PBFTNode) handleNewViewPrePrepare(preprepare *FullPrePrepare) {
+	sender, err := preprepare.SignedMessage.SignatureValid(n.keys.verifier())
+	if err != nil {
+		n.Log("Validating PrePrepare signature: " + err.Error())
+		return
+	}
+	n.handlePrePrepare(sender, preprepare)
+}
+
 func (n *PBFTNode) generateProofsSinceCheckpoint() map[SlotId]PreparedProof {
 	proofs := make(map[SlotId]PreparedProof)
 	for id, slot := range n.log {
@@ -166,6 +190,9 @@ func (n *PBFTNode) startViewChange(view int) {
 	}
 	n.Log("START VIEW CHANGE FOR VIEW %d", view)
 	n.viewChange.inProgress = true
+	// we don't know if outstanding requests will make it into the
+	// new view, so let the clients retry
+	n.failAllProposals(ErrViewChange)
 	n.viewChange.viewNumber = view
 	message := ViewChange{
 		ViewNumber:      view,
@@ -173,18 +200,21 @@ func (n *PBFTNode) startViewChange(view int) {
 		CheckpointProof: n.lastCheckpoint.Proof,
 		Proofs:          n.generateProofsSinceCheckpoint(),
 		Node:            n.id,
+		Evidence:        n.Evidence(),
 	}
 
-	signedMessage, err := message.Sign(n.entity)
+	signedMessage, err := message.Sign(n.keys.signer())
 	if err != nil {
 		n.Log("Signing view change: " + err.Error())
 		return
 	}
+	// our own counts towards the NewView too, if we're the next leader
+	n.viewChange.messages[n.id] = *signedMessage
 
 	// TODO (sydli): instead of stopping this timer, use it for exponential backoff && to
 	// re-transmit
 	n.stopTimers()
-	go broadcast(n.id, n.peermap, "PBFTNode.ViewChange", n.cluster.Endpoint, &signedMessage, time.Duration(100*time.Millisecond))
+	go broadcast(n.id, n.peermap, "PBFTNode.ViewChange", n.cluster.Endpoint, &signedMessage, time.Duration(100*time.Millisecond), n.peerTLS)
 }
 
 func (n *PBFTNode) enterNewView(view int) {
@@ -196,21 +226,54 @@ func (n *PBFTNode) enterNewView(view int) {
 		n.sequenceNumber = n.lastCheckpoint.Number.SeqNumber
 	}
 	n.startTimers()
+	n.replayBuffered()
 }
 
-func (n PBFTNode) ViewChange(req *SignedViewChange, res *Ack) error {
+func (n *PBFTNode) ViewChange(req *SignedViewChange, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.viewChangeChannel <- req
-	return nil
+	return n.authenticate(req, func() (NodeId, error) { return req.SignatureValid(n.keys.verifier()) })
 }
 
-func (n PBFTNode) NewView(req *SignedNewView, res *Ack) error {
+func (n *PBFTNode) NewView(req *SignedNewView, res *Ack) error {
 	if n.down {
 		return errors.New("I'm down")
 	}
-	n.newViewChannel <- req
+	return n.authenticate(req, func() (NodeId, error) {
+		sender, err := req.SignatureValid(n.keys.verifier())
+		if err != nil {
+			return 0, err
+		}
+		// one of the view changes is probably ours
+		return sender, req.Message.viewChangesValid(n.keys.verifyAll())
+	})
+}
+
+// A NewView has to carry properly signed view changes for its view,
+// from a quorum (by weight). Everybody starts in view 0, so that one
+// needs none.
+func (nv *NewView) viewChangesValid(v Verifier) error {
+	if nv.ViewNumber == 0 {
+		return nil
+	}
+	votes := make(map[NodeId]bool)
+	for node, vc := range nv.ViewChanges {
+		signer, err := vc.SignatureValid(v)
+		if err != nil {
+			return err
+		}
+		if signer != node || signer != vc.Message.Node {
+			return ErrViewChangeSigner
+		}
+		if vc.Message.ViewNumber != nv.ViewNumber {
+			return ErrViewChangeView
+		}
+		votes[signer] = true
+	}
+	if v.Weights.Of(votes) < v.Weights.Quorum {
+		return ErrNewViewQuorum
+	}
 	return nil
 }
 
@@ -277,9 +340,9 @@ func (n *PBFTNode) generatePrepreparesForNewView(view int) map[SlotId]FullPrePre
 				ViewNumber: view,
 				SeqNumber:  s,
 			}
-			var request string
+			var request Request
 			var requestDigest [sha256.Size]byte
-			emptyRequestDigest, err := util.GenerateDigest("")
+			emptyRequestDigest, err := Request{}.Digest()
 			if err != nil {
 				n.Error("Message is empty! How did we not generate a digest?")
 			}
@@ -295,7 +358,7 @@ func (n *PBFTNode) generatePrepreparesForNewView(view int) map[SlotId]FullPrePre
 			} else {
 				//    2. There is no such set.
 				//       Primary creates Pre-prepare with a no-op message.
-				request = ""
+				request = Request{}
 				requestDigest = emptyRequestDigest
 
 			}
@@ -303,7 +366,7 @@ func (n *PBFTNode) generatePrepreparesForNewView(view int) map[SlotId]FullPrePre
 				Number:        slotId,
 				RequestDigest: requestDigest,
 			}
-			signedMessage, err := message.Sign(n.entity)
+			signedMessage, err := message.Sign(n.keys.signer())
 			if err != nil {
 				n.Error("Error signing preprepares on view change: " + err.Error())
 			}
@@ -0,0 +1,62 @@
+package pbft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ** VOTING WEIGHTS ** //
+
+// Replicas don't all have to count the same. Each has a Weight (1 if
+// it's left out), and the cluster promises to cope with replicas
+// holding up to FaultyWeight between them being faulty (by default,
+// just under a third of the total). A quorum is enough weight that any
+// two quorums overlap by more than FaultyWeight, i.e. in at least one
+// honest replica, and the honest replicas have to make up a quorum on
+// their own or nothing could ever commit. That only works if the total
+// is more than 3 * FaultyWeight. With every weight 1 this is the usual
+// N = 3f + 1, quorum = 2f + 1.
+
+const DEFAULT_WEIGHT = 1
+
+var ErrFaultyWeight = errors.New("Cluster can't tolerate that much faulty weight")
+
+type Weights struct {
+	Nodes  map[NodeId]int
+	Total  int
+	Faulty int // how much weight can be faulty
+	Quorum int // prepares, commits, checkpoints and new views need this much
+	Weak   int // more than Faulty, so at least one honest replica
+}
+
+func (c ClusterConfig) Weights() (Weights, error) {
+	w := Weights{Nodes: make(map[NodeId]int)}
+	for _, node := range c.Nodes {
+		weight := node.Weight
+		if weight <= 0 {
+			weight = DEFAULT_WEIGHT
+		}
+		w.Nodes[node.Id] = weight
+		w.Total += weight
+	}
+	w.Faulty = c.FaultyWeight
+	if w.Faulty <= 0 {
+		w.Faulty = (w.Total - 1) / 3
+	}
+	w.Quorum = (w.Total+w.Faulty)/2 + 1
+	w.Weak = w.Faulty + 1
+	if w.Total-w.Faulty < w.Quorum {
+		return w, fmt.Errorf("%s: %d faulty out of %d needs a total of at least %d",
+			ErrFaultyWeight.Error(), w.Faulty, w.Total, 3*w.Faulty+1)
+	}
+	return w, nil
+}
+
+// How much the given nodes weigh together
+func (w Weights) Of(nodes map[NodeId]bool) int {
+	total := 0
+	for node, _ := range nodes {
+		total += w.Nodes[node]
+	}
+	return total
+}